@@ -0,0 +1,83 @@
+// Command reconstruct replays the reconstruction of the answers exported by the
+// search CLI with -exportAnswers, without the server, to compare reconstruction
+// strategies on the same answers. It writes one row per exported query: the
+// query index, then the top k results as (cluster ID, index within cluster)
+// pairs, like the results files of the search CLI with -queryID.
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/DeweiFeng/6.5610-project/search/protocol"
+)
+
+func main() {
+	answers := flag.String("answers", "", "Path to the answers written by -exportAnswers")
+	output := flag.String("output", "", "Path to the results csv file to write")
+	topK := flag.Int("topk", 10, "Number of top results to return")
+	clusterOnly := flag.Bool("clusterOnly", false, "Only return top k among vectors in the queried cluster")
+	sortOrder := flag.String("sortOrder", "desc", "Rank the results by descending (desc) or ascending (asc) score")
+	maxCandidates := flag.Uint64("maxCandidates", 0, "If positive, only score this many rows of the bin (or cluster), starting at the query's cluster")
+	flag.Parse()
+
+	if *answers == "" || *output == "" {
+		panic("Error: -answers and -output are required")
+	}
+	if *topK <= 0 {
+		panic("Error: topk must be a positive integer")
+	}
+	if *maxCandidates > 0 && *maxCandidates < uint64(*topK) {
+		panic("Error: maxCandidates must be at least topk")
+	}
+
+	in, err := os.Open(*answers)
+	if err != nil {
+		panic("Error opening answers: " + err.Error())
+	}
+	defer in.Close()
+	reader, err := protocol.NewAnswerReader(in)
+	if err != nil {
+		panic("Error: " + err.Error())
+	}
+	client := protocol.NewOfflineClient(&reader.Header)
+	client.MaxCandidates = *maxCandidates
+	client.Order, err = protocol.ParseSortOrder(*sortOrder)
+	if err != nil {
+		panic("Error: " + err.Error())
+	}
+
+	out, err := os.Create(*output)
+	if err != nil {
+		panic("Error creating output file: " + err.Error())
+	}
+	defer out.Close()
+	writer := csv.NewWriter(out)
+	defer writer.Flush()
+
+	count := 0
+	for {
+		a, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic("Error reading answers: " + err.Error())
+		}
+		scores := client.ReconstructExported(a, *clusterOnly)
+
+		line := []string{fmt.Sprintf("%d", a.QueryID)}
+		for i := 0; i < *topK && i < len(*scores); i++ {
+			res := (*scores)[i]
+			line = append(line, fmt.Sprintf("%d", res.ClusterID), fmt.Sprintf("%d", res.IDWithinCluster))
+		}
+		if err := writer.Write(line); err != nil {
+			panic("Error writing to output file: " + err.Error())
+		}
+		count++
+	}
+	fmt.Printf("Reconstructed %d answers to %s\n", count, *output)
+}
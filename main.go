@@ -1,321 +1,2963 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/csv"
 	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	mathrand "math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/DeweiFeng/6.5610-project/search"
 	"github.com/DeweiFeng/6.5610-project/search/database"
 	"github.com/DeweiFeng/6.5610-project/search/protocol"
 	"github.com/DeweiFeng/6.5610-project/search/utils"
+	"github.com/ahenzinger/underhood/underhood"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+	"github.com/henrycg/simplepir/rand"
 )
 
-func argumentsValidation(preamble string, topk int, query string) {
+func argumentsValidation(preamble string, topks []uint64, query string, perClusterTopK int, maxCandidates uint64) error {
 	if preamble == "" {
-		panic("Error: Preamble is required")
+		return errors.New("preamble is required")
 	}
-	if topk <= 0 {
-		panic("Error: topk must be a positive integer")
+	if len(topks) == 0 {
+		return errors.New("topk is required")
+	}
+	seen := make(map[uint64]bool)
+	for _, topk := range topks {
+		if topk == 0 {
+			return errors.New("topk must be a positive integer")
+		}
+		if seen[topk] {
+			return fmt.Errorf("topk %d is given twice", topk)
+		}
+		seen[topk] = true
+	}
+	topk := utils.Max(topks)
+	if perClusterTopK < 0 {
+		return errors.New("perClusterTopK must be a non-negative integer")
+	}
+	if maxCandidates > 0 && maxCandidates < uint64(topk) {
+		return errors.New("maxCandidates must be at least topk")
 	}
 	// query is empty or a csv file
 	if query != "" && filepath.Ext(query) != ".csv" {
-		panic("Error: when specified, query must be a csv file")
+		return errors.New("when specified, query must be a csv file")
 	}
 	// query must be inside the same directory as preamble
 	if query != "" {
 		dir := filepath.Dir(preamble)
 		if filepath.Dir(query) != dir {
-			panic("Error: query must be in the same directory as indicated by preamble")
+			return errors.New("query must be in the same directory as indicated by preamble")
+		}
+	}
+	return nil
+}
+
+// parseUint64List parses a comma-separated list of integers, such as "1,4,7"
+func parseUint64List(s string) ([]uint64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	fields := strings.Split(s, ",")
+	res := make([]uint64, len(fields))
+	for i, f := range fields {
+		v, err := utils.StringToUint64(strings.TrimSpace(f))
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q in list %q", f, s)
 		}
+		res[i] = v
+	}
+	return res, nil
+}
+
+// formatUint64List is the inverse of parseUint64List
+func formatUint64List(vals []uint64) string {
+	fields := make([]string, len(vals))
+	for i, v := range vals {
+		fields[i] = fmt.Sprintf("%d", v)
+	}
+	return strings.Join(fields, ",")
+}
+
+// intList converts parsed flag values to ints
+func intList(vals []uint64) []int {
+	res := make([]int, len(vals))
+	for i, v := range vals {
+		res[i] = int(v)
+	}
+	return res
+}
+
+// clusterCountWarning describes how queries routed against a build of routed
+// clusters fare against a database of built clusters, if the counts differ
+func clusterCountWarning(routed uint64, built uint64) string {
+	if routed < built {
+		return fmt.Sprintf("the queries were routed against %d clusters, but the database has %d: clusters %d to %d are unreachable by them", routed, built, routed, built-1)
 	}
+	if routed > built {
+		return fmt.Sprintf("the queries were routed against %d clusters, but the database has %d: queries to clusters %d to %d will fail", routed, built, built, routed-1)
+	}
+	return ""
 }
 
-func readQueryLine(reader *csv.Reader, dim uint64, precBits uint64) (uint64, []int8, bool) {
+// readQueryLine reads the cluster index and raw values of the next query. It
+// returns io.EOF once the query file is exhausted, and any other error if the row
+// is malformed, in which case the caller may skip it and keep reading. Rows have
+// exactly dim+1 columns, unless extraColumns is set: then any columns after the
+// embedding, e.g., timestamps, are allowed and returned as they are.
+func readQueryLine(reader *csv.Reader, dim uint64, extraColumns bool) (uint64, []float64, []string, error) {
 	row, err := reader.Read()
 	if err == io.EOF {
-		return 0, nil, true
+		return 0, nil, nil, io.EOF
 	}
 	if err != nil {
-		panic("Error reading query line: " + err.Error())
+		return 0, nil, nil, fmt.Errorf("error reading query line: %w", err)
+	}
+	if extraColumns && len(row) < int(dim)+1 {
+		return 0, nil, nil, fmt.Errorf("expected at least %d columns, got %d", dim+1, len(row))
 	}
-	if len(row) != int(dim)+1 {
-		panic(fmt.Sprintf("Error: expected %d columns, got %d", dim+1, len(row)))
+	if !extraColumns && len(row) != int(dim)+1 {
+		return 0, nil, nil, fmt.Errorf("expected %d columns, got %d", dim+1, len(row))
 	}
 	clusterIndex, err := utils.StringToUint64(row[0])
 	if err != nil {
-		panic("Error converting cluster index to uint64: " + err.Error())
+		return 0, nil, nil, fmt.Errorf("error converting cluster index to uint64: %w", err)
 	}
-	query := make([]int8, dim)
+	query := make([]float64, dim)
 	for i := 0; i < int(dim); i++ {
-		u, err := strconv.ParseFloat(row[i+1], 64)
-		query[i] = utils.QuantizeClamp(u, precBits)
+		query[i], err = strconv.ParseFloat(row[i+1], 64)
 		if err != nil {
-			panic("Error converting query to int8: " + err.Error())
+			return 0, nil, nil, fmt.Errorf("error converting query to float: %w", err)
 		}
 	}
-	return clusterIndex, query, false
+	return clusterIndex, query, row[dim+1:], nil
+}
+
+// queryValues holds a value per query index, e.g., the ID read from the query
+// file, until the outcome of the query is written. Queries may be read ahead of
+// it, by another goroutine when pipelined.
+type queryValues[T any] struct {
+	mu     sync.Mutex
+	values map[int]T
 }
 
-type QueryPerf struct {
-	clientHintQueryTime       time.Duration
-	serverHintAnswerTime      time.Duration
-	clientHintApplyTime       time.Duration
-	clientQueryProcessingTime time.Duration
-	serverComputeTime         time.Duration
-	clientReconTime           time.Duration
-	hintQuerySize             uint64
-	hintAnsSize               uint64
-	querySize                 uint64
-	ansSize                   uint64
+// queryLabels holds the IDs read from the query file
+type queryLabels = queryValues[string]
+
+func newQueryLabels() *queryLabels {
+	return &queryLabels{values: make(map[int]string)}
+}
+
+func (l *queryValues[T]) set(queryID int, v T) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.values[queryID] = v
 }
 
-func writeResults(writer *csv.Writer, perfWriter *csv.Writer, scores *[]protocol.VectorScore, k int, perf *QueryPerf) {
-	if len(*scores) == 0 {
-		panic("Error: No scores to write")
+// get returns the value kept for a query, if any
+func (l *queryValues[T]) get(queryID int) (T, bool) {
+	var v T
+	if l == nil {
+		return v, false
 	}
-	numRes := k
-	if numRes > len(*scores) {
-		numRes = len(*scores)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	v, ok := l.values[queryID]
+	return v, ok
+}
+
+func (l *queryValues[T]) forget(queryID int) {
+	if l == nil {
+		return
 	}
-	line := make([]string, numRes*2)
-	for i := 0; i < numRes; i++ {
-		line[i*2] = fmt.Sprintf("%d", (*scores)[i].ClusterID)
-		line[i*2+1] = fmt.Sprintf("%d", (*scores)[i].IDWithinCluster)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.values, queryID)
+}
+
+// shuffleQueries reads every line of a query file and returns a reader over
+// them in an order drawn from seed, along with the index in the file of every
+// line of the new order. Blank lines, which csv readers skip, are dropped.
+func shuffleQueries(r io.Reader, seed int64) (*csv.Reader, []int, error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
 	}
-	if err := writer.Write(line); err != nil {
-		panic("Error writing to output file: " + err.Error())
+	lines := make([]string, 0)
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line = strings.TrimSuffix(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	order := mathrand.New(mathrand.NewSource(seed)).Perm(len(lines))
+	shuffled := make([]string, len(lines))
+	for i, j := range order {
+		shuffled[i] = lines[j]
 	}
-	writer.Flush()
+	reader := csv.NewReader(strings.NewReader(strings.Join(shuffled, "\n")))
+	reader.FieldsPerRecord = -1
+	return reader, order, nil
+}
 
-	perfLine := []string{
-		fmt.Sprintf("%g", perf.clientHintQueryTime.Seconds()),
-		fmt.Sprintf("%g", perf.serverHintAnswerTime.Seconds()),
-		fmt.Sprintf("%g", perf.clientHintApplyTime.Seconds()),
-		fmt.Sprintf("%g", perf.clientQueryProcessingTime.Seconds()),
-		fmt.Sprintf("%g", perf.serverComputeTime.Seconds()),
-		fmt.Sprintf("%g", perf.clientReconTime.Seconds()),
-		fmt.Sprintf("%d", perf.hintQuerySize),
-		fmt.Sprintf("%d", perf.hintAnsSize),
-		fmt.Sprintf("%d", perf.querySize),
-		fmt.Sprintf("%d", perf.ansSize),
-	}
-	if err := perfWriter.Write(perfLine); err != nil {
-		panic("Error writing to performance output file: " + err.Error())
-	}
-	perfWriter.Flush()
-}
-
-func filesValidation(preamble string, query string) {
-	// we check if preamble_metadata.json is present
-	metadataFile := preamble + "_metadata.json"
-	if _, err := os.Stat(metadataFile); os.IsNotExist(err) {
-		panic("Error: metadata file does not exist: " + metadataFile)
-	}
-	var queryFile string
-	if query != "" {
-		// check if preamble_query.csv is present
-		queryFile = query
+// readClusterSets reads the clusters to probe for every query, one line per row
+// of the query file, each a non-empty list of cluster indices below numClusters
+func readClusterSets(file string, numClusters uint64) ([][]uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	sets := make([][]uint64, 0)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return sets, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		line, _ := reader.FieldPos(0)
+		set := make([]uint64, 0, len(row))
+		for _, field := range row {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			c, err := utils.StringToUint64(field)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid cluster index %q", file, line, field)
+			}
+			if c >= numClusters {
+				return nil, fmt.Errorf("%s:%d: cluster %d does not exist, there are %d clusters", file, line, c, numClusters)
+			}
+			set = append(set, c)
+		}
+		if len(set) == 0 {
+			return nil, fmt.Errorf("%s:%d: no clusters to probe", file, line)
+		}
+		sets = append(sets, set)
+	}
+}
+
+// countQueryRows returns the number of rows of a query file, which csv readers
+// number queries by
+func countQueryRows(file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	n := 0
+	for {
+		_, err := reader.Read()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", file, err)
+		}
+		n++
+	}
+}
+
+// diffResults prints how the rankings of a results file changed from an old
+// one, and writes the comparison of every query to output, if set. queryIDs
+// names the files written with -queryID: "old", "new", "both" or "".
+func diffResults(oldFile string, newFile string, output string, queryIDs string) error {
+	if queryIDs != "" && queryIDs != "old" && queryIDs != "new" && queryIDs != "both" {
+		return fmt.Errorf("-diffQueryID must be old, new or both, got %q", queryIDs)
+	}
+	oldRows, err := database.ReadResults(oldFile, queryIDs == "old" || queryIDs == "both")
+	if err != nil {
+		return fmt.Errorf("reading old results: %w", err)
+	}
+	newRows, err := database.ReadResults(newFile, queryIDs == "new" || queryIDs == "both")
+	if err != nil {
+		return fmt.Errorf("reading new results: %w", err)
+	}
+	d := database.DiffResults(oldRows, newRows)
+	jaccard, tau, changed := d.Summary()
+	fmt.Printf("Compared %d queries of %s and %s\n", len(d.Queries), oldFile, newFile)
+	fmt.Printf("  mean Jaccard overlap: %.4f\n", jaccard)
+	fmt.Printf("  mean Kendall tau: %.4f\n", tau)
+	fmt.Printf("  top-1 changed: %d\n", changed)
+	if d.Failed > 0 || d.OnlyOld > 0 || d.OnlyNew > 0 {
+		fmt.Printf("  skipped %d queries that failed, %d only in the old file and %d only in the new one\n", d.Failed, d.OnlyOld, d.OnlyNew)
+	}
+
+	if output == "" {
+		return nil
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("creating diff output: %w", err)
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"queryID", "jaccard", "kendallTau", "top1Changed"}); err != nil {
+		return fmt.Errorf("writing diff output: %w", err)
+	}
+	for _, q := range d.Queries {
+		line := []string{q.QueryID, strconv.FormatFloat(q.Jaccard, 'f', -1, 64), strconv.FormatFloat(q.KendallTau, 'f', -1, 64), strconv.FormatBool(q.Top1Changed)}
+		if err := w.Write(line); err != nil {
+			return fmt.Errorf("writing diff output: %w", err)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("writing diff output: %w", err)
+	}
+	fmt.Printf("Per-query comparison written to %s\n", output)
+	return nil
+}
+
+// QueryPerf is the cost of a query, written to the performance files
+type QueryPerf = search.QueryPerf
+
+// queryOptions controls how each query is run and how its results are written
+type queryOptions struct {
+	// the results are cut off at each of these k, one results file per k
+	topKs []int
+	// the database is quantized with precBits bits, the queries with queryPrecBits,
+	// over [-dbRange, dbRange] and [-queryRange, queryRange], where 0 stands for 1
+	precBits       uint64
+	queryPrecBits  uint64
+	dbRange        float64
+	queryRange     float64
+	clusterOnly    bool
+	perClusterTopK int
+
+	// if not nil, every result is followed by the external ID of the vector, or
+	// an empty field if its cluster has none
+	externalIDs [][]string
+	// if not nil, every result is followed by the norm of its stored vector,
+	// computed from these clusters, after its score if written, or with
+	// rawNorms the norm of its vector as read, from their statistics
+	norms    []*database.Cluster
+	rawNorms bool
+	// if set, every row starts with the index of its query in the query file
+	withQueryID bool
+	// if set, every result is followed by its score, transformed by scoreTransform
+	withScores     bool
+	scoreTransform utils.ScoreTransform
+	// dimension of the database vectors, used to bound the scores
+	dim uint64
+	// unit of the timing columns of the performance file
+	timeUnit timeUnit
+	// if not nil, the output files are continued in new parts between queries
+	rotation *outputRotation
+	// if not nil, the queries were shuffled: the i-th query processed is line
+	// order[i] of the query file
+	order []int
+	// if set, the results are the vectors scoring at least minScore (at most,
+	// with -sortOrder=asc), unsorted,
+	// and only their number is written
+	countOnly bool
+	// with -denseScores, write the scores of every vector of the queried cluster
+	// in index order, at most denseLimit if positive, instead of the top-k
+	dense      bool
+	denseLimit int
+	minScore   int
+	// if positive, the top-k are cut off at the results within this relative
+	// margin of the best score, and at minScore too if marginMinScore is set
+	relMargin      float64
+	marginMinScore bool
+	// if not nil, the answer of every successful query is exported
+	answers *answerExporter
+	// if not nil, warns when no query completes for a while
+	watchdog *watchdog
+	// if not nil, the calls to the server are retried with this policy
+	retry *protocol.RetryPolicy
+	// if not nil, the database was built from transformed clusters, e.g.,
+	// compacted or deduplicated: the cluster of every query is translated to its
+	// new one, and results back to the first original vector of theirs
+	remap *database.ClusterRemap
+	// if set, every result is followed by the other original vectors of remap
+	// stored as the same one, e.g., its duplicates
+	allCopies bool
+	// if set, the vectors were sliced to these dimensions, and the rows of the
+	// query file, of fileDim values, are sliced alike
+	dimSlice database.DimSlice
+	fileDim  uint64
+	// if set, rows of the query file may have columns after the embedding. If
+	// labels is not nil, column idColumn of every row is the ID of its query,
+	// kept there until it is written instead of the query index.
+	extraColumns bool
+	idColumn     int
+	labels       *queryLabels
+	// number of rows read from the query file
+	reads int
+	// if not nil, the clusters, translated, to probe for every row of the query
+	// file instead of its own; nextQuery then returns the index of the row
+	clusterSets [][]uint64
+	// if not nil, every query prepared from the query file is written to
+	// recorder; if replay is not nil, the queries are read from it instead
+	recorder *protocol.QueryLogWriter
+	replay   []*protocol.LoggedQuery
+	// the order of the ranking; if sidecar is not nil, the top results are
+	// reranked in it by their exact scores against the vectors of sidecar, with
+	// the raw queries kept in rawQueries until then
+	sidecar *database.FloatSidecar
+	// number of results reranked, at least the largest of topKs
+	rerankCandidates int
+	sortOrder        protocol.SortOrder
+	rawQueries       *queryValues[[]float64]
+}
+
+// startRun sets opts up for the queries of a query file: the indices of the
+// queries, and so the order and labels they key, start again from 0
+func (opts *queryOptions) startRun(run *queryRun) {
+	opts.rotation = run.rotation
+	opts.order = run.order
+	opts.reads = 0
+	if opts.labels != nil {
+		opts.labels = newQueryLabels()
+	}
+	if opts.rawQueries != nil {
+		opts.rawQueries = &queryValues[[]float64]{values: make(map[int][]float64)}
+	}
+}
+
+// readQuery reads the next query of the query file for a client, sliced as the
+// vectors, and keeps its ID if the file has a column of them
+func (opts *queryOptions) readQuery(reader *csv.Reader, c *protocol.Client) (uint64, []float64, error) {
+	dim := c.QueryDim()
+	if opts.dimSlice.IsSet() {
+		dim = opts.fileDim
+	}
+	clusterIndex, query, extra, err := readQueryLine(reader, dim, opts.extraColumns)
+	if err == io.EOF {
+		return 0, nil, io.EOF
+	}
+	queryID := opts.queryID(opts.reads)
+	opts.reads++
+	if err != nil {
+		return 0, nil, err
+	}
+	if opts.labels != nil {
+		col := opts.idColumn - int(dim) - 1
+		if col < 0 {
+			return 0, nil, fmt.Errorf("query ID column %d is not after the %d values of the embedding", opts.idColumn, dim)
+		}
+		if col >= len(extra) {
+			return 0, nil, fmt.Errorf("expected a query ID in column %d, got %d columns", opts.idColumn, int(dim)+1+len(extra))
+		}
+		opts.labels.set(queryID, extra[col])
+	}
+	if opts.dimSlice.IsSet() {
+		query = query[opts.dimSlice.Lo:opts.dimSlice.Hi]
+	}
+	return clusterIndex, query, nil
+}
+
+// nextQuery returns the next query for a client, quantized, and the cluster of
+// the database holding its own, either replayed or read from the query file, or,
+// with clusterSets, the index of its row, which names its set. It returns io.EOF
+// once the queries are exhausted.
+func (opts *queryOptions) nextQuery(reader *csv.Reader, c *protocol.Client) (uint64, []int8, error) {
+	if opts.replay != nil {
+		if opts.reads == len(opts.replay) {
+			return 0, nil, io.EOF
+		}
+		q := opts.replay[opts.reads]
+		opts.reads++
+		clusterIndex, err := opts.translateQuery(q.ClusterIndex)
+		if err == nil {
+			err = c.ValidateCluster(clusterIndex)
+		}
+		return clusterIndex, q.Embedding, err
+	}
+
+	clusterIndex, rawQuery, err := opts.readQuery(reader, c)
+	if err == io.EOF {
+		return 0, nil, io.EOF
+	}
+	// the index in the query file of the row just read
+	row := opts.queryID(opts.reads - 1)
+	original := clusterIndex
+	if opts.clusterSets != nil {
+		// the cluster of the row is ignored
+		clusterIndex = uint64(row)
 	} else {
-		queryFile = preamble + "_query.csv"
+		if err == nil {
+			clusterIndex, err = opts.translateQuery(clusterIndex)
+		}
+		if err == nil {
+			err = c.ValidateCluster(clusterIndex)
+		}
 	}
-	if _, err := os.Stat(queryFile); os.IsNotExist(err) {
-		panic("Error: query file does not exist: " + queryFile)
+	var query []int8
+	if err == nil {
+		query, err = c.PrepareQueryWith(rawQuery, opts.queryQuantizer())
 	}
-	// check if prefix_cluster_0.csv is present
-	clusterFile := preamble + "_cluster_0.csv"
-	if _, err := os.Stat(clusterFile); os.IsNotExist(err) {
-		panic("Error: cluster file does not exist: " + clusterFile)
+	if err == nil && opts.rawQueries != nil {
+		opts.rawQueries.set(row, rawQuery)
+	}
+	if err == nil && opts.recorder != nil {
+		// the log names the cluster as the query file does
+		if err := opts.recorder.Write(&protocol.LoggedQuery{QueryID: row, ClusterIndex: original, Embedding: query}); err != nil {
+			return 0, nil, outputError{fmt.Errorf("recording query %d: %w", row, err)}
+		}
 	}
+	return clusterIndex, query, err
 }
 
-func logHintSize(hint *protocol.TiptoeHint) uint64 {
-	gob.Register(database.Metadata{})
-	total := utils.MessageSizeBytes(hint.Metadata)
+// queryID is the index in the query file of the i-th query processed
+func (opts *queryOptions) queryID(i int) int {
+	if opts.order != nil {
+		return opts.order[i]
+	}
+	return i
+}
 
-	gob.Register(database.ClusterMap{})
-	h := utils.MessageSizeBytes(hint.PIRHint)
-	m := utils.MessageSizeBytes(hint.IndexMap)
-	total += (h + m)
+// queryQuantizer quantizes the queries
+func (opts *queryOptions) queryQuantizer() utils.Quantizer {
+	return utils.LinearQuantizer{PrecBits: opts.queryPrecBits, Range: opts.queryRange}
+}
 
-	return total
+// dbQuantizer is the quantizer of the database vectors
+func (opts *queryOptions) dbQuantizer() utils.Quantizer {
+	return utils.LinearQuantizer{PrecBits: opts.precBits, Range: opts.dbRange}
 }
 
-func main() {
-	preamble := flag.String("preamble", "", "Preamble to use for the search")
-	query := flag.String("query", "", "Path to the query file to use for the search")
-	topK := flag.Int("topk", 10, "Number of top results to return")
-	precBits := flag.Uint64("precBits", 5, "Number of bits to use for precision")
-	clusterOnly := flag.Bool("clusterOnly", false, "Only return top k among vectors in the specified cluster")
+// scoreBound is the largest absolute score of any vector, see Client.ScoreBound
+func (opts *queryOptions) scoreBound() int {
+	return int(utils.MixedScoreRange(opts.dim, opts.queryPrecBits, opts.precBits))
+}
 
-	flag.Parse()
-	argumentsValidation(*preamble, *topK, *query)
+// translateQuery returns the cluster of the database holding a query's cluster
+func (opts *queryOptions) translateQuery(clusterIndex uint64) (uint64, error) {
+	if opts.remap == nil {
+		return clusterIndex, nil
+	}
+	return opts.remap.Translate(clusterIndex)
+}
 
-	filesValidation(*preamble, *query)
+// rerankExact reranks the results of a query, named by their original vectors,
+// by their exact scores against the raw query
+func (opts *queryOptions) rerankExact(queryID int, scores *[]protocol.VectorScore) (*[]protocol.VectorScore, error) {
+	raw, ok := opts.rawQueries.get(queryID)
+	if !ok {
+		return nil, fmt.Errorf("the raw query %d was not kept for reranking", queryID)
+	}
+	reranked, _, err := protocol.RerankExact(scores, raw, opts.rerankCandidates, opts.sortOrder, opts.sidecar)
+	return reranked, err
+}
 
-	fmt.Printf("Preamble: %s\n", *preamble)
-	fmt.Printf("Query location: %s\n", *query)
-	fmt.Printf("Top K: %d\n", *topK)
-	fmt.Printf("Cluster Only: %t\n", *clusterOnly)
+// translateClusters translates clusters like translateQuery, leaving out those
+// the database of the client does not hold, e.g., empty ones
+func (opts *queryOptions) translateClusters(clusters []uint64, c *protocol.Client) ([]uint64, error) {
+	res := make([]uint64, 0, len(clusters))
+	for _, cluster := range clusters {
+		t, err := opts.translateQuery(cluster)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := c.ClusterToIndex[uint(t)]; ok {
+			res = append(res, t)
+		}
+	}
+	return res, nil
+}
 
-	dir := filepath.Dir(*preamble)
-	prefix := filepath.Base(*preamble)
+// originalResults names the vectors of results by their original cluster and
+// index within it
+func (opts *queryOptions) originalResults(scores *[]protocol.VectorScore) *[]protocol.VectorScore {
+	if opts.remap == nil {
+		return scores
+	}
+	res := make([]protocol.VectorScore, len(*scores))
+	for i, sc := range *scores {
+		cluster, id := opts.remap.Original(uint64(sc.ClusterID), sc.IDWithinCluster)
+		res[i] = protocol.VectorScore{ClusterID: uint(cluster), IDWithinCluster: id, Score: sc.Score}
+	}
+	return &res
+}
 
-	var queryFile *os.File
-	if *query != "" {
-		queryFile = utils.OpenFile(*query)
-	} else {
-		queryFile = utils.OpenFile(filepath.Join(dir, prefix+"_query.csv"))
+// copies returns a result named by its first original vector, followed, with
+// allCopies, by the other original vectors stored as the same one, each with the
+// score of the result
+func (opts *queryOptions) copies(res protocol.VectorScore) []protocol.VectorScore {
+	if !opts.allCopies {
+		return []protocol.VectorScore{res}
 	}
-	defer queryFile.Close()
+	cluster := uint64(res.ClusterID)
+	originals := opts.remap.Originals(opts.remap.Clusters[cluster], opts.remap.IDs[cluster][res.IDWithinCluster])
+	copies := make([]protocol.VectorScore, len(originals))
+	for i, o := range originals {
+		copies[i] = protocol.VectorScore{ClusterID: uint(o.Cluster), IDWithinCluster: o.ID, Score: res.Score}
+	}
+	return copies
+}
 
-	reader := csv.NewReader(queryFile)
+// answerExporter writes the answer of every successful query for offline
+// reconstruction. The answer is decrypted by reconstructRound and written by
+// queryStats.record, which knows the query index.
+type answerExporter struct {
+	// w, if not nil, writes the answers to an export, and dumpDir, if set, to
+	// files of their own
+	w       *protocol.AnswerWriter
+	dumpDir string
+	pending *protocol.ExportedAnswer
+}
 
-	outputFileSuffix := "_results.csv"
-	if *clusterOnly {
-		outputFileSuffix = "_results_cluster_only.csv"
+// record writes the pending answer of a query, if it succeeded. It only fails
+// with an outputError.
+func (e *answerExporter) record(queryID int, err error) error {
+	pending := e.pending
+	e.pending = nil
+	if pending == nil || err != nil {
+		return nil
 	}
-	var outputFileName string
-	if *query != "" {
-		outputFileName = (*query)[:len(*query)-4] + outputFileSuffix
-	} else {
-		outputFileName = filepath.Join(dir, prefix+outputFileSuffix)
+	pending.QueryID = queryID
+	if e.w != nil {
+		if err := e.w.Write(pending); err != nil {
+			return outputError{fmt.Errorf("exporting answer %d: %w", queryID, err)}
+		}
 	}
-	outputFile, err := os.Create(outputFileName)
-	if err != nil {
-		panic("Error creating output file: " + err.Error())
+	if e.dumpDir != "" {
+		if err := protocol.WriteAnswerDump(e.dumpDir, pending); err != nil {
+			return outputError{fmt.Errorf("dumping answer %d: %w", queryID, err)}
+		}
+	}
+	return nil
+}
+
+// prefixQueryID prepends the query index, or the ID read from the query file, to
+// a row if the options ask for it
+func prefixQueryID(line []string, queryID int, opts *queryOptions) []string {
+	if !opts.withQueryID {
+		return line
 	}
-	defer outputFile.Close()
-	writer := csv.NewWriter(outputFile)
-	defer writer.Flush()
+	if label, ok := opts.labels.get(queryID); ok {
+		return append([]string{label}, line...)
+	}
+	return append([]string{fmt.Sprintf("%d", queryID)}, line...)
+}
 
-	fmt.Printf("%s writing vector search results to %s\n", time.Now().Format("2006/01/02 15:04:05"), outputFileName)
+// outputError is a failure to write an output file, e.g., of a full disk,
+// which stops the run
+type outputError struct {
+	err error
+}
 
-	perfFileSuffix := "_perf.csv"
-	if *clusterOnly {
-		perfFileSuffix = "_perf_cluster_only.csv"
+func (e outputError) Error() string {
+	return e.err.Error()
+}
+
+func (e outputError) Unwrap() error {
+	return e.err
+}
+
+// writeOutput writes a row to a writer of an output file and flushes it,
+// returning an outputError if either fails. Every row is flushed as it is
+// written, so that a failure leaves the rows of the previous queries in the file.
+func writeOutput(w *csv.Writer, line []string) error {
+	if err := w.Write(line); err != nil {
+		return outputError{err}
 	}
-	var perfFileName string
-	if *query != "" {
-		perfFileName = (*query)[:len(*query)-4] + perfFileSuffix
-	} else {
-		perfFileName = filepath.Join(dir, prefix+perfFileSuffix)
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return outputError{err}
 	}
-	perfFile, err := os.Create(perfFileName)
+	return nil
+}
+
+// denseRow lays out the scores of a query with -denseScores: the number of
+// vectors of its cluster, followed by their scores in index order
+func denseRow(scores *[]protocol.VectorScore, opts *queryOptions) ([]string, error) {
+	n, dense, err := protocol.DenseScores(scores, opts.denseLimit)
 	if err != nil {
-		panic("Error creating performance output file: " + err.Error())
+		return nil, err
+	}
+	line := make([]string, 0, len(dense)+1)
+	line = append(line, fmt.Sprintf("%d", n))
+	for _, score := range dense {
+		line = append(line, fmt.Sprintf("%d", score))
+	}
+	return line, nil
+}
+
+// writeResults writes the top k results of a query for each k, all cut off from
+// the same ranking, or with -denseScores its denseLine, and its performance
+// statistics. It only fails with an outputError.
+func writeResults(writers []*csv.Writer, perfWriter *csv.Writer, queryID int, scores *[]protocol.VectorScore, denseLine []string, perf *QueryPerf, opts *queryOptions) error {
+	for i, writer := range writers {
+		var err error
+		if opts.dense {
+			err = writeOutput(writer, prefixQueryID(denseLine, queryID, opts))
+		} else if opts.countOnly {
+			err = writeOutput(writer, prefixQueryID([]string{fmt.Sprintf("%d", len(*scores))}, queryID, opts))
+		} else {
+			err = writeTopK(writer, queryID, scores, opts.topKs[i], opts)
+		}
+		if err != nil {
+			return err
+		}
 	}
-	defer perfFile.Close()
-	perfWriter := csv.NewWriter(perfFile)
-	defer perfWriter.Flush()
 
-	fmt.Printf("%s writing performance statistics to %s\n", time.Now().Format("2006/01/02 15:04:05"), perfFileName)
+	perfLine := []string{
+		opts.timeUnit.format(perf.ClientHintQueryTime),
+		opts.timeUnit.format(perf.ServerHintAnswerTime),
+		opts.timeUnit.format(perf.ClientHintApplyTime),
+		opts.timeUnit.format(perf.ClientQueryProcessingTime),
+		opts.timeUnit.format(perf.ServerComputeTime),
+		opts.timeUnit.format(perf.ClientReconTime),
+		fmt.Sprintf("%d", perf.HintQuerySize),
+		fmt.Sprintf("%d", perf.HintAnsSize),
+		fmt.Sprintf("%d", perf.QuerySize),
+		fmt.Sprintf("%d", perf.AnsSize),
+		fmt.Sprintf("%d", perf.NumCandidates),
+	}
+	if opts.retry != nil {
+		perfLine = append(perfLine, fmt.Sprintf("%d", perf.Retries), opts.timeUnit.format(perf.RetryWaitTime))
+	}
+	return writeOutput(perfWriter, prefixQueryID(perfLine, queryID, opts))
+}
 
-	// write the header for the perf csv
-	perfHeader := []string{
-		"clientHintQueryTime",
-		"serverHintAnswerTime",
-		"clientHintApplyTime",
-		"clientQueryProcessingTime",
-		"serverComputeTime",
-		"clientReconTime",
-		"hintQuerySize",
-		"hintAnsSize",
-		"querySize",
-		"ansSize",
+// writeTopK writes the first k results of a ranking as one row, which is empty
+// if there are none, e.g., for an empty cluster
+func writeTopK(writer *csv.Writer, queryID int, scores *[]protocol.VectorScore, k int, opts *queryOptions) error {
+	numRes := k
+	if numRes > len(*scores) {
+		numRes = len(*scores)
+	}
+	if opts.relMargin > 0 {
+		if n := protocol.WithinMargin(scores, opts.relMargin, opts.sortOrder); n < numRes {
+			numRes = n
+		}
+		if opts.marginMinScore {
+			for n := 0; n < numRes; n++ {
+				if !opts.sortOrder.Meets((*scores)[n].Score, opts.minScore) {
+					numRes = n
+					break
+				}
+			}
+		}
+	}
+	var transformed []float64
+	if opts.withScores {
+		raw := make([]int, numRes)
+		for i := 0; i < numRes; i++ {
+			raw[i] = (*scores)[i].Score
+		}
+		transformed = utils.TransformQuantizedScores(raw, opts.scoreTransform, opts.dim, opts.queryQuantizer(), opts.dbQuantizer())
 	}
-	if err := perfWriter.Write(perfHeader); err != nil {
-		panic("Error writing to performance output file: " + err.Error())
+	line := make([]string, 0, numRes*4)
+	for i := 0; i < numRes; i++ {
+		for _, res := range opts.copies((*scores)[i]) {
+			line = appendResult(line, res, i, transformed, opts)
+		}
 	}
-	perfWriter.Flush()
+	return writeOutput(writer, prefixQueryID(line, queryID, opts))
+}
 
-	// start a timer
-	serverPreProcessingStart := time.Now()
-	metadata, clusters := database.ReadAllClusters(*preamble, *precBits)
-	hintSz := uint64(900)
+// appendResult appends the fields of the i-th result of a row to it, whose
+// score, if transformed, is transformed[i]
+func appendResult(line []string, res protocol.VectorScore, i int, transformed []float64, opts *queryOptions) []string {
+	line = append(line, fmt.Sprintf("%d", res.ClusterID), fmt.Sprintf("%d", res.IDWithinCluster))
+	if opts.externalIDs != nil {
+		id := ""
+		if ids := opts.externalIDs[res.ClusterID]; ids != nil {
+			id = ids[res.IDWithinCluster]
+		}
+		line = append(line, id)
+	}
+	if opts.withScores {
+		if opts.scoreTransform == utils.IdentityTransform {
+			line = append(line, fmt.Sprintf("%d", res.Score))
+		} else {
+			line = append(line, fmt.Sprintf("%g", transformed[i]))
+		}
+	}
+	if opts.norms != nil {
+		c := opts.norms[res.ClusterID]
+		var norm float64
+		if opts.rawNorms {
+			norm = c.Stats.Norms[res.IDWithinCluster]
+		} else {
+			norm = c.VectorNorm(res.IDWithinCluster)
+		}
+		line = append(line, fmt.Sprintf("%g", norm))
+	}
+	return line
+}
 
-	server := new(protocol.Server)
-	server.ProcessVectorsFromClusters(metadata, clusters, hintSz, *precBits)
+// writeError writes an error marker in place of the results and performance
+// statistics of a query that failed, so that rows stay aligned with the queries.
+// It only fails with an outputError.
+func writeError(writers []*csv.Writer, perfWriter *csv.Writer, queryID int, queryErr error, opts *queryOptions) error {
+	line := prefixQueryID([]string{"error", queryErr.Error()}, queryID, opts)
+	for _, writer := range writers {
+		if err := writeOutput(writer, line); err != nil {
+			return err
+		}
+	}
+	return writeOutput(perfWriter, line)
+}
+
+// timeUnit is the unit of the timing columns of the performance file; the zero
+// value is seconds
+type timeUnit time.Duration
 
-	serverPreProcessingTime := time.Since(serverPreProcessingStart)
+func parseTimeUnit(s string) (timeUnit, error) {
+	switch s {
+	case "s":
+		return timeUnit(time.Second), nil
+	case "ms":
+		return timeUnit(time.Millisecond), nil
+	case "us":
+		return timeUnit(time.Microsecond), nil
+	}
+	return 0, fmt.Errorf("unknown time unit %q, expected s, ms or us", s)
+}
 
-	fmt.Printf("%s Server database construction time: %s\n", time.Now().Format("2006/01/02 15:04:05"), serverPreProcessingTime)
+// format writes a duration in the unit: seconds as before, with %g, and other
+// units in decimal notation, without exponents
+func (u timeUnit) format(d time.Duration) string {
+	if u == 0 || u == timeUnit(time.Second) {
+		return fmt.Sprintf("%g", d.Seconds())
+	}
+	return strconv.FormatFloat(float64(d)/float64(u), 'f', -1, 64)
+}
 
-	// print server hint size in bytes
-	fmt.Printf("Server hint size: %d bytes\n", logHintSize(server.Hint))
+// column is the header of a timing column, suffixed with the unit unless it is
+// seconds, e.g., clientReconTimeMs
+func (u timeUnit) column(name string) string {
+	switch u {
+	case timeUnit(time.Millisecond):
+		return name + "Ms"
+	case timeUnit(time.Microsecond):
+		return name + "Us"
+	}
+	return name
+}
 
-	client := new(protocol.Client)
-	client.Setup(server.Hint)
+// rotatingFile is an output file that can be continued in a new part between
+// two queries. Every part starts with header, e.g., a byte order mark and the
+// header row of the performance file.
+type rotatingFile struct {
+	name    func(part int) string
+	header  []byte
+	f       *os.File
+	path    string
+	written uint64
+}
 
-	queryCount := 0
-	for {
-		clusterIndex, query, isEnd := readQueryLine(reader, metadata.Dim, *precBits)
-		if isEnd {
-			break
+func (r *rotatingFile) open(part int) error {
+	if r.f != nil {
+		if err := r.f.Close(); err != nil {
+			return err
 		}
-		sortedScores, perf := runRound(client, server, query, clusterIndex, *clusterOnly)
-		writeResults(writer, perfWriter, sortedScores, *topK, perf)
-		queryCount++
+	}
+	f, err := os.Create(r.name(part))
+	if err != nil {
+		return fmt.Errorf("output file %s cannot be created: %w", r.name(part), errors.Unwrap(err))
+	}
+	r.f, r.path = f, r.name(part)
+	r.written = 0
+	_, err = r.Write(r.header)
+	return err
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	n, err := r.f.Write(b)
+	r.written += uint64(n)
+	if err != nil {
+		err = fmt.Errorf("error writing %s: %w", r.path, errors.Unwrap(err))
+	}
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
+
+// outputRotation starts new parts of all output files together, after every
+// everyQueries queries or once a file reaches everyBytes bytes, so that the
+// rows of the results and performance files of a part stay aligned
+type outputRotation struct {
+	everyQueries int
+	everyBytes   uint64
+	files        []*rotatingFile
+	part         int
+	queries      int
+}
 
-		if queryCount%100 == 0 {
-			fmt.Printf("%s Processed %d queries\n", time.Now().Format("2006/01/02 15:04:05"), queryCount)
+// parseRotateEvery parses -rotateEvery: a number of queries, or a size in
+// megabytes such as 64MB
+func parseRotateEvery(s string) (*outputRotation, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if mb := strings.TrimSuffix(s, "MB"); mb != s {
+		n, err := strconv.ParseUint(mb, 10, 64)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid rotation size %q, expected a positive number of megabytes", s)
 		}
+		return &outputRotation{everyBytes: n << 20}, nil
 	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid rotation %q, expected a positive number of queries or a size such as 64MB", s)
+	}
+	return &outputRotation{everyQueries: n}, nil
+}
+
+// partName inserts the part index before the extension of an output file name
+func partName(name string, part int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s_part%d%s", strings.TrimSuffix(name, ext), part, ext)
 }
 
-func runRound(c *protocol.Client, s *protocol.Server, query []int8, clusterIndex uint64, clusterOnly bool) (*[]protocol.VectorScore, *QueryPerf) {
-	clientHintQuery := time.Now()
-	ct := c.PreprocessQuery()
-	clientHintQueryTime := time.Since(clientHintQuery)
-	hintQuerySize := utils.MessageSizeBytes(*ct)
+// next is called before the rows of every query are written, so that no part
+// is started after the last query. It only fails with an outputError.
+func (o *outputRotation) next() error {
+	full := o.everyQueries > 0 && o.queries >= o.everyQueries
+	for _, f := range o.files {
+		if o.everyBytes > 0 && f.written >= o.everyBytes {
+			full = true
+		}
+	}
+	o.queries++
+	if !full {
+		return nil
+	}
+	o.part++
+	o.queries = 1
+	for _, f := range o.files {
+		if err := f.open(o.part); err != nil {
+			return outputError{fmt.Errorf("rotating output file: %w", err)}
+		}
+	}
+	fmt.Printf("%s continuing the output files in part %d\n", time.Now().Format("2006/01/02 15:04:05"), o.part)
+	return nil
+}
 
-	serverHintAnswerStart := time.Now()
-	offlineAns := s.HintAnswer(ct)
-	serverHintAnswerTime := time.Since(serverHintAnswerStart)
-	hintAnsSize := utils.MessageSizeBytes(*offlineAns)
+// newOutputWriter returns a csv writer for an output file, optionally with CRLF
+// line endings and a leading UTF-8 byte order mark for spreadsheet tools. It
+// only fails with an outputError, writing the mark.
+func newOutputWriter(w io.Writer, crlf bool, bom bool) (*csv.Writer, error) {
+	if bom {
+		if _, err := w.Write([]byte{0xEF, 0xBB, 0xBF}); err != nil {
+			return nil, outputError{err}
+		}
+	}
+	writer := csv.NewWriter(w)
+	writer.UseCRLF = crlf
+	return writer, nil
+}
 
-	clientHintApplyStart := time.Now()
-	c.ProcessHintApply(offlineAns)
-	clientHintApplyTime := time.Since(clientHintApplyStart)
+// findQueryFiles returns the query files of a run: preamble_query.csv by
+// default, or the query file, or the files matching it, in lexical order, if it
+// is a pattern such as dir/queries_*.csv. Matches named after another match,
+// such as the outputs dir/queries_1_results.csv of dir/queries_1.csv from a
+// previous run, are skipped.
+func findQueryFiles(preamble string, query string) ([]string, error) {
+	if query == "" {
+		return []string{preamble + "_query.csv"}, nil
+	}
+	if !strings.ContainsAny(query, "*?[") {
+		return []string{query}, nil
+	}
+	files, err := filepath.Glob(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query pattern %q: %w", query, err)
+	}
+	queries := make([]string, 0, len(files))
+	for _, f := range files {
+		output := false
+		for _, other := range files {
+			if other != f && strings.HasPrefix(f, strings.TrimSuffix(other, filepath.Ext(other))+"_") {
+				output = true
+			}
+		}
+		if !output {
+			queries = append(queries, f)
+		}
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("no query file matches %s", query)
+	}
+	return queries, nil
+}
 
-	clientQueryProcessingStart := time.Now()
-	queryEmb := c.QueryEmbeddings(query, clusterIndex)
-	clientQueryProcessingTime := time.Since(clientQueryProcessingStart)
+func filesValidation(preamble string, queryFiles []string) error {
+	// preamble_metadata.json is optional: without it, the metadata is inferred from the cluster files
+	for _, queryFile := range queryFiles {
+		if _, err := os.Stat(queryFile); os.IsNotExist(err) {
+			return fmt.Errorf("query file does not exist: %s", queryFile)
+		}
+	}
+	// check if prefix_cluster_0.csv, prefix_cluster_0.jsonl or prefix_clusters.jsonl is present
+	if database.FindClusterFiles(preamble) == database.NoClusterFiles {
+		return fmt.Errorf("cluster files do not exist: %s_cluster_0.csv", preamble)
+	}
+	return nil
+}
 
-	querySize := utils.MessageSizeBytes(*queryEmb)
+// outputConfig is how the output files of every query file are written
+type outputConfig struct {
+	topKs       []uint64
+	clusterOnly bool
+	withQueryID bool
+	crlf        bool
+	bom         bool
+	rotateEvery string
+	timeUnit    timeUnit
+	// with -rpcRetries, the performance files have columns of the retries
+	withRetries bool
+}
 
-	serverComputeStart := time.Now()
-	ans := s.Answer(queryEmb)
-	serverComputeTime := time.Since(serverComputeStart)
-	ansSize := utils.MessageSizeBytes(*ans)
+// queryRun is a query file and its output files: one results file per cutoff
+// and a performance file, named after base
+type queryRun struct {
+	file      string
+	queryFile *os.File
+	reader    *csv.Reader
+	// with -shuffleQueries, the line of the query file of every query read
+	order      []int
+	writers    []*csv.Writer
+	perfWriter *csv.Writer
+	// every output file can be continued in new parts with -rotateEvery, each
+	// starting with the byte order mark and the header row of the file, if any
+	rotation *outputRotation
+	files    []*rotatingFile
+}
 
-	var recon *[]protocol.VectorScore
+// checkWritable checks that an output file can be created, or overwritten,
+// without changing it, and names the file and the reason if not
+func checkWritable(file string) error {
+	_, statErr := os.Stat(file)
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("output file %s is not writable: %w", file, errors.Unwrap(err))
+	}
+	f.Close()
+	if os.IsNotExist(statErr) {
+		os.Remove(file)
+	}
+	return nil
+}
 
-	clientReconStart := time.Now()
-	if clusterOnly {
-		recon = c.ReconstructWithinCluster(ans, clusterIndex, c.DBInfo.P())
-	} else {
-		recon = c.ReconstructWithinBin(ans, clusterIndex, c.DBInfo.P())
+// checkWritableDir checks that files can be created in a directory, creating it
+// if needed
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("output directory %s cannot be created: %w", dir, errors.Unwrap(err))
 	}
-	clientReconTime := time.Since(clientReconStart)
+	f, err := os.CreateTemp(dir, ".writable")
+	if err != nil {
+		return fmt.Errorf("output directory %s is not writable: %w", dir, errors.Unwrap(err))
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
 
-	perf := &QueryPerf{
-		clientHintQueryTime:       clientHintQueryTime,
-		serverHintAnswerTime:      serverHintAnswerTime,
-		clientHintApplyTime:       clientHintApplyTime,
-		clientQueryProcessingTime: clientQueryProcessingTime,
-		serverComputeTime:         serverComputeTime,
-		clientReconTime:           clientReconTime,
-		hintQuerySize:             hintQuerySize,
-		hintAnsSize:               hintAnsSize,
-		querySize:                 querySize,
-		ansSize:                   ansSize,
+func openQueryRun(file string, base string, cfg outputConfig) (*queryRun, error) {
+	queryFile, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	run := &queryRun{file: file, queryFile: queryFile}
+	run.reader = csv.NewReader(run.queryFile)
+	// rows are validated by readQueryLine, so that a bad row only fails its own query
+	run.reader.FieldsPerRecord = -1
+
+	if run.rotation, err = parseRotateEvery(cfg.rotateEvery); err != nil {
+		run.close()
+		return nil, err
+	}
+	newOutputFile := func(name string, header []string) (*csv.Writer, error) {
+		var buf bytes.Buffer
+		headerWriter, err := newOutputWriter(&buf, cfg.crlf, cfg.bom)
+		if err != nil {
+			return nil, err
+		}
+		if header != nil {
+			if err := headerWriter.Write(header); err != nil {
+				return nil, fmt.Errorf("writing header: %w", err)
+			}
+			headerWriter.Flush()
+		}
+		f := &rotatingFile{
+			name: func(part int) string {
+				if run.rotation == nil {
+					return name
+				}
+				return partName(name, part)
+			},
+			header: buf.Bytes(),
+		}
+		if err := f.open(0); err != nil {
+			return nil, err
+		}
+		run.files = append(run.files, f)
+		if run.rotation != nil {
+			run.rotation.files = append(run.rotation.files, f)
+		}
+		return newOutputWriter(f, cfg.crlf, false)
+	}
+
+	outputFileSuffix := "_results.csv"
+	if cfg.clusterOnly {
+		outputFileSuffix = "_results_cluster_only.csv"
+	}
+	// with several cutoffs, each gets its own file, e.g., _results_k10.csv
+	run.writers = make([]*csv.Writer, len(cfg.topKs))
+	for i, k := range cfg.topKs {
+		suffix := outputFileSuffix
+		if len(cfg.topKs) > 1 {
+			suffix = fmt.Sprintf("%s_k%d.csv", strings.TrimSuffix(outputFileSuffix, ".csv"), k)
+		}
+		if run.writers[i], err = newOutputFile(base+suffix, nil); err != nil {
+			run.close()
+			return nil, err
+		}
+
+		fmt.Printf("%s writing vector search results to %s\n", time.Now().Format("2006/01/02 15:04:05"), run.files[len(run.files)-1].name(0))
+	}
+
+	perfFileSuffix := "_perf.csv"
+	if cfg.clusterOnly {
+		perfFileSuffix = "_perf_cluster_only.csv"
+	}
+	perfHeader := []string{
+		cfg.timeUnit.column("clientHintQueryTime"),
+		cfg.timeUnit.column("serverHintAnswerTime"),
+		cfg.timeUnit.column("clientHintApplyTime"),
+		cfg.timeUnit.column("clientQueryProcessingTime"),
+		cfg.timeUnit.column("serverComputeTime"),
+		cfg.timeUnit.column("clientReconTime"),
+		"hintQuerySize",
+		"hintAnsSize",
+		"querySize",
+		"ansSize",
+		"numCandidates",
+	}
+	if cfg.withRetries {
+		perfHeader = append(perfHeader, "retries", cfg.timeUnit.column("retryWaitTime"))
+	}
+	if cfg.withQueryID {
+		perfHeader = append([]string{"queryID"}, perfHeader...)
+	}
+	if run.perfWriter, err = newOutputFile(base+perfFileSuffix, perfHeader); err != nil {
+		run.close()
+		return nil, err
+	}
+
+	fmt.Printf("%s writing performance statistics to %s\n", time.Now().Format("2006/01/02 15:04:05"), run.files[len(run.files)-1].name(0))
+	return run, nil
+}
+
+// close flushes the output files and closes them and the query file, also of
+// a run that failed to open all of its output files
+func (r *queryRun) close() {
+	for _, w := range r.writers {
+		if w != nil {
+			w.Flush()
+		}
+	}
+	if r.perfWriter != nil {
+		r.perfWriter.Flush()
+	}
+	for _, f := range r.files {
+		f.Close()
+	}
+	r.queryFile.Close()
+}
+
+func logHintSize(hint *protocol.TiptoeHint) uint64 {
+	gob.Register(database.ClusterMap{})
+	return hintSize(hint, utils.MessageSizeBytes(hint.IndexMap))
+}
+
+// deterministicHintSize is the size of the hint with the index map serialized
+// by MarshalDeterministic, as hintDigest hashes it, rather than gob-encoded
+func deterministicHintSize(hint *protocol.TiptoeHint) uint64 {
+	return hintSize(hint, uint64(len(hint.IndexMap.MarshalDeterministic())))
+}
+
+// hintSize adds the size of the index map, however it is serialized, to the
+// size of the rest of the hint
+func hintSize(hint *protocol.TiptoeHint, indexMapSize uint64) uint64 {
+	gob.Register(database.Metadata{})
+	total := utils.MessageSizeBytes(hint.Metadata)
+
+	h := utils.MessageSizeBytes(hint.PIRHint)
+	total += (h + indexMapSize + 8*uint64(len(hint.ClusterSizes)))
+
+	return total
+}
+
+// buildManifest records how the database was built, so that it can be rebuilt
+// identically by passing Seed back with -seed
+type buildManifest struct {
+	Seed           string   `json:"seed"`
+	PrecBits       uint64   `json:"prec_bits"`
+	HintSz         uint64   `json:"hint_sz"`
+	MaxColumns     uint64   `json:"max_columns"`
+	PinnedClusters []uint64 `json:"pinned_clusters"`
+	BestFit        bool     `json:"best_fit"`
+	MaxAnswerBytes uint64   `json:"max_answer_bytes,omitempty"`
+	// the wire format of MaxAnswerBytes, from -wireFormat
+	AnswerWire string `json:"answer_wire,omitempty"`
+	// with -compact, the clusters of fewer vectors were merged before building,
+	// and the pinned clusters are numbered before compaction
+	CompactMinSize uint64 `json:"compact_min_size,omitempty"`
+	// with -dedup, identical vectors were stored once before compaction
+	Dedup bool `json:"dedup,omitempty"`
+	// with -dimSlice, the dimensions kept, as lo:hi
+	DimSlice string `json:"dim_slice,omitempty"`
+	// with -dbRange, the range of the values quantized to precBits bits
+	DBRange float64 `json:"db_range,omitempty"`
+	// with -exportAnswers, the file of the answers and the version of its format
+	AnswersFile    string `json:"answers_file,omitempty"`
+	AnswersVersion int    `json:"answers_version,omitempty"`
+	// with -dumpAnswers, the directory of the dump and the version of its layout
+	DumpDir     string `json:"dump_dir,omitempty"`
+	DumpVersion int    `json:"dump_version,omitempty"`
+	// with -recordQueries or -replay, the query log and the version of its layout
+	QueryLog        string            `json:"query_log,omitempty"`
+	QueryLogVersion int               `json:"query_log_version,omitempty"`
+	InputQuantized  bool              `json:"input_quantized"`
+	Metadata        database.Metadata `json:"metadata"`
+	HintSHA256      string            `json:"hint_sha256"`
+}
+
+// hintDigest hashes the parts of the hint that depend on the seed and layout
+func hintDigest(hint *protocol.TiptoeHint) string {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(hint.PIRHint); err != nil {
+		panic("Error encoding hint: " + err.Error())
+	}
+	digest := sha256.New()
+	digest.Write(buf.Bytes())
+	digest.Write(hint.IndexMap.MarshalDeterministic())
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+func writeManifest(file string, manifest buildManifest) error {
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(b, '\n'), 0644)
+}
+
+// writeAccessStats writes the number of queries to every queried cluster, hottest
+// first, as cluster,count rows
+func writeAccessStats(file string, counts map[uint64]uint64) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"cluster", "count"})
+	for _, cluster := range protocol.HottestClusters(counts) {
+		w.Write([]string{fmt.Sprintf("%d", cluster), fmt.Sprintf("%d", counts[cluster])})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func main() {
+	cfg, err := parseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		// the flag set has printed the error and the usage
+		os.Exit(2)
+	}
+	if err := run(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// config holds the options of a run, one per flag of parseFlags, which
+// documents them
+type config struct {
+	preamble           string
+	query              string
+	topK               string
+	precBits           uint64
+	strictQuantization bool
+	queryPrecBits      uint64
+	dbRange            float64
+	queryRange         float64
+	withQueryID        bool
+	withNorms          bool
+	rawNorms           bool
+	withExternalIDs    bool
+	withScores         bool
+	exactRerank        string
+	rerankCandidates   int
+	scoreTransform     string
+	crlf               bool
+	bom                bool
+	projection         string
+	clusterOnly        bool
+	maxColumns         uint64
+	maxAnswerBytes     uint64
+	packingLayout      string
+	plan               bool
+	explain            int
+	readBuffer         int
+	maxDim             uint64
+	inputQuantized     bool
+	maxCandidates      uint64
+	queryCache         int
+	wireFormat         string
+	global             int
+	clusterSetsFile    string
+	centroidsFile      string
+	writeCentroids     bool
+	writeMetadata      bool
+	center             bool
+	centerFile         string
+	pipeline           bool
+	plaintext          bool
+	bestFit            bool
+	pinClusters        string
+	perClusterTopK     int
+	denseScores        bool
+	denseLimit         int
+	countOnly          bool
+	minScore           int
+	relMargin          float64
+	sortOrder          string
+	perfTimeUnit       string
+	rotateEvery        string
+	dumpAnswers        string
+	exportAnswers      string
+	dimSlice           string
+	deduplicate        bool
+	allCopies          bool
+	compact            uint64
+	lazyClusters       int
+	rpcRetries         int
+	rpcTimeout         time.Duration
+	rpcBackoff         time.Duration
+	stallWarning       time.Duration
+	accessStats        bool
+	shuffle            bool
+	diffOld            string
+	diffOutput         string
+	diffQueryID        string
+	recordQueries      string
+	replay             string
+	extraColumns       bool
+	queryIDColumn      int
+	shuffleSeed        int64
+	concurrency        int
+	queryMetadata      string
+	maxProcs           int
+	seedHex            string
+	recordManifest     bool
+	// whether -minScore was given, rather than left at its default
+	minScoreSet bool
+	// the arguments after the flags: the new results file of -diff
+	args []string
+}
+
+// defaultConfig returns the options of a run without flags
+func defaultConfig() config {
+	return config{
+		topK:           "10",
+		precBits:       5,
+		dbRange:        1,
+		queryRange:     1,
+		scoreTransform: "identity",
+		explain:        -1,
+		readBuffer:     database.DefaultReadBufferSize,
+		maxDim:         database.DefaultMaxDim,
+		wireFormat:     "gob",
+		global:         -1,
+		sortOrder:      "desc",
+		perfTimeUnit:   "s",
+		rpcBackoff:     100 * time.Millisecond,
+		queryIDColumn:  -1,
+		concurrency:    1,
+	}
+}
+
+// parseFlags parses the command-line arguments, without the program name, into
+// the options of a run, printing the usage on an error
+func parseFlags(args []string) (config, error) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.StringVar(&cfg.preamble, "preamble", cfg.preamble, "Preamble to use for the search")
+	fs.StringVar(&cfg.query, "query", cfg.query, "Path to the query file to use for the search")
+	fs.StringVar(&cfg.topK, "topk", cfg.topK, "Number of top results to return, or a comma-separated list of cutoffs, each written to its own results file")
+	fs.Uint64Var(&cfg.precBits, "precBits", cfg.precBits, "Number of bits to use for precision")
+	fs.BoolVar(&cfg.strictQuantization, "strictQuantization", cfg.strictQuantization, "Stop at the first query with a value that quantization would clamp, naming the dimension and value, instead of clamping it")
+	fs.Uint64Var(&cfg.queryPrecBits, "queryPrecBits", cfg.queryPrecBits, "If positive, quantize the queries with this many bits instead of precBits, at most 7")
+	fs.Float64Var(&cfg.dbRange, "dbRange", cfg.dbRange, "Quantize the database values over [-dbRange, dbRange] instead of [-1, 1]")
+	fs.Float64Var(&cfg.queryRange, "queryRange", cfg.queryRange, "Quantize the query values over [-queryRange, queryRange] instead of [-1, 1]")
+	fs.BoolVar(&cfg.withQueryID, "queryID", cfg.withQueryID, "Start every row of the results and performance files with the index of its query in the query file")
+	fs.BoolVar(&cfg.withNorms, "norms", cfg.withNorms, "Write the norm of the stored vector of each result, after its score if written (reveals the magnitude of returned vectors)")
+	fs.BoolVar(&cfg.rawNorms, "rawNorms", cfg.rawNorms, "With -norms, write the norm of the vector as read, before quantization, gathered as the csv cluster files are read, instead of that of the stored vector")
+	fs.BoolVar(&cfg.withExternalIDs, "externalIDs", cfg.withExternalIDs, "Write the external ID of each result, read from <preamble>_cluster_<i>_ids.csv")
+	fs.BoolVar(&cfg.withScores, "scores", cfg.withScores, "Write the score of each result after its ID")
+	fs.StringVar(&cfg.exactRerank, "exactRerank", cfg.exactRerank, "Path to a csv file of rows cluster,index,values... holding the unquantized vectors, to rerank the top results of every query by their exact scores; reveals the candidates to whoever holds the file")
+	fs.IntVar(&cfg.rerankCandidates, "rerankCandidates", cfg.rerankCandidates, "With -exactRerank, number of results reranked, at least the largest -topk, so that reranking can change which results are returned; the largest -topk by default")
+	fs.StringVar(&cfg.scoreTransform, "scoreTransform", cfg.scoreTransform, "Transform applied to written scores: identity, sigmoid, minmax or linear (implies -scores unless identity)")
+	fs.BoolVar(&cfg.crlf, "crlf", cfg.crlf, "End the rows of the output files with CRLF instead of LF")
+	fs.BoolVar(&cfg.bom, "bom", cfg.bom, "Start the output files with a UTF-8 byte order mark")
+	fs.StringVar(&cfg.projection, "projection", cfg.projection, "Path to a csv projection matrix applied to queries before quantization, one row per database dimension")
+	fs.BoolVar(&cfg.clusterOnly, "clusterOnly", cfg.clusterOnly, "Only return top k among vectors in the specified cluster")
+	fs.Uint64Var(&cfg.maxColumns, "maxColumns", cfg.maxColumns, "If positive, pack the clusters into at most this many database columns, making them taller as needed")
+	fs.Uint64Var(&cfg.maxAnswerBytes, "maxAnswerBytes", cfg.maxAnswerBytes, "If positive, cap the size of an answer in the -wireFormat at this many bytes, by filling the columns only up to the rows that fit")
+	fs.StringVar(&cfg.packingLayout, "packingLayout", cfg.packingLayout, "Write which clusters landed in which columns of the database, with the fill and slack of every column, to this file, as JSON if it ends in .json and csv otherwise")
+	fs.BoolVar(&cfg.plan, "plan", cfg.plan, "Print the layout and SimplePIR parameters of the database of the metadata file, assuming clusters of even sizes, and exit without reading the clusters")
+	fs.IntVar(&cfg.explain, "explain", cfg.explain, "If non-negative, print where this cluster is stored in the database and exit without running queries")
+	fs.IntVar(&cfg.readBuffer, "readBuffer", cfg.readBuffer, "Read buffer size in bytes of the cluster csv files")
+	fs.Uint64Var(&cfg.maxDim, "maxDim", cfg.maxDim, "Largest dimension of the vectors accepted, to fail on a mis-specified metadata dimension rather than attempt an absurd allocation")
+	fs.BoolVar(&cfg.inputQuantized, "inputQuantized", cfg.inputQuantized, "Cluster csv files already hold values quantized to precBits bits, which are read without quantizing them again")
+	fs.Uint64Var(&cfg.maxCandidates, "maxCandidates", cfg.maxCandidates, "If positive, only score this many rows of the bin (or cluster), starting at the query's cluster, to bound reconstruction time")
+	fs.IntVar(&cfg.queryCache, "queryCache", cfg.queryCache, "If positive, cache the encodings of this many distinct queries and resend them when repeated (benchmarking only: the server can link repeated queries)")
+	fs.StringVar(&cfg.wireFormat, "wireFormat", cfg.wireFormat, "Serialization measured for the message sizes of the performance file: gob or binary (language-neutral)")
+	fs.IntVar(&cfg.global, "global", cfg.global, "If non-negative, ignore the cluster of each query and search the whole database with this many bin probes (0 for all bins), reporting the recall against an exhaustive search")
+	fs.StringVar(&cfg.clusterSetsFile, "clusterSets", cfg.clusterSetsFile, "Path to a csv file listing, on the line of every row of the query file, the clusters to probe for it instead of the cluster of the row, e.g., from an external router")
+	fs.StringVar(&cfg.centroidsFile, "centroids", cfg.centroidsFile, "Path to the cluster centroids written by -writeCentroids, which -global uses to choose the bins to probe")
+	fs.BoolVar(&cfg.writeCentroids, "writeCentroids", cfg.writeCentroids, "Write the mean of each cluster's unquantized vectors to <preamble>_centroids.csv, for routing queries to clusters")
+	fs.BoolVar(&cfg.writeMetadata, "writeMetadata", cfg.writeMetadata, "If <preamble>_metadata.json does not exist, write the metadata inferred from the cluster files to it, or, with -center, add the mean computed to it")
+	fs.BoolVar(&cfg.center, "center", cfg.center, "Subtract the per-dimension mean of the corpus from the vectors, and the queries, before quantization, unless the metadata holds a mean; csv cluster files only")
+	fs.StringVar(&cfg.centerFile, "centerFile", cfg.centerFile, "Path to a csv file of a single row, the mean to center the vectors and queries on instead of the corpus mean")
+	fs.BoolVar(&cfg.pipeline, "pipeline", cfg.pipeline, "Overlap the server computation of the next query with the reconstruction of the current one (not with -plaintext or -queryCache)")
+	fs.BoolVar(&cfg.plaintext, "plaintext", cfg.plaintext, "Baseline without PIR: score the queries directly against the clusters (reveals the queries, for analysis only)")
+	fs.BoolVar(&cfg.bestFit, "bestFit", cfg.bestFit, "Pack each cluster into the database column it leaves with the least free space, instead of the first column with room")
+	fs.StringVar(&cfg.pinClusters, "pinClusters", cfg.pinClusters, "Comma-separated indices of clusters that each get a database column of their own")
+	fs.IntVar(&cfg.perClusterTopK, "perClusterTopK", cfg.perClusterTopK, "If positive, return at most this many vectors from each cluster of the bin (ignored with -clusterOnly)")
+	fs.BoolVar(&cfg.denseScores, "denseScores", cfg.denseScores, "With -clusterOnly, instead of the top k, write the scores of all vectors of the queried cluster, in their order within the cluster, after their number")
+	fs.IntVar(&cfg.denseLimit, "denseLimit", cfg.denseLimit, "If positive, write at most this many scores with -denseScores, of the first vectors of the cluster")
+	fs.BoolVar(&cfg.countOnly, "countOnly", cfg.countOnly, "Instead of the top k, write the number of vectors of the cluster (or bin) scoring at least -minScore")
+	fs.IntVar(&cfg.minScore, "minScore", cfg.minScore, "Raw score threshold of -countOnly (an upper bound with -sortOrder=asc), and of the results of -relMargin if given")
+	fs.Float64Var(&cfg.relMargin, "relMargin", cfg.relMargin, "If positive, write only the top-k results whose raw score is within this relative margin of the best one, e.g., 0.1 for at least 90% of a positive best score")
+	fs.StringVar(&cfg.sortOrder, "sortOrder", cfg.sortOrder, "Rank the results by descending (desc) or ascending (asc) score")
+	fs.StringVar(&cfg.perfTimeUnit, "timeUnit", cfg.perfTimeUnit, "Unit of the timing columns of the performance file: s, ms or us")
+	fs.StringVar(&cfg.rotateEvery, "rotateEvery", cfg.rotateEvery, "Continue the results and performance files in a new part, e.g., _results_part1.csv, every this many queries, or once a file reaches a size such as 64MB")
+	fs.StringVar(&cfg.dumpAnswers, "dumpAnswers", cfg.dumpAnswers, "Write the raw answer of every query, with its decryption, to <dir>/<query>.bin for tools in other languages (the decryptions reveal the scores of whole bins: local analysis only)")
+	fs.StringVar(&cfg.exportAnswers, "exportAnswers", cfg.exportAnswers, "Write the decrypted answer of every query to this file, for offline reconstruction with cmd/reconstruct (reveals the scores of whole bins)")
+	fs.StringVar(&cfg.dimSlice, "dimSlice", cfg.dimSlice, "Keep only dimensions lo to hi-1 of the vectors and queries, given as lo:hi, to build a lower-dimensional index from the same files")
+	fs.BoolVar(&cfg.deduplicate, "dedup", cfg.deduplicate, "Store the identical quantized vectors of a cluster once, recording the mapping to all original vectors in _remap.json")
+	fs.BoolVar(&cfg.allCopies, "allCopies", cfg.allCopies, "With -dedup, follow every result with the other original vectors stored as the same one, with the same score")
+	fs.Uint64Var(&cfg.compact, "compact", cfg.compact, "If positive, merge the clusters of fewer than this many vectors into others before building, recording the remapping in _remap.json")
+	fs.IntVar(&cfg.lazyClusters, "lazyClusters", cfg.lazyClusters, "If positive, with -clusterOnly, build a database per cluster on its first query and keep at most this many (reveals the queried cluster to the server)")
+	fs.IntVar(&cfg.rpcRetries, "rpcRetries", cfg.rpcRetries, "Retry a failed or timed out call to the server this many times, with exponential backoff; the performance file then has the retries and their time")
+	fs.DurationVar(&cfg.rpcTimeout, "rpcTimeout", cfg.rpcTimeout, "If positive, time out every call to the server after this long, e.g., 30s, and retry it if -rpcRetries allows; the server still computes the abandoned attempt")
+	fs.DurationVar(&cfg.rpcBackoff, "rpcBackoff", cfg.rpcBackoff, "Wait before the first retry of a call, doubled before every other one, up to 100 times it")
+	fs.DurationVar(&cfg.stallWarning, "stallWarning", cfg.stallWarning, "If positive, warn when no query completes for this long, e.g., 5m, without stopping the run")
+	fs.BoolVar(&cfg.accessStats, "accessStats", cfg.accessStats, "Count the queries to each cluster and write them to _access.csv, to choose -pinClusters (analysis only: a real server cannot see them)")
+	fs.BoolVar(&cfg.shuffle, "shuffleQueries", cfg.shuffle, "Read the whole query file and process its queries in an order drawn from -shuffleSeed, to spread hot and cold cluster accesses over the run; requires -queryID")
+	fs.StringVar(&cfg.diffOld, "diff", cfg.diffOld, "Compare the old results file given here with the new one given after the flags, by query ID, and exit")
+	fs.StringVar(&cfg.diffOutput, "diffOutput", cfg.diffOutput, "With -diff, also write the comparison of every query to this csv file")
+	fs.StringVar(&cfg.diffQueryID, "diffQueryID", cfg.diffQueryID, "With -diff, the results files written with -queryID: old, new or both")
+	fs.StringVar(&cfg.recordQueries, "recordQueries", cfg.recordQueries, "Write every query prepared from the query file, quantized, with its cluster, to this log for -replay")
+	fs.StringVar(&cfg.replay, "replay", cfg.replay, "Run the queries of a log written by -recordQueries instead of a query file; the outputs are named after the log")
+	fs.BoolVar(&cfg.extraColumns, "extraColumns", cfg.extraColumns, "Accept rows of the query file with columns after the embedding, e.g., timestamps, and ignore them")
+	fs.IntVar(&cfg.queryIDColumn, "queryIDColumn", cfg.queryIDColumn, "With -extraColumns and -queryID, the index of the column of the query file, counting the cluster index as column 0, holding the ID of every query, written instead of its index")
+	fs.Int64Var(&cfg.shuffleSeed, "shuffleSeed", cfg.shuffleSeed, "Seed of the query order of -shuffleQueries")
+	fs.IntVar(&cfg.concurrency, "concurrency", cfg.concurrency, "Number of query files, when -query is a pattern matching several, processed in parallel against the same server")
+	fs.StringVar(&cfg.queryMetadata, "queryMetadata", cfg.queryMetadata, "Metadata file of the build the queries were routed against, to warn if its number of clusters differs from the database's")
+	fs.IntVar(&cfg.maxProcs, "maxProcs", cfg.maxProcs, "If positive, run Go code on at most this many cores (GOMAXPROCS), and process at most this many query files at a time; all cores by default")
+	fs.StringVar(&cfg.seedHex, "seed", cfg.seedHex, "Seed of the database build as 32 hexadecimal digits, e.g., from a previous manifest, instead of a random one")
+	fs.BoolVar(&cfg.recordManifest, "manifest", cfg.recordManifest, "Record the seed, build parameters and hint digest of the database in _manifest.json")
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		cfg.minScoreSet = cfg.minScoreSet || f.Name == "minScore"
+	})
+	cfg.args = fs.Args()
+	return cfg, nil
+}
+
+// run runs the search that cfg describes, writing its outputs next to the
+// preamble or the query files, and returns the first error that stops it
+func run(cfg config) (err error) {
+	if cfg.diffOld != "" {
+		if len(cfg.args) != 1 {
+			return errors.New("-diff takes the old results file, followed by the new one, e.g., -diff old_results.csv new_results.csv")
+		}
+		return diffResults(cfg.diffOld, cfg.args[0], cfg.diffOutput, cfg.diffQueryID)
+	}
+	topKs, err := parseUint64List(cfg.topK)
+	if err != nil {
+		return err
+	}
+	if err := argumentsValidation(cfg.preamble, topKs, cfg.query, cfg.perClusterTopK, cfg.maxCandidates); err != nil {
+		return err
+	}
+	if cfg.pipeline && (cfg.plaintext || cfg.queryCache > 0) {
+		return errors.New("-pipeline cannot be combined with -plaintext or -queryCache")
+	}
+	if cfg.global >= 0 && (cfg.plaintext || cfg.pipeline || cfg.queryCache > 0 || cfg.clusterOnly) {
+		return errors.New("-global cannot be combined with -plaintext, -pipeline, -queryCache or -clusterOnly")
+	}
+	if cfg.clusterSetsFile != "" && (cfg.global >= 0 || cfg.plaintext || cfg.pipeline || cfg.queryCache > 0 || cfg.lazyClusters > 0 || cfg.countOnly || cfg.replay != "" ||
+		cfg.exportAnswers != "" || cfg.dumpAnswers != "" || cfg.accessStats) {
+		return errors.New("-clusterSets cannot be combined with -global, -plaintext, -pipeline, -queryCache, -lazyClusters, -countOnly, -replay, -exportAnswers, -dumpAnswers or -accessStats")
+	}
+	if cfg.exactRerank != "" && (cfg.replay != "" || cfg.countOnly || cfg.withScores) {
+		return errors.New("-exactRerank cannot be combined with -replay, -countOnly or -scores")
+	}
+	if cfg.rerankCandidates != 0 && (cfg.exactRerank == "" || cfg.rerankCandidates < int(utils.Max(topKs))) {
+		return errors.New("-rerankCandidates requires -exactRerank, and must be at least the largest -topk")
+	}
+	pinnedClusters, err := parseUint64List(cfg.pinClusters)
+	if err != nil {
+		return err
+	}
+	if cfg.queryPrecBits == 0 {
+		cfg.queryPrecBits = cfg.precBits
+	}
+	// a quantized query entry lies in [-2^(queryPrecBits-1), 2^(queryPrecBits-1)], which must fit in an int8
+	if cfg.queryPrecBits > 7 {
+		return errors.New("queryPrecBits must be at most 7")
+	}
+	if _, err := utils.NewLinearQuantizer(cfg.precBits, cfg.dbRange); err != nil {
+		return fmt.Errorf("-dbRange: %w", err)
+	}
+	if _, err := utils.NewLinearQuantizer(cfg.queryPrecBits, cfg.queryRange); err != nil {
+		return fmt.Errorf("-queryRange: %w", err)
+	}
+	if cfg.dbRange != 1 && cfg.inputQuantized {
+		return errors.New("-dbRange cannot be combined with -inputQuantized, whose values are already quantized")
+	}
+	if cfg.exportAnswers != "" && (cfg.plaintext || cfg.global >= 0) {
+		return errors.New("-exportAnswers cannot be combined with -plaintext or -global")
+	}
+	if cfg.dumpAnswers != "" && (cfg.plaintext || cfg.global >= 0 || cfg.lazyClusters > 0 || cfg.compact > 0) {
+		return errors.New("-dumpAnswers cannot be combined with -plaintext, -global, -lazyClusters or -compact")
+	}
+	if cfg.compact > 0 && (cfg.explain >= 0 || cfg.global >= 0 || cfg.accessStats || cfg.exportAnswers != "") {
+		return errors.New("-compact cannot be combined with -explain, -global, -accessStats or -exportAnswers")
+	}
+	if cfg.allCopies && !cfg.deduplicate {
+		return errors.New("-allCopies requires -dedup")
+	}
+	if cfg.deduplicate && (cfg.lazyClusters > 0 || cfg.exportAnswers != "" || cfg.dumpAnswers != "") {
+		return errors.New("-dedup cannot be combined with -lazyClusters, -exportAnswers or -dumpAnswers")
+	}
+	dims, err := database.ParseDimSlice(cfg.dimSlice)
+	if err != nil {
+		return err
+	}
+	if (cfg.center || cfg.centerFile != "") && cfg.inputQuantized {
+		return errors.New("-center and -centerFile cannot be combined with -inputQuantized, whose values are already quantized")
+	}
+	if dims.IsSet() && cfg.projection != "" {
+		return errors.New("-dimSlice cannot be combined with -projection")
+	}
+	if cfg.concurrency <= 0 {
+		return errors.New("-concurrency must be positive")
+	}
+	if cfg.rpcRetries < 0 || cfg.rpcTimeout < 0 || cfg.rpcBackoff < 0 {
+		return errors.New("-rpcRetries, -rpcTimeout and -rpcBackoff must be non-negative")
+	}
+	if (cfg.rpcRetries > 0 || cfg.rpcTimeout > 0) && cfg.plaintext {
+		return errors.New("-rpcRetries and -rpcTimeout cannot be combined with -plaintext, which makes no calls to the server")
+	}
+	if cfg.maxProcs < 0 {
+		return errors.New("-maxProcs must be non-negative")
+	}
+	if capped := limitProcs(cfg.maxProcs, cfg.concurrency); capped != cfg.concurrency {
+		fmt.Printf("%s -concurrency %d capped at -maxProcs %d\n", time.Now().Format("2006/01/02 15:04:05"), cfg.concurrency, capped)
+		cfg.concurrency = capped
+	}
+	// the answer export and dump and the query log are written by one query
+	// file at a time, under the IDs of its own queries
+	if cfg.concurrency > 1 && (cfg.pipeline || cfg.lazyClusters > 0 || cfg.global >= 0 || cfg.queryCache > 0 || cfg.stallWarning > 0 ||
+		cfg.exportAnswers != "" || cfg.dumpAnswers != "" || cfg.recordQueries != "" || cfg.replay != "") {
+		return errors.New("-concurrency cannot be combined with -pipeline, -lazyClusters, -global, -queryCache, -stallWarning, -exportAnswers, -dumpAnswers, -recordQueries or -replay")
+	}
+	if cfg.shuffle && !cfg.withQueryID {
+		return errors.New("-shuffleQueries requires -queryID, to tell which query every row is for")
+	}
+	if cfg.queryIDColumn >= 0 && (!cfg.extraColumns || !cfg.withQueryID) {
+		return errors.New("-queryIDColumn requires -extraColumns and -queryID")
+	}
+	if cfg.readBuffer <= 0 {
+		return errors.New("-readBuffer must be positive")
+	}
+	if cfg.replay != "" && (cfg.query != "" || cfg.recordQueries != "" || cfg.shuffle || cfg.extraColumns) {
+		return errors.New("-replay cannot be combined with -query, -recordQueries, -shuffleQueries or -extraColumns")
+	}
+	if cfg.maxDim == 0 {
+		return errors.New("-maxDim must be positive")
+	}
+	if cfg.recordManifest && (cfg.plaintext || cfg.lazyClusters > 0) {
+		return errors.New("-manifest cannot be combined with -plaintext or -lazyClusters, which build no database up front")
+	}
+	if cfg.accessStats && (cfg.plaintext || cfg.global >= 0) {
+		return errors.New("-accessStats cannot be combined with -plaintext or -global")
+	}
+	if cfg.rawNorms && (!cfg.withNorms || cfg.dimSlice != "") {
+		return errors.New("-rawNorms requires -norms, and cannot be combined with -dimSlice, which drops the norms of the whole vectors")
+	}
+	if cfg.relMargin < 0 {
+		return errors.New("-relMargin must be non-negative")
+	}
+	if cfg.relMargin > 0 && (cfg.countOnly || cfg.exactRerank != "") {
+		return errors.New("-relMargin cannot be combined with -countOnly or -exactRerank")
+	}
+	// -minScore only applies to the top-k with -relMargin if it is given
+	marginMinScore := cfg.minScoreSet && cfg.relMargin > 0
+	if cfg.denseLimit < 0 {
+		return errors.New("-denseLimit must be non-negative")
+	}
+	if cfg.denseScores && (!cfg.clusterOnly || cfg.countOnly || cfg.relMargin > 0 || cfg.exactRerank != "" || cfg.withScores || cfg.withExternalIDs || cfg.withNorms ||
+		cfg.compact > 0 || cfg.deduplicate || cfg.clusterSetsFile != "" || cfg.global >= 0 || len(topKs) > 1) {
+		return errors.New("-denseScores requires -clusterOnly, and cannot be combined with -countOnly, -relMargin, -exactRerank, -scores, -externalIDs, -norms, -compact, -dedup, -clusterSets, -global or several -topk cutoffs")
+	}
+	if cfg.countOnly && (cfg.global >= 0 || len(topKs) > 1) {
+		return errors.New("-countOnly cannot be combined with -global or several -topk cutoffs")
+	}
+	if cfg.lazyClusters > 0 && (!cfg.clusterOnly || cfg.plaintext || cfg.global >= 0 || cfg.pipeline || cfg.queryCache > 0 || cfg.seedHex != "" || cfg.explain >= 0 || cfg.compact > 0 ||
+		cfg.writeCentroids || cfg.withExternalIDs || cfg.withNorms || cfg.exportAnswers != "" || cfg.accessStats || cfg.packingLayout != "") {
+		return errors.New("-lazyClusters requires -clusterOnly, and cannot be combined with -plaintext, -global, -pipeline, -queryCache, -seed, -explain, -compact, -writeCentroids, -externalIDs, -norms, -exportAnswers, -accessStats or -packingLayout")
+	}
+	if _, err := parseRotateEvery(cfg.rotateEvery); err != nil {
+		return err
+	}
+	var seed *rand.PRGKey
+	if cfg.seedHex != "" {
+		if cfg.plaintext {
+			return errors.New("-seed has no effect with -plaintext")
+		}
+		seed, err = utils.ParsePRGKey(cfg.seedHex)
+		if err != nil {
+			return err
+		}
+	}
+	unit, err := parseTimeUnit(cfg.perfTimeUnit)
+	if err != nil {
+		return err
+	}
+	order, err := protocol.ParseSortOrder(cfg.sortOrder)
+	if err != nil {
+		return err
+	}
+	if order == protocol.Ascending && cfg.global > 0 {
+		return errors.New("-sortOrder=asc requires probing every bin with -global=0")
+	}
+	transform, err := utils.ParseScoreTransform(cfg.scoreTransform)
+	if err != nil {
+		return err
+	}
+	if transform != utils.IdentityTransform {
+		cfg.withScores = true
+	}
+	utils.ActiveWireFormat, err = utils.ParseWireFormat(cfg.wireFormat)
+	if err != nil {
+		return err
+	}
+
+	params := database.DatabaseParams{
+		HintSz:         900,
+		MaxColumns:     cfg.maxColumns,
+		PinnedClusters: pinnedClusters,
+		BestFit:        cfg.bestFit,
+		MaxAnswerBytes: cfg.maxAnswerBytes,
+		AnswerWire:     utils.ActiveWireFormat,
+	}
+	// -plan only reads the metadata, so it neither needs the query files nor
+	// opens the output files, which would truncate earlier results
+	if cfg.plan {
+		if cfg.compact > 0 || cfg.deduplicate || cfg.dimSlice != "" {
+			return errors.New("-plan cannot be combined with -compact, -dedup or -dimSlice, which change the clusters")
+		}
+		metadata, err := database.ReadMetadata(cfg.preamble + "_metadata.json")
+		if err != nil {
+			return fmt.Errorf("-plan requires a metadata file: %w", err)
+		}
+		report, err := database.EstimateParams(metadata, params)
+		fmt.Printf("%d vectors of dimension %d in %d clusters of even sizes\n", metadata.NumVectors, metadata.Dim, metadata.NumClusters)
+		fmt.Printf("Layout: %d bins filled up to %d vectors, a database of %d by %d (%d values)\n", report.Bins, report.Capacity, report.Rows, report.Columns, report.Size)
+		if err == nil {
+			fmt.Printf("SimplePIR: P = %d (%d-bit records), LogQ = %d, N = %d\n", report.P, report.RecordLen, report.Logq, report.N)
+			err = report.CheckPrecBits(cfg.precBits)
+		}
+		if err != nil {
+			return fmt.Errorf("the database cannot be built: %w", err)
+		}
+		fmt.Printf("Feasible with precBits %d\n", cfg.precBits)
+		return nil
+	}
+
+	queryLocation := cfg.query
+	if cfg.replay != "" {
+		// the log takes the place of the query file
+		queryLocation = cfg.replay
+	}
+	queryFiles, err := findQueryFiles(cfg.preamble, queryLocation)
+	if err != nil {
+		return err
+	}
+	if err := filesValidation(cfg.preamble, queryFiles); err != nil {
+		return err
+	}
+	if len(queryFiles) > 1 && (cfg.exportAnswers != "" || cfg.dumpAnswers != "" || cfg.recordQueries != "") {
+		return errors.New("-exportAnswers, -dumpAnswers and -recordQueries take a single query file")
+	}
+
+	fmt.Printf("Preamble: %s\n", cfg.preamble)
+	fmt.Printf("Query location: %s\n", queryLocation)
+	if len(queryFiles) > 1 {
+		fmt.Printf("Query files: %d, %d at a time\n", len(queryFiles), cfg.concurrency)
+	}
+	fmt.Printf("Top K: %s\n", cfg.topK)
+	fmt.Printf("Cluster Only: %t\n", cfg.clusterOnly)
+	if order == protocol.Ascending {
+		fmt.Printf("Sort Order: %s\n", order)
+	}
+	if cfg.perClusterTopK > 0 {
+		fmt.Printf("Per Cluster Top K: %d\n", cfg.perClusterTopK)
+	}
+	if cfg.withScores {
+		fmt.Printf("Score Transform: %s\n", transform)
+	}
+
+	dir := filepath.Dir(cfg.preamble)
+	prefix := filepath.Base(cfg.preamble)
+
+	var retry *protocol.RetryPolicy
+	if cfg.rpcRetries > 0 || cfg.rpcTimeout > 0 {
+		retry = &protocol.RetryPolicy{Retries: cfg.rpcRetries, Timeout: cfg.rpcTimeout, Backoff: cfg.rpcBackoff, MaxBackoff: 100 * cfg.rpcBackoff}
+	}
+	// with several query files, the files of the run are named after the preamble
+	var manifestFileName, accessFileName, remapFileName string
+	if queryLocation != "" && len(queryFiles) == 1 {
+		base := queryFiles[0][:len(queryFiles[0])-4]
+		manifestFileName = base + "_manifest.json"
+		accessFileName = base + "_access.csv"
+		remapFileName = base + "_remap.json"
+	} else {
+		manifestFileName = filepath.Join(dir, prefix+"_manifest.json")
+		accessFileName = filepath.Join(dir, prefix+"_access.csv")
+		remapFileName = filepath.Join(dir, prefix+"_remap.json")
+	}
+
+	// fail before building the database, rather than once it is built
+	outputFiles := make([]string, 0)
+	for _, out := range []struct {
+		enabled bool
+		file    string
+	}{
+		{cfg.recordManifest, manifestFileName},
+		{cfg.accessStats, accessFileName},
+		{cfg.compact > 0 || cfg.deduplicate, remapFileName},
+		{cfg.writeCentroids, cfg.preamble + "_centroids.csv"},
+		{cfg.writeMetadata, cfg.preamble + "_metadata.json"},
+		{cfg.packingLayout != "", cfg.packingLayout},
+		{cfg.recordQueries != "", cfg.recordQueries},
+		{cfg.exportAnswers != "", cfg.exportAnswers},
+	} {
+		if out.enabled {
+			outputFiles = append(outputFiles, out.file)
+		}
+	}
+	for _, file := range outputFiles {
+		if err := checkWritable(file); err != nil {
+			return err
+		}
+	}
+	if cfg.dumpAnswers != "" {
+		if err := checkWritableDir(cfg.dumpAnswers); err != nil {
+			return err
+		}
+	}
+
+	// start a timer
+	serverPreProcessingStart := time.Now()
+	metadataFile := cfg.preamble + "_metadata.json"
+	_, err = os.Stat(metadataFile)
+	inferMetadata := os.IsNotExist(err)
+	readOptions := database.ReadOptions{Quantized: cfg.inputQuantized, BufferSize: cfg.readBuffer, MaxDim: cfg.maxDim, Center: cfg.center}
+	if cfg.dbRange != 1 {
+		readOptions.Quantizer = utils.LinearQuantizer{PrecBits: cfg.precBits, Range: cfg.dbRange}
+	}
+	if cfg.rawNorms {
+		readOptions.Stats = database.StatNorms
+	}
+	if cfg.centerFile != "" {
+		rows, err := database.ReadCentroids(cfg.centerFile)
+		if err != nil {
+			return fmt.Errorf("reading the mean: %w", err)
+		}
+		if len(rows) != 1 {
+			return fmt.Errorf("%s must hold a single row, the mean, but has %d", cfg.centerFile, len(rows))
+		}
+		readOptions.Mean = rows[0]
+	}
+	// whether the metadata file lacks the mean the vectors are centered on
+	storedMean := false
+	var metadata database.Metadata
+	var clusters []*database.Cluster
+	if cfg.lazyClusters > 0 {
+		// clusters are read on their first query
+		if metadata, err = database.ReadMetadata(metadataFile); err != nil {
+			return fmt.Errorf("-lazyClusters requires a metadata file: %w", err)
+		}
+		if err := metadata.ValidateDim(cfg.maxDim); err != nil {
+			return fmt.Errorf("%s: %w", metadataFile, err)
+		}
+		storedMean = metadata.Mean != nil
+		if metadata.Mean, err = readOptions.Centering(cfg.preamble, metadata); err != nil {
+			return err
+		}
+		readOptions.Mean = metadata.Mean
+	} else {
+		if !inferMetadata {
+			stored, err := database.ReadMetadata(metadataFile)
+			storedMean = err == nil && stored.Mean != nil
+		}
+		var err error
+		if metadata, clusters, err = database.ReadAllClustersWithOptions(cfg.preamble, cfg.precBits, readOptions); err != nil {
+			return err
+		}
+	}
+	if cfg.queryMetadata != "" {
+		routed, err := database.ReadMetadata(cfg.queryMetadata)
+		if err != nil {
+			return fmt.Errorf("reading the metadata of the queries: %w", err)
+		}
+		if warning := clusterCountWarning(routed.NumClusters, metadata.NumClusters); warning != "" {
+			fmt.Printf("%s Warning: %s\n", time.Now().Format("2006/01/02 15:04:05"), warning)
+		}
+	}
+	if metadata.Mean != nil {
+		fmt.Printf("Centering the vectors and queries on a %d-dim mean\n", len(metadata.Mean))
+	}
+	if !inferMetadata && cfg.writeMetadata && metadata.Mean != nil && !storedMean {
+		if err := database.WriteMetadata(metadataFile, metadata); err != nil {
+			return fmt.Errorf("writing metadata: %w", err)
+		}
+		fmt.Printf("Added the mean to %s\n", metadataFile)
+	}
+	if inferMetadata && cfg.writeMetadata {
+		if err := database.WriteMetadata(metadataFile, metadata); err != nil {
+			return fmt.Errorf("writing metadata: %w", err)
+		}
+		fmt.Printf("Wrote the inferred metadata to %s\n", metadataFile)
+	}
+	// the files keep all dimensions: clusters are sliced once read, and queries once parsed
+	fileMetadata := metadata
+	if dims.IsSet() {
+		if err := dims.Validate(metadata.Dim); err != nil {
+			return err
+		}
+		if cfg.lazyClusters == 0 {
+			if metadata, clusters, err = database.SliceClusters(metadata, clusters, dims); err != nil {
+				return fmt.Errorf("slicing the clusters: %w", err)
+			}
+		} else if metadata.Mean != nil {
+			metadata.Mean = metadata.Mean[dims.Lo:dims.Hi]
+		}
+		metadata.Dim = dims.Hi - dims.Lo
+		fmt.Printf("Keeping dimensions %s of the %d-dim vectors and queries\n", dims, fileMetadata.Dim)
+	}
+	var clusterSets [][]uint64
+	if cfg.clusterSetsFile != "" {
+		if len(queryFiles) > 1 {
+			return errors.New("-clusterSets requires a single query file")
+		}
+		if clusterSets, err = readClusterSets(cfg.clusterSetsFile, fileMetadata.NumClusters); err != nil {
+			return fmt.Errorf("reading cluster sets: %w", err)
+		}
+		numQueries, err := countQueryRows(queryFiles[0])
+		if err != nil {
+			return fmt.Errorf("reading query file: %w", err)
+		}
+		if len(clusterSets) != numQueries {
+			return fmt.Errorf("%s has %d lines, but the query file %s has %d rows", cfg.clusterSetsFile, len(clusterSets), queryFiles[0], numQueries)
+		}
+	}
+	if cfg.writeCentroids {
+		centroidsFile := cfg.preamble + "_centroids.csv"
+		if err := database.WriteCentroids(centroidsFile, clusters); err != nil {
+			return fmt.Errorf("writing centroids: %w", err)
+		}
+		fmt.Printf("Wrote the centroids of %d clusters to %s\n", len(clusters), centroidsFile)
+	}
+
+	// queries and results keep naming the original clusters, translated by opts
+	originalClusters := clusters
+	// the remaps of the transforms, chained
+	var remap *database.ClusterRemap
+	if cfg.deduplicate {
+		before := database.PackedSize(metadata, clusters, params)
+		var dedup *database.Deduplication
+		metadata, clusters, dedup = database.DeduplicateClusters(metadata, clusters)
+		remap = dedup.Remap()
+		after := database.PackedSize(metadata, clusters, params)
+		fmt.Printf("Deduplication collapsed %d duplicate vectors, leaving %d: DB size %d -> %d\n",
+			dedup.Collapsed, metadata.NumVectors, before, after)
+	}
+	if cfg.compact > 0 {
+		before := database.PackedSize(metadata, clusters, params)
+		var compaction *database.Compaction
+		metadata, clusters, compaction = database.CompactClusters(metadata, clusters, cfg.compact, params.ColumnCapacity())
+		if remap == nil {
+			remap = compaction.Remap()
+		} else if remap, err = remap.Then(compaction.Remap()); err != nil {
+			return fmt.Errorf("chaining the remaps: %w", err)
+		}
+		params.PinnedClusters = make([]uint64, len(pinnedClusters))
+		for i, c := range pinnedClusters {
+			if params.PinnedClusters[i], err = remap.Translate(c); err != nil {
+				return fmt.Errorf("pinned %w", err)
+			}
+		}
+		after := database.PackedSize(metadata, clusters, params)
+		actualSz := metadata.NumVectors * metadata.Dim
+		fmt.Printf("Compaction merged %d clusters of fewer than %d vectors, leaving %d clusters: DB size %d -> %d, padding %d -> %d values\n",
+			compaction.Merged, cfg.compact, len(clusters), before, after, before-actualSz, after-actualSz)
+	}
+	if remap != nil {
+		if err := database.WriteRemap(remapFileName, remap); err != nil {
+			return fmt.Errorf("writing remap: %w", err)
+		}
+		fmt.Printf("Mapping of the original vectors to the database written to %s\n", remapFileName)
+	}
+	if cfg.packingLayout != "" {
+		layout := database.NewPackingLayout(clusters, params)
+		f, err := os.Create(cfg.packingLayout)
+		if err != nil {
+			return fmt.Errorf("creating packing layout file: %w", err)
+		}
+		if strings.HasSuffix(cfg.packingLayout, ".json") {
+			err = layout.WriteJSON(f)
+		} else {
+			err = layout.WriteCSV(f)
+		}
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("writing packing layout: %w", err)
+		}
+		fmt.Printf("Wrote the layout of %d columns of up to %d rows to %s\n", len(layout.Columns), layout.Rows, cfg.packingLayout)
+	}
+
+	if cfg.explain >= 0 {
+		// only the layout is needed, so skip the PIR server and its hint
+		db, indexMap, err := database.BuildVectorDatabase(metadata, clusters, seed, params, cfg.precBits)
+		if err != nil {
+			return err
+		}
+		layout, err := indexMap.Layout(clusters, db.Info.L, db.Info.M, uint64(cfg.explain))
+		if err != nil {
+			return err
+		}
+		fmt.Println(layout)
+		return nil
+	}
+
+	// the results and performance files are only opened, and truncated, once
+	// there are queries to run
+	outputs := outputConfig{topKs: topKs, clusterOnly: cfg.clusterOnly, withQueryID: cfg.withQueryID, crlf: cfg.crlf, bom: cfg.bom, rotateEvery: cfg.rotateEvery, timeUnit: unit, withRetries: retry != nil}
+	runs := make([]*queryRun, len(queryFiles))
+	for i, file := range queryFiles {
+		// the outputs are named after the query file, or the preamble for the default one
+		base := filepath.Join(dir, prefix)
+		if queryLocation != "" {
+			base = file[:len(file)-4]
+		}
+		if runs[i], err = openQueryRun(file, base, outputs); err != nil {
+			return err
+		}
+		defer runs[i].close()
+		if cfg.shuffle {
+			if runs[i].reader, runs[i].order, err = shuffleQueries(runs[i].queryFile, cfg.shuffleSeed); err != nil {
+				return fmt.Errorf("reading query file: %w", err)
+			}
+			fmt.Printf("Shuffled the %d queries of %s with seed %d\n", len(runs[i].order), file, cfg.shuffleSeed)
+		}
+	}
+
+	// the ID table is a plaintext client-side lookup by position, it does not go through PIR
+	var externalIDs [][]string
+	if cfg.withExternalIDs {
+		externalIDs = make([][]string, len(originalClusters))
+		for i, c := range originalClusters {
+			externalIDs[i] = c.ExternalIDs
+		}
+	}
+
+	// like the ID table, norms are a plaintext client-side lookup
+	var norms []*database.Cluster
+	if cfg.withNorms {
+		norms = originalClusters
+	}
+
+	opts := &queryOptions{
+		topKs:          intList(topKs),
+		precBits:       cfg.precBits,
+		queryPrecBits:  cfg.queryPrecBits,
+		dbRange:        cfg.dbRange,
+		queryRange:     cfg.queryRange,
+		clusterOnly:    cfg.clusterOnly,
+		perClusterTopK: cfg.perClusterTopK,
+		externalIDs:    externalIDs,
+		norms:          norms,
+		rawNorms:       cfg.rawNorms,
+		withQueryID:    cfg.withQueryID,
+		withScores:     cfg.withScores,
+		scoreTransform: transform,
+		dim:            metadata.Dim,
+		countOnly:      cfg.countOnly,
+		dense:          cfg.denseScores,
+		denseLimit:     cfg.denseLimit,
+		minScore:       cfg.minScore,
+		relMargin:      cfg.relMargin,
+		sortOrder:      order,
+		marginMinScore: marginMinScore,
+		dimSlice:       dims,
+		fileDim:        fileMetadata.Dim,
+		extraColumns:   cfg.extraColumns,
+		idColumn:       cfg.queryIDColumn,
+		remap:          remap,
+		allCopies:      cfg.allCopies,
+		retry:          retry,
+		timeUnit:       unit,
+	}
+	if cfg.queryIDColumn >= 0 {
+		opts.labels = newQueryLabels()
+	}
+	if cfg.recordQueries != "" {
+		logFile, err := os.Create(cfg.recordQueries)
+		if err != nil {
+			return fmt.Errorf("creating query log: %w", err)
+		}
+		if opts.recorder, err = protocol.NewQueryLogWriter(logFile, metadata.Dim, cfg.queryPrecBits); err != nil {
+			return fmt.Errorf("writing query log: %w", err)
+		}
+		defer func() {
+			if flushErr := opts.recorder.Flush(); flushErr != nil && err == nil {
+				err = fmt.Errorf("writing query log: %w", flushErr)
+			}
+			logFile.Close()
+		}()
+		fmt.Printf("Recording the queries to %s\n", cfg.recordQueries)
+	}
+	if cfg.replay != "" {
+		lr, err := protocol.NewQueryLogReader(runs[0].queryFile)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", cfg.replay, err)
+		}
+		if lr.Header.Dim != metadata.Dim || lr.Header.PrecBits != cfg.queryPrecBits {
+			return fmt.Errorf("%s holds %d-dim queries of %d bits, but the database is %d-dim and -queryPrecBits is %d", cfg.replay, lr.Header.Dim, lr.Header.PrecBits, metadata.Dim, cfg.queryPrecBits)
+		}
+		if opts.replay, err = lr.ReadAll(); err != nil {
+			return fmt.Errorf("reading %s: %w", cfg.replay, err)
+		}
+		// every row names the query of the original query file
+		runs[0].order = make([]int, len(opts.replay))
+		for i, q := range opts.replay {
+			runs[0].order[i] = q.QueryID
+		}
+		fmt.Printf("Replaying the %d queries of %s\n", len(opts.replay), cfg.replay)
+	}
+
+	var client *protocol.Client
+	var round roundFunc
+	// with -global, the recall against an exhaustive search
+	recall := new(meanRecall)
+	// in pipelined mode, the server and the clients of the queries in flight
+	var server *protocol.Server
+	var pipelineClients []*protocol.Client
+	var lazy *protocol.LazyServers
+	// with -concurrency, the client and round of each query file processed in
+	// parallel, and how to free the client
+	var newRound func(opts *queryOptions) (*protocol.Client, roundFunc, func())
+	var proj *protocol.Projection
+	if cfg.lazyClusters > 0 {
+		fmt.Printf("On-demand mode: a database per cluster, built on its first query, at most %d held\n", cfg.lazyClusters)
+		lazy = protocol.NewLazyServers(metadata, func(i uint64) (*database.Cluster, error) {
+			c, err := database.ReadCluster(cfg.preamble, fileMetadata, i, cfg.precBits, readOptions)
+			if err != nil || !dims.IsSet() {
+				return c, err
+			}
+			return database.SliceCluster(c, dims)
+		}, params, cfg.precBits, cfg.lazyClusters)
+		defer lazy.Close()
+		// the client of every cluster held, set up with the hint of its database
+		lazyClients := make(map[uint64]*protocol.Client)
+		lazy.OnEvict = func(i uint64) {
+			lazyClients[i].Free()
+			delete(lazyClients, i)
+		}
+		defer func() {
+			for _, c := range lazyClients {
+				c.Free()
+			}
+		}()
+
+		// the client only prepares the queries
+		client = &protocol.Client{Metadata: metadata, StrictQuantization: cfg.strictQuantization}
+		round = func(query []int8, clusterIndex uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+			return runLazyRound(lazy, lazyClients, query, clusterIndex, cfg.maxCandidates, order, opts)
+		}
+	} else if cfg.plaintext {
+		fmt.Println("Plaintext mode: the server sees the queries, for analysis only")
+		plaintextServer := protocol.NewPlaintextServer(metadata, clusters, params)
+		plaintextServer.Order = order
+		fmt.Printf("%s Plaintext server construction time: %s\n", time.Now().Format("2006/01/02 15:04:05"), time.Since(serverPreProcessingStart))
+
+		// the client only prepares the queries
+		client = &protocol.Client{Metadata: metadata, StrictQuantization: cfg.strictQuantization}
+		round = func(query []int8, clusterIndex uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+			return runPlaintextRound(plaintextServer, query, clusterIndex, opts)
+		}
+		newRound = func(opts *queryOptions) (*protocol.Client, roundFunc, func()) {
+			c := &protocol.Client{Metadata: metadata, Projection: proj, StrictQuantization: cfg.strictQuantization}
+			return c, func(query []int8, clusterIndex uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+				return runPlaintextRound(plaintextServer, query, clusterIndex, opts)
+			}, func() {}
+		}
+	} else {
+		server = new(protocol.Server)
+		if err := server.Build(metadata, clusters, params, cfg.precBits, seed); err != nil {
+			return fmt.Errorf("building the database: %w", err)
+		}
+
+		serverPreProcessingTime := time.Since(serverPreProcessingStart)
+		if cfg.accessStats {
+			server.TrackClusterAccess()
+		}
+
+		fmt.Printf("%s Server database construction time: %s\n", time.Now().Format("2006/01/02 15:04:05"), serverPreProcessingTime)
+		if params.MaxAnswerBytes > 0 {
+			fmt.Printf("Answers take up to %d bytes in the %s wire format for %d rows, against a budget of %d bytes\n", utils.AnswerSize(server.Hint.PIRHint.Info.L, params.AnswerWire), params.AnswerWire, server.Hint.PIRHint.Info.L, params.MaxAnswerBytes)
+		}
+
+		effectiveSeed := server.Seed()
+		answerWire := ""
+		if params.MaxAnswerBytes > 0 {
+			answerWire = params.AnswerWire.String()
+		}
+		manifest := buildManifest{
+			Seed:           utils.FormatPRGKey(&effectiveSeed),
+			PrecBits:       cfg.precBits,
+			HintSz:         params.HintSz,
+			MaxColumns:     params.MaxColumns,
+			PinnedClusters: pinnedClusters,
+			BestFit:        params.BestFit,
+			MaxAnswerBytes: params.MaxAnswerBytes,
+			AnswerWire:     answerWire,
+			CompactMinSize: cfg.compact,
+			Dedup:          cfg.deduplicate,
+			DimSlice:       dims.String(),
+			InputQuantized: cfg.inputQuantized,
+			Metadata:       metadata,
+			HintSHA256:     hintDigest(server.Hint),
+		}
+		if cfg.dbRange != 1 {
+			manifest.DBRange = cfg.dbRange
+		}
+		if cfg.exportAnswers != "" {
+			answersFile, err := os.Create(cfg.exportAnswers)
+			if err != nil {
+				return fmt.Errorf("creating answer export: %w", err)
+			}
+			defer answersFile.Close()
+			w, err := protocol.NewAnswerWriter(answersFile, server.Hint)
+			if err != nil {
+				return fmt.Errorf("writing answer export: %w", err)
+			}
+			opts.answers = &answerExporter{w: w}
+			manifest.AnswersFile = cfg.exportAnswers
+			manifest.AnswersVersion = protocol.AnswerExportVersion
+			fmt.Printf("Exporting the decrypted answers to %s\n", cfg.exportAnswers)
+		}
+		if cfg.dumpAnswers != "" {
+			if err := protocol.WriteAnswerDumpHeader(cfg.dumpAnswers, server.Hint); err != nil {
+				return fmt.Errorf("creating answer dump: %w", err)
+			}
+			if opts.answers == nil {
+				opts.answers = new(answerExporter)
+			}
+			opts.answers.dumpDir = cfg.dumpAnswers
+			manifest.DumpDir = cfg.dumpAnswers
+			manifest.DumpVersion = protocol.AnswerDumpVersion
+			fmt.Printf("Warning: dumping the answers decrypted with the client secret to %s, which reveals the scores of whole bins: for local analysis only\n", cfg.dumpAnswers)
+		}
+		if cfg.recordQueries != "" || cfg.replay != "" {
+			manifest.QueryLog = cfg.recordQueries + cfg.replay
+			manifest.QueryLogVersion = protocol.QueryLogVersion
+		}
+		if cfg.recordManifest {
+			if err := writeManifest(manifestFileName, manifest); err != nil {
+				return fmt.Errorf("writing manifest: %w", err)
+			}
+			fmt.Printf("Database seed %s, recorded in %s\n", manifest.Seed, manifestFileName)
+		}
+
+		// print server hint size in bytes
+		fmt.Printf("Server hint size: %d bytes\n", logHintSize(server.Hint))
+		fmt.Printf("Server hint size with the deterministic index map: %d bytes\n", deterministicHintSize(server.Hint))
+
+		newClient := func() *protocol.Client {
+			c := new(protocol.Client)
+			c.Setup(server.Hint)
+			c.MaxCandidates = cfg.maxCandidates
+			c.Order = order
+			c.ScoreBound = opts.scoreBound()
+			c.StrictQuantization = cfg.strictQuantization
+			return c
+		}
+		client = newClient()
+		// scores are reduced modulo P to (-P/2, P/2], and those of unit-norm vectors lie within the score scale
+		if (cfg.queryPrecBits != cfg.precBits || cfg.dbRange != 1 || cfg.queryRange != 1) && utils.QuantizerScoreScale(opts.queryQuantizer(), opts.dbQuantizer()) >= float64(client.DBInfo.P()/2) {
+			return fmt.Errorf("with queryPrecBits %d, precBits %d and ranges %g and %g, scores may wrap around modulo P = %d", cfg.queryPrecBits, cfg.precBits, cfg.queryRange, cfg.dbRange, client.DBInfo.P())
+		}
+		if cfg.queryCache > 0 {
+			client.EnableQueryCache(cfg.queryCache)
+		}
+		round = func(query []int8, clusterIndex uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+			return runRound(client, server, query, clusterIndex, opts)
+		}
+		newRound = func(opts *queryOptions) (*protocol.Client, roundFunc, func()) {
+			c := newClient()
+			c.Projection = proj
+			return c, func(query []int8, clusterIndex uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+				return runRound(c, server, query, clusterIndex, opts)
+			}, c.Free
+		}
+
+		if cfg.global >= 0 {
+			if cfg.centroidsFile != "" {
+				centroids, err := database.ReadCentroids(cfg.centroidsFile)
+				if err != nil {
+					return fmt.Errorf("reading centroids: %w", err)
+				}
+				if err := client.SetCentroids(centroids); err != nil {
+					return err
+				}
+			}
+			probes := client.NumBins()
+			if cfg.global > 0 && cfg.global < probes {
+				probes = cfg.global
+			}
+			fmt.Printf("Global search: %d probes of %d bins per query\n", probes, client.NumBins())
+			exact := protocol.NewPlaintextServer(metadata, clusters, params)
+			exact.Order = order
+			k := int(utils.Max(topKs))
+			round = func(query []int8, _ uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+				return runGlobalRound(client, server, exact, query, k, cfg.global, recall, opts.retry)
+			}
+		}
+
+		if clusterSets != nil {
+			// the sets name the original clusters, and every query probes as many
+			// bins as the widest set, so the server does not learn the size of any
+			opts.clusterSets = make([][]uint64, len(clusterSets))
+			for i, set := range clusterSets {
+				if opts.clusterSets[i], err = opts.translateClusters(set, client); err != nil {
+					return fmt.Errorf("cluster set %d: %w", i, err)
+				}
+			}
+			probes := 1
+			for _, set := range opts.clusterSets {
+				bins := make(map[uint64]bool)
+				for _, c := range set {
+					bins[client.Bin(c)] = true
+				}
+				if len(bins) > probes {
+					probes = len(bins)
+				}
+			}
+			fmt.Printf("Cluster sets: %d probes per query, the most bins of any set\n", probes)
+			round = func(query []int8, row uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+				return runClusterSetRound(client, server, query, opts.clusterSets[row], probes, opts)
+			}
+		}
+
+		if cfg.pipeline {
+			// two clients: one reconstructs a query while the other runs the next one
+			pipelineClients = []*protocol.Client{client, newClient()}
+		}
+	}
+
+	if cfg.projection != "" {
+		p, err := protocol.ReadProjectionFromCsv(cfg.projection)
+		if err != nil {
+			return fmt.Errorf("reading projection: %w", err)
+		}
+		proj = p
+		if err := client.SetProjection(p); err != nil {
+			return err
+		}
+		for _, c := range pipelineClients {
+			if c != client {
+				c.SetProjection(p)
+			}
+		}
+		fmt.Printf("Projecting %d-dim queries to %d dimensions\n", p.InDim, p.OutDim)
+	}
+
+	if cfg.exactRerank != "" {
+		sidecar, err := database.ReadFloatSidecar(cfg.exactRerank)
+		if err != nil {
+			return fmt.Errorf("reading the exact vectors: %w", err)
+		}
+		if sidecar.Dim != client.QueryDim() {
+			return fmt.Errorf("%s holds %d-dim vectors, but queries have dimension %d", cfg.exactRerank, sidecar.Dim, client.QueryDim())
+		}
+		opts.sidecar = sidecar
+		opts.rawQueries = &queryValues[[]float64]{values: make(map[int][]float64)}
+		opts.rerankCandidates = int(utils.Max(topKs))
+		if cfg.rerankCandidates > 0 {
+			opts.rerankCandidates = cfg.rerankCandidates
+		}
+		fmt.Printf("Reranking the top %d results of every query with the exact scores of the %d vectors of %s\n", opts.rerankCandidates, sidecar.Len(), cfg.exactRerank)
+	}
+	if cfg.stallWarning > 0 {
+		opts.watchdog = startWatchdog(cfg.stallWarning, fmt.Printf)
+		defer opts.watchdog.stop()
+	}
+	if cfg.concurrency > 1 && len(runs) > 1 {
+		if err := processRunsConcurrently(runs, cfg.concurrency, newRound, opts); err != nil {
+			return err
+		}
+	} else {
+		for _, run := range runs {
+			if len(runs) > 1 {
+				fmt.Printf("%s processing query file %s\n", time.Now().Format("2006/01/02 15:04:05"), run.file)
+			}
+			opts.startRun(run)
+			var err error
+			if pipelineClients != nil {
+				_, _, err = processQueriesPipelined(run.reader, run.writers, run.perfWriter, pipelineClients, server, opts)
+			} else {
+				_, _, err = processQueries(run.reader, run.writers, run.perfWriter, client, round, opts)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if lazy != nil {
+		loads, evictions := lazy.Stats()
+		fmt.Printf("On-demand mode: %d databases built, %d evicted\n", loads, evictions)
+	}
+	if cfg.queryCache > 0 && !cfg.plaintext {
+		hits, misses := client.QueryCacheStats()
+		fmt.Printf("Query cache: %d hits, %d misses (hit rate %.1f%%)\n", hits, misses, 100*float64(hits)/float64(hits+misses))
+	}
+	if cfg.accessStats {
+		counts := server.ClusterAccessCounts()
+		if err := writeAccessStats(accessFileName, counts); err != nil {
+			return fmt.Errorf("writing access statistics: %w", err)
+		}
+		hottest := protocol.HottestClusters(counts)
+		if len(hottest) > 5 {
+			hottest = hottest[:5]
+		}
+		fmt.Printf("Queries to %d clusters written to %s, hottest: %s\n", len(counts), accessFileName, formatUint64List(hottest))
+	}
+	if recall.count > 0 {
+		fmt.Printf("Global search recall@%d against an exhaustive search: %.4f over %d queries\n", utils.Max(topKs), recall.sum/float64(recall.count), recall.count)
+	}
+	return nil
+}
+
+// limitProcs runs Go code on at most maxProcs cores, if positive, and returns
+// the number of query files to process at a time, at most maxProcs too. Threads
+// blocked in C calls do not count towards GOMAXPROCS, so C code that starts
+// threads of its own is not bounded.
+func limitProcs(maxProcs int, concurrency int) int {
+	if maxProcs <= 0 {
+		return concurrency
+	}
+	runtime.GOMAXPROCS(maxProcs)
+	if concurrency > maxProcs {
+		return maxProcs
+	}
+	return concurrency
+}
+
+// processRunsConcurrently processes up to concurrency query files at a time
+// against the same server, which answers concurrent queries. Each file gets a
+// client of its own from newRound, since a round overwrites the client's secret,
+// and its queries are processed in order, so that its output files are ordered
+// like the file. The files being processed when one of them fails are finished,
+// and the first error is returned, including a panic of a file's goroutine, so
+// that the caller's deferred calls, e.g., closing the output files, still run.
+// The files share opts but for what startRun resets, so opts must not export
+// the answers or record the queries.
+func processRunsConcurrently(runs []*queryRun, concurrency int, newRound func(opts *queryOptions) (*protocol.Client, roundFunc, func()), opts *queryOptions) error {
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, run := range runs {
+		sem <- struct{}{}
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(run *queryRun) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer func() {
+				if r := recover(); r != nil {
+					fail(fmt.Errorf("%s: %v", run.file, r))
+				}
+			}()
+			runOpts := *opts
+			runOpts.startRun(run)
+			client, round, free := newRound(&runOpts)
+			defer free()
+			queryCount, failedCount, err := processQueries(run.reader, run.writers, run.perfWriter, client, round, &runOpts)
+			if err != nil {
+				fail(fmt.Errorf("%s: %w", run.file, err))
+				return
+			}
+			fmt.Printf("%s finished query file %s: %d queries, %d failed\n", time.Now().Format("2006/01/02 15:04:05"), run.file, queryCount, failedCount)
+		}(run)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// roundFunc runs one prepared query against the database
+type roundFunc func(query []int8, clusterIndex uint64) (*[]protocol.VectorScore, *QueryPerf, error)
+
+// watchdog warns when no query completes for a while, to tell a stalled run,
+// e.g., stuck reconstructing a huge bin, from a slow one. It only logs: the run
+// goes on.
+type watchdog struct {
+	interval time.Duration
+	logf     func(format string, args ...interface{}) (int, error)
+	done     chan struct{}
+	// now is time.Now, but for tests
+	now func() time.Time
+
+	mu sync.Mutex
+	// last is when the last query completed, and next is the index of the
+	// query in progress since then
+	last   time.Time
+	next   int
+	warned int
+}
+
+func startWatchdog(interval time.Duration, logf func(format string, args ...interface{}) (int, error)) *watchdog {
+	w := newWatchdog(interval, logf, time.Now)
+	go w.run()
+	return w
+}
+
+// newWatchdog is a watchdog that reads the time from now, and only checks for
+// progress when check is called
+func newWatchdog(interval time.Duration, logf func(format string, args ...interface{}) (int, error), now func() time.Time) *watchdog {
+	return &watchdog{
+		interval: interval,
+		logf:     logf,
+		done:     make(chan struct{}),
+		now:      now,
+		last:     now(),
+	}
+}
+
+func (w *watchdog) run() {
+	ticker := time.NewTicker(w.interval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+		w.check()
+	}
+}
+
+// check warns once per interval without progress
+func (w *watchdog) check() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.now()
+	if elapsed := now.Sub(w.last); elapsed >= time.Duration(w.warned+1)*w.interval {
+		w.warned++
+		w.logf("%s Warning: query %d has not completed after %s\n", now.Format("2006/01/02 15:04:05"), w.next, elapsed.Round(time.Millisecond))
+	}
+}
+
+// completed records that the queries before next have completed
+func (w *watchdog) completed(next int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.last = w.now()
+	w.next = next
+	w.warned = 0
+}
+
+func (w *watchdog) stop() {
+	close(w.done)
+}
+
+// queryStats counts the queries written so far and why the failed ones failed
+type queryStats struct {
+	start          time.Time
+	queryCount     int
+	failedCount    int
+	failureReasons map[string]int
+}
+
+func newQueryStats() *queryStats {
+	return &queryStats{
+		start:          time.Now(),
+		failureReasons: make(map[string]int),
+	}
+}
+
+// record writes the outcome of the next query, in the order it was processed.
+// It returns an error that stops the run: an outputError, also as the error of
+// the query, e.g., of recording it, or a query that saturated with
+// -strictQuantization.
+func (st *queryStats) record(writers []*csv.Writer, perfWriter *csv.Writer, sortedScores *[]protocol.VectorScore, perf *QueryPerf, err error, opts *queryOptions) error {
+	if errors.As(err, new(outputError)) {
+		return st.stop(err)
+	}
+	if opts.rotation != nil {
+		if rotateErr := opts.rotation.next(); rotateErr != nil {
+			return st.stop(rotateErr)
+		}
+	}
+	queryID := opts.queryID(st.queryCount)
+	if opts.answers != nil {
+		if exportErr := opts.answers.record(queryID, err); exportErr != nil {
+			return st.stop(exportErr)
+		}
+	}
+	var scores *[]protocol.VectorScore
+	var denseLine []string
+	if err == nil {
+		scores = opts.originalResults(sortedScores)
+		if opts.sidecar != nil {
+			scores, err = opts.rerankExact(queryID, scores)
+		}
+	}
+	if err == nil && opts.dense {
+		// a query whose scores cannot be laid out fails like any other
+		denseLine, err = denseRow(scores, opts)
+	}
+	var writeErr error
+	if err != nil {
+		fmt.Printf("%s Query %d failed: %s\n", time.Now().Format("2006/01/02 15:04:05"), queryID, err.Error())
+		writeErr = writeError(writers, perfWriter, queryID, err, opts)
+		if writeErr == nil && errors.Is(err, protocol.ErrSaturated) {
+			// with -strictQuantization, the input is broken upstream: stop at the first such query
+			return fmt.Errorf("query %d: %w", queryID, err)
+		}
+		st.failedCount++
+		st.failureReasons[err.Error()]++
+	} else {
+		writeErr = writeResults(writers, perfWriter, queryID, scores, denseLine, perf, opts)
+	}
+	if writeErr != nil {
+		return st.stop(writeErr)
+	}
+	opts.labels.forget(queryID)
+	opts.rawQueries.forget(queryID)
+	st.queryCount++
+	if opts.watchdog != nil {
+		opts.watchdog.completed(st.queryCount)
+	}
+
+	if st.queryCount%100 == 0 {
+		fmt.Printf("%s Processed %d queries\n", time.Now().Format("2006/01/02 15:04:05"), st.queryCount)
+	}
+	return nil
+}
+
+// stop returns the outputError that stops the run, with the number of queries
+// written. The output files are closed by the deferred calls of run.
+func (st *queryStats) stop(err error) error {
+	return fmt.Errorf("%w; stopping, the output files hold the rows of the %d queries before", err, st.queryCount)
+}
+
+func (st *queryStats) print() {
+	elapsed := time.Since(st.start)
+	fmt.Printf("%s Processed %d queries, %d failed, in %s (%.2f queries/s)\n", time.Now().Format("2006/01/02 15:04:05"), st.queryCount, st.failedCount, elapsed, float64(st.queryCount)/elapsed.Seconds())
+	reasons := make([]string, 0, len(st.failureReasons))
+	for reason := range st.failureReasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Printf("  %d x %s\n", st.failureReasons[reason], reason)
+	}
+}
+
+// processQueries runs every query of the reader in order, writing one row per
+// query to each results writer (one per cutoff of opts.topKs) and to the
+// performance writer, in the order of the query file. It returns the number of
+// queries and how many of them failed, and stops at the first error of record.
+func processQueries(reader *csv.Reader, writers []*csv.Writer, perfWriter *csv.Writer, client *protocol.Client, round roundFunc, opts *queryOptions) (int, int, error) {
+	stats := newQueryStats()
+	for {
+		clusterIndex, query, err := opts.nextQuery(reader, client)
+		if err == io.EOF {
+			break
+		}
+		var sortedScores *[]protocol.VectorScore
+		var perf *QueryPerf
+		if err == nil {
+			sortedScores, perf, err = round(query, clusterIndex)
+		}
+		if err := stats.record(writers, perfWriter, sortedScores, perf, err, opts); err != nil {
+			return stats.queryCount, stats.failedCount, err
+		}
+	}
+
+	stats.print()
+	return stats.queryCount, stats.failedCount, nil
+}
+
+// pendingQuery is a query answered by the server, waiting to be reconstructed
+type pendingQuery struct {
+	clusterIndex uint64
+	client       *protocol.Client
+	ans          *pir.Answer[matrix.Elem64]
+	perf         *QueryPerf
+	err          error
+}
+
+// processQueriesPipelined is like processQueries, but overlaps the hint round,
+// encoding and server computation of the next query with the reconstruction of
+// the current one. Each query in flight needs a client of its own, since a round
+// overwrites the client's secret: with n clients, at most n queries are in flight.
+func processQueriesPipelined(reader *csv.Reader, writers []*csv.Writer, perfWriter *csv.Writer, clients []*protocol.Client, s *protocol.Server, opts *queryOptions) (int, int, error) {
+	stats := newQueryStats()
+
+	idle := make(chan *protocol.Client, len(clients))
+	for _, c := range clients {
+		idle <- c
+	}
+
+	// queries are answered and reconstructed in the order of the query file, and
+	// the next queries are abandoned once stop is closed
+	pending := make(chan *pendingQuery, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(pending)
+		for {
+			// preparing a query only reads the client's projection and metadata
+			clusterIndex, query, err := opts.nextQuery(reader, clients[0])
+			if err == io.EOF {
+				return
+			}
+			p := &pendingQuery{clusterIndex: clusterIndex}
+			if err == nil {
+				select {
+				case p.client = <-idle:
+				case <-stop:
+					return
+				}
+				p.ans, p.perf, err = search.Round(p.client, s, query, clusterIndex, opts.retry)
+			}
+			p.err = err
+			select {
+			case pending <- p:
+			case <-stop:
+				return
+			}
+			if errors.As(err, new(outputError)) {
+				// record stops the run at this query
+				return
+			}
+		}
+	}()
+
+	for p := range pending {
+		var sortedScores *[]protocol.VectorScore
+		if p.err == nil {
+			sortedScores, p.err = reconstructRound(p.client, p.ans, p.clusterIndex, p.perf, opts)
+		}
+		if p.client != nil {
+			idle <- p.client
+		}
+		if err := stats.record(writers, perfWriter, sortedScores, p.perf, p.err, opts); err != nil {
+			return stats.queryCount, stats.failedCount, err
+		}
+	}
+
+	stats.print()
+	return stats.queryCount, stats.failedCount, nil
+}
+
+// runRound runs the full protocol for one query. Failures, including panics from
+// the client, are returned as an error so that one bad query does not abort the run.
+func runRound(c *protocol.Client, s *protocol.Server, query []int8, clusterIndex uint64, opts *queryOptions) (*[]protocol.VectorScore, *QueryPerf, error) {
+	ans, perf, err := search.Round(c, s, query, clusterIndex, opts.retry)
+	if err != nil {
+		return nil, nil, err
+	}
+	recon, err := reconstructRound(c, ans, clusterIndex, perf, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return recon, perf, nil
+}
+
+// runLazyRound runs a query against the database of its cluster, built on demand,
+// with the client set up for it. The cluster is cluster 0 of its database.
+func runLazyRound(lazy *protocol.LazyServers, clients map[uint64]*protocol.Client, query []int8, clusterIndex uint64, maxCandidates uint64, order protocol.SortOrder, opts *queryOptions) (recon *[]protocol.VectorScore, perf *QueryPerf, err error) {
+	s, err := lazy.Get(clusterIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, ok := clients[clusterIndex]
+	if !ok {
+		c = new(protocol.Client)
+		c.Setup(s.Hint)
+		c.MaxCandidates = maxCandidates
+		c.Order = order
+		c.ScoreBound = opts.scoreBound()
+		clients[clusterIndex] = c
+	}
+	recon, perf, err = runRound(c, s, query, 0, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range *recon {
+		(*recon)[i].ClusterID = uint(clusterIndex)
+	}
+	return recon, perf, nil
+}
+
+// reconstructRound recovers the scores from the server's answer, with the client
+// that made the query, and records the time it takes in perf, like
+// search.Reconstruct, which it runs unless -countOnly
+func reconstructRound(c *protocol.Client, ans *pir.Answer[matrix.Elem64], clusterIndex uint64, perf *QueryPerf, opts *queryOptions) (recon *[]protocol.VectorScore, err error) {
+	if opts.answers != nil {
+		// outside of the timed reconstruction
+		opts.answers.pending = c.ExportAnswer(ans, -1, clusterIndex)
+	}
+
+	defer warnAnomalies(c, c.Anomalies())
+	if !opts.countOnly {
+		recon, err = search.Reconstruct(c, ans, clusterIndex, opts.clusterOnly, perf)
+		if err != nil || opts.clusterOnly || opts.perClusterTopK == 0 {
+			return recon, err
+		}
+		start := time.Now()
+		recon = protocol.TopKPerCluster(recon, opts.perClusterTopK)
+		perf.ClientReconTime += time.Since(start)
+		return recon, nil
+	}
+
+	// -countOnly keeps every vector that meets -minScore, not only the top-k
+	scored := c.Scored()
+	clientReconStart := time.Now()
+	if opts.clusterOnly {
+		recon = c.MatchWithinCluster(ans, clusterIndex, c.DBInfo.P(), opts.minScore)
+	} else {
+		recon = c.MatchWithinBin(ans, clusterIndex, c.DBInfo.P(), opts.minScore)
+	}
+	perf.ClientReconTime = time.Since(clientReconStart)
+	perf.NumCandidates = c.Scored() - scored
+
+	return recon, nil
+}
+
+// warnAnomalies reports the candidates the client dropped since it had dropped
+// before, for scoring beyond its ScoreBound
+func warnAnomalies(c *protocol.Client, before uint64) {
+	if dropped := c.Anomalies() - before; dropped > 0 {
+		fmt.Printf("%s Warning: dropped %d candidates scoring beyond %d, from corrupted values or a wraparound modulo P\n", time.Now().Format("2006/01/02 15:04:05"), dropped, c.ScoreBound)
+	}
+}
+
+// meanRecall averages the recall of queries
+type meanRecall struct {
+	sum   float64
+	count int
+}
+
+// timedResponder forwards the messages of a round to a server, adding the server
+// times and the message sizes to perf. With a retry policy, the calls are
+// retried, and the server times are those of the successful attempts; the
+// retries and the time spent in the failed attempts and backoff are added to
+// perf apart, like in search.Round.
+type timedResponder struct {
+	s       protocol.Responder
+	retries *protocol.RetryingResponder
+	perf    *QueryPerf
+}
+
+// newTimedResponder starts a round with s, retrying its calls with retry if not
+// nil
+func newTimedResponder(s *protocol.Server, retry *protocol.RetryPolicy) *timedResponder {
+	r := &timedResponder{s: s, perf: new(QueryPerf)}
+	if retry != nil {
+		r.retries = &protocol.RetryingResponder{Responder: s, Policy: *retry}
+		r.s = r.retries
+	}
+	return r
+}
+
+// since is the time since start of a successful call, less the time spent in
+// its failed attempts and backoff, which is recorded apart
+func (r *timedResponder) since(start time.Time) time.Duration {
+	elapsed := time.Since(start)
+	if r.retries == nil {
+		return elapsed
+	}
+	waited := r.retries.Waited()
+	elapsed -= waited - r.perf.RetryWaitTime
+	r.perf.RetryWaitTime = waited
+	r.perf.Retries = int(r.retries.Retries())
+	return elapsed
+}
+
+func (r *timedResponder) HintAnswer(ct *[][]byte) (*underhood.HintAnswer, error) {
+	start := time.Now()
+	ans, err := r.s.HintAnswer(ct)
+	if err != nil {
+		return nil, err
+	}
+	r.perf.ServerHintAnswerTime += r.since(start)
+	r.perf.HintQuerySize += utils.MessageSizeBytes(*ct)
+	r.perf.HintAnsSize += utils.MessageSizeBytes(*ans)
+	return ans, nil
+}
+
+func (r *timedResponder) Answer(query *pir.Query[matrix.Elem64]) (*pir.Answer[matrix.Elem64], error) {
+	start := time.Now()
+	ans, err := r.s.Answer(query)
+	if err != nil {
+		return nil, err
+	}
+	r.perf.ServerComputeTime += r.since(start)
+	r.perf.QuerySize += utils.MessageSizeBytes(*query)
+	r.perf.AnsSize += utils.MessageSizeBytes(*ans)
+	return ans, nil
+}
+
+// runGlobalRound searches the whole database with Client.GlobalQuery and adds its
+// recall against an exhaustive plaintext search to recall. The server times and
+// message sizes are summed over the probes, and the client time of all probes is
+// written as clientReconTime.
+func runGlobalRound(c *protocol.Client, s *protocol.Server, exact *protocol.PlaintextServer, query []int8, k int, nprobe int, recall *meanRecall, retry *protocol.RetryPolicy) (scores *[]protocol.VectorScore, perf *QueryPerf, err error) {
+	r := newTimedResponder(s, retry)
+	defer warnAnomalies(c, c.Anomalies())
+	scored := c.Scored()
+	start := time.Now()
+	scores, err = c.GlobalQuery(r, query, k, nprobe)
+	if err != nil {
+		return nil, nil, err
+	}
+	perf = r.perf
+	perf.ClientReconTime = time.Since(start) - perf.ServerHintAnswerTime - perf.ServerComputeTime - perf.RetryWaitTime
+	perf.NumCandidates = c.Scored() - scored
+
+	recall.sum += protocol.RecallAtK(scores, exact.SearchAll(query), k)
+	recall.count++
+	return scores, perf, nil
+}
+
+// runClusterSetRound scores a query against the bins of a set of clusters with
+// Client.ProbeClusters, in numProbes rounds, and returns the vectors of those
+// clusters only. The server times and message sizes are summed over the probes,
+// like in runGlobalRound.
+func runClusterSetRound(c *protocol.Client, s *protocol.Server, query []int8, set []uint64, numProbes int, opts *queryOptions) (scores *[]protocol.VectorScore, perf *QueryPerf, err error) {
+	res := make([]protocol.VectorScore, 0)
+	if len(set) == 0 {
+		// only clusters that are not in the database
+		return &res, new(QueryPerf), nil
+	}
+	r := newTimedResponder(s, opts.retry)
+	defer warnAnomalies(c, c.Anomalies())
+	scored := c.Scored()
+	start := time.Now()
+	all, err := c.ProbeClusters(r, query, set, numProbes)
+	if err != nil {
+		return nil, nil, err
+	}
+	inSet := make(map[uint]bool)
+	for _, cluster := range set {
+		inSet[uint(cluster)] = true
+	}
+	for _, sc := range *all {
+		if inSet[sc.ClusterID] {
+			res = append(res, sc)
+		}
+	}
+	scores = &res
+	if opts.perClusterTopK > 0 {
+		scores = protocol.TopKPerCluster(scores, opts.perClusterTopK)
+	}
+	perf = r.perf
+	perf.ClientReconTime = time.Since(start) - perf.ServerHintAnswerTime - perf.ServerComputeTime - perf.RetryWaitTime
+	perf.NumCandidates = c.Scored() - scored
+	return scores, perf, nil
+}
+
+// runPlaintextRound scores a query without PIR. Only the scoring time is
+// measured, as serverComputeTime; all other costs are 0.
+func runPlaintextRound(s *protocol.PlaintextServer, query []int8, clusterIndex uint64, opts *queryOptions) (recon *[]protocol.VectorScore, perf *QueryPerf, err error) {
+	serverComputeStart := time.Now()
+	if opts.clusterOnly {
+		recon = s.SearchCluster(query, clusterIndex)
+	} else {
+		recon = s.SearchBin(query, clusterIndex)
+	}
+	numCandidates := uint64(len(*recon))
+	if !opts.clusterOnly && opts.perClusterTopK > 0 && !opts.countOnly {
+		recon = protocol.TopKPerCluster(recon, opts.perClusterTopK)
+	}
+	if opts.countOnly {
+		recon = protocol.FilterScores(recon, opts.minScore, s.Order)
+	}
+	perf = &QueryPerf{
+		ServerComputeTime: time.Since(serverComputeStart),
+		NumCandidates:     numCandidates,
 	}
 
-	return recon, perf
+	return recon, perf, nil
 }
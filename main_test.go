@@ -0,0 +1,1238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+	"github.com/DeweiFeng/6.5610-project/search/protocol"
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+// newTestSession builds a server of the test data and a client set up for it,
+// which are freed at the end of the test, and returns them with the lines of
+// the test queries
+func newTestSession(t *testing.T) (*protocol.Server, *protocol.Client, []string) {
+	preamble := utils.GenerateTestData()
+	defer utils.RemoveTestData()
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries, err := os.ReadFile(preamble + "_queries.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := new(protocol.Server)
+	server.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: 900}, 5)
+	t.Cleanup(server.Close)
+	client := new(protocol.Client)
+	client.Setup(server.Hint)
+	t.Cleanup(client.Free)
+	return server, client, strings.Split(strings.TrimSpace(string(queries)), "\n")
+}
+
+func TestProcessQueriesPreservesOrder(t *testing.T) {
+	server, client, lines := newTestSession(t)
+
+	// insert a malformed row, whose error marker must stay in place
+	badRow := 3
+	lines = append(lines[:badRow], append([]string{"not,a,query"}, lines[badRow:]...)...)
+
+	reader := csv.NewReader(strings.NewReader(strings.Join(lines, "\n")))
+	reader.FieldsPerRecord = -1
+	var results, perf bytes.Buffer
+	opts := &queryOptions{topKs: []int{3}, precBits: 5, queryPrecBits: 5, withQueryID: true}
+	queryCount, failedCount, err := processQueries(reader, []*csv.Writer{csv.NewWriter(&results)}, csv.NewWriter(&perf), client, func(query []int8, clusterIndex uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+		return runRound(client, server, query, clusterIndex, opts)
+	}, opts)
+
+	if err != nil || queryCount != len(lines) || failedCount != 1 {
+		t.Fatalf("Expected %d queries with 1 failure, but got %d with %d failures and %v", len(lines), queryCount, failedCount, err)
+	}
+
+	for name, out := range map[string]*bytes.Buffer{"results": &results, "perf": &perf} {
+		// rows do not all have the same number of fields
+		r := csv.NewReader(out)
+		r.FieldsPerRecord = -1
+		rows, err := r.ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != len(lines) {
+			t.Fatalf("Expected %d %s rows, but got %d", len(lines), name, len(rows))
+		}
+		for i, row := range rows {
+			if row[0] != fmt.Sprintf("%d", i) {
+				t.Errorf("Expected %s row %d to be for query %d, but got %s", name, i, i, row[0])
+			}
+			if (i == badRow) != (row[1] == "error") {
+				t.Errorf("Expected only %s row %d to be an error, but row %d is %v", name, badRow, i, row)
+			}
+		}
+	}
+}
+
+func TestWriteResultsMultipleTopK(t *testing.T) {
+	scores := []protocol.VectorScore{
+		{ClusterID: 0, IDWithinCluster: 2, Score: 9},
+		{ClusterID: 1, IDWithinCluster: 0, Score: 7},
+		{ClusterID: 0, IDWithinCluster: 1, Score: 4},
+		{ClusterID: 1, IDWithinCluster: 1, Score: 1},
+	}
+	opts := &queryOptions{topKs: []int{1, 3, 10}, precBits: 5, withScores: true}
+
+	outs := make([]bytes.Buffer, len(opts.topKs))
+	writers := make([]*csv.Writer, len(opts.topKs))
+	for i := range outs {
+		writers[i] = csv.NewWriter(&outs[i])
+	}
+	var perf bytes.Buffer
+	writeResults(writers, csv.NewWriter(&perf), 0, &scores, nil, &QueryPerf{}, opts)
+
+	// every cutoff is a prefix of the same ranking, and a k beyond it keeps all results
+	expected := []string{"0,2,9\n", "0,2,9,1,0,7,0,1,4\n", "0,2,9,1,0,7,0,1,4,1,1,1\n"}
+	for i, out := range outs {
+		if out.String() != expected[i] {
+			t.Errorf("Expected %q for k=%d, but got %q", expected[i], opts.topKs[i], out.String())
+		}
+	}
+	if strings.Count(perf.String(), "\n") != 1 {
+		t.Errorf("Expected a single performance row, but got %q", perf.String())
+	}
+}
+
+func TestWriteResultsRelMargin(t *testing.T) {
+	scores := []protocol.VectorScore{
+		{ClusterID: 0, IDWithinCluster: 2, Score: 20},
+		{ClusterID: 1, IDWithinCluster: 0, Score: 18},
+		{ClusterID: 0, IDWithinCluster: 1, Score: 18},
+		{ClusterID: 1, IDWithinCluster: 1, Score: 17},
+	}
+	write := func(scores []protocol.VectorScore, opts *queryOptions) []string {
+		outs := make([]bytes.Buffer, len(opts.topKs))
+		writers := make([]*csv.Writer, len(opts.topKs))
+		for i := range outs {
+			writers[i] = csv.NewWriter(&outs[i])
+		}
+		writeResults(writers, csv.NewWriter(io.Discard), 0, &scores, nil, &QueryPerf{}, opts)
+		res := make([]string, len(outs))
+		for i := range outs {
+			res[i] = outs[i].String()
+		}
+		return res
+	}
+
+	// within 10% of 20, i.e., at least 18, ties included, and capped at each k
+	opts := &queryOptions{topKs: []int{2, 10}, precBits: 5, withScores: true, relMargin: 0.1}
+	expected := []string{"0,2,20,1,0,18\n", "0,2,20,1,0,18,0,1,18\n"}
+	if got := write(scores, opts); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %q, but got %q", expected, got)
+	}
+
+	// a given -minScore is a floor on top of the margin
+	opts = &queryOptions{topKs: []int{10}, precBits: 5, relMargin: 0.1, minScore: 19, marginMinScore: true}
+	if got := write(scores, opts); got[0] != "0,2\n" {
+		t.Errorf("Expected the results of at least 19, but got %q", got[0])
+	}
+
+	// a negative best score keeps the results at most 10% of its magnitude below
+	// it, and ascending rankings those at most 10% above it
+	negative := []protocol.VectorScore{{ClusterID: 0, Score: -20}, {ClusterID: 1, Score: -22}, {ClusterID: 2, Score: -23}}
+	opts = &queryOptions{topKs: []int{10}, precBits: 5, relMargin: 0.1}
+	if got := write(negative, opts); got[0] != "0,0,1,0\n" {
+		t.Errorf("Expected the results of at least -22, but got %q", got[0])
+	}
+	ascending := []protocol.VectorScore{{ClusterID: 0, Score: 10}, {ClusterID: 1, Score: 11}, {ClusterID: 2, Score: 12}}
+	opts = &queryOptions{topKs: []int{10}, precBits: 5, relMargin: 0.1, sortOrder: protocol.Ascending}
+	if got := write(ascending, opts); got[0] != "0,0,1,0\n" {
+		t.Errorf("Expected the results of at most 11, but got %q", got[0])
+	}
+
+	// no results stay no results
+	if got := write(nil, opts); got[0] != "\n" {
+		t.Errorf("Expected an empty row, but got %q", got[0])
+	}
+}
+
+func TestWriteResultsNorms(t *testing.T) {
+	clusters := make([]*database.Cluster, 2)
+	for i, vectors := range [][]float64{{1, 0, 0.5, 0.5}, {0, -0.75}} {
+		var err error
+		if clusters[i], err = database.NewClusterFromFloats(uint64(i), vectors, 2, 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scores := []protocol.VectorScore{
+		{ClusterID: 0, IDWithinCluster: 1, Score: 9},
+		{ClusterID: 1, IDWithinCluster: 0, Score: 7},
+		{ClusterID: 0, IDWithinCluster: 0, Score: 4},
+	}
+	opts := &queryOptions{topKs: []int{3}, precBits: 5, withScores: true, norms: clusters}
+
+	var out, perf bytes.Buffer
+	writeResults([]*csv.Writer{csv.NewWriter(&out)}, csv.NewWriter(&perf), 0, &scores, nil, &QueryPerf{}, opts)
+
+	// every result is followed by its score and the norm of its quantized vector
+	expected := "0,1,9,0.7071067811865476,1,0,7,0.75,0,0,4,1\n"
+	if out.String() != expected {
+		t.Errorf("Expected %q, but got %q", expected, out.String())
+	}
+}
+
+func TestRecordDenseFailure(t *testing.T) {
+	// the scores of two clusters cannot be laid out densely
+	scores := []protocol.VectorScore{{ClusterID: 0, IDWithinCluster: 0, Score: 3}, {ClusterID: 1, IDWithinCluster: 0, Score: 2}}
+	var results bytes.Buffer
+	opts := &queryOptions{topKs: []int{1}, dense: true}
+	st := newQueryStats()
+	if err := st.record([]*csv.Writer{csv.NewWriter(&results)}, csv.NewWriter(io.Discard), &scores, new(QueryPerf), nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	if st.queryCount != 1 || st.failedCount != 1 || !strings.HasPrefix(results.String(), "error,") {
+		t.Errorf("Expected the query to be written and counted as a failure, but got %d failures and %q", st.failedCount, results.String())
+	}
+}
+
+func TestNewOutputWriter(t *testing.T) {
+	tests := []struct {
+		crlf     bool
+		bom      bool
+		expected string
+	}{
+		{false, false, "a,b\nc,d\n"},
+		{true, false, "a,b\r\nc,d\r\n"},
+		{true, true, "\xEF\xBB\xBFa,b\r\nc,d\r\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		writer, err := newOutputWriter(&buf, test.crlf, test.bom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]string{"a", "b"})
+		writer.Write([]string{"c", "d"})
+		writer.Flush()
+		if buf.String() != test.expected {
+			t.Errorf("crlf=%t bom=%t: expected %q, but got %q", test.crlf, test.bom, test.expected, buf.String())
+		}
+	}
+}
+
+func TestProcessQueriesPipelined(t *testing.T) {
+	server, client, lines := newTestSession(t)
+	clients := []*protocol.Client{client, new(protocol.Client)}
+	clients[1].Setup(server.Hint)
+	defer clients[1].Free()
+
+	lines = append(lines[:2], append([]string{"not,a,query"}, lines[2:]...)...)
+	input := strings.Join(lines, "\n")
+
+	opts := &queryOptions{topKs: []int{3}, precBits: 5, queryPrecBits: 5, withQueryID: true}
+	run := func(pipelined bool) (string, time.Duration) {
+		reader := csv.NewReader(strings.NewReader(input))
+		reader.FieldsPerRecord = -1
+		var results, perf bytes.Buffer
+		start := time.Now()
+		if pipelined {
+			processQueriesPipelined(reader, []*csv.Writer{csv.NewWriter(&results)}, csv.NewWriter(&perf), clients, server, opts)
+		} else {
+			processQueries(reader, []*csv.Writer{csv.NewWriter(&results)}, csv.NewWriter(&perf), clients[0], func(query []int8, clusterIndex uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+				return runRound(clients[0], server, query, clusterIndex, opts)
+			}, opts)
+		}
+		return results.String(), time.Since(start)
+	}
+
+	sequential, sequentialTime := run(false)
+	pipelined, pipelinedTime := run(true)
+	if sequential != pipelined {
+		t.Errorf("Expected the pipelined results to equal the sequential ones:\n%s\nvs\n%s", pipelined, sequential)
+	}
+	t.Logf("Sequential: %s, pipelined: %s (%.2fx throughput)", sequentialTime, pipelinedTime, sequentialTime.Seconds()/pipelinedTime.Seconds())
+}
+
+func TestOutputRotation(t *testing.T) {
+	for _, s := range []string{"0", "-3", "x", "0MB", "1.5MB"} {
+		if _, err := parseRotateEvery(s); err == nil {
+			t.Errorf("Expected an error parsing -rotateEvery=%s", s)
+		}
+	}
+	rotation, err := parseRotateEvery("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bySize, err := parseRotateEvery("64MB"); err != nil || bySize.everyBytes != 64<<20 {
+		t.Errorf("Expected a rotation every 64 MB, but got %+v, %v", bySize, err)
+	}
+
+	dir := t.TempDir()
+	results := &rotatingFile{name: func(part int) string { return partName(dir+"/q_results.csv", part) }}
+	perf := &rotatingFile{name: func(part int) string { return partName(dir+"/q_perf.csv", part) }, header: []byte("header\n")}
+	for _, f := range []*rotatingFile{results, perf} {
+		if err := f.open(0); err != nil {
+			t.Fatal(err)
+		}
+		rotation.files = append(rotation.files, f)
+	}
+	for q := 0; q < 5; q++ {
+		if err := rotation.next(); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(results, "r%d\n", q)
+		fmt.Fprintf(perf, "p%d\n", q)
+	}
+	results.Close()
+	perf.Close()
+
+	// no part is started after the last query
+	expected := map[string]string{
+		"q_results_part0.csv": "r0\nr1\n",
+		"q_results_part1.csv": "r2\nr3\n",
+		"q_results_part2.csv": "r4\n",
+		"q_perf_part0.csv":    "header\np0\np1\n",
+		"q_perf_part1.csv":    "header\np2\np3\n",
+		"q_perf_part2.csv":    "header\np4\n",
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(expected) {
+		t.Errorf("Expected %d files, but got %d", len(expected), len(entries))
+	}
+	for name, content := range expected {
+		got, err := os.ReadFile(dir + "/" + name)
+		if err != nil {
+			t.Errorf("Error reading %s: %v", name, err)
+			continue
+		}
+		if string(got) != content {
+			t.Errorf("%s: expected %q, but got %q", name, content, got)
+		}
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	var log bytes.Buffer
+	logf := func(format string, args ...interface{}) (int, error) {
+		return fmt.Fprintf(&log, format, args...)
+	}
+	// the rounds move the clock of the watchdog and check it, without waiting
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	opts := &queryOptions{topKs: []int{1}, precBits: 5, queryPrecBits: 5}
+	opts.watchdog = newWatchdog(20*time.Millisecond, logf, func() time.Time { return clock })
+	advance := func(d time.Duration) {
+		clock = clock.Add(d)
+		opts.watchdog.check()
+	}
+
+	// the second query stalls for several intervals, the others for less than one
+	client := &protocol.Client{Metadata: database.Metadata{Dim: 2, NumClusters: 1}}
+	reader := csv.NewReader(strings.NewReader("0,0.5,0.5\n0,0.5,-0.5\n0,-0.5,0.5\n"))
+	round := func(query []int8, clusterIndex uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+		advance(15 * time.Millisecond)
+		if query[1] < 0 {
+			for i := 0; i < 4; i++ {
+				advance(15 * time.Millisecond)
+			}
+		}
+		return &[]protocol.VectorScore{{}}, &QueryPerf{}, nil
+	}
+	var results, perf bytes.Buffer
+	if queryCount, _, _ := processQueries(reader, []*csv.Writer{csv.NewWriter(&results)}, csv.NewWriter(&perf), client, round, opts); queryCount != 3 {
+		t.Fatalf("Expected the run to go on after the stall, but only %d queries completed", queryCount)
+	}
+
+	// once per interval: after 30ms, 45ms and 60ms, but not 75ms
+	expected := []string{"query 1 has not completed after 30ms", "query 1 has not completed after 45ms", "query 1 has not completed after 60ms"}
+	warnings := strings.Count(log.String(), "Warning")
+	if warnings != len(expected) {
+		t.Errorf("Expected %d warnings for query 1, but got %q", len(expected), log.String())
+	}
+	for _, warning := range expected {
+		if !strings.Contains(log.String(), warning) {
+			t.Errorf("Expected the warning %q, but got %q", warning, log.String())
+		}
+	}
+}
+
+func TestProcessRunsConcurrently(t *testing.T) {
+	preamble := utils.GenerateTestData()
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries, err := os.ReadFile(preamble + "_queries.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.RemoveTestData()
+	lines := strings.Split(strings.TrimSpace(string(queries)), "\n")
+
+	// query files of different lengths, and the output of a previous run; a few
+	// queries each, since every PIR query takes a round
+	dir := t.TempDir()
+	numFiles := 3
+	lines = lines[:numFiles+1]
+	for i := 0; i < numFiles; i++ {
+		contents := strings.Join(lines[i:], "\n") + "\n"
+		if err := os.WriteFile(fmt.Sprintf("%s/q_%d.csv", dir, i), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(dir+"/q_0_results.csv", []byte("stale\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := findQueryFiles(preamble, dir+"/q_*.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != numFiles {
+		t.Fatalf("Expected %d query files, but got %v", numFiles, files)
+	}
+
+	opts := &queryOptions{topKs: []int{3}, precBits: 5, queryPrecBits: 5, withScores: true}
+	plaintext := protocol.NewPlaintextServer(metadata, clusters, database.DatabaseParams{})
+	// the PIR server is shared by the files, each with a client of its own
+	server := new(protocol.Server)
+	server.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: 900}, 5)
+	defer server.Close()
+	rounds := []struct {
+		name     string
+		newRound func(opts *queryOptions) (*protocol.Client, roundFunc, func())
+	}{
+		{"plaintext", func(opts *queryOptions) (*protocol.Client, roundFunc, func()) {
+			return &protocol.Client{Metadata: metadata}, func(query []int8, clusterIndex uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+				return runPlaintextRound(plaintext, query, clusterIndex, opts)
+			}, func() {}
+		}},
+		{"PIR", func(opts *queryOptions) (*protocol.Client, roundFunc, func()) {
+			c := new(protocol.Client)
+			c.Setup(server.Hint)
+			return c, func(query []int8, clusterIndex uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+				return runRound(c, server, query, clusterIndex, opts)
+			}, c.Free
+		}},
+	}
+	runs := make([]*queryRun, len(files))
+	for _, r := range rounds {
+		for i, file := range files {
+			if runs[i], err = openQueryRun(file, file[:len(file)-4], outputConfig{topKs: []uint64{3}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := processRunsConcurrently(runs, 2, r.newRound, opts); err != nil {
+			t.Fatal(err)
+		}
+		for _, run := range runs {
+			run.close()
+		}
+
+		// every file has the results of a sequential run, in order
+		for i, file := range files {
+			reader := csv.NewReader(strings.NewReader(strings.Join(lines[i:], "\n")))
+			reader.FieldsPerRecord = -1
+			var expected, perf bytes.Buffer
+			client, round, free := r.newRound(opts)
+			processQueries(reader, []*csv.Writer{csv.NewWriter(&expected)}, csv.NewWriter(&perf), client, round, opts)
+			free()
+
+			got, err := os.ReadFile(file[:len(file)-4] + "_results.csv")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != expected.String() {
+				t.Errorf("%s, %s: expected results\n%s\nbut got\n%s", r.name, file, expected.String(), got)
+			}
+		}
+	}
+
+	// a panic in the goroutine of a file is returned, not a crash of the process
+	panicking := func(opts *queryOptions) (*protocol.Client, roundFunc, func()) {
+		return &protocol.Client{Metadata: metadata}, func(query []int8, clusterIndex uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+			panic("reconstruction bug")
+		}, func() {}
+	}
+	for i, file := range files {
+		if runs[i], err = openQueryRun(file, file[:len(file)-4], outputConfig{topKs: []uint64{3}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = processRunsConcurrently(runs, 2, panicking, opts)
+	for _, run := range runs {
+		run.close()
+	}
+	if err == nil || !strings.Contains(err.Error(), "reconstruction bug") {
+		t.Errorf("Expected the panic of a file to be returned, but got %v", err)
+	}
+}
+
+func TestTimeUnit(t *testing.T) {
+	d := 30 * time.Microsecond
+	for _, tc := range []struct {
+		unit   string
+		value  string
+		column string
+	}{
+		{"s", "3e-05", "clientReconTime"},
+		{"ms", "0.03", "clientReconTimeMs"},
+		{"us", "30", "clientReconTimeUs"},
+	} {
+		u, err := parseTimeUnit(tc.unit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := u.format(d); got != tc.value {
+			t.Errorf("%s: expected %s, but got %s", tc.unit, tc.value, got)
+		}
+		if got := u.column("clientReconTime"); got != tc.column {
+			t.Errorf("%s: expected column %s, but got %s", tc.unit, tc.column, got)
+		}
+	}
+	// the zero value is seconds, as before the option
+	if got := timeUnit(0).format(d); got != "3e-05" {
+		t.Errorf("Expected seconds by default, but got %s", got)
+	}
+	if _, err := parseTimeUnit("ns"); err == nil {
+		t.Errorf("Expected an error for an unknown unit")
+	}
+
+	var results, perf bytes.Buffer
+	scores := []protocol.VectorScore{{ClusterID: 0, IDWithinCluster: 1, Score: 3}}
+	opts := &queryOptions{topKs: []int{1}, precBits: 5, timeUnit: timeUnit(time.Millisecond)}
+	perfWriter := csv.NewWriter(&perf)
+	writeResults([]*csv.Writer{csv.NewWriter(&results)}, perfWriter, 0, &scores, nil, &QueryPerf{ClientReconTime: 1500 * time.Microsecond}, opts)
+	if row := strings.Split(strings.TrimSpace(perf.String()), ","); row[5] != "1.5" {
+		t.Errorf("Expected clientReconTime 1.5 ms, but got %v", row)
+	}
+}
+
+func TestShuffleQueries(t *testing.T) {
+	server, client, lines := newTestSession(t)
+
+	badRow := 2
+	lines[badRow] = "not,a,query"
+	input := strings.Join(lines, "\n") + "\n\n"
+
+	// the order only depends on the seed
+	_, order, err := shuffleQueries(strings.NewReader(input), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, again, _ := shuffleQueries(strings.NewReader(input), 7)
+	if !reflect.DeepEqual(order, again) {
+		t.Errorf("Expected the same order for the same seed, but got %v and %v", order, again)
+	}
+	if len(order) != len(lines) {
+		t.Fatalf("Expected %d queries, but got %d", len(lines), len(order))
+	}
+
+	run := func(reader *csv.Reader, order []int) map[string][]string {
+		var results bytes.Buffer
+		opts := &queryOptions{topKs: []int{3}, precBits: 5, queryPrecBits: 5, withQueryID: true, order: order}
+		processQueries(reader, []*csv.Writer{csv.NewWriter(&results)}, csv.NewWriter(io.Discard), client, func(query []int8, clusterIndex uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+			return runRound(client, server, query, clusterIndex, opts)
+		}, opts)
+		r := csv.NewReader(&results)
+		r.FieldsPerRecord = -1
+		rows, err := r.ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		byID := make(map[string][]string)
+		for _, row := range rows {
+			byID[row[0]] = row
+		}
+		return byID
+	}
+	inOrder := csv.NewReader(strings.NewReader(input))
+	inOrder.FieldsPerRecord = -1
+	expected := run(inOrder, nil)
+	shuffled, order, _ := shuffleQueries(strings.NewReader(input), 7)
+	got := run(shuffled, order)
+
+	// every row still names the line of its query
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected the results of the file order by query ID, %v, but got %v", expected, got)
+	}
+	if got[fmt.Sprintf("%d", badRow)][1] != "error" {
+		t.Errorf("Expected query %d to fail, but got %v", badRow, got[fmt.Sprintf("%d", badRow)])
+	}
+}
+
+func TestQueryExtraColumns(t *testing.T) {
+	server, client, lines := newTestSession(t)
+
+	withExtra := make([]string, len(lines))
+	for i, line := range lines {
+		withExtra[i] = fmt.Sprintf("%s,2026-10-17,q%d", line, i)
+	}
+	// the last row has no ID
+	withExtra[len(lines)-1] = lines[len(lines)-1]
+
+	run := func(input []string, opts *queryOptions) [][]string {
+		reader := csv.NewReader(strings.NewReader(strings.Join(input, "\n")))
+		reader.FieldsPerRecord = -1
+		var results bytes.Buffer
+		processQueries(reader, []*csv.Writer{csv.NewWriter(&results)}, csv.NewWriter(io.Discard), client, func(query []int8, clusterIndex uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+			return runRound(client, server, query, clusterIndex, opts)
+		}, opts)
+		r := csv.NewReader(&results)
+		r.FieldsPerRecord = -1
+		rows, err := r.ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rows
+	}
+	expected := run(lines, &queryOptions{topKs: []int{3}, precBits: 5, queryPrecBits: 5, withQueryID: true})
+
+	// the exact width stays the default
+	for _, row := range run(withExtra[:1], &queryOptions{topKs: []int{3}, precBits: 5, queryPrecBits: 5, withQueryID: true}) {
+		if row[1] != "error" {
+			t.Errorf("Expected a row with extra columns to fail by default, but got %v", row)
+		}
+	}
+
+	ignored := run(withExtra, &queryOptions{topKs: []int{3}, precBits: 5, queryPrecBits: 5, withQueryID: true, extraColumns: true})
+	if !reflect.DeepEqual(ignored, expected) {
+		t.Errorf("Expected the extra columns to be ignored, %v, but got %v", expected, ignored)
+	}
+
+	idColumn := int(client.Metadata.Dim) + 2
+	labeled := run(withExtra, &queryOptions{topKs: []int{3}, precBits: 5, queryPrecBits: 5, withQueryID: true, extraColumns: true, idColumn: idColumn, labels: newQueryLabels()})
+	if len(labeled) != len(lines) {
+		t.Fatalf("Expected %d rows, but got %d", len(lines), len(labeled))
+	}
+	for i, row := range labeled[:len(lines)-1] {
+		if id := fmt.Sprintf("q%d", i); row[0] != id || !reflect.DeepEqual(row[1:], expected[i][1:]) {
+			t.Errorf("Expected row %d to be %v with ID %s, but got %v", i, expected[i][1:], id, row)
+		}
+	}
+	if last := labeled[len(lines)-1]; last[1] != "error" {
+		t.Errorf("Expected the row without an ID to fail, but got %v", last)
+	}
+}
+
+func TestReadClusterSets(t *testing.T) {
+	file := t.TempDir() + "/sets.csv"
+	if err := os.WriteFile(file, []byte("0,2\n1\n2, 0 ,1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sets, err := readClusterSets(file, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]uint64{{0, 2}, {1}, {2, 0, 1}}
+	if !reflect.DeepEqual(sets, expected) {
+		t.Errorf("Expected %v, but got %v", expected, sets)
+	}
+	if n, err := countQueryRows(file); err != nil || n != 3 {
+		t.Errorf("Expected 3 rows, but got %d, %v", n, err)
+	}
+
+	for _, contents := range []string{"0\n3\n", "0\nx\n", "0\n,\n"} {
+		if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readClusterSets(file, 3); err == nil || !strings.Contains(err.Error(), ":2:") {
+			t.Errorf("Expected an error on line 2 of %q, but got %v", contents, err)
+		}
+	}
+}
+
+func TestRunClusterSets(t *testing.T) {
+	// the cluster of each row is not the one of its nearest vector, which its
+	// set holds
+	preamble := writeFixture(t, map[string]string{
+		"_query.csv": "1,0.8,0.1,0,0\n0,0,0,0.8,0.1\n",
+		"_sets.csv":  "0\n1\n",
+	})
+	top1 := map[string]string{"0": "0,0", "1": "1,0"}
+	for _, variant := range []struct {
+		name string
+		set  func(cfg *config)
+	}{
+		{"in order", func(cfg *config) {}},
+		{"shuffled", func(cfg *config) { cfg.shuffle, cfg.shuffleSeed = true, 1 }},
+		{"with retries", func(cfg *config) { cfg.rpcRetries = 1 }},
+	} {
+		cfg := defaultConfig()
+		cfg.preamble, cfg.topK, cfg.withQueryID, cfg.clusterSetsFile = preamble, "1", true, preamble+"_sets.csv"
+		variant.set(&cfg)
+		if err := run(cfg); err != nil {
+			t.Fatal(err)
+		}
+		results, err := os.ReadFile(preamble + "_results.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := csv.NewReader(bytes.NewReader(results)).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != len(top1) {
+			t.Fatalf("%s: expected a row per query, but got %q", variant.name, results)
+		}
+		for _, row := range rows {
+			if expected, ok := top1[row[0]]; !ok || row[1]+","+row[2] != expected {
+				t.Errorf("%s: expected query %s to find %s in its set, but got %q", variant.name, row[0], expected, row)
+			}
+		}
+	}
+	perf, err := os.ReadFile(preamble + "_perf.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header, _, _ := strings.Cut(string(perf), "\n"); !strings.Contains(header, "retries") {
+		t.Errorf("Expected the retries of the probes in the performance file, but got the header %q", header)
+	}
+}
+
+func TestOutputFailures(t *testing.T) {
+	dir := t.TempDir()
+	existing := dir + "/existing.csv"
+	if err := os.WriteFile(existing, []byte("kept\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWritable(existing); err != nil {
+		t.Errorf("Expected %s to be writable, but got %v", existing, err)
+	}
+	if buf, _ := os.ReadFile(existing); string(buf) != "kept\n" {
+		t.Errorf("Expected the check to leave the file as is, but got %q", buf)
+	}
+	if err := checkWritable(dir + "/new.csv"); err != nil {
+		t.Errorf("Expected a new file to be writable, but got %v", err)
+	}
+	if _, err := os.Stat(dir + "/new.csv"); !os.IsNotExist(err) {
+		t.Errorf("Expected the check to leave no file behind")
+	}
+	err := checkWritable(dir + "/missing/out.csv")
+	if err == nil || !strings.Contains(err.Error(), dir+"/missing/out.csv") || !strings.Contains(err.Error(), "no such file or directory") {
+		t.Errorf("Expected an error naming the file and the reason, but got %v", err)
+	}
+	if err := checkWritableDir(dir + "/dump"); err != nil {
+		t.Errorf("Expected a new directory to be writable, but got %v", err)
+	}
+
+	// a full disk stops the run with the file and the number of queries written
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full to simulate a full disk")
+	}
+	f, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("cannot open /dev/full: " + err.Error())
+	}
+	full := &rotatingFile{f: f, path: "/dev/full"}
+	defer full.Close()
+	writers := []*csv.Writer{csv.NewWriter(full)}
+	perf := csv.NewWriter(io.Discard)
+	scores := []protocol.VectorScore{{ClusterID: 0, IDWithinCluster: 1}}
+	opts := &queryOptions{topKs: []int{1}}
+	err = newQueryStats().record(writers, perf, &scores, new(QueryPerf), nil, opts)
+	var oe outputError
+	if !errors.As(err, &oe) || !strings.Contains(err.Error(), "/dev/full") || !strings.Contains(err.Error(), "no space left on device") || !strings.Contains(err.Error(), "the rows of the 0 queries before") {
+		t.Errorf("Expected a clear outputError for a full disk, but got %v", err)
+	}
+}
+
+func TestOutputFailuresMidRun(t *testing.T) {
+	scores := []protocol.VectorScore{{ClusterID: 0, IDWithinCluster: 1}}
+	record := func(opts *queryOptions) error {
+		st := newQueryStats()
+		if err := st.record([]*csv.Writer{csv.NewWriter(io.Discard)}, csv.NewWriter(io.Discard), &scores, new(QueryPerf), nil, opts); err != nil {
+			return err
+		}
+		return st.record([]*csv.Writer{csv.NewWriter(io.Discard)}, csv.NewWriter(io.Discard), &scores, new(QueryPerf), nil, opts)
+	}
+
+	// the next part of a rotation cannot be created
+	dir := t.TempDir()
+	results := &rotatingFile{name: func(part int) string {
+		if part > 0 {
+			return dir + "/missing/q_results.csv"
+		}
+		return dir + "/q_results.csv"
+	}}
+	if err := results.open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer results.Close()
+	rotation := &outputRotation{everyQueries: 1, files: []*rotatingFile{results}}
+	err := record(&queryOptions{topKs: []int{1}, rotation: rotation})
+	if !errors.As(err, new(outputError)) || !strings.Contains(err.Error(), "rotating") || !strings.Contains(err.Error(), "the rows of the 1 queries before") {
+		t.Errorf("Expected an outputError rotating after the first query, but got %v", err)
+	}
+
+	// the answer of a query cannot be dumped
+	answers := &answerExporter{dumpDir: dir + "/missing", pending: &protocol.ExportedAnswer{Answer: pir.Answer[matrix.Elem64]{Answer: matrix.Zeros[matrix.Elem64](1, 1)}}}
+	err = record(&queryOptions{topKs: []int{1}, answers: answers})
+	if !errors.As(err, new(outputError)) || !strings.Contains(err.Error(), "dumping answer 0") {
+		t.Errorf("Expected an outputError dumping the answer, but got %v", err)
+	}
+
+	// a query cannot be recorded, sequentially or pipelined: the run stops at
+	// its first query
+	server, client, lines := newTestSession(t)
+	clients := []*protocol.Client{client, new(protocol.Client)}
+	clients[1].Setup(server.Hint)
+	defer clients[1].Free()
+	for _, pipelined := range []bool{false, true} {
+		// a log of another dimension than the queries fails every write
+		recorder, err := protocol.NewQueryLogWriter(io.Discard, client.Metadata.Dim+1, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := &queryOptions{topKs: []int{3}, precBits: 5, queryPrecBits: 5, recorder: recorder}
+		reader := csv.NewReader(strings.NewReader(strings.Join(lines, "\n")))
+		var out bytes.Buffer
+		if pipelined {
+			_, _, err = processQueriesPipelined(reader, []*csv.Writer{csv.NewWriter(&out)}, csv.NewWriter(io.Discard), clients, server, opts)
+		} else {
+			_, _, err = processQueries(reader, []*csv.Writer{csv.NewWriter(&out)}, csv.NewWriter(io.Discard), client, func(query []int8, clusterIndex uint64) (*[]protocol.VectorScore, *QueryPerf, error) {
+				return runRound(client, server, query, clusterIndex, opts)
+			}, opts)
+		}
+		if !errors.As(err, new(outputError)) || !strings.Contains(err.Error(), "recording query 0") || out.Len() != 0 {
+			t.Errorf("pipelined=%t: expected an outputError recording the first query, and no rows, but got %v and %q", pipelined, err, out.String())
+		}
+	}
+}
+
+// writeFixture writes files named after a new preamble, and returns it. The
+// fixture has two clusters of vectors along the axes, unless files replaces
+// them, and queries close to one vector each, which must come first.
+func writeFixture(t *testing.T, files map[string]string) string {
+	preamble := t.TempDir() + "/fixture"
+	all := map[string]string{
+		"_metadata.json": `{"num_vectors": 5, "num_clusters": 2, "dim": 4}`,
+		"_cluster_0.csv": "0.9,0,0,0\n0,0.9,0,0\n",
+		"_cluster_1.csv": "0,0,0.9,0\n0,0,0,0.9\n0,0,-0.6,-0.6\n",
+		"_query.csv":     "1,0,0,0.8,0.1\n0,0.7,-0.1,0,0\n1,0,0,-0.5,-0.5\n",
+	}
+	for suffix, content := range files {
+		all[suffix] = content
+	}
+	for suffix, content := range all {
+		if err := os.WriteFile(preamble+suffix, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return preamble
+}
+
+func TestParseFlags(t *testing.T) {
+	cfg, err := parseFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, defaultConfig()) {
+		t.Errorf("Expected no flags to give the default options, but got %+v", cfg)
+	}
+
+	cfg, err = parseFlags([]string{"-preamble=p", "-topk=1,5", "-rpcTimeout=30s", "-minScore=0", "-diff", "old.csv", "new.csv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := defaultConfig()
+	expected.preamble, expected.topK, expected.rpcTimeout = "p", "1,5", 30*time.Second
+	expected.minScoreSet, expected.diffOld, expected.args = true, "old.csv", []string{"new.csv"}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("Expected %+v, but got %+v", expected, cfg)
+	}
+
+	if _, err := parseFlags([]string{"-topk"}); err == nil {
+		t.Errorf("Expected an error for a flag without its value")
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	preamble := writeFixture(t, map[string]string{"_results.csv": "earlier results\n"})
+	for _, tc := range []struct {
+		set      func(cfg *config)
+		expected string
+	}{
+		{func(cfg *config) { cfg.preamble = "" }, "preamble is required"},
+		{func(cfg *config) { cfg.pipeline, cfg.plaintext = true, true }, "-pipeline cannot be combined"},
+		{func(cfg *config) { cfg.concurrency, cfg.exportAnswers = 2, preamble+"_answers.bin" }, "-concurrency cannot be combined"},
+		{func(cfg *config) { cfg.concurrency, cfg.recordQueries = 2, preamble+"_queries.log" }, "-concurrency cannot be combined"},
+		{func(cfg *config) { cfg.diffOld = preamble + "_results.csv" }, "-diff takes the old results file"},
+		{func(cfg *config) { cfg.query = preamble + "_missing.csv" }, "query file does not exist"},
+	} {
+		cfg := defaultConfig()
+		cfg.preamble = preamble
+		tc.set(&cfg)
+		if err := run(cfg); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("Expected an error containing %q, but got %v", tc.expected, err)
+		}
+	}
+	if results, err := os.ReadFile(preamble + "_results.csv"); err != nil || string(results) != "earlier results\n" {
+		t.Errorf("Expected the failed runs to leave the earlier results alone, but got %q and %v", results, err)
+	}
+
+	// the build fails, rather than panics, if no answer fits the budget
+	cfg := defaultConfig()
+	cfg.preamble, cfg.maxAnswerBytes = preamble, 1
+	if err := run(cfg); err == nil || !strings.Contains(err.Error(), "building the database") {
+		t.Errorf("Expected the error of the build, but got %v", err)
+	}
+}
+
+func TestRunEndToEnd(t *testing.T) {
+	preamble := writeFixture(t, nil)
+
+	cfg := defaultConfig()
+	cfg.preamble, cfg.topK, cfg.withQueryID, cfg.withScores, cfg.recordManifest = preamble, "2", true, true, true
+	if err := run(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := os.ReadFile(preamble + "_results.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(results)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the query index, then cluster, index and score of the top 2
+	top1 := []string{"1,0", "0,0", "1,2"}
+	if len(rows) != len(top1) {
+		t.Fatalf("Expected a row per query, but got %q", results)
+	}
+	for i, row := range rows {
+		if len(row) != 7 || row[0] != fmt.Sprint(i) {
+			t.Errorf("Expected query %d and 2 results of 3 fields, but got %q", i, row)
+			continue
+		}
+		if got := row[1] + "," + row[2]; got != top1[i] {
+			t.Errorf("Query %d: expected the top-1 %s, but got %s", i, top1[i], got)
+		}
+	}
+
+	perf, err := os.ReadFile(preamble + "_perf.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	perfRows, err := csv.NewReader(bytes.NewReader(perf)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(perfRows) != len(top1)+1 || perfRows[0][0] != "queryID" || perfRows[0][1] != "clientHintQueryTime" {
+		t.Fatalf("Expected a header and a row per query, but got %q", perf)
+	}
+	for _, row := range perfRows[1:] {
+		if len(row) != len(perfRows[0]) {
+			t.Errorf("Expected %d columns, but got %q", len(perfRows[0]), row)
+		}
+	}
+	if _, err := os.Stat(preamble + "_manifest.json"); err != nil {
+		t.Errorf("Expected a manifest: %v", err)
+	}
+}
+
+func TestRunDenseScores(t *testing.T) {
+	preamble := writeFixture(t, nil)
+	readRows := func() [][]string {
+		results, err := os.ReadFile(preamble + "_results_cluster_only.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := csv.NewReader(bytes.NewReader(results))
+		// the clusters have different sizes
+		reader.FieldsPerRecord = -1
+		rows, err := reader.ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rows
+	}
+
+	// the ranked scores of the same queries, by vector
+	cfg := defaultConfig()
+	cfg.preamble, cfg.topK, cfg.clusterOnly, cfg.withScores = preamble, "3", true, true
+	if err := run(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ranked := make([]map[string]string, 0)
+	for _, row := range readRows() {
+		scores := make(map[string]string)
+		for j := 0; j+2 < len(row); j += 3 {
+			scores[row[j+1]] = row[j+2]
+		}
+		ranked = append(ranked, scores)
+	}
+
+	cfg = defaultConfig()
+	cfg.preamble, cfg.clusterOnly, cfg.denseScores, cfg.denseLimit = preamble, true, true, 2
+	if err := run(cfg); err != nil {
+		t.Fatal(err)
+	}
+	rows := readRows()
+	// queries 0 and 2 are to cluster 1, of 3 vectors, and query 1 to cluster 0
+	sizes := []string{"3", "2", "3"}
+	if len(rows) != len(sizes) {
+		t.Fatalf("Expected a row per query, but got %q", rows)
+	}
+	for i, row := range rows {
+		if len(row) != 3 || row[0] != sizes[i] {
+			t.Errorf("Query %d: expected %s vectors and the first 2 scores, but got %q", i, sizes[i], row)
+			continue
+		}
+		for id, score := range row[1:] {
+			if expected := ranked[i][fmt.Sprint(id)]; score != expected {
+				t.Errorf("Query %d: expected score %s for vector %d, but got %s", i, expected, id, score)
+			}
+		}
+	}
+}
+
+func TestRunRawNorms(t *testing.T) {
+	preamble := writeFixture(t, nil)
+
+	cfg := defaultConfig()
+	cfg.preamble, cfg.topK, cfg.withNorms, cfg.rawNorms = preamble, "1", true, true
+	if err := run(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := os.ReadFile(preamble + "_results.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the norms of the vectors of the cluster files, not of their quantized copies
+	expected := fmt.Sprintf("1,0,0.9\n0,0,0.9\n1,2,%g\n", math.Sqrt(0.6*0.6*2))
+	if string(results) != expected {
+		t.Errorf("Expected %q, but got %q", expected, results)
+	}
+}
+
+func TestRunPlan(t *testing.T) {
+	preamble := writeFixture(t, map[string]string{"_results.csv": "earlier results\n"})
+	// -plan needs neither the queries nor the clusters
+	for _, suffix := range []string{"_query.csv", "_cluster_0.csv", "_cluster_1.csv"} {
+		if err := os.Remove(preamble + suffix); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.preamble, cfg.plan = preamble, true
+	if err := run(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if results, err := os.ReadFile(preamble + "_results.csv"); err != nil || string(results) != "earlier results\n" {
+		t.Errorf("Expected -plan to leave the earlier results alone, but got %q and %v", results, err)
+	}
+	if _, err := os.Stat(preamble + "_perf.csv"); !os.IsNotExist(err) {
+		t.Errorf("Expected -plan not to create a performance file, but got %v", err)
+	}
+}
+
+func TestRunExplain(t *testing.T) {
+	preamble := writeFixture(t, map[string]string{"_results.csv": "earlier results\n"})
+
+	cfg := defaultConfig()
+	cfg.preamble, cfg.explain = preamble, 1
+	if err := run(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if results, err := os.ReadFile(preamble + "_results.csv"); err != nil || string(results) != "earlier results\n" {
+		t.Errorf("Expected -explain to leave the earlier results alone, but got %q and %v", results, err)
+	}
+	if _, err := os.Stat(preamble + "_perf.csv"); !os.IsNotExist(err) {
+		t.Errorf("Expected -explain not to create a performance file, but got %v", err)
+	}
+}
+
+func TestRunQueryFilesShuffledWithIDs(t *testing.T) {
+	// the second file is longer, so that its query indices must start again
+	preamble := writeFixture(t, map[string]string{
+		"_qa.csv": "1,0,0,0.8,0.1,a0\n0,0.7,-0.1,0,0,a1\n",
+		"_qb.csv": "1,0,0,-0.5,-0.5,b0\n1,0,0,0.8,0.1,b1\n0,0.7,-0.1,0,0,b2\n",
+	})
+	for _, concurrency := range []int{1, 2} {
+		cfg := defaultConfig()
+		cfg.preamble, cfg.query, cfg.topK, cfg.concurrency = preamble, preamble+"_q?.csv", "1", concurrency
+		cfg.withQueryID, cfg.extraColumns, cfg.queryIDColumn = true, true, 5
+		cfg.shuffle, cfg.shuffleSeed = true, 3
+		if err := run(cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, file := range []struct {
+			name string
+			top1 map[string]string
+		}{
+			{"_qa", map[string]string{"a0": "1,0", "a1": "0,0"}},
+			{"_qb", map[string]string{"b0": "1,2", "b1": "1,0", "b2": "0,0"}},
+		} {
+			results, err := os.ReadFile(preamble + file.name + "_results.csv")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, err := csv.NewReader(bytes.NewReader(results)).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != len(file.top1) {
+				t.Fatalf("-concurrency=%d: expected a row per query of %s, but got %q", concurrency, file.name, results)
+			}
+			for _, row := range rows {
+				if top1, ok := file.top1[row[0]]; !ok || row[1]+","+row[2] != top1 {
+					t.Errorf("-concurrency=%d: expected query %s of %s to find %s, but got %q", concurrency, row[0], file.name, top1, row)
+				}
+			}
+		}
+	}
+}
+
+func TestRunDedupAllCopies(t *testing.T) {
+	// vectors 0 and 2 of cluster 0 are the same, and closest to the first query
+	preamble := writeFixture(t, map[string]string{
+		"_metadata.json": `{"num_vectors": 6, "num_clusters": 2, "dim": 4}`,
+		"_cluster_0.csv": "0.9,0,0,0\n0,0.9,0,0\n0.9,0,0,0\n",
+		"_query.csv":     "0,1,0,0,0\n0,0,1,0,0\n",
+	})
+	for _, tc := range []struct {
+		allCopies bool
+		expected  []string
+	}{
+		{false, []string{"0,0", "0,1"}},
+		{true, []string{"0,0,0,2", "0,1"}},
+	} {
+		cfg := defaultConfig()
+		cfg.preamble, cfg.topK, cfg.deduplicate, cfg.allCopies = preamble, "1", true, tc.allCopies
+		if err := run(cfg); err != nil {
+			t.Fatal(err)
+		}
+		results, err := os.ReadFile(preamble + "_results.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Split(strings.TrimSpace(string(results)), "\n"); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("-allCopies=%t: expected the results %q, but got %q", tc.allCopies, tc.expected, got)
+		}
+	}
+}
+
+func TestRunExactRerankCandidates(t *testing.T) {
+	// the exact vectors of the sidecar reverse the quantized ranking of the
+	// first two vectors for the query
+	preamble := writeFixture(t, map[string]string{
+		"_query.csv": "0,0.7,0.3,0,0\n",
+		"_exact.csv": "0,0,0.1,0,0,0\n0,1,0,1,0,0\n1,0,0,0,0,0\n1,1,0,0,0,0\n1,2,0,0,0,0\n",
+	})
+	for _, tc := range []struct {
+		rerankCandidates int
+		expected         string
+	}{
+		// the top 1 alone can only be reordered
+		{0, "0,0"},
+		{2, "0,1"},
+	} {
+		cfg := defaultConfig()
+		cfg.preamble, cfg.topK, cfg.exactRerank, cfg.rerankCandidates = preamble, "1", preamble+"_exact.csv", tc.rerankCandidates
+		if err := run(cfg); err != nil {
+			t.Fatal(err)
+		}
+		results, err := os.ReadFile(preamble + "_results.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(results)); got != tc.expected {
+			t.Errorf("-rerankCandidates=%d: expected the result %s, but got %s", tc.rerankCandidates, tc.expected, got)
+		}
+	}
+}
+
+func TestRunDiff(t *testing.T) {
+	// the old file has no query IDs, the new one was written with -queryID
+	preamble := writeFixture(t, map[string]string{
+		"_old_results.csv": "1,0\n0,0\n",
+		"_new_results.csv": "1,1,1\n0,1,0\n",
+	})
+	cfg := defaultConfig()
+	cfg.diffQueryID, cfg.diffOutput = "new", preamble+"_diff.csv"
+	cfg.diffOld, cfg.args = preamble+"_old_results.csv", []string{preamble + "_new_results.csv"}
+	if err := run(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := os.ReadFile(preamble + "_diff.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "queryID,jaccard,kendallTau,top1Changed\n0,1,NaN,false\n1,0,NaN,true\n"
+	if string(diff) != expected {
+		t.Errorf("Expected the comparison %q, but got %q", expected, diff)
+	}
+}
+
+func TestLimitProcs(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	all := runtime.GOMAXPROCS(0)
+
+	// by default, neither the cores nor the query files are limited
+	if got := limitProcs(0, 8); got != 8 || runtime.GOMAXPROCS(0) != all {
+		t.Errorf("Expected 8 query files on %d cores, but got %d on %d", all, got, runtime.GOMAXPROCS(0))
+	}
+	if got := limitProcs(2, 8); got != 2 || runtime.GOMAXPROCS(0) != 2 {
+		t.Errorf("Expected 2 query files on 2 cores, but got %d on %d", got, runtime.GOMAXPROCS(0))
+	}
+	if got := limitProcs(3, 1); got != 1 || runtime.GOMAXPROCS(0) != 3 {
+		t.Errorf("Expected 1 query file on 3 cores, but got %d on %d", got, runtime.GOMAXPROCS(0))
+	}
+}
+
+func TestQueryClusterCount(t *testing.T) {
+	// queries routed against a build of 3 clusters, the third of which the
+	// database lacks
+	preamble := writeFixture(t, map[string]string{
+		"_query.csv":         "1,0,0,0.8,0.1\n2,0.7,-0.1,0,0\n0,0.9,0,0,0\n",
+		"_old_metadata.json": `{"num_vectors": 6, "num_clusters": 3, "dim": 4}`,
+	})
+	cfg := defaultConfig()
+	cfg.preamble, cfg.topK, cfg.queryMetadata = preamble, "1", preamble+"_old_metadata.json"
+	if err := run(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := os.ReadFile(preamble + "_results.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "1,0\nerror,\"unknown cluster: cluster 2, of a database of 2 clusters\"\n0,0\n"
+	if string(results) != expected {
+		t.Errorf("Expected %q, but got %q", expected, results)
+	}
+
+	for _, test := range []struct {
+		routed, built uint64
+		want          string
+	}{
+		{2, 2, ""},
+		{2, 5, "clusters 2 to 4 are unreachable"},
+		{5, 2, "queries to clusters 2 to 4 will fail"},
+	} {
+		if got := clusterCountWarning(test.routed, test.built); !strings.Contains(got, test.want) || (test.want == "") != (got == "") {
+			t.Errorf("%d routed, %d built: expected a warning with %q, but got %q", test.routed, test.built, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Binary artifacts are encoded explicitly in little-endian, field by field, so
+// that they load identically on every architecture, unlike native layouts.
+var (
+	clusterMagic  = [4]byte{'T', 'C', 'L', '1'}
+	clustersMagic = [4]byte{'T', 'C', 'S', '1'}
+)
+
+// MarshalBinary encodes a cluster as:
+//
+//	"TCL1" | Index | NumVectors | Dim | PrecBits | Vectors | numIDs | (len | ID)*
+//
+// where integers are little-endian uint64s, Vectors holds one byte per value and
+// numIDs is either 0 or NumVectors. The centroid is not encoded.
+func (c *Cluster) MarshalBinary() ([]byte, error) {
+	if uint64(len(c.Vectors)) != c.NumVectors*c.Dim {
+		return nil, fmt.Errorf("cluster %d has %d values, expected %d", c.Index, len(c.Vectors), c.NumVectors*c.Dim)
+	}
+	if c.ExternalIDs != nil && uint64(len(c.ExternalIDs)) != c.NumVectors {
+		return nil, fmt.Errorf("cluster %d has %d IDs, expected %d", c.Index, len(c.ExternalIDs), c.NumVectors)
+	}
+
+	buf := make([]byte, 0, 4+5*8+len(c.Vectors))
+	buf = append(buf, clusterMagic[:]...)
+	buf = binary.LittleEndian.AppendUint64(buf, c.Index)
+	buf = binary.LittleEndian.AppendUint64(buf, c.NumVectors)
+	buf = binary.LittleEndian.AppendUint64(buf, c.Dim)
+	buf = binary.LittleEndian.AppendUint64(buf, c.PrecBits)
+	for _, v := range c.Vectors {
+		buf = append(buf, byte(v))
+	}
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(c.ExternalIDs)))
+	for _, id := range c.ExternalIDs {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(len(id)))
+		buf = append(buf, id...)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary is the inverse of MarshalBinary
+func (c *Cluster) UnmarshalBinary(buf []byte) error {
+	d := decoder{buf: buf}
+	if magic := d.bytes(4); d.err == nil && string(magic) != string(clusterMagic[:]) {
+		return fmt.Errorf("not a binary cluster")
+	}
+
+	res := Cluster{
+		Index:      d.uint64(),
+		NumVectors: d.uint64(),
+		Dim:        d.uint64(),
+		PrecBits:   d.uint64(),
+	}
+	if d.err == nil && res.Dim != 0 && res.NumVectors > uint64(len(d.buf))/res.Dim {
+		return fmt.Errorf("binary cluster %d is truncated", res.Index)
+	}
+	vectors := d.bytes(res.NumVectors * res.Dim)
+	res.Vectors = make([]int8, len(vectors))
+	for i, v := range vectors {
+		res.Vectors[i] = int8(v)
+	}
+
+	numIDs := d.uint64()
+	if d.err == nil && numIDs != 0 {
+		if numIDs != res.NumVectors {
+			return fmt.Errorf("binary cluster %d has %d IDs, expected %d", res.Index, numIDs, res.NumVectors)
+		}
+		res.ExternalIDs = make([]string, numIDs)
+		for i := range res.ExternalIDs {
+			res.ExternalIDs[i] = string(d.bytes(d.uint64()))
+		}
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.buf) != 0 {
+		return fmt.Errorf("binary cluster %d has %d trailing bytes", res.Index, len(d.buf))
+	}
+	*c = res
+	return nil
+}
+
+// WriteClusters writes the metadata and all clusters as:
+//
+//	"TCS1" | NumVectors | Dim | NumClusters | (len | cluster)*
+//
+// with the clusters encoded by MarshalBinary
+func WriteClusters(w io.Writer, metadata Metadata, clusters []*Cluster) error {
+	if uint64(len(clusters)) != metadata.NumClusters {
+		return fmt.Errorf("got %d clusters, but metadata has %d", len(clusters), metadata.NumClusters)
+	}
+
+	buf := append([]byte{}, clustersMagic[:]...)
+	buf = binary.LittleEndian.AppendUint64(buf, metadata.NumVectors)
+	buf = binary.LittleEndian.AppendUint64(buf, metadata.Dim)
+	buf = binary.LittleEndian.AppendUint64(buf, metadata.NumClusters)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+
+	for _, c := range clusters {
+		enc, err := c.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(enc)))); err != nil {
+			return err
+		}
+		if _, err := w.Write(enc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadClusters reads what WriteClusters wrote
+func ReadClusters(r io.Reader) (Metadata, []*Cluster, error) {
+	header := make([]byte, 4+3*8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Metadata{}, nil, fmt.Errorf("error reading binary clusters header: %w", err)
+	}
+	d := decoder{buf: header}
+	if string(d.bytes(4)) != string(clustersMagic[:]) {
+		return Metadata{}, nil, fmt.Errorf("not a binary clusters file")
+	}
+	metadata := Metadata{
+		NumVectors:  d.uint64(),
+		Dim:         d.uint64(),
+		NumClusters: d.uint64(),
+	}
+
+	clusters := make([]*Cluster, 0)
+	lenBuf := make([]byte, 8)
+	for i := uint64(0); i < metadata.NumClusters; i++ {
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			return Metadata{}, nil, fmt.Errorf("error reading binary cluster %d: %w", i, err)
+		}
+		// copy rather than allocate the length read from the input up front
+		var enc bytes.Buffer
+		if _, err := io.CopyN(&enc, r, int64(binary.LittleEndian.Uint64(lenBuf))); err != nil {
+			return Metadata{}, nil, fmt.Errorf("error reading binary cluster %d: %w", i, err)
+		}
+		c := new(Cluster)
+		if err := c.UnmarshalBinary(enc.Bytes()); err != nil {
+			return Metadata{}, nil, err
+		}
+		if c.Index != i || c.Dim != metadata.Dim {
+			return Metadata{}, nil, fmt.Errorf("binary cluster %d does not match the metadata", i)
+		}
+		clusters = append(clusters, c)
+	}
+	return metadata, clusters, nil
+}
+
+// decoder consumes little-endian values from a buffer, remembering the first error
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) bytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = fmt.Errorf("unexpected end of binary data")
+		return nil
+	}
+	res := d.buf[:n]
+	d.buf = d.buf[n:]
+	return res
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// clusterFixture is the encoding of a cluster with index 2, two 3-dim 5-bit
+// vectors and external IDs. Being spelled out byte by byte, it is what every
+// architecture must produce and accept, whatever its native byte order.
+var clusterFixture = []byte{
+	'T', 'C', 'L', '1',
+	0x02, 0, 0, 0, 0, 0, 0, 0, // Index
+	0x02, 0, 0, 0, 0, 0, 0, 0, // NumVectors
+	0x03, 0, 0, 0, 0, 0, 0, 0, // Dim
+	0x05, 0, 0, 0, 0, 0, 0, 0, // PrecBits
+	0x10, 0xF0, 0x00, 0x03, 0xF9, 0x01, // 16, -16, 0, 3, -7, 1
+	0x02, 0, 0, 0, 0, 0, 0, 0, // number of IDs
+	0x01, 0, 0, 0, 0, 0, 0, 0, 'a',
+	0x02, 0, 0, 0, 0, 0, 0, 0, 'b', 'c',
+}
+
+func TestClusterBinaryFixture(t *testing.T) {
+	expected := &Cluster{
+		Index:       2,
+		NumVectors:  2,
+		Dim:         3,
+		PrecBits:    5,
+		Vectors:     []int8{16, -16, 0, 3, -7, 1},
+		ExternalIDs: []string{"a", "bc"},
+	}
+
+	c := new(Cluster)
+	if err := c.UnmarshalBinary(clusterFixture); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("Expected fixture to decode to %+v, but got %+v", expected, c)
+	}
+
+	enc, err := expected.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(enc, clusterFixture) {
+		t.Errorf("Expected cluster to encode to the fixture %x, but got %x", clusterFixture, enc)
+	}
+
+	for _, n := range []int{0, 3, 20, len(clusterFixture) - 1} {
+		if err := new(Cluster).UnmarshalBinary(clusterFixture[:n]); err == nil {
+			t.Errorf("Expected an error decoding the first %d bytes of the fixture", n)
+		}
+	}
+}
+
+func TestWriteReadClusters(t *testing.T) {
+	metadata := Metadata{NumVectors: 3, Dim: 2, NumClusters: 2}
+	clusters, err := ClustersFromFloats(metadata, [][]float64{{0.5, -0.5, 1, 0}, {-1, 0.25}}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters[1].ExternalIDs = []string{"doc"}
+	// centroids are not part of the binary format
+	for _, c := range clusters {
+		c.Centroid = nil
+	}
+
+	var buf bytes.Buffer
+	if err := WriteClusters(&buf, metadata, clusters); err != nil {
+		t.Fatal(err)
+	}
+	readMetadata, readClusters, err := ReadClusters(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(readMetadata, metadata) || !reflect.DeepEqual(readClusters, clusters) {
+		t.Errorf("Expected to read back %+v %v, but got %+v %v", metadata, clusters, readMetadata, readClusters)
+	}
+}
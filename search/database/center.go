@@ -0,0 +1,88 @@
+package database
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// ComputeMean is the per-dimension mean of the unquantized vectors of the csv
+// cluster files of a preamble, read in a pass of its own since the vectors are
+// quantized as they are read
+func ComputeMean(clusterPreamble string, metadata Metadata) ([]float64, error) {
+	if FindClusterFiles(clusterPreamble) != CsvClusterFiles {
+		return nil, fmt.Errorf("the mean can only be computed from csv cluster files, but %s_cluster_0.csv does not exist", clusterPreamble)
+	}
+	sum := make([]float64, metadata.Dim)
+	numVec := uint64(0)
+	for i := uint64(0); i < metadata.NumClusters; i++ {
+		n, err := sumCsvFile(fmt.Sprintf("%s_cluster_%d.csv", clusterPreamble, i), sum)
+		if err != nil {
+			return nil, err
+		}
+		numVec += n
+	}
+	if numVec == 0 {
+		return nil, fmt.Errorf("all cluster files are empty")
+	}
+	return centroid(sum, numVec), nil
+}
+
+// sumCsvFile adds the rows of a csv file of floats to sum, and returns their number
+func sumCsvFile(file string, sum []float64) (uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(bufio.NewReaderSize(f, DefaultReadBufferSize))
+	reader.FieldsPerRecord = len(sum)
+	n := uint64(0)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", file, err)
+		}
+		for j := range sum {
+			u, err := strconv.ParseFloat(row[j], 64)
+			if err != nil {
+				return 0, fmt.Errorf("%s, line %d: %w", file, n+1, err)
+			}
+			sum[j] += u
+		}
+		n++
+	}
+}
+
+// Centering returns the mean subtracted from the vectors read with opts, or nil
+// if they are not centered: opts.Mean if set, else the mean stored in the
+// metadata, else, with opts.Center, the mean of the corpus
+func (opts ReadOptions) Centering(clusterPreamble string, metadata Metadata) ([]float64, error) {
+	mean := opts.Mean
+	if mean == nil {
+		mean = metadata.Mean
+	}
+	if mean == nil && opts.Center {
+		var err error
+		if mean, err = ComputeMean(clusterPreamble, metadata); err != nil {
+			return nil, fmt.Errorf("error computing the mean: %w", err)
+		}
+	}
+	if mean == nil {
+		return nil, nil
+	}
+	if uint64(len(mean)) != metadata.Dim {
+		return nil, fmt.Errorf("the mean has dimension %d, but the vectors %d", len(mean), metadata.Dim)
+	}
+	if opts.Quantized {
+		return nil, fmt.Errorf("quantized input cannot be centered")
+	}
+	return mean, nil
+}
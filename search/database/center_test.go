@@ -0,0 +1,164 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+)
+
+// topK returns the indices of the k highest scores
+func topK(scores []float64, k int) map[int]bool {
+	idx := make([]int, len(scores))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return scores[idx[a]] > scores[idx[b]] })
+	res := make(map[int]bool)
+	for _, i := range idx[:k] {
+		res[i] = true
+	}
+	return res
+}
+
+// quantizedRecall is the mean recall at k of the quantized vectors of a cluster,
+// quantized after shifting queries and vectors by -mean, against the exact top k
+// of the original, uncentered, float vectors, so that the recall of any mean is
+// measured against the same truth
+func quantizedRecall(c *Cluster, vectors [][]float64, queries [][]float64, mean []float64, k int) float64 {
+	recall := 0.0
+	for _, q := range queries {
+		exact := make([]float64, len(vectors))
+		quantized := make([]float64, len(vectors))
+		for i, v := range vectors {
+			for j := range q {
+				exact[i] += q[j] * v[j]
+				qq := utils.QuantizeClamp(q[j]-mean[j], c.PrecBits)
+				quantized[i] += float64(qq) * float64(c.Vectors[uint64(i)*c.Dim+uint64(j)])
+			}
+		}
+		truth := topK(exact, k)
+		for i := range topK(quantized, k) {
+			if truth[i] {
+				recall++
+			}
+		}
+	}
+	return recall / float64(k*len(queries))
+}
+
+func TestCentering(t *testing.T) {
+	// embeddings sharing a large common component, which saturates the
+	// quantization of most values unless it is subtracted. The variation is
+	// orthogonal to the common component, so that x · mean is the same for
+	// every vector and (q - mean) · (x - mean) ranks the vectors like q · x.
+	const dim, numVectors, numQueries, precBits, k = 16, 300, 50, 5, 10
+	r := rand.New(rand.NewSource(7))
+	offset := make([]float64, dim)
+	offsetNorm := 0.0
+	for j := range offset {
+		offset[j] = 0.6 + 0.3*r.Float64()
+		offsetNorm += offset[j] * offset[j]
+	}
+	sample := func() []float64 {
+		noise := make([]float64, dim)
+		dot := 0.0
+		for j := range noise {
+			noise[j] = 0.15 * r.NormFloat64()
+			dot += noise[j] * offset[j]
+		}
+		v := make([]float64, dim)
+		for j := range v {
+			v[j] = offset[j] + noise[j] - dot/offsetNorm*offset[j]
+		}
+		return v
+	}
+	vectors := make([][]float64, numVectors)
+	var csv strings.Builder
+	for i := range vectors {
+		vectors[i] = sample()
+		for j, u := range vectors[i] {
+			if j > 0 {
+				csv.WriteString(",")
+			}
+			fmt.Fprintf(&csv, "%g", u)
+		}
+		csv.WriteString("\n")
+	}
+	queries := make([][]float64, numQueries)
+	for i := range queries {
+		queries[i] = sample()
+	}
+
+	preamble := filepath.Join(t.TempDir(), "centered")
+	writeTestFile(t, preamble+"_cluster_0.csv", csv.String())
+	writeTestFile(t, preamble+"_metadata.json", fmt.Sprintf(`{"num_vectors": %d, "num_clusters": 1, "dim": %d}`, numVectors, dim))
+
+	metadata, clusters, err := ReadAllClustersWithOptions(preamble, precBits, ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Mean != nil {
+		t.Errorf("Expected no mean without centering, but got %v", metadata.Mean)
+	}
+	raw := quantizedRecall(clusters[0], vectors, queries, make([]float64, dim), k)
+
+	metadata, clusters, err = ReadAllClustersWithOptions(preamble, precBits, ReadOptions{Center: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mean, err := ComputeMean(preamble, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata.Mean) != dim {
+		t.Fatalf("Expected the %d-dim mean in the metadata, but got %v", dim, metadata.Mean)
+	}
+	for j := range mean {
+		if math.Abs(metadata.Mean[j]-mean[j]) > 1e-9 || math.Abs(mean[j]-offset[j]) > 0.05 {
+			t.Errorf("Expected the mean of dimension %d to be %g, but got %g", j, mean[j], metadata.Mean[j])
+		}
+		// the centroid is in the centered scale, like the queries routed with it
+		if math.Abs(clusters[0].Centroid[j]) > 1e-9 {
+			t.Errorf("Expected a centroid of 0 in dimension %d, but got %g", j, clusters[0].Centroid[j])
+		}
+	}
+	centered := quantizedRecall(clusters[0], vectors, queries, metadata.Mean, k)
+
+	t.Logf("recall@%d of %d-bit quantization: %.2f raw, %.2f centered", k, precBits, raw, centered)
+	if centered <= raw {
+		t.Errorf("Expected centering to improve the recall of %.2f, but got %.2f", raw, centered)
+	}
+
+	// a mean stored in the metadata applies without Center, and Mean overrides it
+	if err := WriteMetadata(preamble+"_metadata.json", metadata); err != nil {
+		t.Fatal(err)
+	}
+	stored, storedClusters, err := ReadAllClustersWithOptions(preamble, precBits, ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Mean) != dim || fmt.Sprint(storedClusters[0].Vectors) != fmt.Sprint(clusters[0].Vectors) {
+		t.Errorf("Expected the stored mean to center the vectors")
+	}
+	zero := make([]float64, dim)
+	_, uncentered, err := ReadAllClustersWithOptions(preamble, precBits, ReadOptions{Mean: zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(uncentered[0].Vectors) == fmt.Sprint(clusters[0].Vectors) {
+		t.Errorf("Expected an explicit mean to override the stored one")
+	}
+
+	if _, err := (ReadOptions{Mean: []float64{0}}).Centering(preamble, metadata); err == nil {
+		t.Errorf("Expected a mean of the wrong dimension to be rejected")
+	}
+	if _, err := (ReadOptions{Quantized: true, Center: true}).Centering(preamble, Metadata{Dim: dim, NumClusters: 1}); err == nil {
+		t.Errorf("Expected quantized input to be rejected for centering")
+	}
+}
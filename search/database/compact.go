@@ -0,0 +1,197 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Compaction records how CompactClusters merged clusters: the vectors of
+// original cluster i are vectors Offset[i] to Offset[i]+Sizes[i]-1 of compacted
+// cluster NewCluster[i]. Queries name original clusters, which Translate maps
+// to compacted ones, and results name compacted vectors, which Original maps
+// back.
+type Compaction struct {
+	MinSize    uint64
+	NewCluster []uint64
+	Offset     []uint64
+	Sizes      []uint64
+	// Merged is the number of original clusters merged into others
+	Merged int
+
+	// origins lists, for every compacted cluster, its original clusters by offset
+	origins [][]uint64
+}
+
+// CompactClusters merges the clusters of fewer than minSize vectors into other
+// clusters, to reduce the number of tiny clusters that fragment the columns.
+// Each one goes into the cluster of at least minSize vectors with the closest
+// centroid that stays within maxSize vectors (see ColumnCapacity), so as not to
+// make the columns taller, or else into a catch-all cluster, as do all of them
+// without centroids. The kept clusters are renumbered in their original order,
+// followed by the catch-all clusters, and the vectors of merged clusters are
+// appended to their target in the order of the original clusters.
+//
+// The given clusters are not modified. Merged clusters share their target's
+// bin, so queries to them score more vectors; with ClusterOnly, they also score
+// those of their target.
+func CompactClusters(metadata Metadata, clusters []*Cluster, minSize uint64, maxSize uint64) (Metadata, []*Cluster, *Compaction) {
+	comp := &Compaction{
+		MinSize:    minSize,
+		NewCluster: make([]uint64, len(clusters)),
+		Offset:     make([]uint64, len(clusters)),
+		Sizes:      make([]uint64, len(clusters)),
+	}
+	compacted := make([]*Cluster, 0)
+	for i, c := range clusters {
+		comp.Sizes[i] = c.NumVectors
+		if c.NumVectors >= minSize {
+			comp.NewCluster[i] = uint64(len(compacted))
+			compacted = append(compacted, copyCluster(c, uint64(len(compacted))))
+		}
+	}
+	numKept := len(compacted)
+
+	catchAll := -1
+	for i, c := range clusters {
+		if c.NumVectors >= minSize {
+			continue
+		}
+		target := -1
+		best := 0.0
+		for j := 0; j < numKept && c.Centroid != nil; j++ {
+			if compacted[j].Centroid == nil || compacted[j].NumVectors+c.NumVectors > maxSize {
+				continue
+			}
+			d := 0.0
+			for k, v := range c.Centroid {
+				d += (v - compacted[j].Centroid[k]) * (v - compacted[j].Centroid[k])
+			}
+			if target < 0 || d < best {
+				target, best = j, d
+			}
+		}
+		if target < 0 {
+			if catchAll < 0 || compacted[catchAll].NumVectors+c.NumVectors > maxSize {
+				catchAll = len(compacted)
+				compacted = append(compacted, &Cluster{
+					Index:    uint64(catchAll),
+					Dim:      c.Dim,
+					PrecBits: c.PrecBits,
+					Vectors:  make([]int8, 0),
+				})
+			}
+			target = catchAll
+		}
+
+		comp.NewCluster[i] = uint64(target)
+		comp.Offset[i] = compacted[target].NumVectors
+		mergeCluster(compacted[target], c)
+		comp.Merged++
+	}
+
+	metadata.NumClusters = uint64(len(compacted))
+	comp.index()
+	return metadata, compacted, comp
+}
+
+// copyCluster copies a cluster under a new index, so that merging into it does
+// not modify the original
+func copyCluster(c *Cluster, index uint64) *Cluster {
+	res := *c
+	res.Index = index
+	res.Vectors = append([]int8(nil), c.Vectors...)
+	if c.ExternalIDs != nil {
+		res.ExternalIDs = append([]string(nil), c.ExternalIDs...)
+	}
+	if c.Centroid != nil {
+		res.Centroid = append([]float64(nil), c.Centroid...)
+	}
+	res.Stats = c.Stats.clone()
+	return &res
+}
+
+// mergeCluster appends the vectors of src to dst. The centroid of dst becomes
+// the mean of both, or nil if either has none, and its statistics those of
+// both, of the kinds both have. If either has external IDs, the vectors of the
+// other get empty ones.
+func mergeCluster(dst *Cluster, src *Cluster) {
+	if src.ExternalIDs != nil || dst.ExternalIDs != nil {
+		if dst.ExternalIDs == nil {
+			dst.ExternalIDs = make([]string, dst.NumVectors)
+		}
+		if src.ExternalIDs != nil {
+			dst.ExternalIDs = append(dst.ExternalIDs, src.ExternalIDs...)
+		} else {
+			dst.ExternalIDs = append(dst.ExternalIDs, make([]string, src.NumVectors)...)
+		}
+	}
+	if dst.NumVectors == 0 && dst.Stats == nil {
+		dst.Stats = src.Stats.clone()
+	} else {
+		dst.Stats = mergeStats(dst.Stats, dst.NumVectors, dst.Centroid, src.Stats, src.NumVectors, src.Centroid)
+	}
+	if dst.NumVectors == 0 && dst.Centroid == nil {
+		// a new catch-all cluster takes the centroid of its first cluster
+		dst.Centroid = append([]float64(nil), src.Centroid...)
+	} else if dst.Centroid != nil && src.Centroid != nil && dst.NumVectors+src.NumVectors > 0 {
+		total := float64(dst.NumVectors + src.NumVectors)
+		for k := range dst.Centroid {
+			dst.Centroid[k] = (dst.Centroid[k]*float64(dst.NumVectors) + src.Centroid[k]*float64(src.NumVectors)) / total
+		}
+	} else {
+		dst.Centroid = nil
+	}
+	dst.Vectors = append(dst.Vectors, src.Vectors...)
+	dst.NumVectors += src.NumVectors
+}
+
+// index builds the origins of the compacted clusters
+func (c *Compaction) index() {
+	numClusters := uint64(0)
+	for _, n := range c.NewCluster {
+		if n+1 > numClusters {
+			numClusters = n + 1
+		}
+	}
+	c.origins = make([][]uint64, numClusters)
+	for i, n := range c.NewCluster {
+		c.origins[n] = append(c.origins[n], uint64(i))
+	}
+	// a small cluster merged into a kept cluster of a higher index follows it,
+	// so the index does not give the order of the offsets
+	for _, origins := range c.origins {
+		sort.SliceStable(origins, func(a, b int) bool {
+			return c.Offset[origins[a]] < c.Offset[origins[b]]
+		})
+	}
+}
+
+// Translate returns the compacted cluster holding the vectors of an original one
+func (c *Compaction) Translate(cluster uint64) (uint64, error) {
+	if cluster >= uint64(len(c.NewCluster)) {
+		return 0, fmt.Errorf("cluster %d does not exist, there were %d clusters before compaction", cluster, len(c.NewCluster))
+	}
+	return c.NewCluster[cluster], nil
+}
+
+// Original returns the original cluster and index within it of a vector of a
+// compacted cluster
+func (c *Compaction) Original(cluster uint64, id uint64) (uint64, uint64) {
+	if cluster >= uint64(len(c.origins)) {
+		panic(fmt.Sprintf("Compacted cluster %d does not exist", cluster))
+	}
+	origins := c.origins[cluster]
+	// the original cluster with the last offset at or before id; empty ones,
+	// which share the offset of the next cluster, are skipped
+	k := sort.Search(len(origins), func(k int) bool { return c.Offset[origins[k]] > id })
+	for k--; k >= 0; k-- {
+		i := origins[k]
+		if id < c.Offset[i]+c.Sizes[i] {
+			return i, id - c.Offset[i]
+		}
+		if c.Sizes[i] > 0 {
+			break
+		}
+	}
+	panic(fmt.Sprintf("Vector %d of compacted cluster %d has no original", id, cluster))
+}
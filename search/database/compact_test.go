@@ -0,0 +1,113 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompactClusters(t *testing.T) {
+	dim := uint64(2)
+	// two large clusters far apart, and small ones next to one of them
+	sizes := []int{10, 1, 12, 2, 0, 3}
+	centers := [][]float64{{0.5, 0.5}, {0.4, 0.5}, {-0.5, -0.5}, {-0.4, -0.5}, {0, 0}, {0.5, 0.4}}
+	floats := make([][]float64, len(sizes))
+	numVectors := 0
+	for i, sz := range sizes {
+		for j := 0; j < sz; j++ {
+			floats[i] = append(floats[i], centers[i][0]+float64(j)/100, centers[i][1])
+		}
+		numVectors += sz
+	}
+	metadata := Metadata{NumVectors: uint64(numVectors), Dim: dim, NumClusters: uint64(len(sizes))}
+	clusters, err := ClustersFromFloats(metadata, floats, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters[5].ExternalIDs = []string{"a", "b", "c"}
+	original := make([][]int8, len(clusters))
+	for i, c := range clusters {
+		original[i] = make([]int8, len(c.Vectors))
+		copy(original[i], c.Vectors)
+	}
+
+	newMetadata, compacted, comp := CompactClusters(metadata, clusters, 5, 100)
+	if newMetadata.NumClusters != 2 || len(compacted) != 2 || comp.Merged != 4 {
+		t.Fatalf("Expected 4 clusters merged into 2, but got %d clusters (%d merged)", len(compacted), comp.Merged)
+	}
+	// the centroid of the empty cluster is 0, closer to that of cluster 2
+	if expected := []uint64{0, 0, 1, 1, 1, 0}; !reflect.DeepEqual(comp.NewCluster, expected) {
+		t.Errorf("Expected the small clusters to join the closest large one, %v, but got %v", expected, comp.NewCluster)
+	}
+	for i, c := range clusters {
+		if !reflect.DeepEqual(c.Vectors, original[i]) || c.Index != uint64(i) {
+			t.Fatalf("Compaction modified original cluster %d", i)
+		}
+	}
+
+	// every original vector is found where the compaction says, and maps back
+	total := uint64(0)
+	for i, c := range clusters {
+		n, err := comp.Translate(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id := uint64(0); id < c.NumVectors; id++ {
+			at := comp.Offset[i] + id
+			if !reflect.DeepEqual(compacted[n].Vectors[at*dim:(at+1)*dim], c.Vectors[id*dim:(id+1)*dim]) {
+				t.Errorf("Vector %d of cluster %d is not vector %d of compacted cluster %d", id, i, at, n)
+			}
+			if oc, oid := comp.Original(n, at); oc != uint64(i) || oid != id {
+				t.Errorf("Vector %d of compacted cluster %d maps back to (%d, %d), expected (%d, %d)", at, n, oc, oid, i, id)
+			}
+		}
+	}
+	for _, c := range compacted {
+		total += c.NumVectors
+		if uint64(len(c.Vectors)) != c.NumVectors*dim {
+			t.Errorf("Compacted cluster %d has %d values for %d vectors", c.Index, len(c.Vectors), c.NumVectors)
+		}
+	}
+	if total != uint64(numVectors) {
+		t.Errorf("Expected %d vectors after compaction, but got %d", numVectors, total)
+	}
+	if ids := compacted[0].ExternalIDs; len(ids) != int(compacted[0].NumVectors) || ids[len(ids)-1] != "c" || ids[0] != "" {
+		t.Errorf("Expected the external IDs of merged clusters to follow empty ones, but got %v", ids)
+	}
+	if _, err := comp.Translate(uint64(len(clusters))); err == nil {
+		t.Errorf("Expected an error translating a cluster that does not exist")
+	}
+
+	// without room in the large clusters, small ones go to catch-all clusters
+	_, compacted, comp = CompactClusters(metadata, clusters, 5, 12)
+	if expected := []uint64{0, 0, 1, 2, 1, 2}; !reflect.DeepEqual(comp.NewCluster, expected) {
+		t.Errorf("Expected a catch-all cluster for clusters 3 and 5, %v, but got %v", expected, comp.NewCluster)
+	}
+	for _, c := range compacted {
+		if c.NumVectors > 12 {
+			t.Errorf("Compacted cluster %d has %d vectors, more than the maximum of 12", c.Index, c.NumVectors)
+		}
+	}
+
+	// a small cluster joins a kept cluster of a higher index, after its vectors
+	low, err := ClustersFromFloats(Metadata{NumVectors: 8, Dim: dim, NumClusters: 3}, [][]float64{
+		{0.5, 0.5, 0.51, 0.5},
+		{},
+		{0.5, 0.5, 0.5, 0.49, 0.5, 0.48, 0.5, 0.47, 0.5, 0.46, 0.5, 0.45},
+	}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, lowComp := CompactClusters(Metadata{NumVectors: 8, Dim: dim, NumClusters: 3}, low, 5, 100)
+	if expected := []uint64{0, 0, 0}; !reflect.DeepEqual(lowComp.NewCluster, expected) || lowComp.Offset[0] != 6 {
+		t.Fatalf("Expected clusters 0 and 1 to follow cluster 2, but got clusters %v at offsets %v", lowComp.NewCluster, lowComp.Offset)
+	}
+	for at := uint64(0); at < 8; at++ {
+		expectedCluster, expectedID := uint64(2), at
+		if at >= 6 {
+			expectedCluster, expectedID = 0, at-6
+		}
+		if oc, oid := lowComp.Original(0, at); oc != expectedCluster || oid != expectedID {
+			t.Errorf("Vector %d of the compacted cluster maps back to (%d, %d), expected (%d, %d)", at, oc, oid, expectedCluster, expectedID)
+		}
+	}
+}
@@ -1,14 +1,19 @@
 package database
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/DeweiFeng/6.5610-project/search/utils"
 	"github.com/henrycg/simplepir/lwe"
@@ -19,15 +24,131 @@ import (
 
 type ClusterMap map[uint]uint64
 
+// MarshalDeterministic serializes the map as little-endian (cluster, index) pairs
+// sorted by cluster. Unlike gob, the output only depends on the map's contents,
+// so it can be used to size, hash or compare hints across runs.
+func (cm ClusterMap) MarshalDeterministic() []byte {
+	keys := make([]uint, 0, len(cm))
+	for k := range cm {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+
+	buf := make([]byte, 16*len(keys))
+	for i, k := range keys {
+		binary.LittleEndian.PutUint64(buf[16*i:], uint64(k))
+		binary.LittleEndian.PutUint64(buf[16*i+8:], cm[k])
+	}
+	return buf
+}
+
+// UnmarshalClusterMap is the inverse of ClusterMap.MarshalDeterministic
+func UnmarshalClusterMap(buf []byte) (ClusterMap, error) {
+	if len(buf)%16 != 0 {
+		return nil, fmt.Errorf("invalid cluster map encoding of length %d", len(buf))
+	}
+
+	cm := make(ClusterMap, len(buf)/16)
+	for i := 0; i < len(buf); i += 16 {
+		cm[uint(binary.LittleEndian.Uint64(buf[i:]))] = binary.LittleEndian.Uint64(buf[i+8:])
+	}
+	return cm, nil
+}
+
 // DBIndex calculates the index of an element in the database
 func DBIndex(row, col, m uint64) uint64 {
 	return row*m + col
 }
 
+// ClusterLayout describes where a cluster is stored in the database
+type ClusterLayout struct {
+	Cluster    uint64
+	NumVectors uint64
+	PrecBits   uint64
+	// Column is the first database column of the cluster's bin, which spans dim columns
+	Column uint64
+	// the cluster occupies rows [StartRow, StartRow+NumVectors)
+	StartRow uint64
+	// PaddingRows counts the zero rows right below the cluster, up to the next
+	// cluster of the bin or the bottom of the database. Full-search scores them
+	// as 0 and attributes them to this cluster.
+	PaddingRows uint64
+	// BinClusters lists the clusters of the bin from top to bottom
+	BinClusters []uint
+	// BinVectors is the number of vectors stored in the bin, while every query
+	// of the bin scores all rows of the database
+	BinVectors uint64
+	Rows       uint64
+}
+
+// Layout locates a cluster in a database of l rows and m columns built with cm
+func (cm ClusterMap) Layout(clusters []*Cluster, l uint64, m uint64, clusterIndex uint64) (*ClusterLayout, error) {
+	dbIndex, ok := cm[uint(clusterIndex)]
+	if !ok || clusterIndex >= uint64(len(clusters)) {
+		return nil, fmt.Errorf("cluster %d is not in the database", clusterIndex)
+	}
+
+	layout := &ClusterLayout{
+		Cluster:    clusterIndex,
+		NumVectors: clusters[clusterIndex].NumVectors,
+		PrecBits:   clusters[clusterIndex].PrecBits,
+		Column:     dbIndex % m,
+		StartRow:   dbIndex / m,
+		Rows:       l,
+	}
+
+	// find the other clusters of the bin, ordered by their starting row
+	nextRow := l
+	for c, idx := range cm {
+		if idx%m != layout.Column {
+			continue
+		}
+		layout.BinClusters = append(layout.BinClusters, c)
+		layout.BinVectors += clusters[c].NumVectors
+		if row := idx / m; row > layout.StartRow && row < nextRow {
+			nextRow = row
+		}
+	}
+	sort.Slice(layout.BinClusters, func(i, j int) bool {
+		return cm[layout.BinClusters[i]] < cm[layout.BinClusters[j]]
+	})
+	layout.PaddingRows = nextRow - layout.StartRow - layout.NumVectors
+
+	return layout, nil
+}
+
+func (cl *ClusterLayout) String() string {
+	return fmt.Sprintf("cluster %d: %d vectors of %d bits at rows [%d, %d) of the bin at column %d, followed by %d padding rows\n"+
+		"bin: clusters %v, %d vectors in %d rows",
+		cl.Cluster, cl.NumVectors, cl.PrecBits, cl.StartRow, cl.StartRow+cl.NumVectors, cl.Column, cl.PaddingRows,
+		cl.BinClusters, cl.BinVectors, cl.Rows)
+}
+
 type Metadata struct {
 	NumVectors  uint64 `json:"num_vectors"`
 	Dim         uint64 `json:"dim"`
 	NumClusters uint64 `json:"num_clusters"`
+	// Mean, if set, is the per-dimension mean subtracted from the vectors before
+	// they were quantized, which clients subtract from queries as well
+	Mean []float64 `json:"mean,omitempty"`
+}
+
+// DefaultMaxDim is the largest dimension accepted by default. Every column of
+// the database is dim values wide, so a mis-specified dimension would attempt
+// an absurd allocation rather than fail.
+const DefaultMaxDim = 4096
+
+// ValidateDim checks that the dimension is at most maxDim, or DefaultMaxDim if 0
+func (m Metadata) ValidateDim(maxDim uint64) error {
+	if maxDim == 0 {
+		maxDim = DefaultMaxDim
+	}
+	if m.Dim > maxDim {
+		return fmt.Errorf("dimension %d exceeds the maximum of %d, raise the maximum if the vectors really have that many dimensions", m.Dim, maxDim)
+	}
+	return nil
 }
 
 type Cluster struct {
@@ -36,21 +157,173 @@ type Cluster struct {
 	Dim        uint64
 	PrecBits   uint64
 	Vectors    []int8
+
+	// ExternalIDs optionally holds an application ID for every vector. It is a
+	// plaintext side table, not part of the PIR database.
+	ExternalIDs []string
+
+	// Centroid is the mean of the vectors before quantization, in the scale of the
+	// raw queries, for routing queries to clusters. It is nil for clusters that
+	// were not read from floats, e.g., deserialized ones.
+	Centroid []float64
+
+	// Stats holds the statistics requested with ReadOptions.Stats, gathered in
+	// the same pass as the centroid, or nil if none were
+	Stats *ClusterStats
+}
+
+// VectorNorm is the L2 norm of a stored vector, dequantized to the scale of the
+// raw vectors. With unit-norm inputs, it differs from 1 by the quantization error.
+func (c *Cluster) VectorNorm(id uint64) float64 {
+	if id >= c.NumVectors {
+		panic(fmt.Sprintf("Vector %d of cluster %d does not exist", id, c.Index))
+	}
+	sum := 0.0
+	for _, v := range c.Vectors[id*c.Dim : (id+1)*c.Dim] {
+		u := utils.Dequantize(v, c.PrecBits)
+		sum += u * u
+	}
+	return math.Sqrt(sum)
 }
 
-func ReadClusterFromCsv(file string, index uint64, dim uint64, precBits uint64) *Cluster {
+// validateUniformDim checks that every cluster has the expected dimension and
+// holds that many values per vector, which the packing of BuildVectorDatabase
+// relies on, reporting the first cluster that does not
+func validateUniformDim(clusters []*Cluster, expected uint64) error {
+	for i, c := range clusters {
+		if c.Dim != expected {
+			return fmt.Errorf("cluster %d has dimension %d, expected %d", i, c.Dim, expected)
+		}
+		if uint64(len(c.Vectors)) != c.NumVectors*expected {
+			return fmt.Errorf("cluster %d has %d values, expected %d for %d vectors of dimension %d", i, len(c.Vectors), c.NumVectors*expected, c.NumVectors, expected)
+		}
+	}
+	return nil
+}
+
+// centroid divides the sum of n vectors by n; the centroid of an empty cluster is 0
+func centroid(sum []float64, n uint64) []float64 {
+	if n > 0 {
+		for j := range sum {
+			sum[j] /= float64(n)
+		}
+	}
+	return sum
+}
+
+// ReadClusterIDs reads one external ID per line
+func ReadClusterIDs(file string) ([]string, error) {
 	f, err := os.Open(file)
 	if err != nil {
-		fmt.Println(err)
-		panic("Error opening file " + file)
+		return nil, err
 	}
 	defer f.Close()
 
 	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = 1
+
+	ids := make([]string, 0)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading ID file %s: %w", file, err)
+		}
+		ids = append(ids, row[0])
+	}
+	return ids, nil
+}
+
+// ReadOptions controls how cluster files are parsed
+type ReadOptions struct {
+	// Quantized means the files already hold quantized integers, which are read
+	// as is instead of being quantized again. They must lie in the range of
+	// QuantizeClamp for the given precBits. Only csv files support it.
+	Quantized bool
+	// BufferSize is the size in bytes of the read buffer of csv files, or
+	// DefaultReadBufferSize if 0. Wide rows span many reads of the 4 KB buffer
+	// csv.Reader uses on its own.
+	BufferSize int
+	// MaxDim is the largest dimension of the metadata accepted, or
+	// DefaultMaxDim if 0
+	MaxDim uint64
+	// Mean is subtracted from every vector before it is quantized, see
+	// Centering. Only csv files support it.
+	Mean []float64
+	// Center centers the vectors on the mean of the corpus, unless Mean or the
+	// metadata holds one
+	Center bool
+	// Quantizer quantizes the values, if set, instead of QuantizeClamp with the
+	// given precBits, which must be its Bits. Only csv files support it.
+	Quantizer utils.Quantizer
+	// Stats are the statistics of the vectors gathered as they are read, into
+	// Cluster.Stats. Only csv files support them.
+	Stats StatKind
+}
+
+// quantizer is the quantizer of the values read with precBits
+func (opts ReadOptions) quantizer(precBits uint64) (utils.Quantizer, error) {
+	if opts.Quantizer == nil {
+		return utils.LinearQuantizer{PrecBits: precBits}, nil
+	}
+	if opts.Quantizer.Bits() != precBits {
+		return nil, fmt.Errorf("the quantizer takes %d bits, but the vectors are read with %d", opts.Quantizer.Bits(), precBits)
+	}
+	return opts.Quantizer, nil
+}
+
+// DefaultReadBufferSize is the read buffer size of csv cluster files by default
+const DefaultReadBufferSize = 1 << 20
+
+// ReadClusterFromCsv reads and quantizes a cluster from a csv file of one vector
+// of dim values per row. It fails, naming the file and the row, on a file that
+// cannot be read or a value that cannot be parsed.
+func ReadClusterFromCsv(file string, index uint64, dim uint64, precBits uint64) (*Cluster, error) {
+	return ReadClusterFromCsvWithOptions(file, index, dim, precBits, ReadOptions{})
+}
+
+// parseQuantized parses an already quantized value, checking that QuantizeClamp
+// could have produced it
+func parseQuantized(s string, precBits uint64) (int8, error) {
+	v, err := utils.StringToInt8(s)
+	if err != nil {
+		return 0, err
+	}
+	bound := 1 << (precBits - 1)
+	if int(v) < -bound || int(v) > bound {
+		return 0, fmt.Errorf("value %d out of range [%d, %d] for %d bits", v, -bound, bound, precBits)
+	}
+	return v, nil
+}
+
+// ReadClusterFromCsvWithOptions is ReadClusterFromCsv with options
+func ReadClusterFromCsvWithOptions(file string, index uint64, dim uint64, precBits uint64, opts ReadOptions) (*Cluster, error) {
+	if opts.Mean != nil && (opts.Quantized || uint64(len(opts.Mean)) != dim) {
+		return nil, fmt.Errorf("cannot center %s on a mean of dimension %d", file, len(opts.Mean))
+	}
+	quantizer, err := opts.quantizer(precBits)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", file, err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("opening cluster file: %w", err)
+	}
+	defer f.Close()
+
+	bufferSize := opts.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultReadBufferSize
+	}
+	reader := csv.NewReader(bufio.NewReaderSize(f, bufferSize))
 
 	reader.FieldsPerRecord = int(dim)
 
 	vectors := make([]int8, 0)
+	acc := NewStatsAccumulator(dim, opts.Stats)
+	raw := make([]float64, dim)
 	// read line by line, append each line (which is a vector) to vectors
 	numVec := 0
 	for {
@@ -59,149 +332,760 @@ func ReadClusterFromCsv(file string, index uint64, dim uint64, precBits uint64)
 			break
 		}
 		if err != nil {
-			panic("Error reading CSV file " + file)
+			return nil, fmt.Errorf("parsing %s row %d: %w", file, numVec+1, err)
 		}
 		for j := 0; j < int(dim); j++ {
+			if opts.Quantized {
+				v, err := parseQuantized(row[j], precBits)
+				if err != nil {
+					return nil, fmt.Errorf("parsing %s row %d: %w", file, numVec+1, err)
+				}
+				vectors = append(vectors, v)
+				raw[j] = utils.Dequantize(v, precBits)
+				continue
+			}
 			u, err := strconv.ParseFloat(row[j], 64)
 			if err != nil {
-				panic("Error parsing CSV embeddings" + file)
+				return nil, fmt.Errorf("parsing %s row %d: %w", file, numVec+1, err)
+			}
+			if opts.Mean != nil {
+				u -= opts.Mean[j]
 			}
-			vectors = append(vectors, utils.QuantizeClamp(u, precBits))
+			vectors = append(vectors, quantizer.Quantize(u))
+			raw[j] = u
 		}
+		acc.Add(raw)
 		numVec++
 	}
 	if len(vectors) != int(numVec)*int(dim) {
-		panic("Error reading CSV file " + file + " -- length of vectors does not match")
+		return nil, fmt.Errorf("reading %s: %d values for %d vectors of dimension %d", file, len(vectors), numVec, dim)
 	}
-	return &Cluster{
+	c := &Cluster{
 		Index:      index,
 		NumVectors: uint64(numVec),
 		Dim:        uint64(dim),
 		PrecBits:   uint64(precBits),
 		Vectors:    vectors,
 	}
+	acc.apply(c)
+	return c, nil
+}
+
+// NewClusterFromFloats quantizes the vectors of a cluster, given back to back in
+// a single slice, exactly like ReadClusterFromCsv quantizes the rows of a file.
+// It fails if the number of values is not a multiple of the dimension.
+func NewClusterFromFloats(index uint64, vectors []float64, dim uint64, precBits uint64) (*Cluster, error) {
+	return NewClusterFromFloatsWith(index, vectors, dim, utils.LinearQuantizer{PrecBits: precBits})
+}
+
+// NewClusterFromFloatsWith is like NewClusterFromFloats, with any quantizer
+func NewClusterFromFloatsWith(index uint64, vectors []float64, dim uint64, q utils.Quantizer) (*Cluster, error) {
+	if dim == 0 {
+		return nil, fmt.Errorf("cluster %d: the dimension must be positive", index)
+	}
+	if uint64(len(vectors))%dim != 0 {
+		return nil, fmt.Errorf("cluster %d has %d values, which is not a multiple of the dimension %d", index, len(vectors), dim)
+	}
+
+	quantized := make([]int8, len(vectors))
+	acc := NewStatsAccumulator(dim, 0)
+	for i, v := range vectors {
+		quantized[i] = q.Quantize(v)
+		if uint64(i+1)%dim == 0 {
+			acc.Add(vectors[uint64(i+1)-dim : i+1])
+		}
+	}
+	c := &Cluster{
+		Index:      index,
+		NumVectors: uint64(len(vectors)) / dim,
+		Dim:        dim,
+		PrecBits:   q.Bits(),
+		Vectors:    quantized,
+	}
+	acc.apply(c)
+	return c, nil
+}
+
+// ClustersFromFloats quantizes in-memory clusters, the i-th of which holds the
+// vectors of cluster i back to back, and checks them against the metadata like
+// ReadAllClusters does, returning an error on a mismatch
+func ClustersFromFloats(metadata Metadata, clusters [][]float64, precBits uint64) ([]*Cluster, error) {
+	if uint64(len(clusters)) != metadata.NumClusters {
+		return nil, fmt.Errorf("got %d clusters, but the metadata has %d", len(clusters), metadata.NumClusters)
+	}
+
+	res := make([]*Cluster, len(clusters))
+	vecCountVeri := uint64(0)
+	for i, vectors := range clusters {
+		var err error
+		if res[i], err = NewClusterFromFloats(uint64(i), vectors, metadata.Dim, precBits); err != nil {
+			return nil, err
+		}
+		vecCountVeri += res[i].NumVectors
+	}
+	if vecCountVeri != metadata.NumVectors {
+		return nil, fmt.Errorf("got %d vectors, but the metadata has %d", vecCountVeri, metadata.NumVectors)
+	}
+	return res, nil
+}
+
+// JsonlRecord is one line of a JSONL embeddings file
+type JsonlRecord struct {
+	ClusterID *uint64   `json:"clusterId"`
+	Embedding []float64 `json:"embedding"`
+}
+
+// readJsonl calls f on every record of a JSONL embeddings file, with both the raw
+// and the quantized embedding, stopping at the first error
+func readJsonl(file string, dim uint64, precBits uint64, f func(line int, clusterID *uint64, raw []float64, vec []int8) error) error {
+	jsonlFile, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("opening cluster file: %w", err)
+	}
+	defer jsonlFile.Close()
+
+	scanner := bufio.NewScanner(jsonlFile)
+	scanner.Buffer(make([]byte, 0, 1<<20), 1<<30)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record JsonlRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("parsing %s line %d: %w", file, line, err)
+		}
+		if uint64(len(record.Embedding)) != dim {
+			return fmt.Errorf("reading %s line %d: expected %d dimensions, got %d", file, line, dim, len(record.Embedding))
+		}
+		vec := make([]int8, dim)
+		for j, u := range record.Embedding {
+			vec[j] = utils.QuantizeClamp(u, precBits)
+		}
+		if err := f(line, record.ClusterID, record.Embedding, vec); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading %s: %w", file, err)
+	}
+	return nil
+}
+
+// ReadClusterFromJsonl reads a single cluster from a JSONL file where each line is
+// {"clusterId": n, "embedding": [floats]}. The cluster id may be omitted, but if
+// present it must match index.
+func ReadClusterFromJsonl(file string, index uint64, dim uint64, precBits uint64) (*Cluster, error) {
+	vectors := make([]int8, 0)
+	acc := NewStatsAccumulator(dim, 0)
+	numVec := uint64(0)
+	err := readJsonl(file, dim, precBits, func(line int, clusterID *uint64, raw []float64, vec []int8) error {
+		if clusterID != nil && *clusterID != index {
+			return fmt.Errorf("reading %s line %d: expected cluster %d, got %d", file, line, index, *clusterID)
+		}
+		vectors = append(vectors, vec...)
+		acc.Add(raw)
+		numVec++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cluster{
+		Index:      index,
+		NumVectors: numVec,
+		Dim:        dim,
+		PrecBits:   precBits,
+		Vectors:    vectors,
+	}
+	acc.apply(c)
+	return c, nil
 }
 
-func PackClusters(clusters []*Cluster, maxCapacity uint64) ([][]uint, []uint64) {
+// ReadClustersFromJsonl reads all clusters from a single JSONL file where each
+// line is {"clusterId": n, "embedding": [floats]}. Vectors keep the order in
+// which they appear in the file within their cluster.
+func ReadClustersFromJsonl(file string, numClusters uint64, dim uint64, precBits uint64) ([]*Cluster, error) {
+	clusters := make([]*Cluster, numClusters)
+	accs := make([]*StatsAccumulator, numClusters)
+	for i := uint64(0); i < numClusters; i++ {
+		clusters[i] = &Cluster{
+			Index:    i,
+			Dim:      dim,
+			PrecBits: precBits,
+			Vectors:  make([]int8, 0),
+		}
+		accs[i] = NewStatsAccumulator(dim, 0)
+	}
+
+	err := readJsonl(file, dim, precBits, func(line int, clusterID *uint64, raw []float64, vec []int8) error {
+		if clusterID == nil {
+			return fmt.Errorf("reading %s line %d: missing clusterId", file, line)
+		}
+		if *clusterID >= numClusters {
+			return fmt.Errorf("reading %s line %d: cluster %d out of range, there are %d clusters", file, line, *clusterID, numClusters)
+		}
+		c := clusters[*clusterID]
+		c.Vectors = append(c.Vectors, vec...)
+		accs[*clusterID].Add(raw)
+		c.NumVectors++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, c := range clusters {
+		accs[i].apply(c)
+	}
+	return clusters, nil
+}
+
+// ClusterFiles describes where the clusters of a preamble are stored
+type ClusterFiles int
+
+const (
+	NoClusterFiles ClusterFiles = iota
+	CsvClusterFiles
+	JsonlClusterFiles
+	CombinedJsonlFile
+)
+
+// FindClusterFiles checks which of the supported layouts the clusters of a
+// preamble use: <preamble>_cluster_<i>.csv, <preamble>_cluster_<i>.jsonl, or a
+// single <preamble>_clusters.jsonl. CSV takes precedence.
+func FindClusterFiles(clusterPreamble string) ClusterFiles {
+	if _, err := os.Stat(clusterPreamble + "_cluster_0.csv"); err == nil {
+		return CsvClusterFiles
+	}
+	if _, err := os.Stat(clusterPreamble + "_cluster_0.jsonl"); err == nil {
+		return JsonlClusterFiles
+	}
+	if _, err := os.Stat(clusterPreamble + "_clusters.jsonl"); err == nil {
+		return CombinedJsonlFile
+	}
+	return NoClusterFiles
+}
+
+// DatabaseParams controls how BuildVectorDatabase lays out the clusters
+type DatabaseParams struct {
+	// HintSz is 900 for text embeddings in Tiptoe, and 500 for image embeddings.
+	// Columns are filled up to HintSz*125 vectors.
+	HintSz uint64
+	// MaxColumns, if positive, caps the number of columns, which bounds the width
+	// of the database and thus the hint size. Columns are made taller as needed.
+	MaxColumns uint64
+	// PinnedClusters are given a column each, which they share with no other
+	// cluster, so that the bins of latency-critical clusters hold nothing else.
+	// Pinned columns count towards MaxColumns.
+	PinnedClusters []uint64
+	// BestFit packs every cluster into the column it leaves with the least free
+	// space, instead of the first column with room for it. It tends to fill
+	// columns more evenly, but the layout differs from the default one.
+	BestFit bool
+	// MaxAnswerBytes, if positive, caps the size of an answer in AnswerWire,
+	// which holds a value per row: columns are filled up to the rows that fit, and
+	// building fails if the largest cluster, or MaxColumns, needs more rows. In
+	// utils.GobWire, the bound of utils.AnswerSize is held to the budget.
+	MaxAnswerBytes uint64
+	AnswerWire     utils.WireFormat
+}
+
+// ColumnCapacity is the number of vectors up to which columns are filled
+func (params DatabaseParams) ColumnCapacity() uint64 {
+	capacity := params.HintSz * 125
+	if params.MaxAnswerBytes > 0 {
+		if rows := params.MaxAnswerRows(); rows < capacity {
+			capacity = rows
+		}
+	}
+	return capacity
+}
+
+// MaxAnswerRows is the number of rows whose answers fit in MaxAnswerBytes
+func (params DatabaseParams) MaxAnswerRows() uint64 {
+	overhead := utils.AnswerSize(0, params.AnswerWire)
+	if params.MaxAnswerBytes < overhead {
+		return 0
+	}
+	return (params.MaxAnswerBytes - overhead) / (utils.AnswerSize(1, params.AnswerWire) - overhead)
+}
+
+func PackClusters(clusters []*Cluster, maxCapacity uint64, params DatabaseParams) ([][]uint, []uint64) {
+	cols, colSzs, err := PackClustersContext(context.Background(), clusters, maxCapacity, params, nil)
+	if err != nil {
+		panic(err)
+	}
+	return cols, colSzs
+}
+
+// PackClustersContext is PackClusters, cancelled when ctx is done, which
+// returns the errors PackClusters panics on. If progress is not nil, it is
+// called with the number of clusters placed so far as the packing advances, and
+// at the end of every pass; with MaxColumns, there may be several passes, each
+// starting again from 0.
+func PackClustersContext(ctx context.Context, clusters []*Cluster, maxCapacity uint64, params DatabaseParams, progress func(placed int, total int)) ([][]uint, []uint64, error) {
 	numClusters := uint64(len(clusters))
 	if numClusters == 0 {
-		panic("No clusters given")
+		return nil, nil, fmt.Errorf("no clusters given")
 	}
-	clusterIndices := make([]uint64, numClusters)
+
+	pinned := make(map[uint64]bool)
+	for _, i := range params.PinnedClusters {
+		if i >= numClusters {
+			return nil, nil, fmt.Errorf("pinned cluster %d does not exist", i)
+		}
+		pinned[i] = true
+	}
+	pinnedIndices := make([]uint64, 0, len(pinned))
+	clusterIndices := make([]uint64, 0, numClusters)
 
 	for i := uint64(0); i < numClusters; i++ {
-		clusterIndices[i] = i
+		if pinned[i] {
+			pinnedIndices = append(pinnedIndices, i)
+		} else {
+			clusterIndices = append(clusterIndices, i)
+		}
 	}
 
-	// reverse sort clusterIndices by their size, largest first
-	sort.Slice(clusterIndices, func(i, j int) bool {
-		return clusters[clusterIndices[i]].NumVectors > clusters[clusterIndices[j]].NumVectors
+	// reverse sort clusterIndices by their size, largest first, breaking ties by
+	// cluster index so that the packing, and thus the database, is reproducible
+	sort.SliceStable(clusterIndices, func(i, j int) bool {
+		a, b := clusters[clusterIndices[i]], clusters[clusterIndices[j]]
+		if a.NumVectors != b.NumVectors {
+			return a.NumVectors > b.NumVectors
+		}
+		return a.Index < b.Index
 	})
 
-	fmt.Printf("The longest row has length %d -- max capacity is %d\n", clusters[0].NumVectors, maxCapacity)
+	// pinned clusters come first, alone in their columns
+	pinnedCols := make([][]uint, len(pinnedIndices))
+	pinnedColSzs := make([]uint64, len(pinnedIndices))
+	for j, i := range pinnedIndices {
+		pinnedCols[j] = []uint{uint(clusters[i].Index)}
+		pinnedColSzs[j] = clusters[i].NumVectors
+	}
+	if len(clusterIndices) == 0 {
+		return pinnedCols, pinnedColSzs, nil
+	}
+
+	maxColumns := params.MaxColumns
+	if maxColumns > 0 {
+		if uint64(len(pinnedIndices)) >= maxColumns {
+			return nil, nil, fmt.Errorf("cannot pack clusters into at most %d columns with %d pinned clusters", maxColumns, len(pinnedIndices))
+		}
+		maxColumns -= uint64(len(pinnedIndices))
+	}
+
+	fmt.Printf("The longest row has length %d -- max capacity is %d\n", clusters[clusterIndices[0]].NumVectors, maxCapacity)
 
 	if clusters[clusterIndices[0]].NumVectors > maxCapacity {
 		maxCapacity = clusters[clusterIndices[0]].NumVectors
 	}
 
-	cols := make([][]uint, 1)
-	cols[0] = []uint{uint(clusters[clusterIndices[0]].Index)}
-	col_szs := []uint64{clusters[clusterIndices[0]].NumVectors}
+	cols, col_szs, err := packColumns(ctx, clusters, clusterIndices, maxCapacity, params.BestFit, progress)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	for i := uint64(1); i < numClusters; i++ {
-		fit := false
-		for j := 0; j < len(cols); j++ {
-			if col_szs[j]+clusters[clusterIndices[i]].NumVectors < maxCapacity {
-				col_szs[j] += clusters[clusterIndices[i]].NumVectors
-				cols[j] = append(cols[j], uint(clusters[clusterIndices[i]].Index))
-				fit = true
-				break
+	if maxColumns > 0 && uint64(len(cols)) > maxColumns {
+		// Binary search for a capacity that packs into few enough columns. A
+		// capacity above the total number of vectors always yields a single column.
+		total := uint64(0)
+		for _, c := range clusters {
+			total += c.NumVectors
+		}
+		lo, hi := maxCapacity, total+1
+		for lo+1 < hi {
+			mid := lo + (hi-lo)/2
+			c, _, err := packColumns(ctx, clusters, clusterIndices, mid, params.BestFit, progress)
+			if err != nil {
+				return nil, nil, err
+			}
+			if uint64(len(c)) <= maxColumns {
+				hi = mid
+			} else {
+				lo = mid
 			}
 		}
 
-		if !fit {
-			new_col := []uint{uint(clusters[clusterIndices[i]].Index)}
-			cols = append(cols, new_col)
-			col_szs = append(col_szs, clusters[clusterIndices[i]].NumVectors)
+		cols, col_szs, err = packColumns(ctx, clusters, clusterIndices, hi, params.BestFit, progress)
+		if err != nil {
+			return nil, nil, err
+		}
+		if uint64(len(cols)) > maxColumns {
+			return nil, nil, fmt.Errorf("cannot pack clusters into at most %d columns", params.MaxColumns)
 		}
+		fmt.Printf("maxColumns=%d forced max capacity from %d to %d (+%d) -- packed into %d columns\n", params.MaxColumns, maxCapacity, hi, hi-maxCapacity, len(cols)+len(pinnedCols))
+	}
+
+	return append(pinnedCols, cols...), append(pinnedColSzs, col_szs...), nil
+}
+
+// PackedSize is the number of values of the database BuildVectorDatabase would
+// build from the clusters, padding included
+func PackedSize(metadata Metadata, clusters []*Cluster, params DatabaseParams) uint64 {
+	_, l, m, err := packDatabase(clusters, metadata.Dim, params)
+	if err != nil {
+		panic(err)
+	}
+	return l * m
+}
+
+// ReadAllClusters reads every cluster of a preamble, and checks them against
+// its metadata. It fails, naming the cluster and the expected and actual values,
+// on the first cluster that cannot be read or does not match.
+func ReadAllClusters(clusterPreamble string, precBits uint64) (Metadata, []*Cluster, error) {
+	return ReadAllClustersWithOptions(clusterPreamble, precBits, ReadOptions{})
+}
+
+// ReadAllClustersWithOptions reads every cluster of a FileClusterSource
+func ReadAllClustersWithOptions(clusterPreamble string, precBits uint64, opts ReadOptions) (Metadata, []*Cluster, error) {
+	src, err := NewFileClusterSource(clusterPreamble, precBits, opts)
+	if err != nil {
+		return Metadata{}, nil, fmt.Errorf("error opening the clusters: %w", err)
 	}
+	metadata, clusters, err := ReadAllFromSource(src, precBits)
+	if err != nil {
+		return metadata, nil, fmt.Errorf("error reading the clusters: %w", err)
+	}
+	fmt.Printf("Building database with %d %d-dim %d-bit vectors, organized in %d clusters\n", metadata.NumVectors, metadata.Dim, precBits, metadata.NumClusters)
+	return metadata, clusters, nil
+}
 
-	return cols, col_szs
+// readClusterFile reads cluster i from its own csv or JSONL file
+func readClusterFile(clusterPreamble string, format ClusterFiles, i uint64, dim uint64, precBits uint64, opts ReadOptions) (*Cluster, error) {
+	if format == JsonlClusterFiles {
+		return ReadClusterFromJsonl(fmt.Sprintf("%s_cluster_%d.jsonl", clusterPreamble, i), i, dim, precBits)
+	}
+	return ReadClusterFromCsvWithOptions(fmt.Sprintf("%s_cluster_%d.csv", clusterPreamble, i), i, dim, precBits, opts)
 }
 
-func ReadAllClusters(clusterPreamble string, precBits uint64) (Metadata, []*Cluster) {
-	dir := filepath.Dir(clusterPreamble)
-	prefix := filepath.Base(clusterPreamble)
+// readClusterIDs reads the external IDs of a cluster, if it has an ID file
+func readClusterIDs(clusterPreamble string, c *Cluster) error {
+	idFile := fmt.Sprintf("%s_cluster_%d_ids.csv", clusterPreamble, c.Index)
+	if _, err := os.Stat(idFile); err != nil {
+		return nil
+	}
+	ids, err := ReadClusterIDs(idFile)
+	if err != nil {
+		return err
+	}
+	if uint64(len(ids)) != c.NumVectors {
+		return fmt.Errorf("ID file %s has %d IDs, but cluster %d has %d vectors", idFile, len(ids), c.Index, c.NumVectors)
+	}
+	c.ExternalIDs = ids
+	return nil
+}
 
-	jsonFile := utils.OpenFile(filepath.Join(dir, prefix+"_metadata.json"))
-	defer jsonFile.Close()
+// ReadCluster reads a single cluster, with its external IDs, like
+// ReadAllClustersWithOptions, e.g., to load clusters on demand. It needs one
+// file per cluster, and checks the cluster against the metadata.
+func ReadCluster(clusterPreamble string, metadata Metadata, i uint64, precBits uint64, opts ReadOptions) (*Cluster, error) {
+	if i >= metadata.NumClusters {
+		return nil, fmt.Errorf("cluster %d does not exist, there are %d clusters", i, metadata.NumClusters)
+	}
+	format := FindClusterFiles(clusterPreamble)
+	if format != CsvClusterFiles && format != JsonlClusterFiles {
+		return nil, fmt.Errorf("reading a single cluster requires one csv or JSONL file per cluster, such as %s_cluster_0.csv", clusterPreamble)
+	}
+	if opts.Quantized && format != CsvClusterFiles {
+		return nil, fmt.Errorf("quantized input is only supported for csv cluster files")
+	}
+	if opts.Mean != nil && format != CsvClusterFiles {
+		return nil, fmt.Errorf("centering is only supported for csv cluster files")
+	}
+	if opts.Quantizer != nil && format != CsvClusterFiles {
+		return nil, fmt.Errorf("custom quantizers are only supported for csv cluster files")
+	}
+	if opts.Stats != 0 && format != CsvClusterFiles {
+		return nil, fmt.Errorf("statistics are only gathered from csv cluster files")
+	}
+	c, err := readClusterFile(clusterPreamble, format, i, metadata.Dim, precBits, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := readClusterIDs(clusterPreamble, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
 
-	decoder := json.NewDecoder(jsonFile)
+// ReadMetadata reads a metadata file, such as <preamble>_metadata.json
+func ReadMetadata(file string) (Metadata, error) {
 	var metadata Metadata
-	if err := decoder.Decode(&metadata); err != nil {
-		panic("Error decoding metadata file")
+	f, err := os.Open(file)
+	if err != nil {
+		return metadata, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&metadata); err != nil {
+		return metadata, fmt.Errorf("error decoding metadata file %s: %w", file, err)
 	}
+	return metadata, nil
+}
 
-	numVectors := metadata.NumVectors
-	numClusters := metadata.NumClusters
-	dim := metadata.Dim
+// InferMetadata reconstructs the metadata of csv cluster files, for datasets that
+// come without a metadata file: it counts the files <preamble>_cluster_<i>.csv,
+// which must be numbered from 0 without gaps, and their rows, and takes the
+// dimension from the number of fields per row.
+func InferMetadata(clusterPreamble string) (Metadata, error) {
+	if FindClusterFiles(clusterPreamble) != CsvClusterFiles {
+		return Metadata{}, fmt.Errorf("metadata can only be inferred for csv cluster files, but %s_cluster_0.csv does not exist", clusterPreamble)
+	}
 
-	// file names of clusters are dir/prefix_cluster_0.csv, ..., until the last cluster (number of clusters is metadata.NumClusters)
+	var metadata Metadata
+	for i := 0; ; i++ {
+		file := fmt.Sprintf("%s_cluster_%d.csv", clusterPreamble, i)
+		if _, err := os.Stat(file); err != nil {
+			break
+		}
+		rows, dim, err := countCsvRows(file)
+		if err != nil {
+			return Metadata{}, err
+		}
+		if rows > 0 && metadata.Dim == 0 {
+			metadata.Dim = dim
+		}
+		if rows > 0 && dim != metadata.Dim {
+			return Metadata{}, fmt.Errorf("%s has dimension %d, but previous clusters have dimension %d", file, dim, metadata.Dim)
+		}
+		metadata.NumVectors += rows
+		metadata.NumClusters += 1
+	}
 
-	fmt.Printf("Building database with %d %d-dim %d-bit vectors, organized in %d clusters\n", numVectors, dim, precBits, numClusters)
+	// cluster files after a gap would be silently ignored
+	matches, err := filepath.Glob(clusterPreamble + "_cluster_*.csv")
+	if err != nil {
+		return Metadata{}, err
+	}
+	numFiles := uint64(0)
+	for _, m := range matches {
+		if !strings.HasSuffix(m, "_ids.csv") {
+			numFiles++
+		}
+	}
+	if numFiles != metadata.NumClusters {
+		return Metadata{}, fmt.Errorf("found %d cluster files, but only %d of them are numbered 0 to %d", numFiles, metadata.NumClusters, metadata.NumClusters-1)
+	}
+	if metadata.Dim == 0 {
+		return Metadata{}, fmt.Errorf("all cluster files are empty")
+	}
 
-	// call ReadEmbeddingsCsv for each cluster, to get a slice of clusters
-	// clusters := make([]*Cluster, numClusters)
-	cluster_sizes := make([]uint64, numClusters)
+	return metadata, nil
+}
 
-	vecCountVeri := uint64(0)
+// countCsvRows returns the number of rows of a csv file and their number of fields
+func countCsvRows(file string) (uint64, uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
 
-	clusters := make([]*Cluster, numClusters)
+	// all rows must have as many fields as the first one
+	reader := csv.NewReader(f)
+	reader.ReuseRecord = true
+	rows, dim := uint64(0), uint64(0)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return rows, dim, nil
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("error reading %s: %w", file, err)
+		}
+		dim = uint64(len(row))
+		rows++
+	}
+}
 
-	for i := uint64(0); i < numClusters; i++ {
-		clusterFile := filepath.Join(dir, fmt.Sprintf("%s_cluster_%d.csv", prefix, i))
-		// clusterNumVec, clusterDim, clusterPrecBits, clusterVec := ReadClusterFromCsv(clusterFile)
-		clusters[i] = ReadClusterFromCsv(clusterFile, i, dim, precBits)
-		cluster_sizes[i] = clusters[i].NumVectors
-		vecCountVeri += clusters[i].NumVectors
+// WriteCentroids writes the centroid of every cluster to a csv file, one row per
+// cluster in cluster order, so that queries can be routed to their nearest cluster
+func WriteCentroids(file string, clusters []*Cluster) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-		if clusters[i].Dim != dim {
-			panic("Dimension mismatch")
+	writer := csv.NewWriter(f)
+	for i, c := range clusters {
+		if c.Centroid == nil {
+			return fmt.Errorf("cluster %d has no centroid", i)
+		}
+		row := make([]string, len(c.Centroid))
+		for j, v := range c.Centroid {
+			row[j] = strconv.FormatFloat(v, 'g', -1, 64)
 		}
-		if clusters[i].PrecBits != precBits {
-			panic("Precision mismatch")
+		if err := writer.Write(row); err != nil {
+			return err
 		}
 	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
 
-	if vecCountVeri != numVectors {
-		panic("Total number of vectors mismatch")
+// ReadCentroids reads the centroids written by WriteCentroids
+func ReadCentroids(file string) ([][]float64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
 
-	return metadata, clusters
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading centroids %s: %w", file, err)
+	}
+	centroids := make([][]float64, len(rows))
+	for i, row := range rows {
+		centroids[i] = make([]float64, len(row))
+		for j, v := range row {
+			if centroids[i][j], err = strconv.ParseFloat(v, 64); err != nil {
+				return nil, fmt.Errorf("error parsing centroids %s, line %d: %w", file, i+1, err)
+			}
+		}
+	}
+	return centroids, nil
 }
 
-// BuildVectorDatabase creates a PIR database from CSV vector files
-func BuildVectorDatabase(metadata Metadata, clusters []*Cluster, seed *rand.PRGKey, hintSz uint64, precBits uint64) (*pir.Database[matrix.Elem64], ClusterMap) {
+// WriteMetadata writes metadata in the format of <preamble>_metadata.json
+func WriteMetadata(file string, metadata Metadata) error {
+	buf, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(buf, '\n'), 0644)
+}
 
-	numVectors := metadata.NumVectors
-	dim := metadata.Dim
+// BuildVectorDatabaseFromFloats creates a PIR database from in-memory float
+// vectors, without going through files. See ClustersFromFloats for the layout of
+// clusters.
+func BuildVectorDatabaseFromFloats(metadata Metadata, clusters [][]float64, precBits uint64, params DatabaseParams) (*pir.Database[matrix.Elem64], ClusterMap, error) {
+	quantized, err := ClustersFromFloats(metadata, clusters, precBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	seed := rand.RandomPRGKey()
+	return BuildVectorDatabase(metadata, quantized, seed, params, precBits)
+}
+
+// recordLen is the number of bits of a database value, which fixes P
+const recordLen = 15
+
+// packDatabase packs the clusters into columns like BuildVectorDatabase, and
+// returns them with the number of rows and columns of the database
+func packDatabase(clusters []*Cluster, dim uint64, params DatabaseParams) ([][]uint, uint64, uint64, error) {
+	cols, colSzs, err := PackClustersContext(context.Background(), clusters, params.ColumnCapacity(), params, nil)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	m := uint64(len(cols)) * dim
+	l := utils.Max(colSzs)
+	if l == 0 {
+		// all clusters are empty, but a database needs a row to be queried
+		l = 1
+	}
+	return cols, l, m, nil
+}
+
+// checkAnswerBudget checks that the answers of a database of l rows fit in
+// MaxAnswerBytes
+func checkAnswerBudget(l uint64, params DatabaseParams) error {
+	if params.MaxAnswerBytes > 0 && l > params.MaxAnswerRows() {
+		return fmt.Errorf("answers would take up to %d bytes in %s, over the budget of %d bytes: the tallest column holds %d vectors, but only %d rows fit", utils.AnswerSize(l, params.AnswerWire), params.AnswerWire, params.MaxAnswerBytes, l, params.MaxAnswerRows())
+	}
+	return nil
+}
 
-	l := hintSz * 125
+// pickParams picks the SimplePIR params of a database of m columns
+func pickParams(m uint64) (*lwe.Params, error) {
 	logQ := uint64(64)
+	p := lwe.NewParamsFixedP(logQ, m, (1 << recordLen))
+	if p == nil {
+		return nil, fmt.Errorf("no parameters with P = %d support %d columns", 1<<recordLen, m)
+	}
+	if p.Logq != logQ {
+		return nil, fmt.Errorf("got LogQ = %d, expected %d", p.Logq, logQ)
+	}
+	return p, nil
+}
 
-	actualSz := uint64(numVectors * dim) // total number of values
-	cols, colSzs := PackClusters(clusters, l)
+// ParamsError is returned when no SimplePIR parameters fit a database, so that
+// callers can retry with other DatabaseParams or fewer bits per value
+type ParamsError struct {
+	// Rows and Columns are the shape of the packed database
+	Rows    uint64
+	Columns uint64
+	// PrecBits is the requested precision, which P must cover, and P the
+	// plaintext modulus of the parameters picked, or 0 if none were
+	PrecBits uint64
+	P        uint64
+	Err      error
+}
 
-	m := uint64(len(cols)) * dim
-	l = utils.Max(colSzs)
+func (e *ParamsError) Error() string {
+	prefix := fmt.Sprintf("failure in picking SimplePIR parameters for a database of %d rows and %d columns with %d-bit values", e.Rows, e.Columns, e.PrecBits)
+	if e.Err != nil {
+		// the columns are too many for P: a larger hintSz fills every column further
+		return fmt.Sprintf("%s: %s; reduce the number of columns, e.g., with a larger hintSz", prefix, e.Err.Error())
+	}
+	// P is fixed at 2^recordLen, whatever the shape of the database
+	return fmt.Sprintf("%s (P = %d): P is fixed at 2^%d, which holds values of at most %d bits; reduce precBits to %d", prefix, e.P, recordLen, recordLen, recordLen)
+}
+
+func (e *ParamsError) Unwrap() error {
+	return e.Err
+}
+
+// EncodeSigned maps a quantized value to its representative in Z_p, i.e., -v to
+// p - v. Casting a negative int8 to uint64 sign-extends it to 2^64 - v, which
+// only agrees with p - v modulo p because p is a power of two; this encoding
+// does not depend on it. utils.SmoothResult maps scores back to signed values.
+func EncodeSigned(v int8, p uint64) uint64 {
+	return uint64(int64(v)+int64(p)) % p
+}
+
+// BuildVectorDatabase creates a PIR database from CSV vector files. It returns an
+// error if the database does not have the shape of the packed clusters, which
+// would misalign every query.
+//
+// Values are stored row-major, with the clusters of a bin down a column, which
+// is the orientation SimplePIR's Answer multiplies in: the encrypted query
+// selects a column, and each row of the answer is the inner product of the
+// query with a row of vals.
+func BuildVectorDatabase(metadata Metadata, clusters []*Cluster, seed *rand.PRGKey, params DatabaseParams, precBits uint64) (*pir.Database[matrix.Elem64], ClusterMap, error) {
+	if err := validateUniformDim(clusters, metadata.Dim); err != nil {
+		return nil, nil, err
+	}
+
+	numVectors := metadata.NumVectors
+	dim := metadata.Dim
+
+	actualSz := uint64(numVectors * dim) // total number of values
+	cols, l, m, err := packDatabase(clusters, dim, params)
+	if err != nil {
+		return nil, nil, err
+	}
 	fmt.Printf("DB size is %d -- best possible would be %d\n", l*m, actualSz)
+	if err := checkAnswerBudget(l, params); err != nil {
+		return nil, nil, err
+	}
 
 	// Pick SimplePIR params
-	recordLen := 15
-	p := lwe.NewParamsFixedP(logQ, m, (1 << recordLen))
-	if (p == nil) || (p.P < uint64(1<<precBits)) || (p.Logq != 64) {
-		fmt.Printf("P = %d; LogQ = %d\n", p.P, p.Logq)
-		panic("Failure in picking SimplePIR DB parameters")
+	p, err := pickParams(m)
+	if err != nil {
+		return nil, nil, &ParamsError{Rows: l, Columns: m, PrecBits: precBits, Err: err}
+	}
+	if p.P < uint64(1)<<precBits {
+		return nil, nil, &ParamsError{Rows: l, Columns: m, PrecBits: precBits, P: p.P}
 	}
 
 	// Store embddings in database, such that clusters are kept together in a column
@@ -223,7 +1107,7 @@ func BuildVectorDatabase(metadata Metadata, clusters []*Cluster, seed *rand.PRGK
 
 			for x := uint64(0); x < sz; x++ {
 				for j := uint64(0); j < slots; j++ {
-					vals[DBIndex(rowIndex, slots*uint64(colIndex)+j, m)] = uint64(clusters[clusterIndex].Vectors[start+j])
+					vals[DBIndex(rowIndex, slots*uint64(colIndex)+j, m)] = EncodeSigned(clusters[clusterIndex].Vectors[start+j], p.P)
 				}
 				start += slots
 				rowIndex += 1
@@ -234,12 +1118,15 @@ func BuildVectorDatabase(metadata Metadata, clusters []*Cluster, seed *rand.PRGK
 		}
 	}
 
-	db := pir.NewDatabaseFixedParams[matrix.Elem64](l*m, uint64(recordLen), vals, p)
+	db := pir.NewDatabaseFixedParams[matrix.Elem64](l*m, recordLen, vals, p)
 	fmt.Printf("DB dimensions: %d by %d\n", db.Info.L, db.Info.M)
 
 	if db.Info.L != l {
-		panic("Should not happen")
+		return nil, nil, fmt.Errorf("database has %d rows, expected the %d of the tallest column", db.Info.L, l)
+	}
+	if db.Info.M != m {
+		return nil, nil, fmt.Errorf("database has %d columns, expected %d for %d bins of dimension %d", db.Info.M, m, len(cols), dim)
 	}
 
-	return db, indexMap
+	return db, indexMap, nil
 }
@@ -1,17 +1,28 @@
 package database
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/DeweiFeng/6.5610-project/search/utils"
-	"github.com/henrycg/simplepir/rand"
+	prgrand "github.com/henrycg/simplepir/rand"
 )
 
 func TestReadEmbeddingsCsv(t *testing.T) {
 	preamble := utils.GenerateTestData()
 	// Test the ReadEmbeddingsCsv function
-	cluster := ReadClusterFromCsv(preamble+"_cluster_0.csv", 0, 10, 5)
+	cluster, err := ReadClusterFromCsv(preamble+"_cluster_0.csv", 0, 10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	fmt.Println("Number of vectors:", cluster.NumVectors)
 	fmt.Println("Dimension:", cluster.Dim)
@@ -29,7 +40,10 @@ func TestReadEmbeddingsCsv(t *testing.T) {
 func TestReadAllClusters(t *testing.T) {
 	preamble := utils.GenerateTestData()
 	// Test the ReadAllClusters function
-	metadata, clusters := ReadAllClusters(preamble, 5)
+	metadata, clusters, err := ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	fmt.Println("Metadata:")
 	fmt.Println("Number of vectors:", metadata.NumVectors)
@@ -48,11 +62,742 @@ func TestReadAllClusters(t *testing.T) {
 func TestBuildVectorDatabase(t *testing.T) {
 	preamble := utils.GenerateTestData()
 	// Test the BuildVectorDatabase function
-	metadata, clusters := ReadAllClusters(preamble, 5)
-	seed := rand.RandomPRGKey()
+	metadata, clusters, err := ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed := prgrand.RandomPRGKey()
 
 	// Call BuildVectorDatabase with the clusters
 	// hintSz is 900 for text embeddings in Tiptoe, and 500 for image embeddings
-	_, _ = BuildVectorDatabase(metadata, clusters, seed, 900, 5)
+	if _, _, err := BuildVectorDatabase(metadata, clusters, seed, DatabaseParams{HintSz: 900}, 5); err != nil {
+		t.Errorf("Error building the database: %v", err)
+	}
+
+	// P = 2^15 cannot hold 16-bit values: the error says why, for a retry
+	_, _, err = BuildVectorDatabase(metadata, clusters, seed, DatabaseParams{HintSz: 900}, 16)
+	var paramsErr *ParamsError
+	if !errors.As(err, &paramsErr) {
+		t.Fatalf("Expected a ParamsError, but got %v", err)
+	}
+	if paramsErr.PrecBits != 16 || paramsErr.P != 1<<15 || paramsErr.Rows == 0 || paramsErr.Columns == 0 {
+		t.Errorf("Expected the shape, the bits and P in the error, but got %+v", paramsErr)
+	}
+	if !strings.Contains(err.Error(), "P is fixed at 2^15") || !strings.Contains(err.Error(), "reduce precBits to 15") || strings.Contains(err.Error(), "hintSz") {
+		t.Errorf("Expected the error to name the limit of P, but got %v", err)
+	}
+	pickErr := &ParamsError{Rows: 10, Columns: 1 << 40, PrecBits: 5, Err: errors.New("no parameters")}
+	if msg := pickErr.Error(); strings.Contains(msg, "P = 0") || !strings.Contains(msg, "larger hintSz") {
+		t.Errorf("Expected an error without P, asking for fewer columns, but got %v", msg)
+	}
 	utils.RemoveTestData()
 }
+
+func TestClusterMapMarshalDeterministic(t *testing.T) {
+	a := make(ClusterMap)
+	b := make(ClusterMap)
+	for i := uint(0); i < 100; i++ {
+		a[i] = uint64(i) * 30
+		b[99-i] = uint64(99-i) * 30
+	}
+
+	encA := a.MarshalDeterministic()
+	for i := 0; i < 10; i++ {
+		if !bytes.Equal(encA, a.MarshalDeterministic()) {
+			t.Fatalf("Expected repeated encodings of the same map to be identical")
+		}
+	}
+	if !bytes.Equal(encA, b.MarshalDeterministic()) {
+		t.Fatalf("Expected maps with the same contents to have identical encodings")
+	}
+
+	decoded, err := UnmarshalClusterMap(encA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(a) {
+		t.Fatalf("Expected %d entries, but got %d", len(a), len(decoded))
+	}
+	for k, v := range a {
+		if decoded[k] != v {
+			t.Errorf("Expected cluster %d to map to %d, but got %d", k, v, decoded[k])
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, file string, contents string) {
+	if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadAllClustersJsonl(t *testing.T) {
+	metadata := `{"num_vectors": 3, "num_clusters": 2, "dim": 2}`
+	expected := [][]int8{
+		{utils.QuantizeClamp(0.6, 5), utils.QuantizeClamp(0.8, 5), utils.QuantizeClamp(-1.0, 5), utils.QuantizeClamp(0.0, 5)},
+		{utils.QuantizeClamp(0.0, 5), utils.QuantizeClamp(1.0, 5)},
+	}
+
+	// one file per cluster
+	grouped := filepath.Join(t.TempDir(), "grouped")
+	writeTestFile(t, grouped+"_metadata.json", metadata)
+	writeTestFile(t, grouped+"_cluster_0.jsonl", "{\"clusterId\": 0, \"embedding\": [0.6, 0.8]}\n{\"embedding\": [-1.0, 0.0]}\n")
+	writeTestFile(t, grouped+"_cluster_1.jsonl", "{\"clusterId\": 1, \"embedding\": [0.0, 1.0]}\n")
+
+	// a single file with a cluster id on every line
+	combined := filepath.Join(t.TempDir(), "combined")
+	writeTestFile(t, combined+"_metadata.json", metadata)
+	writeTestFile(t, combined+"_clusters.jsonl", "{\"clusterId\": 0, \"embedding\": [0.6, 0.8]}\n{\"clusterId\": 1, \"embedding\": [0.0, 1.0]}\n{\"clusterId\": 0, \"embedding\": [-1.0, 0.0]}\n")
+
+	for _, preamble := range []string{grouped, combined} {
+		_, clusters, err := ReadAllClusters(preamble, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(clusters) != len(expected) {
+			t.Fatalf("Expected %d clusters, but got %d", len(expected), len(clusters))
+		}
+		for i, cluster := range clusters {
+			if !reflect.DeepEqual(cluster.Vectors, expected[i]) {
+				t.Errorf("%s: expected cluster %d to be %v, but got %v", preamble, i, expected[i], cluster.Vectors)
+			}
+		}
+	}
+}
+
+func TestPackClustersMaxColumns(t *testing.T) {
+	sizes := []uint64{50, 40, 30, 30, 20, 10, 10, 5, 5, 1}
+	clusters := make([]*Cluster, len(sizes))
+	for i, sz := range sizes {
+		clusters[i] = &Cluster{Index: uint64(i), NumVectors: sz}
+	}
+
+	cols, _ := PackClusters(clusters, 60, DatabaseParams{})
+	if len(cols) <= 2 {
+		t.Fatalf("Expected the unconstrained packing to use more than 2 columns, but got %d", len(cols))
+	}
+
+	for _, maxColumns := range []uint64{1, 2, 3} {
+		cols, colSzs := PackClusters(clusters, 60, DatabaseParams{MaxColumns: maxColumns})
+		if uint64(len(cols)) > maxColumns {
+			t.Errorf("Expected at most %d columns, but got %d", maxColumns, len(cols))
+		}
+
+		seen := make(map[uint]bool)
+		for j, col := range cols {
+			sz := uint64(0)
+			for _, c := range col {
+				if seen[c] {
+					t.Errorf("Cluster %d was packed twice", c)
+				}
+				seen[c] = true
+				sz += sizes[c]
+			}
+			if sz != colSzs[j] {
+				t.Errorf("Expected column %d to hold %d vectors, but got %d", j, sz, colSzs[j])
+			}
+		}
+		if len(seen) != len(sizes) {
+			t.Errorf("Expected all %d clusters to be packed, but got %d", len(sizes), len(seen))
+		}
+	}
+}
+
+func TestReadAllClustersExternalIDs(t *testing.T) {
+	preamble := filepath.Join(t.TempDir(), "ids")
+	writeTestFile(t, preamble+"_metadata.json", `{"num_vectors": 3, "num_clusters": 2, "dim": 2}`)
+	writeTestFile(t, preamble+"_cluster_0.csv", "0.6,0.8\n-1.0,0.0\n")
+	writeTestFile(t, preamble+"_cluster_1.csv", "0.0,1.0\n")
+	writeTestFile(t, preamble+"_cluster_0_ids.csv", "doc-a\ndoc-b\n")
+
+	_, clusters, err := ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(clusters[0].ExternalIDs, []string{"doc-a", "doc-b"}) {
+		t.Errorf("Expected the IDs of cluster 0 to be loaded, but got %v", clusters[0].ExternalIDs)
+	}
+	if clusters[1].ExternalIDs != nil {
+		t.Errorf("Expected cluster 1 to have no IDs, but got %v", clusters[1].ExternalIDs)
+	}
+}
+
+func TestBuildVectorDatabaseFromFloats(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	dim := uint64(6)
+	sizes := []int{7, 0, 12, 3}
+
+	preamble := filepath.Join(t.TempDir(), "floats")
+	floats := make([][]float64, len(sizes))
+	numVectors := 0
+	for i, sz := range sizes {
+		var csv bytes.Buffer
+		for v := 0; v < sz; v++ {
+			for j := uint64(0); j < dim; j++ {
+				// include values outside of [-1, 1] to exercise clamping
+				x := r.NormFloat64()
+				floats[i] = append(floats[i], x)
+				if j > 0 {
+					csv.WriteString(",")
+				}
+				csv.WriteString(fmt.Sprint(x))
+			}
+			csv.WriteString("\n")
+		}
+		writeTestFile(t, fmt.Sprintf("%s_cluster_%d.csv", preamble, i), csv.String())
+		numVectors += sz
+	}
+	writeTestFile(t, preamble+"_metadata.json", fmt.Sprintf(`{"num_vectors": %d, "num_clusters": %d, "dim": %d}`, numVectors, len(sizes), dim))
+
+	metadata, fromCsv, err := ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromFloats, err := ClustersFromFloats(metadata, floats, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range sizes {
+		if fromFloats[i].NumVectors != fromCsv[i].NumVectors || !reflect.DeepEqual(fromFloats[i].Vectors, fromCsv[i].Vectors) {
+			t.Errorf("Cluster %d quantized from floats differs from the one read from csv", i)
+		}
+	}
+
+	params := DatabaseParams{HintSz: 900}
+	csvDB, csvMap, err := BuildVectorDatabase(metadata, fromCsv, prgrand.RandomPRGKey(), params, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	floatsDB, floatsMap, err := BuildVectorDatabaseFromFloats(metadata, floats, 5, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(csvMap, floatsMap) {
+		t.Errorf("Expected identical cluster maps, but got %v and %v", csvMap, floatsMap)
+	}
+	if !csvDB.Data.Equals(floatsDB.Data) {
+		t.Errorf("Expected the database built from floats to equal the one built from csv")
+	}
+
+	// in-memory clusters that do not match their metadata fail, naming the mismatch
+	ragged := append([][]float64{floats[0][:len(floats[0])-1]}, floats[1:]...)
+	for _, tc := range []struct {
+		metadata Metadata
+		floats   [][]float64
+		expected string
+	}{
+		{Metadata{NumVectors: metadata.NumVectors, NumClusters: metadata.NumClusters + 1, Dim: dim}, floats, fmt.Sprintf("got %d clusters, but the metadata has %d", len(sizes), len(sizes)+1)},
+		{Metadata{NumVectors: metadata.NumVectors + 1, NumClusters: metadata.NumClusters, Dim: dim}, floats, fmt.Sprintf("got %d vectors, but the metadata has %d", metadata.NumVectors, metadata.NumVectors+1)},
+		{metadata, ragged, fmt.Sprintf("cluster 0 has %d values, which is not a multiple of the dimension %d", len(ragged[0]), dim)},
+		{Metadata{NumVectors: metadata.NumVectors, NumClusters: metadata.NumClusters}, floats, "cluster 0: the dimension must be positive"},
+	} {
+		if _, _, err := BuildVectorDatabaseFromFloats(tc.metadata, tc.floats, 5, params); err == nil || err.Error() != tc.expected {
+			t.Errorf("Expected the error %q, but got %v", tc.expected, err)
+		}
+	}
+}
+
+func TestPackClustersDeterministic(t *testing.T) {
+	// many clusters of equal size, so that the order of ties matters
+	dim := uint64(4)
+	sizes := []int{3, 5, 3, 3, 5, 1, 3, 1, 5, 3, 3, 1}
+	metadata, floats := SyntheticFloats(dim, sizes, 0)
+	clusters, err := ClustersFromFloats(metadata, floats, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, _ := PackClusters(clusters, 8, DatabaseParams{})
+	for _, col := range cols {
+		for k := 1; k < len(col); k++ {
+			a, b := clusters[col[k-1]], clusters[col[k]]
+			if a.NumVectors == b.NumVectors && a.Index > b.Index {
+				t.Errorf("Clusters %d and %d of equal size were packed out of index order in %v", a.Index, b.Index, col)
+			}
+		}
+	}
+
+	params := DatabaseParams{HintSz: 900}
+	first, firstMap, err := BuildVectorDatabaseFromFloats(metadata, floats, 5, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		db, indexMap, err := BuildVectorDatabaseFromFloats(metadata, floats, 5, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(firstMap.MarshalDeterministic(), indexMap.MarshalDeterministic()) {
+			t.Fatalf("Expected identical cluster maps across builds")
+		}
+		if !first.Data.Equals(db.Data) {
+			t.Fatalf("Expected byte-identical databases across builds")
+		}
+	}
+}
+
+func TestPackClustersPinned(t *testing.T) {
+	dim := uint64(3)
+	sizes := []int{4, 9, 2, 2, 7, 1}
+	metadata, clusters := SyntheticClusters(dim, sizes, 0)
+
+	pinned := []uint64{2, 5}
+	params := DatabaseParams{HintSz: 900, PinnedClusters: pinned}
+	cols, _ := PackClusters(clusters, 100, params)
+	for _, p := range pinned {
+		for _, col := range cols {
+			for _, c := range col {
+				if uint64(c) == p && len(col) != 1 {
+					t.Errorf("Pinned cluster %d shares its column: %v", p, col)
+				}
+			}
+		}
+	}
+
+	db, indexMap, err := BuildVectorDatabase(metadata, clusters, prgrand.RandomPRGKey(), params, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexMap) != len(sizes) {
+		t.Fatalf("Expected %d clusters in the index map, but got %d", len(sizes), len(indexMap))
+	}
+	// every cluster is stored where the index map says
+	for i, cluster := range clusters {
+		start := indexMap[uint(i)]
+		row, col := start/db.Info.M, start%db.Info.M
+		for v := uint64(0); v < cluster.NumVectors; v++ {
+			for j := uint64(0); j < dim; j++ {
+				got := int8(db.Data.Get(row+v, col+j))
+				if got != cluster.Vectors[v*dim+j] {
+					t.Fatalf("Cluster %d: expected %d at vector %d, entry %d, but got %d", i, cluster.Vectors[v*dim+j], v, j, got)
+				}
+			}
+		}
+	}
+
+	// pinned columns count towards MaxColumns
+	cols, _ = PackClusters(clusters, 100, DatabaseParams{MaxColumns: 3, PinnedClusters: pinned})
+	if len(cols) > 3 {
+		t.Errorf("Expected at most 3 columns, but got %d", len(cols))
+	}
+}
+
+func TestClusterMapLayout(t *testing.T) {
+	dim := uint64(2)
+	sizes := []int{5, 3, 2}
+	floats := make([][]float64, len(sizes))
+	numVectors := 0
+	for i, sz := range sizes {
+		floats[i] = make([]float64, sz*int(dim))
+		numVectors += sz
+	}
+	metadata := Metadata{NumVectors: uint64(numVectors), Dim: dim, NumClusters: uint64(len(sizes))}
+	clusters, err := ClustersFromFloats(metadata, floats, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pin cluster 0 so that clusters 1 and 2 share the other bin
+	db, indexMap, err := BuildVectorDatabase(metadata, clusters, prgrand.RandomPRGKey(), DatabaseParams{HintSz: 900, PinnedClusters: []uint64{0}}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layout, err := indexMap.Layout(clusters, db.Info.L, db.Info.M, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.NumVectors != 3 || layout.PrecBits != 5 || layout.Column != dim || layout.StartRow != 0 {
+		t.Errorf("Unexpected layout of cluster 1: %+v", layout)
+	}
+	if !reflect.DeepEqual(layout.BinClusters, []uint{1, 2}) || layout.BinVectors != 5 || layout.PaddingRows != 0 {
+		t.Errorf("Unexpected bin of cluster 1: %+v", layout)
+	}
+
+	// the last cluster of a bin is followed by padding down to the bottom
+	layout, err = indexMap.Layout(clusters, db.Info.L, db.Info.M, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.StartRow != 3 || layout.PaddingRows != db.Info.L-5 {
+		t.Errorf("Unexpected layout of cluster 2: %+v", layout)
+	}
+
+	if _, err := indexMap.Layout(clusters, db.Info.L, db.Info.M, 3); err == nil {
+		t.Errorf("Expected an error for a cluster that does not exist")
+	}
+}
+
+func TestReadAllClustersQuantized(t *testing.T) {
+	preamble := filepath.Join(t.TempDir(), "quantized")
+	writeTestFile(t, preamble+"_metadata.json", `{"num_vectors": 3, "num_clusters": 2, "dim": 3}`)
+	writeTestFile(t, preamble+"_cluster_0.csv", "16,-16,0\n3,-7,1\n")
+	writeTestFile(t, preamble+"_cluster_1.csv", "1,1,-1\n")
+
+	_, clusters, err := ReadAllClustersWithOptions(preamble, 5, ReadOptions{Quantized: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the values are kept as is, while quantizing them again would clamp them all
+	if !reflect.DeepEqual(clusters[0].Vectors, []int8{16, -16, 0, 3, -7, 1}) {
+		t.Errorf("Expected quantized values to be read as is, but got %v", clusters[0].Vectors)
+	}
+	if !reflect.DeepEqual(clusters[1].Vectors, []int8{1, 1, -1}) {
+		t.Errorf("Expected quantized values to be read as is, but got %v", clusters[1].Vectors)
+	}
+
+	for _, contents := range []string{"17,0,0\n", "0,-17,0\n", "0,0.5,0\n", "0,200,0\n"} {
+		file := filepath.Join(t.TempDir(), "cluster.csv")
+		writeTestFile(t, file, contents)
+		if _, err := ReadClusterFromCsvWithOptions(file, 0, 3, 5, ReadOptions{Quantized: true}); err == nil {
+			t.Errorf("Expected %q to be rejected as 5-bit quantized input", contents)
+		}
+	}
+}
+
+func TestReadClusterFromCsvErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []struct {
+		contents string
+		expected string
+	}{
+		{"0.5,0.5,0\n0,x,0\n", "row 2"},
+		{"0.5,0.5,0\n0,1\n", "row 2"},
+		{"0.5,0.5,0\n\"0,1,0\n", "row 2"},
+	} {
+		file := filepath.Join(dir, "cluster.csv")
+		writeTestFile(t, file, c.contents)
+		_, err := ReadClusterFromCsv(file, 0, 3, 5)
+		if err == nil || !strings.Contains(err.Error(), file) || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("Expected an error naming %s and %s for %q, but got %v", file, c.expected, c.contents, err)
+		}
+	}
+
+	missing := filepath.Join(dir, "missing.csv")
+	if _, err := ReadClusterFromCsv(missing, 0, 3, 5); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a missing file to fail with os.ErrNotExist, but got %v", err)
+	}
+	if _, err := ReadClusterFromCsvWithOptions(missing, 0, 3, 5, ReadOptions{Quantizer: utils.LinearQuantizer{PrecBits: 4}}); err == nil {
+		t.Errorf("Expected a quantizer of other bits to be rejected")
+	}
+}
+
+func TestReadAllClustersErrors(t *testing.T) {
+	for _, c := range []struct {
+		files    map[string]string
+		expected string
+	}{
+		{map[string]string{"_metadata.json": `{"num_vectors": 2,`}, "error decoding metadata"},
+		{map[string]string{"_metadata.json": `{"num_vectors": 3, "num_clusters": 2, "dim": 2}`}, "2 vectors in total, but the metadata 3"},
+		{map[string]string{"_cluster_1.csv": "0.5,x\n"}, "cluster 1: parsing"},
+		{map[string]string{"_cluster_1_ids.csv": "a\nb\n"}, "has 2 IDs, but cluster 1 has 1 vectors"},
+	} {
+		preamble := filepath.Join(t.TempDir(), "bad")
+		files := map[string]string{
+			"_metadata.json": `{"num_vectors": 2, "num_clusters": 2, "dim": 2}`,
+			"_cluster_0.csv": "0.6,0.8\n",
+			"_cluster_1.csv": "0.8,0.6\n",
+		}
+		for suffix, contents := range c.files {
+			files[suffix] = contents
+		}
+		for suffix, contents := range files {
+			writeTestFile(t, preamble+suffix, contents)
+		}
+		if _, _, err := ReadAllClusters(preamble, 5); err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("Expected an error about %q, but got %v", c.expected, err)
+		}
+	}
+}
+
+func TestInferMetadata(t *testing.T) {
+	preamble := filepath.Join(t.TempDir(), "inferred")
+	writeTestFile(t, preamble+"_cluster_0.csv", "0.5,0.5,0\n0,1,0\n")
+	writeTestFile(t, preamble+"_cluster_0_ids.csv", "a\nb\n")
+	writeTestFile(t, preamble+"_cluster_1.csv", "")
+	writeTestFile(t, preamble+"_cluster_2.csv", "1,0,0\n")
+
+	expected := Metadata{NumVectors: 3, NumClusters: 3, Dim: 3}
+	metadata, err := InferMetadata(preamble)
+	if err != nil {
+		t.Fatalf("Expected metadata to be inferred, but got %v", err)
+	}
+	if !reflect.DeepEqual(metadata, expected) {
+		t.Errorf("Expected %+v, but got %+v", expected, metadata)
+	}
+
+	// without a metadata file, ReadAllClusters falls back to the inferred metadata
+	metadata, clusters, err := ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, expected) || len(clusters) != 3 || clusters[2].NumVectors != 1 {
+		t.Errorf("Expected the clusters to be read with the inferred metadata, but got %+v", metadata)
+	}
+
+	// the written metadata is read back as is
+	if err := WriteMetadata(preamble+"_metadata.json", metadata); err != nil {
+		t.Fatalf("Error writing metadata: %v", err)
+	}
+	if metadata, _, err = ReadAllClusters(preamble, 5); err != nil || !reflect.DeepEqual(metadata, expected) {
+		t.Errorf("Expected the written metadata %+v, but got %+v", expected, metadata)
+	}
+
+	gap := filepath.Join(t.TempDir(), "gap")
+	writeTestFile(t, gap+"_cluster_0.csv", "1,0\n")
+	writeTestFile(t, gap+"_cluster_2.csv", "0,1\n")
+	if _, err := InferMetadata(gap); err == nil {
+		t.Errorf("Expected an error for cluster files with a gap")
+	}
+
+	mixed := filepath.Join(t.TempDir(), "mixed")
+	writeTestFile(t, mixed+"_cluster_0.csv", "1,0\n")
+	writeTestFile(t, mixed+"_cluster_1.csv", "0,1,0\n")
+	if _, err := InferMetadata(mixed); err == nil {
+		t.Errorf("Expected an error for clusters of different dimensions")
+	}
+}
+
+func TestClusterCentroids(t *testing.T) {
+	preamble := filepath.Join(t.TempDir(), "centroids")
+	writeTestFile(t, preamble+"_metadata.json", `{"num_vectors": 3, "num_clusters": 2, "dim": 2}`)
+	// 0.01 is quantized to 0, but still counts towards the centroid
+	writeTestFile(t, preamble+"_cluster_0.csv", "0.5,0.01\n0.25,0.03\n")
+	writeTestFile(t, preamble+"_cluster_1.csv", "-1,0\n")
+
+	_, clusters, err := ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]float64{{0.375, 0.02}, {-1, 0}}
+	for i, c := range clusters {
+		for j := range expected[i] {
+			if math.Abs(c.Centroid[j]-expected[i][j]) > 1e-12 {
+				t.Errorf("Expected centroid %v for cluster %d, but got %v", expected[i], i, c.Centroid)
+				break
+			}
+		}
+	}
+
+	// in-memory clusters agree with the files, and empty clusters are centered at 0
+	fromFloats, err := ClustersFromFloats(Metadata{NumVectors: 3, NumClusters: 3, Dim: 2}, [][]float64{{0.5, 0.01, 0.25, 0.03}, {-1, 0}, {}}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromFloats[0].Centroid, clusters[0].Centroid) || !reflect.DeepEqual(fromFloats[2].Centroid, []float64{0, 0}) {
+		t.Errorf("Expected centroids %v and [0 0], but got %v and %v", clusters[0].Centroid, fromFloats[0].Centroid, fromFloats[2].Centroid)
+	}
+
+	file := preamble + "_centroids.csv"
+	if err := WriteCentroids(file, clusters); err != nil {
+		t.Fatalf("Error writing centroids: %v", err)
+	}
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "0.375,0.02\n-1,0\n" {
+		t.Errorf("Unexpected centroids file %q", buf)
+	}
+
+	if err := WriteCentroids(file, []*Cluster{{Index: 0, Dim: 2}}); err == nil {
+		t.Errorf("Expected an error for a cluster without centroid")
+	}
+}
+
+func TestEncodeSigned(t *testing.T) {
+	cases := []struct {
+		v        int8
+		p        uint64
+		expected uint64
+	}{
+		{0, 1 << 15, 0},
+		{7, 1 << 15, 7},
+		{-1, 1 << 15, 1<<15 - 1},
+		{-16, 1 << 15, 1<<15 - 16},
+		{-128, 1 << 15, 1<<15 - 128},
+		// the sign-extended uint64(int8(-3)) % 1000 would be 613
+		{-3, 1000, 997},
+	}
+	for _, c := range cases {
+		if got := EncodeSigned(c.v, c.p); got != c.expected {
+			t.Errorf("EncodeSigned(%d, %d): expected %d, but got %d", c.v, c.p, c.expected, got)
+		}
+		if got := utils.SmoothResult(EncodeSigned(c.v, c.p), c.p); got != int(c.v) {
+			t.Errorf("SmoothResult(EncodeSigned(%d, %d)): expected %d, but got %d", c.v, c.p, c.v, got)
+		}
+	}
+}
+
+// BenchmarkReadClusterFromCsv reads a cluster of 1024-dim vectors with the 4 KB
+// buffer of csv.Reader and with larger ones. Run with, e.g.:
+//
+//	go test -run NONE -bench ReadClusterFromCsv ./search/database
+func BenchmarkReadClusterFromCsv(b *testing.B) {
+	dim := uint64(1024)
+	numVectors := 2000
+	file := filepath.Join(b.TempDir(), "bench_cluster_0.csv")
+	f, err := os.Create(file)
+	if err != nil {
+		b.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	var row bytes.Buffer
+	for i := 0; i < numVectors; i++ {
+		row.Reset()
+		for j := uint64(0); j < dim; j++ {
+			if j > 0 {
+				row.WriteByte(',')
+			}
+			fmt.Fprintf(&row, "%.8f", rng.Float64()*2-1)
+		}
+		row.WriteByte('\n')
+		if _, err := f.Write(row.Bytes()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		b.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, size := range []int{4096, 64 << 10, DefaultReadBufferSize} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			b.SetBytes(info.Size())
+			for i := 0; i < b.N; i++ {
+				if _, err := ReadClusterFromCsvWithOptions(file, 0, dim, 5, ReadOptions{BufferSize: size}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// memorySource serves clusters held in memory
+type memorySource struct {
+	metadata Metadata
+	clusters []*Cluster
+}
+
+func (m *memorySource) NumClusters() uint64 { return uint64(len(m.clusters)) }
+func (m *memorySource) Metadata() Metadata  { return m.metadata }
+func (m *memorySource) ReadCluster(i uint64) (*Cluster, error) {
+	if i >= uint64(len(m.clusters)) {
+		return nil, fmt.Errorf("cluster %d does not exist", i)
+	}
+	return m.clusters[i], nil
+}
+
+func TestClusterSource(t *testing.T) {
+	preamble := utils.GenerateTestData()
+	defer utils.RemoveTestData()
+	metadata, expected, err := ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := NewFileClusterSource(preamble, 5, ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(src.Metadata(), metadata) || src.NumClusters() != metadata.NumClusters {
+		t.Errorf("Expected metadata %+v, but got %+v", metadata, src.Metadata())
+	}
+	for _, i := range []uint64{3, 0} {
+		c, err := src.ReadCluster(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c, expected[i]) {
+			t.Errorf("Cluster %d read alone differs from ReadAllClusters", i)
+		}
+	}
+	if _, err := src.ReadCluster(metadata.NumClusters); err == nil {
+		t.Errorf("Expected an error reading a cluster beyond the last one")
+	}
+
+	// any source is read and checked the same way
+	got, clusters, err := ReadAllFromSource(&memorySource{metadata, expected}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, metadata) || !reflect.DeepEqual(clusters, expected) {
+		t.Errorf("Reading a memory source differs from ReadAllClusters")
+	}
+	wrong := metadata
+	wrong.NumVectors++
+	if _, _, err := ReadAllFromSource(&memorySource{wrong, expected}, 5); err == nil {
+		t.Errorf("Expected an error when the clusters do not match the metadata")
+	}
+	if _, _, err := ReadAllFromSource(&memorySource{metadata, expected}, 6); err == nil {
+		t.Errorf("Expected an error when the precision does not match")
+	}
+}
+
+func TestMaxDim(t *testing.T) {
+	preamble := filepath.Join(t.TempDir(), "huge")
+	// a dimension mistyped by a few orders of magnitude
+	if err := WriteMetadata(preamble+"_metadata.json", Metadata{NumVectors: 1, Dim: 76800000, NumClusters: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(preamble+"_cluster_0.csv", []byte("0.5,0.25\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := NewFileClusterSource(preamble, 5, ReadOptions{})
+	if err == nil || !strings.Contains(err.Error(), "exceeds the maximum of 4096") {
+		t.Errorf("Expected an error naming the maximum dimension, but got %v", err)
+	}
+	if err := (Metadata{Dim: 5000}).ValidateDim(0); err == nil {
+		t.Errorf("Expected dimension 5000 to exceed the default maximum")
+	}
+	if err := (Metadata{Dim: 5000}).ValidateDim(8192); err != nil {
+		t.Errorf("Expected a raised maximum to accept dimension 5000, but got %v", err)
+	}
+}
+
+func TestValidateUniformDim(t *testing.T) {
+	metadata := Metadata{NumVectors: 3, Dim: 2, NumClusters: 2}
+	clusters := func() []*Cluster {
+		return []*Cluster{
+			{Index: 0, NumVectors: 2, Dim: 2, PrecBits: 5, Vectors: []int8{1, 2, 3, 4}},
+			{Index: 1, NumVectors: 1, Dim: 2, PrecBits: 5, Vectors: []int8{5, 6}},
+		}
+	}
+	if err := validateUniformDim(clusters(), 2); err != nil {
+		t.Fatalf("Expected uniform clusters to pass, but got %v", err)
+	}
+
+	// a cluster of another dimension, or with values missing, from a custom source
+	wrongDim := clusters()
+	wrongDim[1].Dim, wrongDim[1].Vectors = 3, []int8{5, 6, 7}
+	shortVectors := clusters()
+	shortVectors[1].Vectors = []int8{5}
+	for name, c := range map[string][]*Cluster{"dimension": wrongDim, "values": shortVectors} {
+		_, _, err := ReadAllFromSource(&memorySource{metadata, c}, 5)
+		if err == nil || !strings.Contains(err.Error(), "cluster 1") {
+			t.Errorf("%s: expected an error naming cluster 1, but got %v", name, err)
+		}
+		// clusters built in memory are checked before packing
+		if _, _, err := BuildVectorDatabase(metadata, c, prgrand.RandomPRGKey(), DatabaseParams{}, 5); err == nil {
+			t.Errorf("%s: expected BuildVectorDatabase to reject the clusters", name)
+		}
+	}
+
+	// cluster files of another dimension are rejected while parsing them
+	meta := `{"num_vectors": 2, "num_clusters": 2, "dim": 2}`
+	for _, files := range []map[string]string{
+		{"_cluster_0.csv": "0.6,0.8\n", "_cluster_1.csv": "0.0,0.6,0.8\n"},
+		{"_cluster_0.jsonl": "{\"embedding\": [0.6, 0.8]}\n", "_cluster_1.jsonl": "{\"embedding\": [0.0, 0.6, 0.8]}\n"},
+	} {
+		preamble := filepath.Join(t.TempDir(), "mixed")
+		writeTestFile(t, preamble+"_metadata.json", meta)
+		for suffix, contents := range files {
+			writeTestFile(t, preamble+suffix, contents)
+		}
+		if _, _, err := ReadAllClusters(preamble, 5); err == nil || !strings.Contains(err.Error(), "cluster 1") {
+			t.Errorf("Expected reading %v to fail on cluster 1, but got %v", files, err)
+		}
+	}
+}
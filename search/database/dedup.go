@@ -0,0 +1,108 @@
+package database
+
+import (
+	"fmt"
+)
+
+// Deduplication records how DeduplicateClusters collapsed identical vectors:
+// vector j of original cluster i is stored as vector Stored[i][j] of cluster i.
+// Clusters keep their index, so queries need no translation, and results name
+// stored vectors, which Originals maps back to every original vector.
+type Deduplication struct {
+	Stored [][]uint64
+	// Collapsed is the number of vectors not stored, as copies of another
+	Collapsed int
+
+	// originals lists, for every cluster, the original vectors of every stored one
+	originals [][][]uint64
+}
+
+// DeduplicateClusters stores every distinct quantized vector of a cluster once,
+// in the order of its first occurrence, which keeps its external ID and norm.
+// Vectors are only compared within their cluster, whose variance, that of all
+// its original vectors, is dropped. The given clusters are not modified.
+func DeduplicateClusters(metadata Metadata, clusters []*Cluster) (Metadata, []*Cluster, *Deduplication) {
+	dedup := &Deduplication{Stored: make([][]uint64, len(clusters))}
+	deduped := make([]*Cluster, len(clusters))
+	numVectors := uint64(0)
+	for i, c := range clusters {
+		res := *c
+		res.Vectors = make([]int8, 0, len(c.Vectors))
+		res.NumVectors = 0
+		if c.ExternalIDs != nil {
+			res.ExternalIDs = make([]string, 0, len(c.ExternalIDs))
+		}
+		// the norms follow the stored vectors, and the variance is not that of them
+		var norms []float64
+		if c.Stats != nil && c.Stats.Norms != nil {
+			norms = make([]float64, 0, len(c.Stats.Norms))
+		}
+
+		seen := make(map[string]uint64)
+		dedup.Stored[i] = make([]uint64, c.NumVectors)
+		for j := uint64(0); j < c.NumVectors; j++ {
+			vector := c.Vectors[j*c.Dim : (j+1)*c.Dim]
+			key := vectorKey(vector)
+			stored, ok := seen[key]
+			if !ok {
+				stored = res.NumVectors
+				seen[key] = stored
+				res.Vectors = append(res.Vectors, vector...)
+				if c.ExternalIDs != nil {
+					res.ExternalIDs = append(res.ExternalIDs, c.ExternalIDs[j])
+				}
+				if norms != nil {
+					norms = append(norms, c.Stats.Norms[j])
+				}
+				res.NumVectors++
+			} else {
+				dedup.Collapsed++
+			}
+			dedup.Stored[i][j] = stored
+		}
+		res.Stats = nil
+		if norms != nil {
+			res.Stats = &ClusterStats{Kinds: StatNorms, Norms: norms}
+		}
+		deduped[i] = &res
+		numVectors += res.NumVectors
+	}
+
+	metadata.NumVectors = numVectors
+	dedup.index()
+	return metadata, deduped, dedup
+}
+
+func vectorKey(vector []int8) string {
+	key := make([]byte, len(vector))
+	for i, v := range vector {
+		key[i] = byte(v)
+	}
+	return string(key)
+}
+
+// index builds the originals of the stored vectors
+func (d *Deduplication) index() {
+	d.originals = make([][][]uint64, len(d.Stored))
+	for i, stored := range d.Stored {
+		numStored := uint64(0)
+		for _, s := range stored {
+			if s+1 > numStored {
+				numStored = s + 1
+			}
+		}
+		d.originals[i] = make([][]uint64, numStored)
+		for j, s := range stored {
+			d.originals[i][s] = append(d.originals[i][s], uint64(j))
+		}
+	}
+}
+
+// Originals returns the original vectors of cluster stored as its vector id, in
+// increasing order: the first is the one whose copy is stored
+func (d *Deduplication) Originals(cluster uint64, id uint64) []uint64 {
+	if cluster >= uint64(len(d.originals)) || id >= uint64(len(d.originals[cluster])) {
+		panic(fmt.Sprintf("Vector %d of cluster %d is not stored", id, cluster))
+	}
+	return d.originals[cluster][id]
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeduplicateClusters(t *testing.T) {
+	dim := uint64(2)
+	floats := [][]float64{
+		// vectors 0, 2 and 3 are the same, as are 1 and 4
+		{0.5, 0.25, -0.5, 0.5, 0.5, 0.25, 0.5, 0.25, -0.5, 0.5, 0.75, 0},
+		// the same vector in another cluster is kept
+		{0.5, 0.25},
+		{},
+	}
+	metadata := Metadata{NumVectors: 7, Dim: dim, NumClusters: 3}
+	clusters, err := ClustersFromFloats(metadata, floats, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters[0].ExternalIDs = []string{"a", "b", "c", "d", "e", "f"}
+	clusters[0].Stats = &ClusterStats{Kinds: StatNorms | StatVariance, Norms: []float64{1, 2, 3, 4, 5, 6}, Variance: []float64{0.1, 0.2}}
+	original := append([]int8(nil), clusters[0].Vectors...)
+
+	newMetadata, deduped, dedup := DeduplicateClusters(metadata, clusters)
+	if dedup.Collapsed != 3 || newMetadata.NumVectors != 4 {
+		t.Fatalf("Expected 3 duplicates collapsed, leaving 4 vectors, but got %d collapsed, leaving %d", dedup.Collapsed, newMetadata.NumVectors)
+	}
+	if deduped[0].NumVectors != 3 || deduped[1].NumVectors != 1 || deduped[2].NumVectors != 0 {
+		t.Errorf("Expected clusters of 3, 1 and 0 vectors, but got %d, %d and %d", deduped[0].NumVectors, deduped[1].NumVectors, deduped[2].NumVectors)
+	}
+	if expected := []string{"a", "b", "f"}; !reflect.DeepEqual(deduped[0].ExternalIDs, expected) {
+		t.Errorf("Expected the external IDs of the first copies, %v, but got %v", expected, deduped[0].ExternalIDs)
+	}
+	// the norms of the first copies, and no variance, which is that of all copies
+	if s := deduped[0].Stats; s == nil || s.Kinds != StatNorms || !reflect.DeepEqual(s.Norms, []float64{1, 2, 6}) || s.Variance != nil {
+		t.Errorf("Expected the norms of the stored vectors only, but got %+v", s)
+	}
+	if deduped[1].Stats != nil || len(clusters[0].Stats.Norms) != 6 {
+		t.Errorf("Expected the statistics of the original clusters to be left alone")
+	}
+	if !reflect.DeepEqual(clusters[0].Vectors, original) || clusters[0].NumVectors != 6 {
+		t.Fatalf("Deduplication modified the original cluster")
+	}
+
+	// every original vector is stored, and maps back to all its copies
+	for i, c := range clusters {
+		for id := uint64(0); id < c.NumVectors; id++ {
+			stored := dedup.Stored[i][id]
+			if !reflect.DeepEqual(deduped[i].Vectors[stored*dim:(stored+1)*dim], c.Vectors[id*dim:(id+1)*dim]) {
+				t.Errorf("Vector %d of cluster %d is not stored as vector %d", id, i, stored)
+			}
+			found := false
+			for _, o := range dedup.Originals(uint64(i), stored) {
+				found = found || o == id
+			}
+			if !found {
+				t.Errorf("Vector %d of cluster %d does not map back from its stored copy %d", id, i, stored)
+			}
+		}
+	}
+	if expected := []uint64{0, 2, 3}; !reflect.DeepEqual(dedup.Originals(0, 0), expected) {
+		t.Errorf("Expected vector 0 to stand for %v, but got %v", expected, dedup.Originals(0, 0))
+	}
+	// the remap, which is what is written, lists all the copies too
+	if expected := []VectorRef{{0, 0}, {0, 2}, {0, 3}}; !reflect.DeepEqual(dedup.Remap().Originals(0, 0), expected) {
+		t.Errorf("Expected the remap of vector 0 to list %v, but got %v", expected, dedup.Remap().Originals(0, 0))
+	}
+}
@@ -0,0 +1,205 @@
+package database
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// VectorRef names a vector by its cluster and index within it
+type VectorRef struct {
+	Cluster uint64
+	ID      uint64
+}
+
+// ResultRow is the ranking of a query in a results file, best first
+type ResultRow struct {
+	QueryID string
+	Vectors []VectorRef
+	Failed  bool
+}
+
+// ReadResults reads a results file of the CLI, written without -externalIDs or
+// -scores, and with -queryID if withQueryID is set. Results files have no
+// header, so the caller says which layout the file has. With query IDs, every
+// row starts with the ID of its query; without, every row is for the query of
+// its line, counting from 0, and the empty lines between them, of queries
+// without results, are read as empty rankings. Rows of failed queries are kept
+// as Failed.
+func ReadResults(path string, withQueryID bool) ([]ResultRow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	rows := make([]ResultRow, 0)
+	// the line after the last row without a query ID
+	nextLine := 1
+	for first := true; ; first = false {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		line, _ := reader.FieldPos(0)
+		if first {
+			row[0] = strings.TrimPrefix(row[0], "\uFEFF")
+		}
+
+		res := ResultRow{QueryID: fmt.Sprintf("%d", line-1)}
+		if withQueryID {
+			res.QueryID, row = row[0], row[1:]
+		} else {
+			for ; nextLine < line; nextLine++ {
+				rows = append(rows, ResultRow{QueryID: fmt.Sprintf("%d", nextLine-1)})
+			}
+			nextLine = line + 1
+		}
+		if len(row) > 0 && row[0] == "error" {
+			res.Failed = true
+			rows = append(rows, res)
+			continue
+		}
+		if len(row)%2 != 0 {
+			return nil, fmt.Errorf("%s:%d: expected (cluster, index) pairs, got %d fields", path, line, len(row))
+		}
+		for i := 0; i < len(row); i += 2 {
+			cluster, err := strconv.ParseUint(row[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid cluster ID %q", path, line, row[i])
+			}
+			id, err := strconv.ParseUint(row[i+1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid index %q", path, line, row[i+1])
+			}
+			res.Vectors = append(res.Vectors, VectorRef{Cluster: cluster, ID: id})
+		}
+		rows = append(rows, res)
+	}
+}
+
+// QueryDiff compares the rankings of a query in two results files. KendallTau
+// is the rank correlation of the vectors in both rankings, from -1 (reversed)
+// to 1 (same order), or NaN if fewer than two vectors are in both.
+type QueryDiff struct {
+	QueryID     string
+	Jaccard     float64
+	KendallTau  float64
+	Top1Changed bool
+}
+
+// ResultsDiff compares two results files, row-aligned by query ID
+type ResultsDiff struct {
+	Queries []QueryDiff
+	// queries that failed in either file, and queries of only one file
+	Failed  int
+	OnlyOld int
+	OnlyNew int
+}
+
+// DiffResults compares the queries of two results files, by query ID
+func DiffResults(oldRows []ResultRow, newRows []ResultRow) *ResultsDiff {
+	d := new(ResultsDiff)
+	byID := make(map[string]ResultRow)
+	for _, r := range newRows {
+		byID[r.QueryID] = r
+	}
+	seen := make(map[string]bool)
+	for _, o := range oldRows {
+		n, ok := byID[o.QueryID]
+		if !ok {
+			d.OnlyOld++
+			continue
+		}
+		seen[o.QueryID] = true
+		if o.Failed || n.Failed {
+			d.Failed++
+			continue
+		}
+		d.Queries = append(d.Queries, diffRankings(o.QueryID, o.Vectors, n.Vectors))
+	}
+	d.OnlyNew = len(byID) - len(seen)
+	return d
+}
+
+func diffRankings(queryID string, oldRanking []VectorRef, newRanking []VectorRef) QueryDiff {
+	res := QueryDiff{QueryID: queryID, Jaccard: 1, KendallTau: math.NaN()}
+	if len(oldRanking) > 0 && len(newRanking) > 0 {
+		res.Top1Changed = oldRanking[0] != newRanking[0]
+	} else {
+		res.Top1Changed = len(oldRanking) != len(newRanking)
+	}
+
+	rankNew := make(map[VectorRef]int)
+	for i, v := range newRanking {
+		if _, ok := rankNew[v]; !ok {
+			rankNew[v] = i
+		}
+	}
+	// positions in both rankings of the vectors they share
+	common := make([][2]int, 0)
+	inOld := make(map[VectorRef]bool)
+	for i, v := range oldRanking {
+		if inOld[v] {
+			continue
+		}
+		inOld[v] = true
+		if j, ok := rankNew[v]; ok {
+			common = append(common, [2]int{i, j})
+		}
+	}
+	if union := len(inOld) + len(rankNew) - len(common); union > 0 {
+		res.Jaccard = float64(len(common)) / float64(union)
+	}
+
+	if n := len(common); n >= 2 {
+		concordant := 0
+		for a := 0; a < n; a++ {
+			for b := a + 1; b < n; b++ {
+				// the pairs are in old order, so only the new order can disagree
+				if common[a][1] < common[b][1] {
+					concordant++
+				} else {
+					concordant--
+				}
+			}
+		}
+		res.KendallTau = float64(concordant) / float64(n*(n-1)/2)
+	}
+	return res
+}
+
+// Summary returns the mean Jaccard overlap, the mean Kendall tau over the
+// queries it is defined for, and the number of queries whose top-1 changed
+func (d *ResultsDiff) Summary() (float64, float64, int) {
+	jaccard, tau := 0.0, 0.0
+	taus, changed := 0, 0
+	for _, q := range d.Queries {
+		jaccard += q.Jaccard
+		if !math.IsNaN(q.KendallTau) {
+			tau += q.KendallTau
+			taus++
+		}
+		if q.Top1Changed {
+			changed++
+		}
+	}
+	if len(d.Queries) > 0 {
+		jaccard /= float64(len(d.Queries))
+	}
+	if taus > 0 {
+		tau /= float64(taus)
+	} else {
+		tau = math.NaN()
+	}
+	return jaccard, tau, changed
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiffResults(t *testing.T) {
+	dir := t.TempDir()
+	// the old file has no query IDs, the new one was written with -queryID
+	oldFile := filepath.Join(dir, "old_results.csv")
+	newFile := filepath.Join(dir, "new_results.csv")
+	if err := os.WriteFile(oldFile, []byte("0,1,0,2,1,0\n\nerror,query failed\n2,5,2,6\n3,3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newFile, []byte("0,0,2,0,1,1,0\n1\n2,0,0\n3,2,6,2,5\n5,0,0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldRows, err := ReadResults(oldFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRows, err := ReadResults(newFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(oldRows) != 5 || oldRows[3].QueryID != "3" || !oldRows[2].Failed || oldRows[1].Vectors != nil {
+		t.Fatalf("Expected the rows to be numbered by line, but got %+v", oldRows)
+	}
+
+	// the layout is not guessed from the number of fields
+	if _, err := ReadResults(newFile, false); err == nil {
+		t.Errorf("Expected rows with query IDs to be rejected without withQueryID")
+	}
+	if _, err := ReadResults(filepath.Join(dir, "missing_results.csv"), false); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected a missing file to fail with ErrNotExist, but got %v", err)
+	}
+
+	d := DiffResults(oldRows, newRows)
+	if d.Failed != 1 || d.OnlyOld != 1 || d.OnlyNew != 1 {
+		t.Errorf("Expected 1 failed query and 1 query only in each file, but got %+v", d)
+	}
+	expected := map[string]QueryDiff{
+		// the same vectors, with the first two swapped
+		"0": {Jaccard: 1, KendallTau: 1.0 / 3, Top1Changed: true},
+		// no results in either file
+		"1": {Jaccard: 1, KendallTau: math.NaN()},
+		// reversed
+		"3": {Jaccard: 1, KendallTau: -1, Top1Changed: true},
+	}
+	if len(d.Queries) != len(expected) {
+		t.Fatalf("Expected %d queries compared, but got %+v", len(expected), d.Queries)
+	}
+	for _, q := range d.Queries {
+		e := expected[q.QueryID]
+		if q.Jaccard != e.Jaccard || q.Top1Changed != e.Top1Changed || !(q.KendallTau == e.KendallTau || math.IsNaN(q.KendallTau) && math.IsNaN(e.KendallTau)) {
+			t.Errorf("Expected query %s to compare as %+v, but got %+v", q.QueryID, e, q)
+		}
+	}
+
+	jaccard, tau, changed := d.Summary()
+	if jaccard != 1 || math.Abs(tau-(-1.0/3)) > 1e-9 || changed != 2 {
+		t.Errorf("Expected a summary of 1, -1/3 and 2, but got %v, %v and %d", jaccard, tau, changed)
+	}
+
+	// partial overlap
+	q := diffRankings("q", []VectorRef{{0, 1}, {0, 2}, {0, 3}}, []VectorRef{{0, 1}, {0, 4}})
+	if q.Jaccard != 0.25 || !math.IsNaN(q.KendallTau) || q.Top1Changed {
+		t.Errorf("Expected an overlap of 1/4 and an undefined tau, but got %+v", q)
+	}
+}
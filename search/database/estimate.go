@@ -0,0 +1,102 @@
+package database
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// ParamReport is the layout and SimplePIR parameters BuildVectorDatabase would
+// pick for a database, without building it
+type ParamReport struct {
+	// Bins is the number of columns of clusters, Capacity the number of vectors
+	// up to which they are filled, and Rows (l) and Columns (m) the shape of the
+	// database, whose Size values include the padding
+	Bins     uint64
+	Capacity uint64
+	Rows     uint64
+	Columns  uint64
+	Size     uint64
+	// P is the plaintext modulus, of RecordLen bits, Logq the log of the
+	// ciphertext modulus, and N the LWE secret dimension
+	P         uint64
+	Logq      uint64
+	RecordLen uint64
+	N         uint64
+	// MaxPrecBits is the most bits of precision P leaves room for
+	MaxPrecBits uint64
+	// EvenClusters tells whether the sizes of the clusters were assumed even,
+	// for lack of the actual ones
+	EvenClusters bool
+}
+
+// EstimateParams picks the parameters of a database of the vectors of the
+// metadata, as if they were spread evenly over its clusters: the metadata does
+// not give the size of each cluster, and uneven ones may need more rows or
+// columns. It returns why BuildVectorDatabase would fail, if it would.
+func EstimateParams(metadata Metadata, params DatabaseParams) (ParamReport, error) {
+	if metadata.NumClusters == 0 {
+		return ParamReport{}, fmt.Errorf("the metadata holds no clusters")
+	}
+	clusters := make([]*Cluster, metadata.NumClusters)
+	for i := range clusters {
+		// the first clusters take the remainder, one vector each
+		n := metadata.NumVectors / metadata.NumClusters
+		if uint64(i) < metadata.NumVectors%metadata.NumClusters {
+			n++
+		}
+		clusters[i] = &Cluster{Index: uint64(i), NumVectors: n, Dim: metadata.Dim}
+	}
+	report, err := estimateParams(metadata, clusters, params)
+	report.EvenClusters = true
+	return report, err
+}
+
+// EstimateParamsForClusters is like EstimateParams, with the actual sizes of the
+// clusters; their vectors are not needed
+func EstimateParamsForClusters(metadata Metadata, clusters []*Cluster, params DatabaseParams) (ParamReport, error) {
+	if len(clusters) == 0 {
+		return ParamReport{}, fmt.Errorf("no clusters given")
+	}
+	for i, c := range clusters {
+		if c.Dim != metadata.Dim {
+			return ParamReport{}, fmt.Errorf("cluster %d has dimension %d, expected %d", i, c.Dim, metadata.Dim)
+		}
+	}
+	return estimateParams(metadata, clusters, params)
+}
+
+// estimateParams goes through the steps of BuildVectorDatabase up to the
+// allocation of the database
+func estimateParams(metadata Metadata, clusters []*Cluster, params DatabaseParams) (ParamReport, error) {
+	cols, l, m, err := packDatabase(clusters, metadata.Dim, params)
+	if err != nil {
+		return ParamReport{}, err
+	}
+	report := ParamReport{
+		Bins:      uint64(len(cols)),
+		Capacity:  params.ColumnCapacity(),
+		Rows:      l,
+		Columns:   m,
+		Size:      l * m,
+		RecordLen: recordLen,
+	}
+	if err := checkAnswerBudget(l, params); err != nil {
+		return report, err
+	}
+	p, err := pickParams(m)
+	if err != nil {
+		return report, err
+	}
+	report.P, report.Logq, report.N = p.P, p.Logq, p.N
+	report.MaxPrecBits = uint64(bits.Len64(p.P) - 1)
+	return report, nil
+}
+
+// CheckPrecBits tells why values of precBits bits would not fit in P, if they
+// would not
+func (r ParamReport) CheckPrecBits(precBits uint64) error {
+	if precBits > r.MaxPrecBits {
+		return fmt.Errorf("values of %d bits do not fit in P = %d, which leaves room for %d", precBits, r.P, r.MaxPrecBits)
+	}
+	return nil
+}
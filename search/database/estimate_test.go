@@ -0,0 +1,72 @@
+package database
+
+import "testing"
+
+func TestEstimateParams(t *testing.T) {
+	const dim = 4
+	build := func(sizes []uint64) (Metadata, []*Cluster) {
+		clusters := make([]*Cluster, len(sizes))
+		metadata := Metadata{Dim: dim, NumClusters: uint64(len(sizes))}
+		for i, n := range sizes {
+			clusters[i] = &Cluster{Index: uint64(i), NumVectors: n, Dim: dim, PrecBits: 5, Vectors: make([]int8, n*dim)}
+			metadata.NumVectors += n
+		}
+		return metadata, clusters
+	}
+	matches := func(name string, report ParamReport, metadata Metadata, clusters []*Cluster, params DatabaseParams) {
+		db, _, err := BuildVectorDatabase(metadata, clusters, nil, params, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := db.Info.Params
+		if report.Rows != db.Info.L || report.Columns != db.Info.M || report.Size != db.Info.L*db.Info.M {
+			t.Errorf("%s: expected %d rows and %d columns, as built, but got %+v", name, db.Info.L, db.Info.M, report)
+		}
+		if report.P != p.P || report.Logq != p.Logq || report.N != p.N || report.RecordLen != db.Info.RowLength {
+			t.Errorf("%s: expected P = %d, Logq = %d, N = %d and %d-bit records, as built, but got %+v", name, p.P, p.Logq, p.N, db.Info.RowLength, report)
+		}
+		if report.MaxPrecBits != 15 || report.CheckPrecBits(5) != nil || report.CheckPrecBits(16) == nil {
+			t.Errorf("%s: expected room for 15 bits of precision, but got %+v", name, report)
+		}
+	}
+
+	// columns of at most 125 vectors, with uneven clusters
+	params := DatabaseParams{HintSz: 1, MaxColumns: 3, PinnedClusters: []uint64{3}}
+	metadata, clusters := build([]uint64{60, 70, 50, 10, 90, 30})
+	report, err := EstimateParamsForClusters(metadata, clusters, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.EvenClusters || report.Bins != 3 || report.Capacity != 125 {
+		t.Errorf("Expected the 3 bins of the actual clusters, filled up to 125 vectors, but got %+v", report)
+	}
+	matches("uneven clusters", report, metadata, clusters, params)
+
+	// the metadata alone, of clusters whose sizes are even but for the remainder
+	params = DatabaseParams{HintSz: 1}
+	metadata, clusters = build([]uint64{41, 41, 40, 40, 40})
+	report, err = EstimateParams(metadata, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.EvenClusters || report.Bins != 2 {
+		t.Errorf("Expected 2 bins of even clusters, but got %+v", report)
+	}
+	matches("even clusters", report, metadata, clusters, params)
+
+	// the failures of the build, without allocating the database: answers over
+	// budget, more columns than SimplePIR supports, and a missing pinned cluster
+	if _, err := EstimateParams(metadata, DatabaseParams{HintSz: 1, MaxAnswerBytes: 100}); err == nil {
+		t.Errorf("Expected answers over budget to be rejected")
+	}
+	huge := Metadata{NumVectors: 125 * 600, Dim: 4096, NumClusters: 600}
+	if report, err := EstimateParams(huge, DatabaseParams{HintSz: 1}); err == nil || report.Columns != 600*4096 {
+		t.Errorf("Expected %d columns to be rejected, but got %+v and %v", 600*4096, report, err)
+	}
+	if _, err := EstimateParams(metadata, DatabaseParams{HintSz: 1, PinnedClusters: []uint64{5}}); err == nil {
+		t.Errorf("Expected a missing pinned cluster to be rejected")
+	}
+	if _, err := EstimateParams(Metadata{Dim: dim}, params); err == nil {
+		t.Errorf("Expected metadata without clusters to be rejected")
+	}
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+)
+
+// PackedCluster is a cluster in a column of the database, from StartRow down
+type PackedCluster struct {
+	Cluster    uint64 `json:"cluster"`
+	StartRow   uint64 `json:"start_row"`
+	NumVectors uint64 `json:"num_vectors"`
+}
+
+// PackedColumn is a column of clusters, i.e., a bin. Fill is the number of
+// vectors it holds, and Slack the padding rows below them, up to the rows of
+// the database.
+type PackedColumn struct {
+	Column   uint64          `json:"column"`
+	Clusters []PackedCluster `json:"clusters"`
+	Fill     uint64          `json:"fill"`
+	Slack    uint64          `json:"slack"`
+}
+
+// PackingLayout is the assignment of the clusters to the columns of the
+// database, as BuildVectorDatabase lays them out with the same params, for
+// spotting fragmentation. Capacity is the number of vectors up to which
+// columns were filled, and Rows the height of the database.
+type PackingLayout struct {
+	Capacity uint64         `json:"capacity"`
+	Rows     uint64         `json:"rows"`
+	Columns  []PackedColumn `json:"columns"`
+}
+
+// NewPackingLayout packs the clusters exactly like BuildVectorDatabase, which
+// packing is deterministic, and returns the layout
+func NewPackingLayout(clusters []*Cluster, params DatabaseParams) *PackingLayout {
+	capacity := params.ColumnCapacity()
+	cols, colSzs := PackClusters(clusters, capacity, params)
+	rows := utils.Max(colSzs)
+	if rows == 0 {
+		rows = 1
+	}
+
+	pl := &PackingLayout{Capacity: capacity, Rows: rows, Columns: make([]PackedColumn, len(cols))}
+	for i, col := range cols {
+		pc := PackedColumn{Column: uint64(i), Clusters: make([]PackedCluster, len(col)), Fill: colSzs[i], Slack: rows - colSzs[i]}
+		row := uint64(0)
+		for j, c := range col {
+			n := clusters[c].NumVectors
+			pc.Clusters[j] = PackedCluster{Cluster: uint64(c), StartRow: row, NumVectors: n}
+			row += n
+		}
+		pl.Columns[i] = pc
+	}
+	return pl
+}
+
+// WriteJSON writes the layout as indented JSON
+func (pl *PackingLayout) WriteJSON(w io.Writer) error {
+	buf, err := json.MarshalIndent(pl, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(buf, '\n'))
+	return err
+}
+
+// WriteCSV writes a row per cluster, in column order, with the fill and slack
+// of its column repeated on every row of the column
+func (pl *PackingLayout) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"column", "cluster", "start_row", "num_vectors", "column_fill", "column_slack"})
+	for _, col := range pl.Columns {
+		for _, c := range col.Clusters {
+			cw.Write([]string{
+				fmt.Sprint(col.Column), fmt.Sprint(c.Cluster), fmt.Sprint(c.StartRow),
+				fmt.Sprint(c.NumVectors), fmt.Sprint(col.Fill), fmt.Sprint(col.Slack),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
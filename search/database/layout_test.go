@@ -0,0 +1,68 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPackingLayout(t *testing.T) {
+	const dim = 2
+	sizes := []uint64{60, 70, 50, 10, 90}
+	clusters := make([]*Cluster, len(sizes))
+	metadata := Metadata{Dim: dim, NumClusters: uint64(len(sizes))}
+	for i, n := range sizes {
+		clusters[i] = &Cluster{Index: uint64(i), NumVectors: n, Dim: dim, PrecBits: 5, Vectors: make([]int8, n*dim)}
+		metadata.NumVectors += n
+	}
+	// columns of at most 125 vectors
+	params := DatabaseParams{HintSz: 1}
+
+	layout := NewPackingLayout(clusters, params)
+	db, indexMap, err := BuildVectorDatabase(metadata, clusters, nil, params, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.Rows != db.Info.L || uint64(len(layout.Columns))*dim != db.Info.M {
+		t.Errorf("Expected a layout of %d rows and %d columns, but got %d and %d", db.Info.L, db.Info.M/dim, layout.Rows, len(layout.Columns))
+	}
+
+	placed := 0
+	for _, col := range layout.Columns {
+		fill := uint64(0)
+		for _, c := range col.Clusters {
+			if want := DBIndex(c.StartRow, col.Column*dim, db.Info.M); indexMap[uint(c.Cluster)] != want {
+				t.Errorf("Expected cluster %d at %d, as in the database, but the layout puts it at %d", c.Cluster, indexMap[uint(c.Cluster)], want)
+			}
+			if c.StartRow != fill || c.NumVectors != sizes[c.Cluster] {
+				t.Errorf("Expected cluster %d of %d vectors to start at row %d, but got %+v", c.Cluster, sizes[c.Cluster], fill, c)
+			}
+			fill += c.NumVectors
+			placed++
+		}
+		if col.Fill != fill || col.Slack != layout.Rows-fill || col.Fill >= layout.Capacity {
+			t.Errorf("Expected column %d to hold %d vectors below %d, with %d rows of slack, but got %+v", col.Column, fill, layout.Capacity, layout.Rows-fill, col)
+		}
+	}
+	if placed != len(sizes) {
+		t.Errorf("Expected %d clusters in the layout, but got %d", len(sizes), placed)
+	}
+
+	var buf bytes.Buffer
+	if err := layout.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var read PackingLayout
+	if err := json.Unmarshal(buf.Bytes(), &read); err != nil || len(read.Columns) != len(layout.Columns) {
+		t.Errorf("Expected the JSON layout to be read back, but got %v", err)
+	}
+	buf.Reset()
+	if err := layout.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(sizes)+1 || lines[0] != "column,cluster,start_row,num_vectors,column_fill,column_slack" {
+		t.Errorf("Expected a header and a row per cluster, but got %q", buf.String())
+	}
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/henrycg/simplepir/lwe"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+// MergeDatabases combines databases built separately, e.g., over partitions of
+// the clusters on different machines, into one. The columns of the inputs are
+// placed side by side, and the clusters of the i-th input are renumbered after
+// those of the previous inputs, so cluster c of input i becomes cluster
+// c + metas[0].NumClusters + ... + metas[i-1].NumClusters.
+//
+// The inputs must have been built with BuildVectorDatabase with the same
+// dimension and precision. The precision bits are not recorded in a database, so
+// only the plaintext modulus and record length can be checked; mixing precBits
+// is up to the caller to avoid. The inputs are not modified.
+func MergeDatabases(dbs []*pir.Database[matrix.Elem64], maps []ClusterMap, metas []Metadata) (*pir.Database[matrix.Elem64], ClusterMap, Metadata, error) {
+	if len(dbs) == 0 {
+		return nil, nil, Metadata{}, fmt.Errorf("no databases to merge")
+	}
+	if len(maps) != len(dbs) || len(metas) != len(dbs) {
+		return nil, nil, Metadata{}, fmt.Errorf("got %d databases, %d cluster maps and %d metadata", len(dbs), len(maps), len(metas))
+	}
+
+	first := dbs[0].Info
+	merged := Metadata{Dim: metas[0].Dim}
+	l, m := uint64(0), uint64(0)
+	for i, db := range dbs {
+		info := db.Info
+		switch {
+		case metas[i].Dim != merged.Dim:
+			return nil, nil, Metadata{}, fmt.Errorf("database %d has dimension %d, expected %d", i, metas[i].Dim, merged.Dim)
+		case info.P() != first.P() || info.RowLength != first.RowLength || info.Ne != 1 || info.Params.Logq != first.Params.Logq:
+			return nil, nil, Metadata{}, fmt.Errorf("database %d was built with different parameters", i)
+		case db.Data.Cols() != info.M || db.Data.Rows() != info.L:
+			return nil, nil, Metadata{}, fmt.Errorf("database %d is squished, merge the databases before handing them to a server", i)
+		case uint64(len(maps[i])) != metas[i].NumClusters:
+			return nil, nil, Metadata{}, fmt.Errorf("database %d has %d clusters, but its metadata has %d", i, len(maps[i]), metas[i].NumClusters)
+		}
+
+		merged.NumVectors += metas[i].NumVectors
+		merged.NumClusters += metas[i].NumClusters
+		m += info.M
+		if info.L > l {
+			l = info.L
+		}
+	}
+
+	recordLen := first.RowLength
+	p := lwe.NewParamsFixedP(first.Params.Logq, m, first.P())
+	if p == nil || p.P != first.P() {
+		return nil, nil, Metadata{}, fmt.Errorf("no SimplePIR parameters for a merged database with %d columns", m)
+	}
+
+	// copy each database into its own range of columns, padding shorter ones with zeros
+	vals := make([]uint64, l*m)
+	indexMap := make(ClusterMap)
+	colOffset := uint64(0)
+	clusterOffset := uint(0)
+	for i, db := range dbs {
+		info := db.Info
+		for row := uint64(0); row < info.L; row++ {
+			for col := uint64(0); col < info.M; col++ {
+				vals[DBIndex(row, colOffset+col, m)] = uint64(db.Data.Get(row, col))
+			}
+		}
+		for c, idx := range maps[i] {
+			indexMap[c+clusterOffset] = DBIndex(idx/info.M, colOffset+idx%info.M, m)
+		}
+		colOffset += info.M
+		clusterOffset += uint(metas[i].NumClusters)
+	}
+
+	db := pir.NewDatabaseFixedParams[matrix.Elem64](l*m, recordLen, vals, p)
+	if db.Info.L != l || db.Info.M != m {
+		panic("Should not happen")
+	}
+	fmt.Printf("Merged %d databases into %d by %d\n", len(dbs), db.Info.L, db.Info.M)
+
+	return db, indexMap, merged, nil
+}
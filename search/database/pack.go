@@ -0,0 +1,203 @@
+package database
+
+import (
+	"context"
+)
+
+// packProgressInterval is how many clusters packColumns places between two
+// checks of its context and two progress reports
+const packProgressInterval = 1024
+
+// columnIndex tracks the free space of the open columns, to choose the column
+// of the next cluster
+type columnIndex interface {
+	// fit returns a column with more than sz free space, or -1 if none has
+	fit(sz uint64) int
+	// set records the free space of a column, opening it if needed
+	set(column int, free uint64)
+}
+
+// packColumns places the clusters, in the given order, into the column chosen
+// by the first-fit or best-fit rule, opening a new column when none has room.
+// A cluster fits in a column if it leaves it below maxCapacity. Both rules find
+// the column in O(log columns), and break ties by the lowest column, so that the
+// packing is deterministic.
+func packColumns(ctx context.Context, clusters []*Cluster, clusterIndices []uint64, maxCapacity uint64, bestFit bool, progress func(placed int, total int)) ([][]uint, []uint64, error) {
+	cols := make([][]uint, 0)
+	col_szs := make([]uint64, 0)
+	// there are at most as many columns as clusters
+	var free columnIndex
+	if bestFit {
+		free = newBestFitColumns()
+	} else {
+		free = newColumnTree(len(clusterIndices))
+	}
+
+	for i, clusterIndex := range clusterIndices {
+		if i%packProgressInterval == 0 && i > 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, nil, err
+			}
+			if progress != nil {
+				progress(i, len(clusterIndices))
+			}
+		}
+
+		sz := clusters[clusterIndex].NumVectors
+		j := free.fit(sz)
+		if j < 0 {
+			j = len(cols)
+			cols = append(cols, []uint{})
+			col_szs = append(col_szs, 0)
+		}
+		col_szs[j] += sz
+		cols[j] = append(cols[j], uint(clusters[clusterIndex].Index))
+		if col_szs[j] < maxCapacity {
+			free.set(j, maxCapacity-col_szs[j])
+		} else {
+			free.set(j, 0)
+		}
+	}
+	if progress != nil {
+		progress(len(clusterIndices), len(clusterIndices))
+	}
+
+	return cols, col_szs, nil
+}
+
+// columnTree is a segment tree over the free space of columns, to find the
+// first column with more free space than a cluster in O(log columns). Columns
+// that are not open yet have no free space, so that they are never chosen.
+type columnTree struct {
+	leaves uint64
+	// free[1] is the root, free[i] is the maximum of free[2i] and free[2i+1],
+	// and the column j is the leaf free[leaves+j]
+	free []uint64
+}
+
+func newColumnTree(columns int) *columnTree {
+	leaves := uint64(1)
+	for leaves < uint64(columns) {
+		leaves *= 2
+	}
+	return &columnTree{leaves: leaves, free: make([]uint64, 2*leaves)}
+}
+
+func (t *columnTree) set(column int, free uint64) {
+	i := t.leaves + uint64(column)
+	t.free[i] = free
+	for i > 1 {
+		i /= 2
+		t.free[i] = t.free[2*i]
+		if t.free[2*i+1] > t.free[i] {
+			t.free[i] = t.free[2*i+1]
+		}
+	}
+}
+
+// fit returns the first column with more than sz free space, or -1
+func (t *columnTree) fit(sz uint64) int {
+	if t.free[1] <= sz {
+		return -1
+	}
+	i := uint64(1)
+	for i < t.leaves {
+		if t.free[2*i] > sz {
+			i = 2 * i
+		} else {
+			i = 2*i + 1
+		}
+	}
+	return int(i - t.leaves)
+}
+
+// bestFitColumns is a treap of the open columns ordered by free space, then by
+// column, to find the column with the least free space that is larger than a
+// cluster in O(log columns) expected time. The shape of the treap depends on
+// pseudorandom priorities, but the columns it returns do not.
+type bestFitColumns struct {
+	root *treapNode
+	// free space of every open column, to find its node when it changes
+	free []uint64
+	// state of the xorshift generator of the priorities
+	rng uint64
+}
+
+type treapNode struct {
+	free        uint64
+	column      int
+	priority    uint64
+	left, right *treapNode
+}
+
+func newBestFitColumns() *bestFitColumns {
+	return &bestFitColumns{rng: 0x9E3779B97F4A7C15}
+}
+
+// less orders nodes by free space, then by column
+func (n *treapNode) less(free uint64, column int) bool {
+	return n.free < free || (n.free == free && n.column < column)
+}
+
+// split splits t into the nodes before (free, column) and the others
+func split(t *treapNode, free uint64, column int) (*treapNode, *treapNode) {
+	if t == nil {
+		return nil, nil
+	}
+	if t.less(free, column) {
+		l, r := split(t.right, free, column)
+		t.right = l
+		return t, r
+	}
+	l, r := split(t.left, free, column)
+	t.left = r
+	return l, t
+}
+
+// merge joins two treaps, all the nodes of l being before those of r
+func merge(l *treapNode, r *treapNode) *treapNode {
+	if l == nil {
+		return r
+	}
+	if r == nil {
+		return l
+	}
+	if l.priority > r.priority {
+		l.right = merge(l.right, r)
+		return l
+	}
+	r.left = merge(l, r.left)
+	return r
+}
+
+func (b *bestFitColumns) set(column int, free uint64) {
+	if column < len(b.free) {
+		// remove the node of the column
+		l, r := split(b.root, b.free[column], column)
+		_, r = split(r, b.free[column], column+1)
+		b.root = merge(l, r)
+	} else {
+		b.free = append(b.free, 0)
+	}
+	b.free[column] = free
+
+	b.rng ^= b.rng << 13
+	b.rng ^= b.rng >> 7
+	b.rng ^= b.rng << 17
+	l, r := split(b.root, free, column)
+	b.root = merge(merge(l, &treapNode{free: free, column: column, priority: b.rng}), r)
+}
+
+// fit returns the column with the least free space larger than sz, or -1
+func (b *bestFitColumns) fit(sz uint64) int {
+	best := -1
+	for n := b.root; n != nil; {
+		if n.free > sz {
+			best = n.column
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return best
+}
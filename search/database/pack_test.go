@@ -0,0 +1,161 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// randomClusters returns n clusters of up to maxSize vectors, without vectors
+func randomClusters(seed int64, n int, maxSize int) ([]*Cluster, []uint64) {
+	r := rand.New(rand.NewSource(seed))
+	clusters := make([]*Cluster, n)
+	indices := make([]uint64, n)
+	for i := range clusters {
+		clusters[i] = &Cluster{Index: uint64(i), NumVectors: uint64(r.Intn(maxSize))}
+		indices[i] = uint64(i)
+	}
+	return clusters, indices
+}
+
+// packLinear is the reference packing, scanning every column for each cluster
+func packLinear(clusters []*Cluster, indices []uint64, maxCapacity uint64, bestFit bool) ([][]uint, []uint64) {
+	cols := make([][]uint, 0)
+	colSzs := make([]uint64, 0)
+	for _, i := range indices {
+		sz := clusters[i].NumVectors
+		chosen := -1
+		for j := range cols {
+			if colSzs[j]+sz >= maxCapacity {
+				continue
+			}
+			if chosen < 0 || (bestFit && colSzs[j] > colSzs[chosen]) {
+				chosen = j
+			}
+			if !bestFit {
+				break
+			}
+		}
+		if chosen < 0 {
+			chosen = len(cols)
+			cols = append(cols, []uint{})
+			colSzs = append(colSzs, 0)
+		}
+		colSzs[chosen] += sz
+		cols[chosen] = append(cols[chosen], uint(i))
+	}
+	return cols, colSzs
+}
+
+func TestPackColumns(t *testing.T) {
+	numClusters := 5000
+	clusters, indices := randomClusters(3, numClusters, 40)
+	maxCapacity := uint64(100)
+
+	for _, bestFit := range []bool{false, true} {
+		// the column indices find the same columns as a linear scan
+		refCols, refSzs := packLinear(clusters, indices, maxCapacity, bestFit)
+		calls := 0
+		last := 0
+		cols, colSzs, err := packColumns(context.Background(), clusters, indices, maxCapacity, bestFit, func(placed int, total int) {
+			calls++
+			if placed < last || total != numClusters {
+				t.Errorf("Unexpected progress %d of %d after %d", placed, total, last)
+			}
+			last = placed
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cols, refCols) || !reflect.DeepEqual(colSzs, refSzs) {
+			t.Errorf("bestFit %v: expected the packing of a linear scan", bestFit)
+		}
+		if last != numClusters || calls != numClusters/packProgressInterval+1 {
+			t.Errorf("Expected %d progress reports ending at %d, but got %d ending at %d", numClusters/packProgressInterval+1, numClusters, calls, last)
+		}
+	}
+}
+
+func TestPackClustersContext(t *testing.T) {
+	numClusters := 5000
+	clusters, _ := randomClusters(3, numClusters, 40)
+	maxCapacity := uint64(100)
+
+	// PackClustersContext places the largest clusters first, in the column
+	// the column tree finds, which is the one of a linear first-fit scan
+	indices := make([]uint64, numClusters)
+	for i := range indices {
+		indices[i] = uint64(i)
+	}
+	sort.SliceStable(indices, func(i, j int) bool {
+		return clusters[indices[i]].NumVectors > clusters[indices[j]].NumVectors
+	})
+	refCols, refSzs := packLinear(clusters, indices, maxCapacity, false)
+	calls := 0
+	last := 0
+	cols, colSzs, err := PackClustersContext(context.Background(), clusters, maxCapacity, DatabaseParams{}, func(placed int, total int) {
+		calls++
+		if placed < last || total != numClusters {
+			t.Errorf("Unexpected progress %d of %d after %d", placed, total, last)
+		}
+		last = placed
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cols, refCols) || !reflect.DeepEqual(colSzs, refSzs) {
+		t.Errorf("Expected the packing of a linear first-fit scan")
+	}
+	if last != numClusters || calls != numClusters/packProgressInterval+1 {
+		t.Errorf("Expected %d progress reports ending at %d, but got %d ending at %d", numClusters/packProgressInterval+1, numClusters, calls, last)
+	}
+
+	// a cancelled packing stops with the context's error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := PackClustersContext(ctx, clusters, maxCapacity, DatabaseParams{}, nil); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, but got %v", err)
+	}
+
+	// no clusters fail the packing, and the build
+	if _, _, err := PackClustersContext(context.Background(), nil, maxCapacity, DatabaseParams{}, nil); err == nil {
+		t.Errorf("Expected an error packing no clusters")
+	}
+	if _, _, err := BuildVectorDatabase(Metadata{Dim: 3}, nil, nil, DatabaseParams{HintSz: 900}, 5); err == nil || err.Error() != "no clusters given" {
+		t.Errorf("Expected the error of packing no clusters, but got %v", err)
+	}
+}
+
+// BenchmarkPackClusters compares the linear scan over columns, O(clusters x
+// columns), with the column indices of packColumns, O(clusters x log columns).
+// Run with, e.g.:
+//
+//	go test -run NONE -bench PackClusters ./search/database
+func BenchmarkPackClusters(b *testing.B) {
+	for _, n := range []int{10000, 100000} {
+		// small clusters in small columns, so that there are many columns
+		clusters, indices := randomClusters(1, n, 50)
+		maxCapacity := uint64(200)
+		for _, bestFit := range []bool{false, true} {
+			rule := "firstFit"
+			if bestFit {
+				rule = "bestFit"
+			}
+			b.Run(fmt.Sprintf("linear/%s/%d", rule, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					packLinear(clusters, indices, maxCapacity, bestFit)
+				}
+			})
+			b.Run(fmt.Sprintf("indexed/%s/%d", rule, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, _, err := packColumns(context.Background(), clusters, indices, maxCapacity, bestFit, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
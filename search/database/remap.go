@@ -0,0 +1,157 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+)
+
+// ClusterRemap records where a transform of the clusters, such as
+// CompactClusters or DeduplicateClusters, put every original vector: the
+// vectors of original cluster i go to cluster Clusters[i], and vector j of them
+// becomes vector IDs[i][j] there. Several original vectors may map to the same
+// one, e.g., duplicates. Remaps of successive transforms chain with Then, so
+// that queries and results can name the original clusters whatever was done.
+type ClusterRemap struct {
+	Clusters []uint64   `json:"clusters"`
+	IDs      [][]uint64 `json:"ids"`
+
+	// origins holds, for every new vector, the original ones mapped to it, in
+	// the order of the original clusters and vectors
+	origins [][][]VectorRef
+}
+
+// Remap is the ClusterRemap of a compaction
+func (c *Compaction) Remap() *ClusterRemap {
+	r := &ClusterRemap{Clusters: append([]uint64(nil), c.NewCluster...), IDs: make([][]uint64, len(c.NewCluster))}
+	for i := range c.NewCluster {
+		r.IDs[i] = make([]uint64, c.Sizes[i])
+		for j := range r.IDs[i] {
+			r.IDs[i][j] = c.Offset[i] + uint64(j)
+		}
+	}
+	r.index()
+	return r
+}
+
+// Remap is the ClusterRemap of a deduplication, which keeps the clusters
+func (d *Deduplication) Remap() *ClusterRemap {
+	r := &ClusterRemap{Clusters: make([]uint64, len(d.Stored)), IDs: make([][]uint64, len(d.Stored))}
+	for i, stored := range d.Stored {
+		r.Clusters[i] = uint64(i)
+		r.IDs[i] = append([]uint64(nil), stored...)
+	}
+	r.index()
+	return r
+}
+
+// Then chains two remaps: the result maps the original vectors of r to where
+// next, applied to the clusters r produced, put them
+func (r *ClusterRemap) Then(next *ClusterRemap) (*ClusterRemap, error) {
+	res := &ClusterRemap{Clusters: make([]uint64, len(r.Clusters)), IDs: make([][]uint64, len(r.Clusters))}
+	for i, c := range r.Clusters {
+		if c >= uint64(len(next.Clusters)) {
+			return nil, fmt.Errorf("cluster %d maps to cluster %d, but the next remap has %d clusters", i, c, len(next.Clusters))
+		}
+		res.Clusters[i] = next.Clusters[c]
+		res.IDs[i] = make([]uint64, len(r.IDs[i]))
+		for j, id := range r.IDs[i] {
+			if id >= uint64(len(next.IDs[c])) {
+				return nil, fmt.Errorf("vector %d of cluster %d maps to vector %d of cluster %d, but the next remap has %d vectors there", j, i, id, c, len(next.IDs[c]))
+			}
+			res.IDs[i][j] = next.IDs[c][id]
+		}
+	}
+	res.index()
+	return res, nil
+}
+
+// index builds the origins of the new vectors
+func (r *ClusterRemap) index() {
+	numClusters := uint64(0)
+	for _, c := range r.Clusters {
+		if c+1 > numClusters {
+			numClusters = c + 1
+		}
+	}
+	r.origins = make([][][]VectorRef, numClusters)
+	for i, c := range r.Clusters {
+		for j, id := range r.IDs[i] {
+			for uint64(len(r.origins[c])) <= id {
+				r.origins[c] = append(r.origins[c], nil)
+			}
+			r.origins[c][id] = append(r.origins[c][id], VectorRef{Cluster: uint64(i), ID: uint64(j)})
+		}
+	}
+}
+
+// Translate returns the new cluster holding the vectors of an original one
+func (r *ClusterRemap) Translate(cluster uint64) (uint64, error) {
+	if cluster >= uint64(len(r.Clusters)) {
+		return 0, fmt.Errorf("cluster %d does not exist, there were %d clusters before the remap", cluster, len(r.Clusters))
+	}
+	return r.Clusters[cluster], nil
+}
+
+// ApplyRemap translates the cluster of a row of a query file, which starts
+// with the cluster index, returning a new row
+func (r *ClusterRemap) ApplyRemap(query []string) ([]string, error) {
+	if len(query) == 0 {
+		return nil, fmt.Errorf("empty query row")
+	}
+	cluster, err := utils.StringToUint64(query[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster index %q: %w", query[0], err)
+	}
+	translated, err := r.Translate(cluster)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{fmt.Sprintf("%d", translated)}, query[1:]...), nil
+}
+
+// Original returns the original cluster and index within it of a new vector.
+// Of several original vectors mapped to it, it returns the first.
+func (r *ClusterRemap) Original(cluster uint64, id uint64) (uint64, uint64) {
+	o := r.Originals(cluster, id)[0]
+	return o.Cluster, o.ID
+}
+
+// Originals returns all the original vectors mapped to a new vector, e.g., the
+// copies of a duplicate, in the order of the original clusters and vectors
+func (r *ClusterRemap) Originals(cluster uint64, id uint64) []VectorRef {
+	if cluster >= uint64(len(r.origins)) || id >= uint64(len(r.origins[cluster])) || len(r.origins[cluster][id]) == 0 {
+		panic(fmt.Sprintf("Vector %d of cluster %d has no original", id, cluster))
+	}
+	return r.origins[cluster][id]
+}
+
+// WriteRemap writes a remap as JSON, to translate queries and results outside
+// of the run that built the database. It is the one file of the mapping of the
+// original vectors, whatever transforms made it.
+func WriteRemap(file string, r *ClusterRemap) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(buf, '\n'), 0644)
+}
+
+// LoadRemap reads a remap written by WriteRemap
+func LoadRemap(file string) (*ClusterRemap, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r := new(ClusterRemap)
+	if err := json.Unmarshal(buf, r); err != nil {
+		return nil, fmt.Errorf("error parsing remap %s: %w", file, err)
+	}
+	if len(r.IDs) != len(r.Clusters) {
+		return nil, fmt.Errorf("remap %s has %d clusters, but IDs for %d", file, len(r.Clusters), len(r.IDs))
+	}
+	r.index()
+	return r, nil
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestClusterRemap(t *testing.T) {
+	dim := uint64(2)
+	floats := [][]float64{
+		// vectors 0 and 2 are the same
+		{0.5, 0.25, -0.5, 0.5, 0.5, 0.25, 0.75, 0},
+		{0.25, 0.25},
+		{-0.25, 0.5, -0.25, 0.5},
+	}
+	metadata := Metadata{NumVectors: 7, Dim: dim, NumClusters: 3}
+	clusters, err := ClustersFromFloats(metadata, floats, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// deduplicate, then merge the clusters of fewer than 2 vectors
+	dedupMetadata, deduped, dedup := DeduplicateClusters(metadata, clusters)
+	_, compacted, comp := CompactClusters(dedupMetadata, deduped, 2, 100)
+	remap, err := dedup.Remap().Then(comp.Remap())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every original vector is found where the chained remap says
+	for i, c := range clusters {
+		n, err := remap.Translate(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := uint64(0); j < c.NumVectors; j++ {
+			id := remap.IDs[i][j]
+			if !reflect.DeepEqual(compacted[n].Vectors[id*dim:(id+1)*dim], c.Vectors[j*dim:(j+1)*dim]) {
+				t.Errorf("Vector %d of cluster %d is not vector %d of cluster %d", j, i, id, n)
+			}
+		}
+	}
+	// and every stored vector maps back to its first original
+	for n, c := range compacted {
+		for id := uint64(0); id < c.NumVectors; id++ {
+			oc, oid := remap.Original(uint64(n), id)
+			if remap.Clusters[oc] != uint64(n) || remap.IDs[oc][oid] != id {
+				t.Errorf("Vector %d of cluster %d maps back to (%d, %d), which is not stored there", id, n, oc, oid)
+			}
+		}
+	}
+	if oc, oid := remap.Original(remap.Clusters[0], remap.IDs[0][2]); oc != 0 || oid != 0 {
+		t.Errorf("Expected the duplicate vector 2 of cluster 0 to map back to vector 0, but got (%d, %d)", oc, oid)
+	}
+
+	row, err := remap.ApplyRemap([]string{"1", "0.25", "0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{fmt.Sprintf("%d", remap.Clusters[1]), "0.25", "0.5"}; !reflect.DeepEqual(row, expected) {
+		t.Errorf("Expected the row %v, but got %v", expected, row)
+	}
+	if _, err := remap.ApplyRemap([]string{"3", "0.25", "0.5"}); err == nil {
+		t.Errorf("Expected an error for a cluster that does not exist")
+	}
+
+	file := filepath.Join(t.TempDir(), "remap.json")
+	if err := WriteRemap(file, remap); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadRemap(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, remap) {
+		t.Errorf("Expected the remap to round-trip, but got %+v", loaded)
+	}
+
+	// chaining needs the next remap to cover the vectors produced
+	single := &ClusterRemap{Clusters: []uint64{0}, IDs: [][]uint64{{0}}}
+	if _, err := remap.Then(single); err == nil {
+		t.Errorf("Expected an error chaining a remap of fewer vectors")
+	}
+}
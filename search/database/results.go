@@ -0,0 +1,68 @@
+package database
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ValidateResults checks that every (cluster ID, index within cluster) pair of
+// a results file refers to a vector of the database, e.g., to catch golden files
+// gone stale after a rebuild changed the cluster sizes. The file must be in the
+// default layout of the CLI, i.e., written without -queryID, -externalIDs or
+// -scores; rows of failed queries are skipped. indexMap and clusters are those
+// the database was built with, which give the number of vectors of every
+// cluster. The first invalid pair is reported with its line number.
+func ValidateResults(resultsPath string, indexMap ClusterMap, clusters []*Cluster) error {
+	f, err := os.Open(resultsPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	for first := true; ; first = false {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", resultsPath, err)
+		}
+		// csv skips the empty lines of queries without results
+		line, _ := reader.FieldPos(0)
+		if first {
+			row[0] = strings.TrimPrefix(row[0], "\uFEFF")
+		}
+		if len(row) > 0 && row[0] == "error" {
+			continue
+		}
+		if len(row)%2 != 0 {
+			return fmt.Errorf("%s:%d: expected (cluster, index) pairs, got %d fields", resultsPath, line, len(row))
+		}
+		for i := 0; i < len(row); i += 2 {
+			cluster, err := strconv.ParseUint(row[i], 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s:%d: invalid cluster ID %q", resultsPath, line, row[i])
+			}
+			id, err := strconv.ParseUint(row[i+1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s:%d: invalid index %q", resultsPath, line, row[i+1])
+			}
+			if cluster >= uint64(len(clusters)) {
+				return fmt.Errorf("%s:%d: cluster %d does not exist, the database has %d clusters", resultsPath, line, cluster, len(clusters))
+			}
+			size := clusters[cluster].NumVectors
+			if _, ok := indexMap[uint(cluster)]; !ok && size > 0 {
+				return fmt.Errorf("%s:%d: cluster %d is not in the database", resultsPath, line, cluster)
+			}
+			if id >= size {
+				return fmt.Errorf("%s:%d: (%d, %d) is out of range, cluster %d has %d vectors", resultsPath, line, cluster, id, cluster, size)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateResults(t *testing.T) {
+	indexMap := ClusterMap{0: 0, 1: 1, 2: 2}
+	clusters := []*Cluster{{Index: 0, NumVectors: 4}, {Index: 1, NumVectors: 3}, {Index: 2}}
+
+	cases := []struct {
+		results string
+		err     string // expected substring of the error, or "" for none
+	}{
+		{"0,3,1,2\n\n1,0,0,0\n", ""},
+		{"\uFEFF0,1\nerror,query failed\n1,1\n", ""},
+		{"0,1\n1,3,0,0\n", ":2: (1, 3) is out of range, cluster 1 has 3 vectors"},
+		{"0,1\n\n2,0\n", ":3: (2, 0) is out of range"},
+		{"3,0\n", ":1: cluster 3 does not exist"},
+		{"0,1,2\n", ":1: expected (cluster, index) pairs"},
+		{"0,x\n", `:1: invalid index "x"`},
+	}
+	file := filepath.Join(t.TempDir(), "golden_results.csv")
+	for _, c := range cases {
+		if err := os.WriteFile(file, []byte(c.results), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := ValidateResults(file, indexMap, clusters)
+		if c.err == "" && err != nil {
+			t.Errorf("%q: unexpected error %v", c.results, err)
+		}
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%q: expected an error containing %q, but got %v", c.results, c.err, err)
+		}
+	}
+
+	// a missing file is an error, not a panic
+	if err := ValidateResults(filepath.Join(t.TempDir(), "missing_results.csv"), indexMap, clusters); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected a missing file to fail with ErrNotExist, but got %v", err)
+	}
+}
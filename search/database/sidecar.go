@@ -0,0 +1,77 @@
+package database
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// FloatSidecar is a plaintext store of the unquantized vectors of some or all
+// clusters, outside the PIR database, to score candidates exactly
+type FloatSidecar struct {
+	Dim     uint64
+	vectors map[VectorRef][]float64
+}
+
+// ReadFloatSidecar reads a csv file of rows cluster,index,values..., where the
+// index is that of the vector within its cluster. Every row has the same
+// number of values, which is the dimension of the sidecar.
+func ReadFloatSidecar(file string) (*FloatSidecar, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(bufio.NewReaderSize(f, DefaultReadBufferSize))
+	s := &FloatSidecar{vectors: make(map[VectorRef][]float64)}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		line, _ := reader.FieldPos(0)
+		if len(row) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected a cluster, an index and values, got %d columns", file, line, len(row))
+		}
+		var ref VectorRef
+		if ref.Cluster, err = strconv.ParseUint(row[0], 10, 64); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid cluster ID %q", file, line, row[0])
+		}
+		if ref.ID, err = strconv.ParseUint(row[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid index %q", file, line, row[1])
+		}
+		if _, ok := s.vectors[ref]; ok {
+			return nil, fmt.Errorf("%s:%d: vector %d of cluster %d is listed twice", file, line, ref.ID, ref.Cluster)
+		}
+		v := make([]float64, len(row)-2)
+		for j := range v {
+			if v[j], err = strconv.ParseFloat(row[j+2], 64); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", file, line, err)
+			}
+		}
+		s.vectors[ref] = v
+	}
+	if len(s.vectors) == 0 {
+		return nil, fmt.Errorf("%s holds no vectors", file)
+	}
+	s.Dim = uint64(reader.FieldsPerRecord - 2)
+	return s, nil
+}
+
+// Vector returns the vector of a cluster, if the sidecar holds it
+func (s *FloatSidecar) Vector(cluster uint64, id uint64) ([]float64, bool) {
+	v, ok := s.vectors[VectorRef{Cluster: cluster, ID: id}]
+	return v, ok
+}
+
+// Len is the number of vectors of the sidecar
+func (s *FloatSidecar) Len() int {
+	return len(s.vectors)
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+)
+
+// DimSlice selects dimensions Lo to Hi-1 of every vector, e.g., to study how
+// search quality depends on the dimension without writing new files. The zero
+// value selects every dimension.
+type DimSlice struct {
+	Lo uint64
+	Hi uint64
+}
+
+// ParseDimSlice parses a slice written as lo:hi, or the empty string for none
+func ParseDimSlice(s string) (DimSlice, error) {
+	if s == "" {
+		return DimSlice{}, nil
+	}
+	bounds := strings.Split(s, ":")
+	if len(bounds) != 2 {
+		return DimSlice{}, fmt.Errorf("invalid dimension slice %q, expected lo:hi", s)
+	}
+	lo, err := utils.StringToUint64(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return DimSlice{}, fmt.Errorf("invalid lower bound in dimension slice %q", s)
+	}
+	hi, err := utils.StringToUint64(strings.TrimSpace(bounds[1]))
+	if err != nil {
+		return DimSlice{}, fmt.Errorf("invalid upper bound in dimension slice %q", s)
+	}
+	if lo >= hi {
+		return DimSlice{}, fmt.Errorf("dimension slice %q is empty, expected lo < hi", s)
+	}
+	return DimSlice{Lo: lo, Hi: hi}, nil
+}
+
+// IsSet tells whether the slice selects dimensions, rather than all of them
+func (d DimSlice) IsSet() bool {
+	return d.Hi > 0
+}
+
+func (d DimSlice) String() string {
+	if !d.IsSet() {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", d.Lo, d.Hi)
+}
+
+// Validate checks that the slice selects dimensions of dim-dimensional vectors
+func (d DimSlice) Validate(dim uint64) error {
+	if d.Lo >= d.Hi || d.Hi > dim {
+		return fmt.Errorf("dimension slice %d:%d is out of range for %d-dim vectors, expected 0 <= lo < hi <= %d", d.Lo, d.Hi, dim, dim)
+	}
+	return nil
+}
+
+// SliceCluster returns a copy of a cluster holding the sliced dimensions of its
+// vectors and of its centroid and variance, if any. The norms of the whole
+// vectors do not carry over to the slices, and are dropped.
+func SliceCluster(c *Cluster, d DimSlice) (*Cluster, error) {
+	if err := d.Validate(c.Dim); err != nil {
+		return nil, fmt.Errorf("cluster %d: %w", c.Index, err)
+	}
+	res := *c
+	res.Dim = d.Hi - d.Lo
+	res.Vectors = make([]int8, 0, c.NumVectors*res.Dim)
+	for j := uint64(0); j < c.NumVectors; j++ {
+		res.Vectors = append(res.Vectors, c.Vectors[j*c.Dim+d.Lo:j*c.Dim+d.Hi]...)
+	}
+	if uint64(len(c.Centroid)) == c.Dim {
+		res.Centroid = append([]float64(nil), c.Centroid[d.Lo:d.Hi]...)
+	}
+	if c.Stats != nil {
+		res.Stats = &ClusterStats{Kinds: c.Stats.Kinds &^ StatNorms}
+		if uint64(len(c.Stats.Variance)) == c.Dim {
+			res.Stats.Variance = append([]float64(nil), c.Stats.Variance[d.Lo:d.Hi]...)
+		}
+		if res.Stats.Kinds == 0 {
+			res.Stats = nil
+		}
+	}
+	return &res, nil
+}
+
+// SliceClusters slices every cluster, as SliceCluster, along with the metadata
+func SliceClusters(metadata Metadata, clusters []*Cluster, d DimSlice) (Metadata, []*Cluster, error) {
+	if err := d.Validate(metadata.Dim); err != nil {
+		return metadata, nil, err
+	}
+	sliced := make([]*Cluster, len(clusters))
+	for i, c := range clusters {
+		var err error
+		if sliced[i], err = SliceCluster(c, d); err != nil {
+			return metadata, nil, err
+		}
+	}
+	metadata.Dim = d.Hi - d.Lo
+	if metadata.Mean != nil {
+		metadata.Mean = metadata.Mean[d.Lo:d.Hi]
+	}
+	return metadata, sliced, nil
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSliceClusters(t *testing.T) {
+	metadata := Metadata{NumVectors: 3, Dim: 4, NumClusters: 2}
+	clusters, err := ClustersFromFloats(metadata, [][]float64{
+		{0.5, 0.25, -0.5, 0, 0.125, -0.25, 0.75, 1},
+		{-1, 0.5, 0.25, 0.5},
+	}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := append([]int8(nil), clusters[0].Vectors...)
+
+	d, err := ParseDimSlice("1:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newMetadata, sliced, err := SliceClusters(metadata, clusters, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newMetadata.Dim != 2 || newMetadata.NumVectors != 3 {
+		t.Errorf("Expected 3 2-dim vectors, but got %d %d-dim vectors", newMetadata.NumVectors, newMetadata.Dim)
+	}
+	expected := []int8{original[1], original[2], original[5], original[6]}
+	if !reflect.DeepEqual(sliced[0].Vectors, expected) || sliced[0].Dim != 2 {
+		t.Errorf("Expected the vectors %v, but got %v", expected, sliced[0].Vectors)
+	}
+	if !reflect.DeepEqual(sliced[1].Centroid, clusters[1].Centroid[1:3]) {
+		t.Errorf("Expected the centroid %v, but got %v", clusters[1].Centroid[1:3], sliced[1].Centroid)
+	}
+	if !reflect.DeepEqual(clusters[0].Vectors, original) || clusters[0].Dim != 4 {
+		t.Errorf("Slicing modified the original cluster")
+	}
+
+	// the whole range is the identity
+	_, all, err := SliceClusters(metadata, clusters, DimSlice{Lo: 0, Hi: 4})
+	if err != nil || !reflect.DeepEqual(all[0].Vectors, original) {
+		t.Errorf("Expected slice 0:4 to keep every value, but got %v, %v", all, err)
+	}
+
+	for _, s := range []string{"3", "2:2", "3:1", "a:2", "1:b", "-1:2"} {
+		if _, err := ParseDimSlice(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+	if _, _, err := SliceClusters(metadata, clusters, DimSlice{Lo: 2, Hi: 5}); err == nil {
+		t.Errorf("Expected an error for a slice beyond the dimension")
+	}
+}
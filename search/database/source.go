@@ -0,0 +1,145 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ClusterSource provides the clusters of a database, one at a time, e.g., from
+// files, a database or an object store
+type ClusterSource interface {
+	NumClusters() uint64
+	Metadata() Metadata
+	// ReadCluster returns cluster i, with its Index set to i
+	ReadCluster(i uint64) (*Cluster, error)
+}
+
+// FileClusterSource reads the clusters of a preamble from files, in any of the
+// layouts of FindClusterFiles, along with their external IDs. Without a
+// metadata file, the metadata is inferred from csv cluster files.
+type FileClusterSource struct {
+	preamble string
+	precBits uint64
+	opts     ReadOptions
+	metadata Metadata
+	format   ClusterFiles
+	// combined holds the clusters of a CombinedJsonlFile once read
+	combined []*Cluster
+}
+
+func NewFileClusterSource(clusterPreamble string, precBits uint64, opts ReadOptions) (*FileClusterSource, error) {
+	dir := filepath.Dir(clusterPreamble)
+	prefix := filepath.Base(clusterPreamble)
+
+	metadataFile := filepath.Join(dir, prefix+"_metadata.json")
+	var metadata Metadata
+	if _, err := os.Stat(metadataFile); os.IsNotExist(err) {
+		metadata, err = InferMetadata(clusterPreamble)
+		if err != nil {
+			return nil, fmt.Errorf("error inferring metadata: %w", err)
+		}
+		fmt.Printf("Warning: %s does not exist, inferred %d %d-dim vectors in %d clusters from the cluster files\n", metadataFile, metadata.NumVectors, metadata.Dim, metadata.NumClusters)
+	} else {
+		var err error
+		if metadata, err = ReadMetadata(metadataFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := metadata.ValidateDim(opts.MaxDim); err != nil {
+		return nil, fmt.Errorf("%s: %w", metadataFile, err)
+	}
+
+	format := FindClusterFiles(clusterPreamble)
+	if opts.Quantized && format != CsvClusterFiles {
+		return nil, fmt.Errorf("quantized input is only supported for csv cluster files")
+	}
+	mean, err := opts.Centering(clusterPreamble, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if mean != nil && format != CsvClusterFiles {
+		return nil, fmt.Errorf("centering is only supported for csv cluster files")
+	}
+	if opts.Quantizer != nil && (format != CsvClusterFiles || opts.Quantized) {
+		return nil, fmt.Errorf("custom quantizers are only supported for unquantized csv cluster files")
+	}
+	if opts.Stats != 0 && format != CsvClusterFiles {
+		return nil, fmt.Errorf("statistics are only gathered from csv cluster files")
+	}
+	opts.Mean, metadata.Mean = mean, mean
+	return &FileClusterSource{
+		preamble: clusterPreamble,
+		precBits: precBits,
+		opts:     opts,
+		metadata: metadata,
+		format:   format,
+	}, nil
+}
+
+func (s *FileClusterSource) NumClusters() uint64 {
+	return s.metadata.NumClusters
+}
+
+func (s *FileClusterSource) Metadata() Metadata {
+	return s.metadata
+}
+
+// ReadCluster reads cluster i. With a single JSONL file, the first call reads
+// all clusters, which later calls return.
+func (s *FileClusterSource) ReadCluster(i uint64) (*Cluster, error) {
+	switch s.format {
+	case CsvClusterFiles, JsonlClusterFiles:
+		return ReadCluster(s.preamble, s.metadata, i, s.precBits, s.opts)
+	case CombinedJsonlFile:
+		if i >= s.metadata.NumClusters {
+			return nil, fmt.Errorf("cluster %d does not exist, there are %d clusters", i, s.metadata.NumClusters)
+		}
+		if s.combined == nil {
+			dir := filepath.Dir(s.preamble)
+			prefix := filepath.Base(s.preamble)
+			combined, err := ReadClustersFromJsonl(filepath.Join(dir, prefix+"_clusters.jsonl"), s.metadata.NumClusters, s.metadata.Dim, s.precBits)
+			if err != nil {
+				return nil, err
+			}
+			s.combined = combined
+		}
+		c := s.combined[i]
+		if err := readClusterIDs(s.preamble, c); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("no cluster files found for %s", s.preamble)
+}
+
+// ReadAllFromSource reads every cluster of a source, checking them against its
+// metadata and precBits
+func ReadAllFromSource(src ClusterSource, precBits uint64) (Metadata, []*Cluster, error) {
+	metadata := src.Metadata()
+	if src.NumClusters() != metadata.NumClusters {
+		return metadata, nil, fmt.Errorf("source has %d clusters, but its metadata %d", src.NumClusters(), metadata.NumClusters)
+	}
+
+	clusters := make([]*Cluster, metadata.NumClusters)
+	numVectors := uint64(0)
+	for i := range clusters {
+		c, err := src.ReadCluster(uint64(i))
+		if err != nil {
+			return metadata, nil, fmt.Errorf("cluster %d: %w", i, err)
+		}
+		if c.PrecBits != precBits {
+			return metadata, nil, fmt.Errorf("cluster %d has precision %d, expected %d", i, c.PrecBits, precBits)
+		}
+		clusters[i] = c
+		numVectors += c.NumVectors
+	}
+	if err := validateUniformDim(clusters, metadata.Dim); err != nil {
+		return metadata, nil, err
+	}
+	if numVectors != metadata.NumVectors {
+		return metadata, nil, fmt.Errorf("clusters hold %d vectors in total, but the metadata %d", numVectors, metadata.NumVectors)
+	}
+	return metadata, clusters, nil
+}
@@ -0,0 +1,145 @@
+package database
+
+import "math"
+
+// StatKind selects the statistics of the vectors of a cluster gathered as they
+// are read, beyond the centroid, which is always computed
+type StatKind uint
+
+const (
+	// StatNorms is the L2 norm of every vector
+	StatNorms StatKind = 1 << iota
+	// StatVariance is the per-dimension variance
+	StatVariance
+)
+
+// ClusterStats holds the statistics a cluster was read with, of the vectors
+// before quantization, after centering if any, in the scale of the raw queries
+type ClusterStats struct {
+	Kinds StatKind
+	// Norms is the norm of every vector, with StatNorms
+	Norms []float64
+	// Variance is the population variance of every dimension, with StatVariance
+	Variance []float64
+}
+
+// StatsAccumulator gathers the centroid and the requested statistics of the
+// vectors of a cluster in a single pass, as they are read. The variance is
+// accumulated with Welford's algorithm, which does not lose precision to large
+// means the way a sum of squares does.
+type StatsAccumulator struct {
+	kinds StatKind
+	n     uint64
+	sum   []float64
+	mean  []float64
+	m2    []float64
+	norms []float64
+}
+
+// NewStatsAccumulator accumulates the statistics of vectors of dimension dim
+func NewStatsAccumulator(dim uint64, kinds StatKind) *StatsAccumulator {
+	a := &StatsAccumulator{kinds: kinds, sum: make([]float64, dim)}
+	if kinds&StatVariance != 0 {
+		a.mean = make([]float64, dim)
+		a.m2 = make([]float64, dim)
+	}
+	if kinds&StatNorms != 0 {
+		a.norms = make([]float64, 0)
+	}
+	return a
+}
+
+// Add accumulates a vector, which the accumulator does not keep
+func (a *StatsAccumulator) Add(vec []float64) {
+	a.n++
+	norm := 0.0
+	for j, u := range vec {
+		a.sum[j] += u
+		norm += u * u
+		if a.m2 != nil {
+			delta := u - a.mean[j]
+			a.mean[j] += delta / float64(a.n)
+			a.m2[j] += delta * (u - a.mean[j])
+		}
+	}
+	if a.norms != nil {
+		a.norms = append(a.norms, math.Sqrt(norm))
+	}
+}
+
+// Centroid is the mean of the vectors added so far
+func (a *StatsAccumulator) Centroid() []float64 {
+	return centroid(append([]float64(nil), a.sum...), a.n)
+}
+
+// Stats returns the requested statistics of the vectors added so far, or nil if
+// none were requested
+func (a *StatsAccumulator) Stats() *ClusterStats {
+	if a.kinds == 0 {
+		return nil
+	}
+	stats := &ClusterStats{Kinds: a.kinds}
+	if a.norms != nil {
+		stats.Norms = append([]float64(nil), a.norms...)
+	}
+	if a.m2 != nil {
+		stats.Variance = make([]float64, len(a.m2))
+		for j, v := range a.m2 {
+			if a.n > 0 {
+				stats.Variance[j] = v / float64(a.n)
+			}
+		}
+	}
+	return stats
+}
+
+// apply sets the centroid and the statistics of a cluster read with a
+func (a *StatsAccumulator) apply(c *Cluster) {
+	c.Centroid = a.Centroid()
+	c.Stats = a.Stats()
+}
+
+// clone copies the statistics, which may be nil
+func (s *ClusterStats) clone() *ClusterStats {
+	if s == nil {
+		return nil
+	}
+	res := *s
+	if s.Norms != nil {
+		res.Norms = append([]float64(nil), s.Norms...)
+	}
+	if s.Variance != nil {
+		res.Variance = append([]float64(nil), s.Variance...)
+	}
+	return &res
+}
+
+// mergeStats returns the statistics of the union of two clusters, of the kinds
+// both have, given their sizes and centroids
+func mergeStats(dst *ClusterStats, n uint64, dstCentroid []float64, src *ClusterStats, m uint64, srcCentroid []float64) *ClusterStats {
+	if dst == nil || src == nil {
+		return nil
+	}
+	res := &ClusterStats{Kinds: dst.Kinds & src.Kinds}
+	if res.Kinds&StatNorms != 0 {
+		res.Norms = append(append([]float64(nil), dst.Norms...), src.Norms...)
+	}
+	if res.Kinds&StatVariance != 0 {
+		if dstCentroid == nil || srcCentroid == nil {
+			res.Kinds &^= StatVariance
+		} else {
+			// Chan et al.'s combination of the sums of squared deviations
+			total := float64(n + m)
+			res.Variance = make([]float64, len(dst.Variance))
+			for j := 0; n+m > 0 && j < len(res.Variance); j++ {
+				delta := srcCentroid[j] - dstCentroid[j]
+				m2 := dst.Variance[j]*float64(n) + src.Variance[j]*float64(m) + delta*delta*float64(n)*float64(m)/total
+				res.Variance[j] = m2 / total
+			}
+		}
+	}
+	if res.Kinds == 0 {
+		return nil
+	}
+	return res
+}
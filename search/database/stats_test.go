@@ -0,0 +1,115 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// naiveStats recomputes the centroid, norms and variance of vectors in separate
+// passes
+func naiveStats(vectors [][]float64) (centroid []float64, norms []float64, variance []float64) {
+	dim := len(vectors[0])
+	centroid = make([]float64, dim)
+	for _, v := range vectors {
+		for j, u := range v {
+			centroid[j] += u / float64(len(vectors))
+		}
+	}
+	variance = make([]float64, dim)
+	for _, v := range vectors {
+		norm := 0.0
+		for j, u := range v {
+			norm += u * u
+			variance[j] += (u - centroid[j]) * (u - centroid[j]) / float64(len(vectors))
+		}
+		norms = append(norms, math.Sqrt(norm))
+	}
+	return centroid, norms, variance
+}
+
+func checkClose(t *testing.T, what string, got []float64, expected []float64) {
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d values of the %s, but got %d", len(expected), what, len(got))
+	}
+	for j := range got {
+		if math.Abs(got[j]-expected[j]) > 1e-9*(1+math.Abs(expected[j])) {
+			t.Errorf("Expected %g for value %d of the %s, but got %g", expected[j], j, what, got[j])
+		}
+	}
+}
+
+func TestClusterStats(t *testing.T) {
+	dim := 6
+	sizes := []int{40, 25}
+	rng := rand.New(rand.NewSource(3))
+	preamble := filepath.Join(t.TempDir(), "stats")
+	vectors := make([][][]float64, len(sizes))
+	for i, n := range sizes {
+		var csv strings.Builder
+		for k := 0; k < n; k++ {
+			v := make([]float64, dim)
+			row := make([]string, dim)
+			for j := range v {
+				// a large offset, which a sum of squares would lose the variance to
+				v[j] = 1000 + float64(j) + rng.Float64() - 0.5
+				row[j] = strconv.FormatFloat(v[j], 'g', -1, 64)
+			}
+			vectors[i] = append(vectors[i], v)
+			csv.WriteString(strings.Join(row, ",") + "\n")
+		}
+		writeTestFile(t, fmt.Sprintf("%s_cluster_%d.csv", preamble, i), csv.String())
+	}
+	writeTestFile(t, preamble+"_metadata.json", fmt.Sprintf(`{"num_vectors": %d, "num_clusters": %d, "dim": %d}`, sizes[0]+sizes[1], len(sizes), dim))
+
+	_, clusters, err := ReadAllClustersWithOptions(preamble, 5, ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clusters[0].Stats != nil || clusters[0].Centroid == nil {
+		t.Errorf("Expected only the centroid without statistics requested, but got %+v", clusters[0].Stats)
+	}
+
+	metadata, clusters, err := ReadAllClustersWithOptions(preamble, 5, ReadOptions{Stats: StatNorms | StatVariance})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range clusters {
+		centroid, norms, variance := naiveStats(vectors[i])
+		checkClose(t, fmt.Sprintf("centroid of cluster %d", i), c.Centroid, centroid)
+		checkClose(t, fmt.Sprintf("norms of cluster %d", i), c.Stats.Norms, norms)
+		checkClose(t, fmt.Sprintf("variance of cluster %d", i), c.Stats.Variance, variance)
+	}
+
+	_, onlyNorms, err := ReadAllClustersWithOptions(preamble, 5, ReadOptions{Stats: StatNorms})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := onlyNorms[1].Stats; s.Variance != nil || len(s.Norms) != sizes[1] {
+		t.Errorf("Expected only the %d norms, but got %d norms and variance %v", sizes[1], len(s.Norms), s.Variance)
+	}
+
+	// merged clusters have the statistics of the union
+	_, compacted, _ := CompactClusters(metadata, clusters, 100, 100)
+	if len(compacted) != 1 {
+		t.Fatalf("Expected the clusters to be merged into one, but got %d", len(compacted))
+	}
+	centroid, norms, variance := naiveStats(append(append([][]float64(nil), vectors[0]...), vectors[1]...))
+	checkClose(t, "centroid of the merged cluster", compacted[0].Centroid, centroid)
+	checkClose(t, "norms of the merged cluster", compacted[0].Stats.Norms, norms)
+	checkClose(t, "variance of the merged cluster", compacted[0].Stats.Variance, variance)
+	checkClose(t, "norms of the original cluster", clusters[0].Stats.Norms, norms[:sizes[0]])
+
+	sliced, err := SliceCluster(clusters[0], DimSlice{Lo: 2, Hi: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sliced.Stats.Norms != nil || sliced.Stats.Kinds != StatVariance {
+		t.Errorf("Expected the norms of the whole vectors to be dropped from a slice, but got %+v", sliced.Stats)
+	}
+	checkClose(t, "variance of the slice", sliced.Stats.Variance, clusters[0].Stats.Variance[2:4])
+}
@@ -0,0 +1,84 @@
+//go:build stress && linux
+
+package database
+
+import (
+	"flag"
+	"math/rand"
+	"runtime"
+	"syscall"
+	"testing"
+
+	prgrand "github.com/henrycg/simplepir/rand"
+)
+
+// Run with, e.g.:
+//
+//	go test -tags stress -run TestBuildVectorDatabaseMemory -timeout 0 ./search/database -stress.vectors=5000000 -stress.dim=256
+var (
+	stressVectors  = flag.Uint64("stress.vectors", 5000000, "number of synthetic vectors")
+	stressDim      = flag.Uint64("stress.dim", 256, "dimension of the synthetic vectors")
+	stressClusters = flag.Uint64("stress.clusters", 2000, "number of synthetic clusters")
+	stressSeed     = flag.Int64("stress.seed", 1, "seed of the synthetic database")
+	stressMaxRSS   = flag.Uint64("stress.maxRSSMB", 32768, "fail if the peak RSS exceeds this many MB")
+)
+
+// randomSyntheticClusters deterministically generates numVectors quantized vectors
+// spread over numClusters clusters of uneven sizes
+func randomSyntheticClusters(seed int64, numVectors uint64, dim uint64, numClusters uint64, precBits uint64) (Metadata, []*Cluster) {
+	r := rand.New(rand.NewSource(seed))
+	bound := 1 << (precBits - 1)
+
+	// assign every vector to a random cluster
+	sizes := make([]uint64, numClusters)
+	for i := uint64(0); i < numVectors; i++ {
+		sizes[r.Int63n(int64(numClusters))]++
+	}
+
+	clusters := make([]*Cluster, numClusters)
+	for i, sz := range sizes {
+		vectors := make([]int8, sz*dim)
+		for j := range vectors {
+			vectors[j] = int8(r.Intn(2*bound+1) - bound)
+		}
+		clusters[i] = &Cluster{
+			Index:      uint64(i),
+			NumVectors: sz,
+			Dim:        dim,
+			PrecBits:   precBits,
+			Vectors:    vectors,
+		}
+	}
+	return Metadata{NumVectors: numVectors, Dim: dim, NumClusters: numClusters}, clusters
+}
+
+func TestBuildVectorDatabaseMemory(t *testing.T) {
+	metadata, clusters := randomSyntheticClusters(*stressSeed, *stressVectors, *stressDim, *stressClusters, 5)
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	db, _, err := BuildVectorDatabase(metadata, clusters, prgrand.RandomPRGKey(), DatabaseParams{HintSz: 900}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		t.Fatal(err)
+	}
+
+	// vals holds one uint64 per database entry, including the padding
+	valsMB := float64(db.Info.L*db.Info.M*8) / (1 << 20)
+	inputMB := float64(metadata.NumVectors*metadata.Dim) / (1 << 20)
+	peakRSSMB := uint64(usage.Maxrss) / 1024 // Maxrss is in KB on Linux
+	t.Logf("%d %d-dim vectors in %d clusters: input %.0f MB, vals %.0f MB (%d by %d), allocated %.0f MB, peak RSS %d MB",
+		metadata.NumVectors, metadata.Dim, metadata.NumClusters, inputMB, valsMB, db.Info.L, db.Info.M,
+		float64(after.TotalAlloc-before.TotalAlloc)/(1<<20), peakRSSMB)
+
+	if peakRSSMB > *stressMaxRSS {
+		t.Errorf("Peak RSS of %d MB exceeds the limit of %d MB", peakRSSMB, *stressMaxRSS)
+	}
+}
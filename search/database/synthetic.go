@@ -0,0 +1,27 @@
+package database
+
+// SyntheticFloats generates clusters of the given sizes of dim values, which
+// cycle through [-0.5, 0.5) from seed: clusters of different seeds differ. It
+// backs the tests of this package and of the packages built on it
+func SyntheticFloats(dim uint64, sizes []int, seed int) (Metadata, [][]float64) {
+	floats := make([][]float64, len(sizes))
+	numVectors := 0
+	for i, sz := range sizes {
+		for j := 0; j < sz*int(dim); j++ {
+			floats[i] = append(floats[i], float64((seed+i*7+j*3)%11)/11-0.5)
+		}
+		numVectors += sz
+	}
+	return Metadata{NumVectors: uint64(numVectors), Dim: dim, NumClusters: uint64(len(sizes))}, floats
+}
+
+// SyntheticClusters is SyntheticFloats, quantized to 5 bits
+func SyntheticClusters(dim uint64, sizes []int, seed int) (Metadata, []*Cluster) {
+	metadata, floats := SyntheticFloats(dim, sizes, seed)
+	clusters, err := ClustersFromFloats(metadata, floats, 5)
+	if err != nil {
+		// the metadata and values are generated to match, so only a dim of 0 gets here
+		panic(err)
+	}
+	return metadata, clusters
+}
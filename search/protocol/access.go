@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"sort"
+	"sync"
+)
+
+// accessCounts counts the queries made to each cluster
+type accessCounts struct {
+	mu     sync.Mutex
+	counts map[uint64]uint64
+}
+
+// TrackClusterAccess enables counting the queries made to each cluster, to find
+// hot clusters worth pinning (see DatabaseParams.PinnedClusters). Tracking is off
+// by default.
+//
+// The server cannot tell which cluster a query is for, since the query is
+// encrypted: the counts are only as good as what is passed to
+// RecordClusterAccess, e.g., by a benchmark harness that plays both parties.
+// Reporting the cluster of real queries would reveal the access pattern that PIR
+// hides, so this is for offline analysis only.
+func (s *Server) TrackClusterAccess() {
+	s.access = &accessCounts{counts: make(map[uint64]uint64)}
+}
+
+// RecordClusterAccess counts a query to a cluster. It is a no-op unless tracking
+// is enabled with TrackClusterAccess.
+func (s *Server) RecordClusterAccess(clusterIndex uint64) {
+	if s.access == nil {
+		return
+	}
+	s.access.mu.Lock()
+	defer s.access.mu.Unlock()
+	s.access.counts[clusterIndex]++
+}
+
+// ClusterAccessCounts returns the number of queries recorded for each cluster
+// queried at least once, or nil if tracking is disabled
+func (s *Server) ClusterAccessCounts() map[uint64]uint64 {
+	if s.access == nil {
+		return nil
+	}
+	s.access.mu.Lock()
+	defer s.access.mu.Unlock()
+	counts := make(map[uint64]uint64, len(s.access.counts))
+	for cluster, count := range s.access.counts {
+		counts[cluster] = count
+	}
+	return counts
+}
+
+// HottestClusters returns the clusters of counts by decreasing count, ties broken
+// by the lowest cluster
+func HottestClusters(counts map[uint64]uint64) []uint64 {
+	clusters := make([]uint64, 0, len(counts))
+	for cluster := range counts {
+		clusters = append(clusters, cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if counts[clusters[i]] != counts[clusters[j]] {
+			return counts[clusters[i]] > counts[clusters[j]]
+		}
+		return clusters[i] < clusters[j]
+	})
+	return clusters
+}
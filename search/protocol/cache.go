@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+	"github.com/ahenzinger/underhood/underhood"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+// queryCache remembers the encoded query of recent (query, cluster) pairs,
+// together with the underhood client holding the secret it was encrypted under,
+// which is needed to decrypt the answers to it
+type queryCache struct {
+	size    int
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+
+	// own is the client used for rounds that miss the cache. It moves into the
+	// cache with the query it encrypted, and a new one is made for the next round.
+	own *underhood.Client[matrix.Elem64]
+
+	hits   uint64
+	misses uint64
+}
+
+type queryCacheEntry struct {
+	key    [sha256.Size]byte
+	client *underhood.Client[matrix.Elem64]
+	query  *pir.Query[matrix.Elem64]
+}
+
+func queryCacheKey(emb []int8, clusterIndex uint64) [sha256.Size]byte {
+	buf := binary.LittleEndian.AppendUint64(nil, clusterIndex)
+	for _, v := range emb {
+		buf = append(buf, byte(v))
+	}
+	return sha256.Sum256(buf)
+}
+
+// EnableQueryCache makes the client remember the encoded queries of the last size
+// distinct (query, cluster) pairs, so that repeating one skips the hint round and
+// the query encoding. Use CachedQuery to look queries up; QueryEmbeddings fills
+// the cache.
+//
+// This is meant for replaying traffic in benchmarks: a repeated query is sent as
+// the very same ciphertext, so the server can tell that two queries are equal.
+// Each entry also keeps its own underhood client, which takes memory.
+func (c *Client) EnableQueryCache(size int) {
+	if size <= 0 {
+		panic("Query cache size must be positive")
+	}
+	if c.cache != nil {
+		panic("Query cache is already enabled")
+	}
+	c.cache = &queryCache{
+		size:    size,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		lru:     list.New(),
+		own:     c.UnderhoodClient,
+	}
+}
+
+// CachedQuery returns the cached encoding of emb for clusterIndex, or nil if the
+// cache is disabled or does not hold it. On a hit, the client is set up to
+// reconstruct the answer to the returned query, and the hint round must be skipped.
+func (c *Client) CachedQuery(emb []int8, clusterIndex uint64) *pir.Query[matrix.Elem64] {
+	if c.cache == nil {
+		return nil
+	}
+	elem, ok := c.cache.entries[queryCacheKey(emb, clusterIndex)]
+	if !ok {
+		return nil
+	}
+
+	c.cache.hits += 1
+	c.cache.lru.MoveToFront(elem)
+	entry := elem.Value.(*queryCacheEntry)
+	c.UnderhoodClient = entry.client
+	return entry.query
+}
+
+// QueryCacheStats returns the number of cache hits and misses so far
+func (c *Client) QueryCacheStats() (uint64, uint64) {
+	if c.cache == nil {
+		return 0, 0
+	}
+	return c.cache.hits, c.cache.misses
+}
+
+// startRound makes sure a round that missed the cache uses the client's own
+// underhood client, rather than one held by the cache
+func (c *queryCache) startRound(hint *TiptoeHint) *underhood.Client[matrix.Elem64] {
+	if c.own == nil {
+		c.own = utils.NewUnderhoodClient(&hint.PIRHint)
+	}
+	return c.own
+}
+
+// store caches a query encrypted by the client's own underhood client, which is
+// handed over to the cache
+func (c *queryCache) store(emb []int8, clusterIndex uint64, query *pir.Query[matrix.Elem64]) {
+	key := queryCacheKey(emb, clusterIndex)
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	// the secret of this round is already cached with another query
+	if c.own == nil {
+		return
+	}
+
+	c.misses += 1
+	c.entries[key] = c.lru.PushFront(&queryCacheEntry{
+		key:    key,
+		client: c.own,
+		query:  query,
+	})
+	c.own = nil
+
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Remove(c.lru.Back()).(*queryCacheEntry)
+		delete(c.entries, oldest.key)
+		oldest.client.Free()
+	}
+}
+
+func (c *queryCache) free() {
+	if c.own != nil {
+		c.own.Free()
+	}
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		elem.Value.(*queryCacheEntry).client.Free()
+	}
+}
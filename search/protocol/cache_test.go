@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+)
+
+func TestQueryCache(t *testing.T) {
+	preamble := utils.GenerateTestData()
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.RemoveTestData()
+
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: 900}, 5)
+	defer s.Close()
+
+	plain := new(Client)
+	plain.Setup(s.Hint)
+	defer plain.Free()
+
+	cached := new(Client)
+	cached.Setup(s.Hint)
+	cached.EnableQueryCache(2)
+	defer cached.Free()
+
+	queries := make([][]int8, 3)
+	for i := range queries {
+		queries[i] = make([]int8, metadata.Dim)
+		for j := range queries[i] {
+			queries[i][j] = int8((i+j)%5) - 2
+		}
+	}
+
+	// replayed log of query indices: 0 and 1 repeat, and 2 evicts 0 from the cache
+	log := []int{0, 1, 0, 1, 1, 2, 0, 2}
+	for _, i := range log {
+		clusterIndex := uint64(i)
+
+		expected := roundForTest(t, plain, s, queries[i], clusterIndex, false)
+
+		var got *[]VectorScore
+		if query := cached.CachedQuery(queries[i], clusterIndex); query != nil {
+			ans, err := s.Answer(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = cached.ReconstructWithinBin(ans, clusterIndex, cached.DBInfo.P())
+		} else {
+			got = roundForTest(t, cached, s, queries[i], clusterIndex, false)
+		}
+
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("Query %d: cached client returned different scores", i)
+		}
+	}
+
+	hits, misses := cached.QueryCacheStats()
+	if hits != 4 || misses != 4 {
+		t.Errorf("Expected 4 hits and 4 misses, but got %d and %d", hits, misses)
+	}
+	t.Logf("Hit rate on the replayed log: %.0f%%", 100*float64(hits)/float64(hits+misses))
+}
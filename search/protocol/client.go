@@ -1,6 +1,9 @@
 package protocol
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"sort"
 
 	"github.com/DeweiFeng/6.5610-project/search/database"
@@ -10,6 +13,10 @@ import (
 	"github.com/henrycg/simplepir/pir"
 )
 
+// ErrSaturated is returned by PrepareQuery, with StrictQuantization, for a query
+// value beyond the quantization range
+var ErrSaturated = errors.New("query value saturates the quantization range")
+
 type QueryType interface {
 	bool | underhood.HintQuery | pir.Query[matrix.Elem64] | pir.Query[matrix.Elem32]
 }
@@ -25,25 +32,137 @@ type Client struct {
 	DBInfo         *pir.DBInfo
 	ClusterToIndex database.ClusterMap
 	IndexToCluster map[uint64]uint
+
+	// Projection, if set, maps raw queries to the database dimension in PrepareQuery
+	Projection *Projection
+
+	// MaxCandidates, if positive, caps the number of rows scored by reconstruction,
+	// which bounds its cost regardless of the bin size. Only the rows starting at
+	// the query's cluster are scored, so vectors further down the bin (or of other
+	// clusters of the bin) are missed, lowering recall.
+	MaxCandidates uint64
+
+	// Order is the direction in which reconstruction ranks the results, and in
+	// which the thresholds of MatchWithinCluster and MatchWithinBin apply
+	Order SortOrder
+
+	// ScoreBound, if positive, is the largest absolute score of any vector, e.g.,
+	// utils.MixedScoreRange of the quantization. Reconstruction drops the
+	// candidates scoring beyond it, which can only come from corrupted values or
+	// a wraparound modulo P, instead of ranking them first; Anomalies counts them.
+	ScoreBound int
+	anomalies  uint64
+	// scored counts the candidates scored by reconstruction, see Scored
+	scored uint64
+
+	// StrictQuantization makes PrepareQuery fail with ErrSaturated on the first
+	// value that quantization would clamp, instead of clamping it
+	StrictQuantization bool
+
+	hint         *TiptoeHint
+	cache        *queryCache
+	centroids    [][]float64
+	clusterSizes []uint64
 }
 
 func (c *Client) Free() {
+	if c.cache != nil {
+		c.cache.free()
+		return
+	}
 	c.UnderhoodClient.Free()
 }
 
 func (c *Client) Setup(hint *TiptoeHint) {
+	// cached queries are only valid for the hint they were made with
+	if c.cache != nil {
+		c.cache.free()
+		defer c.EnableQueryCache(c.cache.size)
+		c.cache = nil
+	}
+
+	c.hint = hint
 	c.Metadata = hint.Metadata
 	c.DBInfo = &hint.PIRHint.Info
 	c.ClusterToIndex = hint.IndexMap
 	c.UnderhoodClient = utils.NewUnderhoodClient(&hint.PIRHint)
 	// c.Indices = make(map[uint64]bool) // is this index (of DB) a start of a cluster?
+	c.clusterSizes = hint.ClusterSizes
+	c.indexClusters()
+}
+
+// indexClusters fills IndexToCluster from ClusterToIndex
+func (c *Client) indexClusters() {
 	c.IndexToCluster = make(map[uint64]uint)
 	for k, v := range c.ClusterToIndex {
+		// an empty cluster shares its index with the next cluster of its bin
+		if c.clusterSizes != nil && c.clusterSizes[k] == 0 {
+			continue
+		}
 		c.IndexToCluster[v] = k
 	}
 }
 
+// SetProjection makes PrepareQuery project raw queries with p, whose output
+// dimension must match the database
+func (c *Client) SetProjection(p *Projection) error {
+	if p.OutDim != c.Metadata.Dim {
+		return fmt.Errorf("projection maps %d dimensions to %d, but the database has dimension %d", p.InDim, p.OutDim, c.Metadata.Dim)
+	}
+	c.Projection = p
+	return nil
+}
+
+// QueryDim is the number of values expected in a raw query
+func (c *Client) QueryDim() uint64 {
+	if c.Projection != nil {
+		return c.Projection.InDim
+	}
+	return c.Metadata.Dim
+}
+
+// PrepareQuery projects a raw query if the client has a projection, centers it
+// on the mean of the metadata if the database vectors were, and quantizes it for
+// QueryEmbeddings
+func (c *Client) PrepareQuery(raw []float64, precBits uint64) ([]int8, error) {
+	return c.PrepareQueryWith(raw, utils.LinearQuantizer{PrecBits: precBits})
+}
+
+// PrepareQueryWith is like PrepareQuery, with any quantizer, which may differ
+// from that of the database: scores are then the dot products of the raw
+// query and vectors times utils.QuantizerScoreScale of both
+func (c *Client) PrepareQueryWith(raw []float64, q utils.Quantizer) ([]int8, error) {
+	if uint64(len(raw)) != c.QueryDim() {
+		return nil, fmt.Errorf("expected a query of dimension %d, got %d", c.QueryDim(), len(raw))
+	}
+	if c.Projection != nil {
+		raw = c.Projection.Apply(raw)
+	}
+	if c.Metadata.Mean != nil {
+		if len(c.Metadata.Mean) != len(raw) {
+			return nil, fmt.Errorf("the mean has dimension %d, but the query %d", len(c.Metadata.Mean), len(raw))
+		}
+		centered := make([]float64, len(raw))
+		for i, u := range raw {
+			centered[i] = u - c.Metadata.Mean[i]
+		}
+		raw = centered
+	}
+
+	query := make([]int8, len(raw))
+	for i, u := range raw {
+		if c.StrictQuantization && utils.Saturates(u*q.Scale()/float64(q.Bound()), q.Bits()) {
+			return nil, fmt.Errorf("%w: dimension %d is %g, which quantizes beyond ±%d at %d bits", ErrSaturated, i, u, q.Bound(), q.Bits())
+		}
+		query[i] = q.Quantize(u)
+	}
+	return query, nil
+}
+
 func (c *Client) PreprocessQuery() *underhood.HintQuery {
+	if c.cache != nil {
+		c.UnderhoodClient = c.cache.startRound(c.hint)
+	}
 	return c.UnderhoodClient.HintQuery()
 }
 
@@ -75,36 +194,130 @@ func (c *Client) QueryEmbeddings(emb []int8, clusterIndex uint64) *pir.Query[mat
 		arr.AddAt(colIndex+j, 0, matrix.Elem64(emb[j]))
 	}
 
-	return c.UnderhoodClient.QueryLHE(arr)
+	query := c.UnderhoodClient.QueryLHE(arr)
+	if c.cache != nil {
+		c.cache.store(emb, clusterIndex, query)
+	}
+	return query
 }
 
 func (c *Client) ReconstructWithinCluster(answer *pir.Answer[matrix.Elem64], clusterIndex uint64, mod uint64) *[]VectorScore {
+	res := c.scoreWithinCluster(c.UnderhoodClient.RecoverLHE(answer), clusterIndex, mod)
+
+	sort.Slice(res, func(i, j int) bool {
+		return c.Order.Before(res[i].Score, res[j].Score)
+	})
+
+	return &res
+}
+
+// MatchWithinCluster returns the vectors of the cluster that score at least
+// minScore (at most, in Ascending order), in no particular order. It skips the sorting of
+// ReconstructWithinCluster, e.g., to count the matches of a query.
+func (c *Client) MatchWithinCluster(answer *pir.Answer[matrix.Elem64], clusterIndex uint64, mod uint64, minScore int) *[]VectorScore {
+	res := c.scoreWithinCluster(c.UnderhoodClient.RecoverLHE(answer), clusterIndex, mod)
+	return FilterScores(&res, minScore, c.Order)
+}
+
+// scoreWithinCluster scores the vectors of the cluster, in row order, from the
+// decrypted answer
+func (c *Client) scoreWithinCluster(vals *matrix.Matrix[matrix.Elem64], clusterIndex uint64, mod uint64) []VectorScore {
 	dbIndex := c.ClusterToIndex[uint(clusterIndex)]
 	rowStart := dbIndex / c.DBInfo.M
 	colIndex := dbIndex % c.DBInfo.M
-	rowEnd := utils.FindDBEnd(c.IndexToCluster, rowStart, colIndex, c.DBInfo.M, c.DBInfo.L, 0)
-
-	vals := c.UnderhoodClient.RecoverLHE(answer)
+	var rowEnd uint64
+	if c.clusterSizes != nil {
+		// the cluster ends where its vectors do, without the padding below it
+		size := c.clusterSizes[clusterIndex]
+		if c.MaxCandidates > 0 && size > c.MaxCandidates {
+			size = c.MaxCandidates
+		}
+		if size == 0 {
+			return []VectorScore{}
+		}
+		rowEnd = rowStart + size
+	} else {
+		rowEnd = utils.FindDBEnd(c.IndexToCluster, rowStart, colIndex, c.DBInfo.M, c.DBInfo.L, c.MaxCandidates)
+	}
 
-	res := make([]VectorScore, rowEnd-rowStart)
-	at := 0
+	res := make([]VectorScore, 0, rowEnd-rowStart)
 	for j := rowStart; j < rowEnd; j++ {
-		// res[at] = uint64(vals.Get(j, 0))
-		res[at] = VectorScore{
-			ClusterID:       uint(clusterIndex),
-			IDWithinCluster: uint64(at),
-			Score:           utils.SmoothResult(uint64(vals.Get(j, 0)), mod),
+		score := utils.SmoothResult(uint64(vals.Get(j, 0)), mod)
+		if !c.inBounds(score) {
+			continue
 		}
-		at += 1
+		res = append(res, VectorScore{
+			ClusterID:       uint(clusterIndex),
+			IDWithinCluster: j - rowStart,
+			Score:           score,
+		})
 	}
 
-	sort.Slice(res, func(i, j int) bool {
-		return res[i].Score > res[j].Score
-	})
+	return res
+}
 
+// inBounds reports whether a score is within ScoreBound, counting it as an
+// anomaly if not. Every candidate scored goes through it, and is counted.
+func (c *Client) inBounds(score int) bool {
+	c.scored++
+	if c.ScoreBound <= 0 || (score <= c.ScoreBound && score >= -c.ScoreBound) {
+		return true
+	}
+	c.anomalies++
+	return false
+}
+
+// Anomalies returns the number of candidates dropped so far for scoring beyond
+// ScoreBound
+func (c *Client) Anomalies() uint64 {
+	return c.anomalies
+}
+
+// Scored returns the number of candidates scored so far by reconstruction,
+// before any cut off, including those dropped as anomalies
+func (c *Client) Scored() uint64 {
+	return c.scored
+}
+
+// FilterScores keeps the scores that meet minScore in the given order, i.e., of
+// at least minScore in Descending order, in their order
+func FilterScores(scores *[]VectorScore, minScore int, order SortOrder) *[]VectorScore {
+	res := make([]VectorScore, 0)
+	for _, s := range *scores {
+		if order.Meets(s.Score, minScore) {
+			res = append(res, s)
+		}
+	}
 	return &res
 }
 
+// MarginScore is the worst score within a relative margin of the best score
+// top in the given order: top-margin*|top| in Descending order, which is
+// (1-margin)*top for a positive top, and top+margin*|top| in Ascending order.
+// It is rounded towards top, since scores are integers.
+func MarginScore(top int, margin float64, order SortOrder) int {
+	slack := margin * math.Abs(float64(top))
+	if order == Ascending {
+		return int(math.Floor(float64(top) + slack))
+	}
+	return int(math.Ceil(float64(top) - slack))
+}
+
+// WithinMargin returns the number of leading scores of a ranking, best first,
+// within a relative margin of the first (see MarginScore). Ties with the worst
+// score within the margin are all kept, and an empty ranking has none.
+func WithinMargin(scores *[]VectorScore, margin float64, order SortOrder) int {
+	if len(*scores) == 0 {
+		return 0
+	}
+	threshold := MarginScore((*scores)[0].Score, margin, order)
+	n := 0
+	for n < len(*scores) && order.Meets((*scores)[n].Score, threshold) {
+		n++
+	}
+	return n
+}
+
 // define a struct that saves cluster id, id within cluster, and value
 type VectorScore struct {
 	ClusterID       uint
@@ -113,30 +326,110 @@ type VectorScore struct {
 }
 
 func (c *Client) ReconstructWithinBin(answer *pir.Answer[matrix.Elem64], clusterIndex uint64, mod uint64) *[]VectorScore {
-	vals := c.UnderhoodClient.RecoverLHE(answer)
-	res := make([]VectorScore, c.DBInfo.L)
-	colIndex := c.ClusterToIndex[uint(clusterIndex)] % c.DBInfo.M
+	res := c.scoreWithinBin(c.UnderhoodClient.RecoverLHE(answer), clusterIndex, mod)
+
+	sort.Slice(res, func(i, j int) bool {
+		return c.Order.Before(res[i].Score, res[j].Score)
+	})
+
+	return &res
+}
 
+// MatchWithinBin is like MatchWithinCluster, for all the clusters of the bin
+// scored by ReconstructWithinBin
+func (c *Client) MatchWithinBin(answer *pir.Answer[matrix.Elem64], clusterIndex uint64, mod uint64, minScore int) *[]VectorScore {
+	res := c.scoreWithinBin(c.UnderhoodClient.RecoverLHE(answer), clusterIndex, mod)
+	return FilterScores(&res, minScore, c.Order)
+}
+
+// scoreWithinBin scores the vectors of the bin of the cluster, in row order,
+// from the decrypted answer
+func (c *Client) scoreWithinBin(vals *matrix.Matrix[matrix.Elem64], clusterIndex uint64, mod uint64) []VectorScore {
+	res := make([]VectorScore, 0)
+	c.scoreRows(vals, clusterIndex, mod, func(sc VectorScore) bool {
+		res = append(res, sc)
+		return true
+	})
+	return res
+}
+
+// scoreRows scores the rows of the bin of a cluster in order, as scoreWithinBin,
+// and calls visit with every vector as soon as its row is scored, until visit
+// returns false
+func (c *Client) scoreRows(vals *matrix.Matrix[matrix.Elem64], clusterIndex uint64, mod uint64, visit func(VectorScore) bool) {
+	dbIndex := c.ClusterToIndex[uint(clusterIndex)]
+	colIndex := dbIndex % c.DBInfo.M
+
+	// score the whole bin, or a window of MaxCandidates rows starting at the
+	// query's cluster, moved up if it would run past the bottom of the database
+	rowStart, rowEnd := uint64(0), c.DBInfo.L
+	if c.MaxCandidates > 0 && c.MaxCandidates < c.DBInfo.L {
+		rowStart = dbIndex / c.DBInfo.M
+		if rowStart+c.MaxCandidates > c.DBInfo.L {
+			rowStart = c.DBInfo.L - c.MaxCandidates
+		}
+		rowEnd = rowStart + c.MaxCandidates
+	}
+
+	// find the cluster of the first row; row 0 of a bin always starts a cluster,
+	// unless all clusters of the bin are empty
 	var currCluster uint
 	var at uint64
+	found := false
+	for j := rowStart; ; j-- {
+		if tempCluster, ok := c.IndexToCluster[j*c.DBInfo.M+colIndex]; ok {
+			currCluster = tempCluster
+			at = rowStart - j
+			found = true
+			break
+		}
+		if j == 0 {
+			break
+		}
+	}
 
-	for j := uint64(0); j < c.DBInfo.L; j++ {
+	for j := rowStart; j < rowEnd; j++ {
 		tempCluster, ok := c.IndexToCluster[j*c.DBInfo.M+colIndex]
 		if ok { // this is a new cluster, we update currCluster and at
 			currCluster = tempCluster
 			at = 0
+			found = true
+		}
+		// with known cluster sizes, skip the padding rows at the bottom of the bin
+		if c.clusterSizes != nil && (!found || at >= c.clusterSizes[currCluster]) {
+			continue
 		}
-		res[j] = VectorScore{
-			ClusterID:       currCluster,
-			IDWithinCluster: uint64(at),
-			Score:           utils.SmoothResult(uint64(vals.Get(j, 0)), mod),
+		score := utils.SmoothResult(uint64(vals.Get(j, 0)), mod)
+		if c.inBounds(score) {
+			if !visit(VectorScore{
+				ClusterID:       currCluster,
+				IDWithinCluster: uint64(at),
+				Score:           score,
+			}) {
+				return
+			}
 		}
 		at += 1
 	}
+}
+
+// TopKPerCluster keeps at most m candidates from each cluster of a bin, so that a
+// single cluster cannot take over the whole top-k. The input must already be
+// sorted, in either order; the output keeps that order.
+func TopKPerCluster(scores *[]VectorScore, m int) *[]VectorScore {
+	if m <= 0 {
+		panic("m must be positive")
+	}
 
-	sort.Slice(res, func(i, j int) bool {
-		return res[i].Score > res[j].Score
-	})
+	counts := make(map[uint]int)
+	res := make([]VectorScore, 0, len(*scores))
+	for _, s := range *scores {
+		if counts[s.ClusterID] >= m {
+			continue
+		}
+		counts[s.ClusterID] += 1
+		res = append(res, s)
+	}
 
 	return &res
 }
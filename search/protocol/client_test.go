@@ -1,28 +1,44 @@
 package protocol
 
 import (
+	"errors"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/DeweiFeng/6.5610-project/search/database"
 	"github.com/DeweiFeng/6.5610-project/search/utils"
+	"github.com/ahenzinger/underhood/underhood"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
 )
 
 func TestZeroQuery(t *testing.T) {
 	preamble := utils.GenerateTestData()
 	// Test the BuildVectorDatabase function
-	metadata, clusters := database.ReadAllClusters(preamble, 5)
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	hintSz := uint64(900) // hintSz is 900 for text embeddings in Tiptoe, and 500 for image embeddings
 	// get an empty server
 	s := new(Server)
-	s.ProcessVectorsFromClusters(metadata, clusters, hintSz, 5)
+	s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: hintSz}, 5)
 
 	c := new(Client)
 	c.Setup(s.Hint) // get the hint from the server
 
 	// from here, it is for each query
 	ct := c.PreprocessQuery()
-	offlineAns := s.HintAnswer(ct)
+	offlineAns, err := s.HintAnswer(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
 	c.ProcessHintApply(offlineAns)
 
 	// get the query: a list of uint64 of zeros, size = dim
@@ -34,7 +50,10 @@ func TestZeroQuery(t *testing.T) {
 
 	query := c.QueryEmbeddings(zeroQuery, clusterIndex)
 
-	ans := s.Answer(query)
+	ans, err := s.Answer(query)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	scores := c.ReconstructWithinCluster(ans, clusterIndex, c.DBInfo.P())
 
@@ -52,3 +71,643 @@ func TestZeroQuery(t *testing.T) {
 
 	utils.RemoveTestData()
 }
+
+func TestTopKPerCluster(t *testing.T) {
+	scores := []VectorScore{
+		{ClusterID: 0, IDWithinCluster: 0, Score: 10},
+		{ClusterID: 0, IDWithinCluster: 1, Score: 9},
+		{ClusterID: 0, IDWithinCluster: 2, Score: 8},
+		{ClusterID: 1, IDWithinCluster: 0, Score: 7},
+		{ClusterID: 0, IDWithinCluster: 3, Score: 6},
+		{ClusterID: 1, IDWithinCluster: 1, Score: 5},
+		{ClusterID: 2, IDWithinCluster: 0, Score: 4},
+		{ClusterID: 1, IDWithinCluster: 2, Score: 3},
+	}
+
+	m := 2
+	res := TopKPerCluster(&scores, m)
+
+	counts := make(map[uint]int)
+	for i, s := range *res {
+		counts[s.ClusterID] += 1
+		if i > 0 && (*res)[i-1].Score < s.Score {
+			t.Errorf("Expected results to be sorted by descending score")
+		}
+	}
+	for cluster, count := range counts {
+		if count > m {
+			t.Errorf("Expected at most %d results from cluster %d, but got %d", m, cluster, count)
+		}
+	}
+
+	// clusters 0 and 1 are capped at 2, cluster 2 only has 1 candidate
+	if len(*res) != 5 {
+		t.Errorf("Expected 5 results, but got %d", len(*res))
+	}
+	if (*res)[0].Score != 10 || (*res)[1].Score != 9 || (*res)[2].Score != 7 {
+		t.Errorf("Expected the best candidates of each cluster to be kept")
+	}
+}
+
+func TestProjection(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "projection.csv")
+	// 3 -> 2 dimensions: keep the first value, sum the other two
+	if err := os.WriteFile(file, []byte("1,0,0\n0,0.5,0.5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ReadProjectionFromCsv(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.InDim != 3 || p.OutDim != 2 {
+		t.Fatalf("Expected a 3 -> 2 projection, but got %d -> %d", p.InDim, p.OutDim)
+	}
+
+	c := new(Client)
+	c.Metadata.Dim = 3
+	if err := c.SetProjection(p); err == nil {
+		t.Errorf("Expected a projection to the wrong dimension to be rejected")
+	}
+
+	c.Metadata.Dim = 2
+	if err := c.SetProjection(p); err != nil {
+		t.Fatal(err)
+	}
+	if c.QueryDim() != 3 {
+		t.Errorf("Expected queries of dimension 3, but got %d", c.QueryDim())
+	}
+
+	query, err := c.PrepareQuery([]float64{0.5, 0.25, 0.75}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int8{utils.QuantizeClamp(0.5, 5), utils.QuantizeClamp(0.5, 5)}
+	if len(query) != 2 || query[0] != expected[0] || query[1] != expected[1] {
+		t.Errorf("Expected %v, but got %v", expected, query)
+	}
+
+	if _, err := c.PrepareQuery([]float64{0.5, 0.25}, 5); err == nil {
+		t.Errorf("Expected a query of the wrong dimension to be rejected")
+	}
+
+	// the mean of centered databases is subtracted after the projection
+	c.Metadata.Mean = []float64{0.25, -0.25}
+	query, err = c.PrepareQuery([]float64{0.5, 0.25, 0.75}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []int8{utils.QuantizeClamp(0.25, 5), utils.QuantizeClamp(0.75, 5)}
+	if !reflect.DeepEqual(query, expected) {
+		t.Errorf("Expected the centered query %v, but got %v", expected, query)
+	}
+}
+
+func TestStrictQuantization(t *testing.T) {
+	c := &Client{Metadata: database.Metadata{Dim: 3}}
+	saturated := []float64{0.5, 1.25, -0.5}
+
+	// values are clamped by default
+	query, err := c.PrepareQuery(saturated, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query[1] != 16 {
+		t.Errorf("Expected 1.25 to be clamped to 16, but got %d", query[1])
+	}
+
+	c.StrictQuantization = true
+	if _, err := c.PrepareQuery([]float64{0.5, 1, -1}, 5); err != nil {
+		t.Errorf("Expected the bounds of the range to be accepted, but got %v", err)
+	}
+	_, err = c.PrepareQuery(saturated, 5)
+	if !errors.Is(err, ErrSaturated) {
+		t.Fatalf("Expected ErrSaturated, but got %v", err)
+	}
+	if !strings.Contains(err.Error(), "dimension 1 is 1.25") {
+		t.Errorf("Expected the error to name dimension 1 and its value, but got %v", err)
+	}
+}
+
+func TestMaxCandidates(t *testing.T) {
+	dim := uint64(2)
+	emb := []int8{1, -1}
+	for _, binSize := range []int{300, 3000} {
+		// two clusters sharing a single bin
+		sizes := []int{binSize / 3, binSize - binSize/3}
+		metadata, clusters := database.SyntheticClusters(dim, sizes, 0)
+
+		s := new(Server)
+		s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: 900}, 5)
+		c := new(Client)
+		c.Setup(s.Hint)
+
+		for _, cluster := range []uint64{0, 1} {
+			for _, clusterOnly := range []bool{false, true} {
+				c.MaxCandidates = 0
+				full := roundForTest(t, c, s, emb, cluster, clusterOnly)
+				c.MaxCandidates = 50
+				capped := roundForTest(t, c, s, emb, cluster, clusterOnly)
+
+				// the cost is bounded by the cap, whatever the size of the bin
+				if len(*capped) != 50 {
+					t.Errorf("Bin of %d vectors: expected 50 candidates, but got %d", binSize, len(*capped))
+				}
+				// and the candidates are scored exactly like without the cap
+				scores := make(map[VectorScore]bool)
+				for _, sc := range *full {
+					scores[sc] = true
+				}
+				for _, sc := range *capped {
+					if !scores[sc] {
+						t.Errorf("Bin of %d vectors: capped candidate %+v not found among all candidates", binSize, sc)
+					}
+					if clusterOnly && sc.ClusterID != uint(cluster) {
+						t.Errorf("Expected only candidates of cluster %d, but got %+v", cluster, sc)
+					}
+				}
+			}
+		}
+		c.Free()
+		s.Close()
+	}
+}
+
+// testData reads the clusters of the test data
+func testData(t *testing.T) (database.Metadata, []*database.Cluster) {
+	preamble := utils.GenerateTestData()
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	utils.RemoveTestData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata, clusters
+}
+
+// testSession is a server of the test data, and a client set up for it
+type testSession struct {
+	metadata database.Metadata
+	clusters []*database.Cluster
+	s        *Server
+	c        *Client
+}
+
+// newTestSession builds a server of the test data with params, and a client
+// for it, which are freed at the end of the test
+func newTestSession(t *testing.T, params database.DatabaseParams) *testSession {
+	metadata, clusters := testData(t)
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, params, 5)
+	t.Cleanup(s.Close)
+	c := new(Client)
+	c.Setup(s.Hint)
+	t.Cleanup(c.Free)
+	return &testSession{metadata: metadata, clusters: clusters, s: s, c: c}
+}
+
+// query answers a hint query, and returns the query for emb on a cluster
+func (ts *testSession) query(t *testing.T, emb []int8, clusterIndex uint64) *pir.Query[matrix.Elem64] {
+	offlineAns, err := ts.s.HintAnswer(ts.c.PreprocessQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.c.ProcessHintApply(offlineAns)
+	return ts.c.QueryEmbeddings(emb, clusterIndex)
+}
+
+// answer runs a round for emb on a cluster, and returns its answer
+func (ts *testSession) answer(t *testing.T, emb []int8, clusterIndex uint64) *pir.Answer[matrix.Elem64] {
+	ans, err := ts.s.Answer(ts.query(t, emb, clusterIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ans
+}
+
+// roundForTest runs one round and reconstructs the scores of the query's cluster
+// or bin
+func roundForTest(t *testing.T, c *Client, s *Server, emb []int8, clusterIndex uint64, clusterOnly bool) *[]VectorScore {
+	offlineAns, err := s.HintAnswer(c.PreprocessQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ProcessHintApply(offlineAns)
+	ans, err := s.Answer(c.QueryEmbeddings(emb, clusterIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clusterOnly {
+		return c.ReconstructWithinCluster(ans, clusterIndex, c.DBInfo.P())
+	}
+	return c.ReconstructWithinBin(ans, clusterIndex, c.DBInfo.P())
+}
+
+func TestBinaryWireRound(t *testing.T) {
+	preamble := utils.GenerateTestData()
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.RemoveTestData()
+
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: 900}, 5)
+	c := new(Client)
+	c.Setup(s.Hint)
+	defer c.Free()
+
+	// every message of the round goes through the binary format
+	transfer := func(m interface{}, out interface{}) {
+		enc, err := utils.EncodeMessage(m, utils.BinaryWire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := utils.DecodeMessage(enc, utils.BinaryWire, out); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ct := c.PreprocessQuery()
+	var sentCt underhood.HintQuery
+	transfer(*ct, &sentCt)
+	hintAns, err := s.HintAnswer(&sentCt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sentHintAns underhood.HintAnswer
+	transfer(*hintAns, &sentHintAns)
+	c.ProcessHintApply(&sentHintAns)
+
+	clusterIndex := uint64(1)
+	emb := clusters[clusterIndex].Vectors[:metadata.Dim]
+	query := c.QueryEmbeddings(emb, clusterIndex)
+	var sentQuery pir.Query[matrix.Elem64]
+	transfer(*query, &sentQuery)
+	ans, err := s.Answer(&sentQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sentAns pir.Answer[matrix.Elem64]
+	transfer(*ans, &sentAns)
+
+	// the scores are those of the answer as computed by the server
+	expected := c.ReconstructWithinCluster(ans, clusterIndex, c.DBInfo.P())
+	scores := c.ReconstructWithinCluster(&sentAns, clusterIndex, c.DBInfo.P())
+	if !reflect.DeepEqual(scores, expected) {
+		t.Errorf("Expected scores %v, but got %v", *expected, *scores)
+	}
+	// the query vector is its own best match
+	if (*scores)[0].IDWithinCluster != 0 && (*scores)[0].Score != (*scores)[1].Score {
+		t.Errorf("Expected vector 0 to score highest, but got %v", (*scores)[0])
+	}
+}
+
+func TestTinyDatabases(t *testing.T) {
+	tests := []struct {
+		name   string
+		dim    uint64
+		floats [][]float64
+	}{
+		{"dim 1", 1, [][]float64{{0.5, -0.25, 1}, {0.75}}},
+		{"single vector", 4, [][]float64{{0.5, 0.5, -0.5, 0.25}}},
+		{"all empty", 4, [][]float64{{}, {}}},
+		{"empty first", 4, [][]float64{{}, {0.5, 0.5, 0.5, 0.5}}},
+		{"empty last", 4, [][]float64{{0.5, -0.5, 0.5, 0.5}, {}}},
+	}
+	for _, test := range tests {
+		numVectors := uint64(0)
+		for _, f := range test.floats {
+			numVectors += uint64(len(f)) / test.dim
+		}
+		metadata := database.Metadata{NumVectors: numVectors, Dim: test.dim, NumClusters: uint64(len(test.floats))}
+		clusters, err := database.ClustersFromFloats(metadata, test.floats, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params := database.DatabaseParams{HintSz: 900}
+
+		s := new(Server)
+		s.ProcessVectorsFromClusters(metadata, clusters, params, 5)
+		c := new(Client)
+		c.Setup(s.Hint)
+		exact := NewPlaintextServer(metadata, clusters, params)
+
+		emb := make([]int8, test.dim)
+		emb[0] = 16
+		for i := range clusters {
+			for _, clusterOnly := range []bool{true, false} {
+				// the vectors scored are exactly those of the cluster, or of the bin
+				expected := exact.SearchBin(emb, uint64(i))
+				if clusterOnly {
+					expected = exact.SearchCluster(emb, uint64(i))
+				}
+				scores := roundForTest(t, c, s, emb, uint64(i), clusterOnly)
+				if !sameScores(scores, expected) {
+					t.Errorf("%s, cluster %d, clusterOnly %t: expected %v, but got %v", test.name, i, clusterOnly, *expected, *scores)
+				}
+			}
+		}
+		c.Free()
+		s.Close()
+	}
+}
+
+// sameScores compares two rankings regardless of the order of tied vectors
+func sameScores(a *[]VectorScore, b *[]VectorScore) bool {
+	if len(*a) != len(*b) {
+		return false
+	}
+	count := make(map[VectorScore]int)
+	for i := range *a {
+		if (*a)[i].Score != (*b)[i].Score {
+			return false
+		}
+		count[(*a)[i]]++
+		count[(*b)[i]]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNegativeVectors(t *testing.T) {
+	dim := uint64(8)
+	precBits := uint64(5)
+	bound := int8(1 << (precBits - 1))
+	// vectors with negative components, down to the most negative quantized value
+	vectors := [][]int8{
+		{-bound, -bound, -bound, -bound, -bound, -bound, -bound, -bound},
+		{-1, -2, -3, -4, -5, -6, -7, -8},
+		{bound, -bound, 3, -3, 0, -1, 1, -bound},
+		{-7, 0, 0, 0, 0, 0, 0, 2},
+	}
+	flat := make([]int8, 0)
+	for _, v := range vectors {
+		flat = append(flat, v...)
+	}
+	metadata := database.Metadata{NumVectors: uint64(len(vectors)), Dim: dim, NumClusters: 1}
+	clusters := []*database.Cluster{{
+		Index:      0,
+		NumVectors: uint64(len(vectors)),
+		Dim:        dim,
+		PrecBits:   precBits,
+		Vectors:    flat,
+	}}
+
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: 900}, precBits)
+	defer s.Close()
+	c := new(Client)
+	c.Setup(s.Hint)
+	defer c.Free()
+
+	for _, emb := range [][]int8{
+		{-bound, -bound, -bound, -bound, -bound, -bound, -bound, -bound},
+		{1, -1, 2, -2, 3, -3, 4, -4},
+		{bound, bound, bound, bound, bound, bound, bound, bound},
+	} {
+		got := roundForTest(t, c, s, emb, 0, true)
+		if len(*got) != len(vectors) {
+			t.Fatalf("Expected %d scores, but got %d", len(vectors), len(*got))
+		}
+		for _, sc := range *got {
+			expected := 0
+			for j, v := range vectors[sc.IDWithinCluster] {
+				expected += int(emb[j]) * int(v)
+			}
+			if sc.Score != expected {
+				t.Errorf("Query %v, vector %v: expected signed score %d, but got %d", emb, vectors[sc.IDWithinCluster], expected, sc.Score)
+			}
+		}
+	}
+}
+
+func TestMatchScores(t *testing.T) {
+	preamble := utils.GenerateTestData()
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.RemoveTestData()
+
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: 900}, 5)
+	defer s.Close()
+	c := new(Client)
+	c.Setup(s.Hint)
+	defer c.Free()
+
+	emb := make([]int8, metadata.Dim)
+	for i := range emb {
+		emb[i] = int8(i%7) - 3
+	}
+	cluster := uint64(1)
+	for _, clusterOnly := range []bool{false, true} {
+		ranked := roundForTest(t, c, s, emb, cluster, clusterOnly)
+		// every query needs a hint round of its own
+		offlineAns, err := s.HintAnswer(c.PreprocessQuery())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.ProcessHintApply(offlineAns)
+		ans, err := s.Answer(c.QueryEmbeddings(emb, cluster))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, minScore := range []int{-1000, 0, 10, 1000} {
+			var matched *[]VectorScore
+			if clusterOnly {
+				matched = c.MatchWithinCluster(ans, cluster, c.DBInfo.P(), minScore)
+			} else {
+				matched = c.MatchWithinBin(ans, cluster, c.DBInfo.P(), minScore)
+			}
+			expected := make(map[VectorScore]bool)
+			for _, sc := range *ranked {
+				if sc.Score >= minScore {
+					expected[sc] = true
+				}
+			}
+			if len(*matched) != len(expected) {
+				t.Errorf("clusterOnly %v, minScore %d: expected %d matches, but got %d", clusterOnly, minScore, len(expected), len(*matched))
+			}
+			for _, sc := range *matched {
+				if !expected[sc] {
+					t.Errorf("clusterOnly %v, minScore %d: unexpected match %+v", clusterOnly, minScore, sc)
+				}
+			}
+		}
+	}
+}
+
+func TestSortOrder(t *testing.T) {
+	preamble := utils.GenerateTestData()
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.RemoveTestData()
+
+	params := database.DatabaseParams{HintSz: 900}
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, params, 5)
+	defer s.Close()
+	c := new(Client)
+	c.Setup(s.Hint)
+	defer c.Free()
+	plain := NewPlaintextServer(metadata, clusters, params)
+
+	emb := make([]int8, metadata.Dim)
+	for i := range emb {
+		emb[i] = int8(i%5) - 2
+	}
+	cluster := uint64(1)
+	minScore := 0
+	for _, order := range []SortOrder{Descending, Ascending} {
+		c.Order = order
+		plain.Order = order
+		ranked := roundForTest(t, c, s, emb, cluster, false)
+		for i := 1; i < len(*ranked); i++ {
+			if order.Before((*ranked)[i].Score, (*ranked)[i-1].Score) {
+				t.Fatalf("%s: result %d (score %d) ranks before result %d (score %d)", order, i, (*ranked)[i].Score, i-1, (*ranked)[i-1].Score)
+			}
+		}
+		expected := plain.SearchBin(emb, cluster)
+		if len(*ranked) != len(*expected) {
+			t.Fatalf("%s: expected %d results, but got %d", order, len(*expected), len(*ranked))
+		}
+		for i := range *ranked {
+			if (*ranked)[i].Score != (*expected)[i].Score {
+				t.Errorf("%s: result %d has score %d, but the plaintext search has %d", order, i, (*ranked)[i].Score, (*expected)[i].Score)
+			}
+		}
+
+		// thresholds apply in the direction of the order
+		matched := FilterScores(ranked, minScore, order)
+		for _, sc := range *matched {
+			if (order == Descending && sc.Score < minScore) || (order == Ascending && sc.Score > minScore) {
+				t.Errorf("%s: score %d does not meet the threshold %d", order, sc.Score, minScore)
+			}
+		}
+		if len(*matched) == 0 || len(*matched) == len(*ranked) {
+			t.Errorf("%s: expected the threshold to keep some but not all of %d results, but it kept %d", order, len(*ranked), len(*matched))
+		}
+	}
+
+	if _, err := ParseSortOrder("up"); err == nil {
+		t.Errorf("Expected an error parsing an unknown sort order")
+	}
+}
+
+func TestMixedQuantizers(t *testing.T) {
+	// a finer quantization of the database than of the queries, over different
+	// ranges, so that the two sides have different scales
+	const dim, numVectors = 16, 40
+	dbQuantizer, err := utils.NewLinearQuantizer(6, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryQuantizer, err := utils.NewLinearQuantizer(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(11))
+	vectors := make([]float64, numVectors*dim)
+	for i := range vectors {
+		vectors[i] = r.Float64() - 0.5
+	}
+	cluster, err := database.NewClusterFromFloatsWith(0, vectors, dim, dbQuantizer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cluster.PrecBits != 6 {
+		t.Fatalf("Expected the cluster to take the 6 bits of its quantizer, but got %d", cluster.PrecBits)
+	}
+	metadata := database.Metadata{NumVectors: numVectors, Dim: dim, NumClusters: 1}
+
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, []*database.Cluster{cluster}, database.DatabaseParams{HintSz: 900}, 6)
+	defer s.Close()
+	c := new(Client)
+	c.Setup(s.Hint)
+	defer c.Free()
+	c.StrictQuantization = true
+
+	// the quantization error of the raw dot product, each value being off by at
+	// most half a step of its side
+	dbStep, queryStep := 0.5/dbQuantizer.Scale(), 0.5/queryQuantizer.Scale()
+	for n := 0; n < 5; n++ {
+		raw := make([]float64, dim)
+		for j := range raw {
+			raw[j] = 4*r.Float64() - 2
+		}
+		query, err := c.PrepareQueryWith(raw, queryQuantizer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scores := roundForTest(t, c, s, query, 0, true)
+		if len(*scores) != numVectors {
+			t.Fatalf("Expected %d scores, but got %d", numVectors, len(*scores))
+		}
+		for _, sc := range *scores {
+			v := vectors[sc.IDWithinCluster*dim : (sc.IDWithinCluster+1)*dim]
+			plain, exact, bound := 0, 0.0, 0.0
+			for j := range v {
+				plain += int(query[j]) * int(dbQuantizer.Quantize(v[j]))
+				exact += raw[j] * v[j]
+				bound += (math.Abs(raw[j])+queryStep)*dbStep + math.Abs(v[j])*queryStep
+			}
+			if sc.Score != plain {
+				t.Errorf("Vector %d: expected the plaintext score %d, but got %d", sc.IDWithinCluster, plain, sc.Score)
+			}
+			dot := utils.ReconstructDot(sc.Score, queryQuantizer, dbQuantizer)
+			if math.Abs(dot-exact) > bound+1e-9 {
+				t.Errorf("Vector %d: expected a dot product within %g of %g, but got %g", sc.IDWithinCluster, bound, exact, dot)
+			}
+			sigmoid := utils.TransformQuantizedScores([]int{sc.Score}, utils.SigmoidTransform, dim, queryQuantizer, dbQuantizer)[0]
+			if math.Abs(sigmoid-1/(1+math.Exp(-dot))) > 1e-12 {
+				t.Errorf("Vector %d: expected the sigmoid of the dot product %g, but got %g", sc.IDWithinCluster, dot, sigmoid)
+			}
+		}
+	}
+
+	// values within the range of the query quantizer do not saturate, unlike
+	// beyond it
+	inRange := make([]float64, dim)
+	inRange[0] = 1.9
+	if _, err := c.PrepareQueryWith(inRange, queryQuantizer); err != nil {
+		t.Errorf("Expected %g to fit in the range of the query quantizer, but got %v", inRange[0], err)
+	}
+	inRange[0] = 2.5
+	if _, err := c.PrepareQueryWith(inRange, queryQuantizer); !errors.Is(err, ErrSaturated) {
+		t.Errorf("Expected %g to saturate the query quantizer, but got %v", inRange[0], err)
+	}
+}
+
+func TestDenseScores(t *testing.T) {
+	scores := []VectorScore{{Score: 7, ClusterID: 2, IDWithinCluster: 1}, {Score: 5, ClusterID: 2, IDWithinCluster: 2}, {Score: -3, ClusterID: 2, IDWithinCluster: 0}}
+	n, dense, err := DenseScores(&scores, 0)
+	if err != nil || n != 3 || len(dense) != 3 || dense[0] != -3 || dense[1] != 7 || dense[2] != 5 {
+		t.Errorf("Expected the 3 scores [-3 7 5], but got %d %v, %v", n, dense, err)
+	}
+	if n, dense, _ = DenseScores(&scores, 2); n != 3 || len(dense) != 2 || dense[1] != 7 {
+		t.Errorf("Expected the first 2 of 3 scores, but got %d %v", n, dense)
+	}
+
+	empty := []VectorScore{}
+	if n, dense, err = DenseScores(&empty, 2); err != nil || n != 0 || len(dense) != 0 {
+		t.Errorf("Expected no scores for an empty cluster, but got %d %v, %v", n, dense, err)
+	}
+	for _, bad := range [][]VectorScore{
+		{{ClusterID: 2, IDWithinCluster: 0}, {ClusterID: 3, IDWithinCluster: 1}},
+		{{ClusterID: 2, IDWithinCluster: 0}, {ClusterID: 2, IDWithinCluster: 0}},
+		{{ClusterID: 2, IDWithinCluster: 0}, {ClusterID: 2, IDWithinCluster: 2}},
+	} {
+		if _, _, err := DenseScores(&bad, 0); err == nil {
+			t.Errorf("Expected an error for %v", bad)
+		}
+	}
+}
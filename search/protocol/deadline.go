@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"context"
+	"sort"
+
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+// deadlineCheckRows is how many rows ReconstructWithinBinDeadline scores between
+// two checks of its deadline
+const deadlineCheckRows = 64
+
+// segment is the run of rows of a cluster in a database column
+type segment struct {
+	cluster    uint
+	start, end uint64
+}
+
+// binSegments lists the clusters stored in a database column, in row order. An
+// empty cluster starts at the same row as the next cluster of the column, so
+// with the cluster sizes it is left out, and the clusters of a row are ordered
+// by size, then index, for the rare case of unknown sizes.
+func (c *Client) binSegments(colIndex uint64) []segment {
+	segments := make([]segment, 0)
+	for cluster, dbIndex := range c.ClusterToIndex {
+		if c.clusterSizes != nil && c.clusterSizes[cluster] == 0 {
+			continue
+		}
+		if dbIndex%c.DBInfo.M == colIndex {
+			segments = append(segments, segment{cluster: cluster, start: dbIndex / c.DBInfo.M})
+		}
+	}
+	sort.SliceStable(segments, func(i, j int) bool {
+		if segments[i].start != segments[j].start {
+			return segments[i].start < segments[j].start
+		}
+		if c.clusterSizes != nil && c.clusterSizes[segments[i].cluster] != c.clusterSizes[segments[j].cluster] {
+			return c.clusterSizes[segments[i].cluster] < c.clusterSizes[segments[j].cluster]
+		}
+		return segments[i].cluster < segments[j].cluster
+	})
+	// without the cluster sizes, a cluster runs until the next one, and the last
+	// one of the column includes the padding rows, like in ReconstructWithinBin
+	for i := range segments {
+		if i+1 < len(segments) {
+			segments[i].end = segments[i+1].start
+		} else {
+			segments[i].end = c.DBInfo.L
+		}
+		if c.clusterSizes != nil && segments[i].start+c.clusterSizes[segments[i].cluster] < segments[i].end {
+			segments[i].end = segments[i].start + c.clusterSizes[segments[i].cluster]
+		}
+	}
+	return segments
+}
+
+// ReconstructWithinBinDeadline is an anytime variant of ReconstructWithinBin,
+// which returns the best k vectors found when ctx is done. It scores the
+// query's own cluster first, then the other clusters of the bin, by decreasing
+// inner product of emb with their centroid if the client has them (see
+// SetCentroids), or else by their distance to the query's cluster in the
+// column. The deadline is checked every few dozen rows; the first ones are
+// always scored, so the results are never empty unless the bin is, and the
+// decryption of the answer, which precedes scoring, is not interrupted.
+//
+// The returned flag is true if every row of the bin was scored, in which case
+// the results are the first k of ReconstructWithinBin. Otherwise, they are the
+// exact scores of the vectors scored so far, but vectors that were not reached
+// are missing.
+func (c *Client) ReconstructWithinBinDeadline(ctx context.Context, answer *pir.Answer[matrix.Elem64], emb []int8, clusterIndex uint64, mod uint64, k int) (*[]VectorScore, bool) {
+	if k <= 0 {
+		panic("k must be positive")
+	}
+	vals := c.UnderhoodClient.RecoverLHE(answer)
+	dbIndex, ok := c.ClusterToIndex[uint(clusterIndex)]
+	if !ok {
+		panic("Invalid cluster index")
+	}
+
+	segments := c.binSegments(dbIndex % c.DBInfo.M)
+	priority := func(s segment) float64 {
+		if s.cluster == uint(clusterIndex) {
+			return 1e300
+		}
+		if c.centroids != nil && emb != nil {
+			score := 0.0
+			for j, v := range emb {
+				score += float64(v) * c.centroids[s.cluster][j]
+			}
+			return score
+		}
+		distance := float64(s.start) - float64(dbIndex/c.DBInfo.M)
+		if distance < 0 {
+			distance = -distance
+		}
+		return -distance
+	}
+	sort.SliceStable(segments, func(i, j int) bool {
+		return priority(segments[i]) > priority(segments[j])
+	})
+
+	res := make([]VectorScore, 0)
+	scored := 0
+	complete := true
+scoring:
+	for _, s := range segments {
+		for j := s.start; j < s.end; j++ {
+			if scored > 0 && scored%deadlineCheckRows == 0 && ctx.Err() != nil {
+				complete = false
+				break scoring
+			}
+			score := utils.SmoothResult(uint64(vals.Get(j, 0)), mod)
+			if c.inBounds(score) {
+				res = append(res, VectorScore{
+					ClusterID:       s.cluster,
+					IDWithinCluster: j - s.start,
+					Score:           score,
+				})
+			}
+			scored++
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return c.Order.Before(res[i].Score, res[j].Score)
+	})
+	if len(res) > k {
+		res = res[:k]
+	}
+	return &res, complete
+}
@@ -0,0 +1,104 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+	"github.com/henrycg/simplepir/pir"
+)
+
+func TestReconstructWithinBinDeadline(t *testing.T) {
+	dim := uint64(2)
+	emb := []int8{1, -1}
+	// two clusters sharing a single bin
+	sizes := []int{100, 200}
+	metadata, clusters := database.SyntheticClusters(dim, sizes, 0)
+
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: 900}, 5)
+	defer s.Close()
+	c := new(Client)
+	c.Setup(s.Hint)
+	defer c.Free()
+
+	k := 10
+	cluster := uint64(1)
+	full := roundForTest(t, c, s, emb, cluster, false)
+	scores := make(map[VectorScore]bool)
+	for _, sc := range *full {
+		scores[sc] = true
+	}
+
+	offlineAns, err := s.HintAnswer(c.PreprocessQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ProcessHintApply(offlineAns)
+	ans, err := s.Answer(c.QueryEmbeddings(emb, cluster))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without a deadline, the whole bin is scored
+	got, complete := c.ReconstructWithinBinDeadline(context.Background(), ans, emb, cluster, c.DBInfo.P(), k)
+	if !complete {
+		t.Errorf("Expected a complete reconstruction without a deadline")
+	}
+	if len(*got) != k {
+		t.Fatalf("Expected %d results, but got %d", k, len(*got))
+	}
+	for i, sc := range *got {
+		if sc.Score != (*full)[i].Score || !scores[sc] {
+			t.Errorf("Result %d: expected score %d, but got %+v", i, (*full)[i].Score, sc)
+		}
+	}
+
+	// past the deadline, only the first rows of the query's cluster are scored
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	start := time.Now()
+	got, complete = c.ReconstructWithinBinDeadline(ctx, ans, emb, cluster, c.DBInfo.P(), k)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Reconstruction past its deadline took %s", elapsed)
+	}
+	if complete {
+		t.Errorf("Expected a partial reconstruction past the deadline")
+	}
+	if len(*got) != k {
+		t.Fatalf("Expected %d results, but got %d", k, len(*got))
+	}
+	for i, sc := range *got {
+		if sc.ClusterID != uint(cluster) || sc.IDWithinCluster >= deadlineCheckRows {
+			t.Errorf("Expected only the first %d vectors of cluster %d, but got %+v", deadlineCheckRows, cluster, sc)
+		}
+		if !scores[sc] {
+			t.Errorf("Partial result %+v not found among all candidates", sc)
+		}
+		if i > 0 && sc.Score > (*got)[i-1].Score {
+			t.Errorf("Partial results are not sorted: %+v after %+v", sc, (*got)[i-1])
+		}
+	}
+}
+
+func TestBinSegmentsEmptyCluster(t *testing.T) {
+	// cluster 1 is empty, at the same row as cluster 2, in the middle of column 0
+	c := &Client{
+		ClusterToIndex: database.ClusterMap{0: 0, 1: 20, 2: 20, 3: 1},
+		DBInfo:         &pir.DBInfo{M: 2, L: 30},
+		clusterSizes:   []uint64{10, 0, 15, 25},
+	}
+	for run := 0; run < 20; run++ {
+		segments := c.binSegments(0)
+		expected := []segment{{cluster: 0, start: 0, end: 10}, {cluster: 2, start: 10, end: 25}}
+		if len(segments) != len(expected) {
+			t.Fatalf("Expected segments %+v, but got %+v", expected, segments)
+		}
+		for i := range expected {
+			if segments[i] != expected[i] {
+				t.Errorf("Expected segment %d to be %+v, but got %+v", i, expected[i], segments[i])
+			}
+		}
+	}
+}
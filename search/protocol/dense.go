@@ -0,0 +1,28 @@
+package protocol
+
+import "fmt"
+
+// DenseScores lays out the scores of the vectors of a single cluster by their
+// index within it, e.g., for a learned reranker that consumes every score rather
+// than the top-k. The scores, in any order, must be those of vectors 0 to n-1 of
+// one cluster, as ReconstructWithinCluster returns them. It returns n and the
+// first min(n, limit) scores, or all n if limit is not positive.
+func DenseScores(scores *[]VectorScore, limit int) (int, []int, error) {
+	n := len(*scores)
+	dense := make([]int, n)
+	seen := make([]bool, n)
+	for _, sc := range *scores {
+		if sc.ClusterID != (*scores)[0].ClusterID {
+			return 0, nil, fmt.Errorf("expected the scores of a single cluster, but got clusters %d and %d", (*scores)[0].ClusterID, sc.ClusterID)
+		}
+		if sc.IDWithinCluster >= uint64(n) || seen[sc.IDWithinCluster] {
+			return 0, nil, fmt.Errorf("expected one score for each of the %d vectors of cluster %d, but got vector %d", n, sc.ClusterID, sc.IDWithinCluster)
+		}
+		dense[sc.IDWithinCluster] = sc.Score
+		seen[sc.IDWithinCluster] = true
+	}
+	if limit > 0 && limit < n {
+		dense = dense[:limit]
+	}
+	return n, dense, nil
+}
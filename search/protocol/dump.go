@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+// AnswerDumpVersion is the version of the answer dump layout, bumped on any
+// incompatible change. Readers reject other versions.
+const AnswerDumpVersion = 1
+
+var answerDumpMagic = [4]byte{'T', 'D', 'A', '1'}
+
+// AnswerDumpHeader is written to header.json in the directory of an answer
+// dump, with what a reconstruction needs besides the answers: the database is
+// L rows by M columns of values modulo P, and ClusterIndex maps every non-empty
+// cluster to the database index (row*M + column) of its first vector.
+type AnswerDumpHeader struct {
+	Version      int               `json:"version"`
+	Metadata     database.Metadata `json:"metadata"`
+	L            uint64            `json:"l"`
+	M            uint64            `json:"m"`
+	P            uint64            `json:"p"`
+	ClusterIndex map[uint]uint64   `json:"cluster_index"`
+	ClusterSizes []uint64          `json:"cluster_sizes"`
+}
+
+// WriteAnswerDumpHeader creates the directory of an answer dump, readable by
+// its owner only, and writes its header
+func WriteAnswerDumpHeader(dir string, hint *TiptoeHint) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	header := AnswerDumpHeader{
+		Version:      AnswerDumpVersion,
+		Metadata:     hint.Metadata,
+		L:            hint.PIRHint.Info.L,
+		M:            hint.PIRHint.Info.M,
+		P:            hint.PIRHint.Info.P(),
+		ClusterIndex: hint.IndexMap,
+		ClusterSizes: hint.ClusterSizes,
+	}
+	buf, err := json.MarshalIndent(header, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "header.json"), append(buf, '\n'), 0600)
+}
+
+// AnswerDumpFile is the file of the answer to a query in an answer dump
+func AnswerDumpFile(dir string, queryID int) string {
+	return filepath.Join(dir, fmt.Sprintf("%d.bin", queryID))
+}
+
+// WriteAnswerDump writes an exported answer to its file in an answer dump, for
+// tools in other languages. Integers are little-endian uint64s:
+//
+//	"TDA1" | version | queryID | clusterIndex | rows | decoded*rows | answer
+//
+// where answer is the serialized pir.Answer in utils.BinaryWire. The LHE client
+// does not expose its secret, so instead of the secret, decoded holds the answer
+// decrypted with it, as with ExportAnswer: the values reveal the scores of the
+// whole bin, so the files are readable by their owner only.
+func WriteAnswerDump(dir string, a *ExportedAnswer) error {
+	ans, err := utils.EncodeMessage(a.Answer, utils.BinaryWire)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 0, 4+8*(4+len(a.Decoded))+len(ans))
+	buf = append(buf, answerDumpMagic[:]...)
+	for _, v := range []uint64{AnswerDumpVersion, uint64(a.QueryID), a.ClusterIndex, uint64(len(a.Decoded))} {
+		buf = binary.LittleEndian.AppendUint64(buf, v)
+	}
+	for _, v := range a.Decoded {
+		buf = binary.LittleEndian.AppendUint64(buf, v)
+	}
+	buf = append(buf, ans...)
+	return os.WriteFile(AnswerDumpFile(dir, a.QueryID), buf, 0600)
+}
+
+// ReadAnswerDump reads the file of an answer written by WriteAnswerDump
+func ReadAnswerDump(file string) (*ExportedAnswer, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(buf)
+	var magic [4]byte
+	if _, err := r.Read(magic[:]); err != nil || magic != answerDumpMagic {
+		return nil, fmt.Errorf("%s is not an answer dump", file)
+	}
+	fields := make([]uint64, 4)
+	if err := binary.Read(r, binary.LittleEndian, fields); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", file, err)
+	}
+	if fields[0] != AnswerDumpVersion {
+		return nil, fmt.Errorf("%s has version %d, expected %d", file, fields[0], AnswerDumpVersion)
+	}
+	if fields[3] > uint64(r.Len())/8 {
+		return nil, fmt.Errorf("%s is truncated", file)
+	}
+	a := &ExportedAnswer{QueryID: int(fields[1]), ClusterIndex: fields[2], Decoded: make([]uint64, fields[3])}
+	if err := binary.Read(r, binary.LittleEndian, a.Decoded); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", file, err)
+	}
+	var ans pir.Answer[matrix.Elem64]
+	if err := utils.DecodeMessage(buf[len(buf)-r.Len():], utils.BinaryWire, &ans); err != nil {
+		return nil, fmt.Errorf("error reading the answer of %s: %w", file, err)
+	}
+	a.Answer = ans
+	return a, nil
+}
@@ -0,0 +1,76 @@
+package protocol_test
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+	"github.com/DeweiFeng/6.5610-project/search/protocol"
+)
+
+// silenced runs f with the standard output discarded, so that the output of
+// the example holds its results but not the progress the server prints
+func silenced(f func()) {
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		panic(err)
+	}
+	os.Stdout = devNull
+	defer func() {
+		os.Stdout = stdout
+		devNull.Close()
+	}()
+	f()
+}
+
+// Example builds a tiny database in memory and runs one private query against
+// it: the hint round (offline) and the query round (online).
+func Example() {
+	// two clusters of 2-dimensional unit vectors
+	floats := [][]float64{
+		{1, 0, 0, 1, 0.6, 0.8},
+		{-1, 0, 0, -1},
+	}
+	metadata := database.Metadata{NumVectors: 5, Dim: 2, NumClusters: 2}
+	precBits := uint64(5)
+	clusters, err := database.ClustersFromFloats(metadata, floats, precBits)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// the server builds the database and the hint, which it sends to the client
+	server := new(protocol.Server)
+	silenced(func() {
+		server.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: 900}, precBits)
+	})
+	defer server.Close()
+	client := new(protocol.Client)
+	client.Setup(server.Hint)
+	defer client.Free()
+
+	// every query needs a hint round, which does not depend on the query
+	hintAns, err := server.HintAnswer(client.PreprocessQuery())
+	if err != nil {
+		panic(err)
+	}
+	client.ProcessHintApply(hintAns)
+
+	// the query round scores the query against the cluster it is routed to
+	query, err := client.PrepareQuery([]float64{0.6, 0.8}, precBits)
+	if err != nil {
+		panic(err)
+	}
+	ans, err := server.Answer(client.QueryEmbeddings(query, 0))
+	if err != nil {
+		panic(err)
+	}
+	scores := client.ReconstructWithinCluster(ans, 0, client.DBInfo.P())
+
+	// scores are dot products of the quantized vectors: (0.6, 0.8) is (10, 13)
+	best := (*scores)[0]
+	fmt.Printf("top-1: cluster %d, vector %d, score %d\n", best.ClusterID, best.IDWithinCluster, best.Score)
+	// Output:
+	// top-1: cluster 0, vector 2, score 269
+}
@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+// AnswerExportVersion is the version of the answer export format, bumped on any
+// incompatible change. Readers reject other versions.
+const AnswerExportVersion = 1
+
+// AnswerExportHeader starts an answer export, with the parts of the hint that
+// reconstruction needs. It holds no client secret.
+type AnswerExportHeader struct {
+	Version      int
+	Metadata     database.Metadata
+	DBInfo       pir.DBInfo
+	IndexMap     database.ClusterMap
+	ClusterSizes []uint64
+}
+
+// ExportedAnswer is the answer to one query, for offline reconstruction.
+//
+// Decrypting an answer takes the secret of the client that made the query,
+// which the LHE client does not expose, so Decoded holds the answer decrypted
+// at export time: one value modulo P per database row, the inner product of the
+// query with the row in the queried column. Every reconstruction strategy only
+// needs these values, which reveal the scores of the whole bin: the export must
+// be kept as private as the results. The encrypted Answer is kept for reference.
+type ExportedAnswer struct {
+	QueryID      int
+	ClusterIndex uint64
+	Answer       pir.Answer[matrix.Elem64]
+	Decoded      []uint64
+}
+
+// AnswerWriter writes an answer export: a header followed by answers, all gob
+// encoded in a single stream
+type AnswerWriter struct {
+	enc *gob.Encoder
+}
+
+func NewAnswerWriter(w io.Writer, hint *TiptoeHint) (*AnswerWriter, error) {
+	aw := &AnswerWriter{enc: gob.NewEncoder(w)}
+	header := AnswerExportHeader{
+		Version:      AnswerExportVersion,
+		Metadata:     hint.Metadata,
+		DBInfo:       hint.PIRHint.Info,
+		IndexMap:     hint.IndexMap,
+		ClusterSizes: hint.ClusterSizes,
+	}
+	if err := aw.enc.Encode(header); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+// ExportAnswer decrypts the answer to the client's last query for export
+func (c *Client) ExportAnswer(answer *pir.Answer[matrix.Elem64], queryID int, clusterIndex uint64) *ExportedAnswer {
+	vals := c.UnderhoodClient.RecoverLHE(answer)
+	decoded := make([]uint64, vals.Rows())
+	for i := range decoded {
+		decoded[i] = uint64(vals.Get(uint64(i), 0))
+	}
+	return &ExportedAnswer{
+		QueryID:      queryID,
+		ClusterIndex: clusterIndex,
+		Answer:       *answer,
+		Decoded:      decoded,
+	}
+}
+
+func (aw *AnswerWriter) Write(a *ExportedAnswer) error {
+	return aw.enc.Encode(a)
+}
+
+// AnswerReader reads an answer export written by AnswerWriter
+type AnswerReader struct {
+	Header AnswerExportHeader
+	dec    *gob.Decoder
+}
+
+func NewAnswerReader(r io.Reader) (*AnswerReader, error) {
+	ar := &AnswerReader{dec: gob.NewDecoder(r)}
+	if err := ar.dec.Decode(&ar.Header); err != nil {
+		return nil, fmt.Errorf("error reading answer export header: %w", err)
+	}
+	if ar.Header.Version != AnswerExportVersion {
+		return nil, fmt.Errorf("answer export has version %d, expected %d", ar.Header.Version, AnswerExportVersion)
+	}
+	return ar, nil
+}
+
+// Read returns the next answer, or io.EOF after the last one
+func (ar *AnswerReader) Read() (*ExportedAnswer, error) {
+	a := new(ExportedAnswer)
+	if err := ar.dec.Decode(a); err != nil {
+		return nil, err
+	}
+	if uint64(len(a.Decoded)) != ar.Header.DBInfo.L {
+		return nil, fmt.Errorf("answer to query %d has %d rows, but the database has %d", a.QueryID, len(a.Decoded), ar.Header.DBInfo.L)
+	}
+	return a, nil
+}
+
+// NewOfflineClient returns a client that reconstructs exported answers with
+// ReconstructExported. It cannot make queries.
+func NewOfflineClient(header *AnswerExportHeader) *Client {
+	c := &Client{
+		Metadata:       header.Metadata,
+		DBInfo:         &header.DBInfo,
+		ClusterToIndex: header.IndexMap,
+		clusterSizes:   header.ClusterSizes,
+	}
+	c.indexClusters()
+	return c
+}
+
+// ReconstructExported is ReconstructWithinCluster, or ReconstructWithinBin if
+// clusterOnly is not set, on an exported answer. Like them, it honors
+// MaxCandidates, so that strategies can be compared on the same answers.
+func (c *Client) ReconstructExported(a *ExportedAnswer, clusterOnly bool) *[]VectorScore {
+	if _, ok := c.ClusterToIndex[uint(a.ClusterIndex)]; !ok {
+		panic("Invalid cluster index")
+	}
+	vals := matrix.New[matrix.Elem64](uint64(len(a.Decoded)), 1)
+	for i, v := range a.Decoded {
+		vals.Set(uint64(i), 0, matrix.Elem64(v))
+	}
+
+	var res []VectorScore
+	if clusterOnly {
+		res = c.scoreWithinCluster(vals, a.ClusterIndex, c.DBInfo.P())
+	} else {
+		res = c.scoreWithinBin(vals, a.ClusterIndex, c.DBInfo.P())
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return c.Order.Before(res[i].Score, res[j].Score)
+	})
+	return &res
+}
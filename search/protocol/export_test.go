@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+)
+
+func TestExportAnswers(t *testing.T) {
+	ts := newTestSession(t, database.DatabaseParams{HintSz: 900})
+	s, c, metadata := ts.s, ts.c, ts.metadata
+
+	var buf bytes.Buffer
+	aw, err := NewAnswerWriter(&buf, s.Hint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emb := make([]int8, metadata.Dim)
+	for i := range emb {
+		emb[i] = int8(i%5) - 2
+	}
+	expected := make(map[int][2]*[]VectorScore)
+	for q, cluster := range []uint64{0, 3, 4} {
+		ans := ts.answer(t, emb, cluster)
+		expected[q] = [2]*[]VectorScore{c.ReconstructWithinBin(ans, cluster, c.DBInfo.P()), c.ReconstructWithinCluster(ans, cluster, c.DBInfo.P())}
+		if err := aw.Write(c.ExportAnswer(ans, q, cluster)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the answers reconstruct offline like online, without the client
+	ar, err := NewAnswerReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offline := NewOfflineClient(&ar.Header)
+	read := 0
+	for {
+		a, err := ar.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		read++
+		for i, clusterOnly := range []bool{false, true} {
+			if !sameScores(offline.ReconstructExported(a, clusterOnly), expected[a.QueryID][i]) {
+				t.Errorf("Query %d, clusterOnly %v: offline reconstruction differs from the online one", a.QueryID, clusterOnly)
+			}
+		}
+	}
+	if read != len(expected) {
+		t.Errorf("Expected %d answers, but read %d", len(expected), read)
+	}
+
+	// other versions are rejected
+	var old bytes.Buffer
+	if err := gob.NewEncoder(&old).Encode(AnswerExportHeader{Version: AnswerExportVersion + 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewAnswerReader(&old); err == nil {
+		t.Errorf("Expected an error reading an export of another version")
+	}
+}
+
+func TestReconstructScoreBound(t *testing.T) {
+	ts := newTestSession(t, database.DatabaseParams{HintSz: 900})
+	s, c, metadata := ts.s, ts.c, ts.metadata
+
+	emb := make([]int8, metadata.Dim)
+	for i := range emb {
+		emb[i] = int8(i%5) - 2
+	}
+	cluster := uint64(0)
+	ans := ts.answer(t, emb, cluster)
+	a := c.ExportAnswer(ans, 0, cluster)
+
+	// a corrupted value in the first row of the queried bin, far beyond any score
+	corrupted := c.DBInfo.P()/2 - 1
+	a.Decoded[0] = corrupted
+
+	header := AnswerExportHeader{Metadata: s.Hint.Metadata, DBInfo: s.Hint.PIRHint.Info, IndexMap: s.Hint.IndexMap, ClusterSizes: s.Hint.ClusterSizes}
+	unbounded := NewOfflineClient(&header)
+	res := *unbounded.ReconstructExported(a, false)
+	if len(res) == 0 || res[0].Score != int(corrupted) {
+		t.Fatalf("Expected the corrupted value to rank first without a bound, but got %v", res)
+	}
+
+	bounded := NewOfflineClient(&header)
+	bounded.ScoreBound = int(utils.MixedScoreRange(metadata.Dim, 5, 5))
+	got := *bounded.ReconstructExported(a, false)
+	if bounded.Anomalies() != 1 {
+		t.Errorf("Expected 1 anomaly, but got %d", bounded.Anomalies())
+	}
+	// the dropped candidate was scored all the same
+	if bounded.Scored() != uint64(len(res)) {
+		t.Errorf("Expected %d candidates scored, but got %d", len(res), bounded.Scored())
+	}
+	if len(got) != len(res)-1 {
+		t.Errorf("Expected %d results, but got %d", len(res)-1, len(got))
+	}
+	for _, sc := range got {
+		if sc.Score > bounded.ScoreBound || sc.Score < -bounded.ScoreBound {
+			t.Errorf("Result %+v is beyond the bound %d", sc, bounded.ScoreBound)
+		}
+	}
+}
+
+func TestAnswerDump(t *testing.T) {
+	ts := newTestSession(t, database.DatabaseParams{HintSz: 900})
+	s, c, metadata := ts.s, ts.c, ts.metadata
+
+	emb := make([]int8, metadata.Dim)
+	for i := range emb {
+		emb[i] = int8(i%3) - 1
+	}
+	cluster := uint64(4)
+	ans := ts.answer(t, emb, cluster)
+	expected := c.ReconstructWithinBin(ans, cluster, c.DBInfo.P())
+
+	dir := t.TempDir() + "/dump"
+	if err := WriteAnswerDumpHeader(dir, s.Hint); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteAnswerDump(dir, c.ExportAnswer(ans, 7, cluster)); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{dir, filepath.Join(dir, "header.json"), AnswerDumpFile(dir, 7)} {
+		if info, err := os.Stat(f); err != nil || info.Mode().Perm()&0077 != 0 {
+			t.Errorf("Expected %s to be private to its owner, but got %v and %v", f, info.Mode(), err)
+		}
+	}
+	a, err := ReadAnswerDump(AnswerDumpFile(dir, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.QueryID != 7 || a.ClusterIndex != cluster || !reflect.DeepEqual(a.Answer, *ans) {
+		t.Errorf("Dumped answer of query %d, cluster %d differs from the answer", a.QueryID, a.ClusterIndex)
+	}
+	header := AnswerExportHeader{Metadata: s.Hint.Metadata, DBInfo: s.Hint.PIRHint.Info, IndexMap: s.Hint.IndexMap, ClusterSizes: s.Hint.ClusterSizes}
+	if !sameScores(NewOfflineClient(&header).ReconstructExported(a, false), expected) {
+		t.Errorf("Reconstructing the dumped answer differs from the online reconstruction")
+	}
+
+	// other versions are rejected
+	buf, err := os.ReadFile(AnswerDumpFile(dir, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[4]++
+	if err := os.WriteFile(AnswerDumpFile(dir, 8), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadAnswerDump(AnswerDumpFile(dir, 8)); err == nil {
+		t.Errorf("Expected an error reading a dump of another version")
+	}
+}
@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SetCentroids gives the client the centroid of every cluster, as written by
+// database.WriteCentroids, so that GlobalQuery probes the most promising bins
+// first. The centroids are public: they are used by the client only.
+func (c *Client) SetCentroids(centroids [][]float64) error {
+	if uint64(len(centroids)) != c.Metadata.NumClusters {
+		return fmt.Errorf("got %d centroids, but the database has %d clusters", len(centroids), c.Metadata.NumClusters)
+	}
+	for i, centroid := range centroids {
+		if uint64(len(centroid)) != c.Metadata.Dim {
+			return fmt.Errorf("centroid %d has dimension %d, but the database has dimension %d", i, len(centroid), c.Metadata.Dim)
+		}
+	}
+	c.centroids = centroids
+	return nil
+}
+
+// NumBins is the number of database columns, i.e., the number of rounds of an
+// exhaustive GlobalQuery
+func (c *Client) NumBins() int {
+	return int(c.DBInfo.M / c.Metadata.Dim)
+}
+
+// GlobalQuery searches the whole database, without a cluster index, and returns
+// the global top k. It probes nprobe bins with ProbeClusters, or all of them if
+// nprobe is not positive or at least NumBins, so its cost is nprobe rounds, each
+// as expensive as a regular query. With all bins probed, the results are exact.
+// With fewer, the bins are ranked by the best inner product of the query with
+// the centroids of their clusters, which requires SetCentroids, and vectors of
+// the other bins are missed.
+//
+// As with ProbeClusters, the server learns nprobe but not which bins are probed,
+// so nprobe should be the same for every query. Without the cluster sizes in the
+// hint (e.g., for merged databases), the padding rows at the bottom of a bin have
+// score 0 and may show up among the results, like in ReconstructWithinBin.
+func (c *Client) GlobalQuery(r Responder, emb []int8, k int, nprobe int) (*[]VectorScore, error) {
+	if k <= 0 {
+		return nil, fmt.Errorf("k must be positive")
+	}
+	numBins := c.NumBins()
+	if nprobe <= 0 || nprobe > numBins {
+		nprobe = numBins
+	}
+	if nprobe < numBins && c.centroids == nil {
+		return nil, fmt.Errorf("probing %d of %d bins requires centroids to choose them", nprobe, numBins)
+	}
+	// the bins are chosen by their best centroid score, which says nothing of the
+	// lowest scores of their vectors
+	if nprobe < numBins && c.Order == Ascending {
+		return nil, fmt.Errorf("probing %d of %d bins requires the descending order", nprobe, numBins)
+	}
+
+	// the best centroid score of each bin, and one of its clusters to query it
+	binScore := make(map[uint64]float64)
+	binCluster := make(map[uint64]uint64)
+	for i := uint64(0); i < c.Metadata.NumClusters; i++ {
+		if _, ok := c.ClusterToIndex[uint(i)]; !ok {
+			continue // not in the database
+		}
+		bin := c.Bin(i)
+		// the scale of the quantized query does not change the ranking
+		score := 0.0
+		if c.centroids != nil {
+			for j, v := range emb {
+				score += float64(v) * c.centroids[i][j]
+			}
+		}
+		if best, ok := binScore[bin]; !ok || score > best {
+			binScore[bin] = score
+		}
+		if _, ok := binCluster[bin]; !ok {
+			binCluster[bin] = i
+		}
+	}
+
+	bins := make([]uint64, 0, len(binCluster))
+	for bin := range binCluster {
+		bins = append(bins, bin)
+	}
+	sort.Slice(bins, func(i, j int) bool {
+		if binScore[bins[i]] != binScore[bins[j]] {
+			return binScore[bins[i]] > binScore[bins[j]]
+		}
+		return bins[i] < bins[j]
+	})
+	if nprobe > len(bins) {
+		nprobe = len(bins)
+	}
+
+	probes := make([]uint64, nprobe)
+	for i := range probes {
+		probes[i] = binCluster[bins[i]]
+	}
+	scores, err := c.ProbeClusters(r, emb, probes, nprobe)
+	if err != nil {
+		return nil, err
+	}
+	if len(*scores) > k {
+		*scores = (*scores)[:k]
+	}
+	return scores, nil
+}
+
+// RecallAtK is the fraction of the first k exact results that are among the
+// first k results, comparing vectors by cluster and position. Since vectors tied
+// with the k-th exact score are interchangeable, any of them counts as a hit.
+func RecallAtK(results *[]VectorScore, exact *[]VectorScore, k int) float64 {
+	if len(*exact) < k {
+		k = len(*exact)
+	}
+	if k == 0 {
+		return 1
+	}
+	type vectorID struct {
+		cluster uint
+		id      uint64
+	}
+	relevant := make(map[vectorID]bool)
+	for _, v := range (*exact)[:k] {
+		relevant[vectorID{v.ClusterID, v.IDWithinCluster}] = true
+	}
+	threshold := (*exact)[k-1].Score
+	hits := 0
+	for i := 0; i < k && i < len(*results); i++ {
+		v := (*results)[i]
+		if relevant[vectorID{v.ClusterID, v.IDWithinCluster}] || v.Score == threshold {
+			hits++
+		}
+	}
+	return float64(hits) / float64(k)
+}
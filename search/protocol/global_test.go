@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+)
+
+func TestGlobalQuery(t *testing.T) {
+	dim := uint64(4)
+	sizes := []int{60, 60, 60, 60}
+	metadata, clusters := database.SyntheticClusters(dim, sizes, 0)
+
+	// a small hint makes the columns short, so that the clusters span several bins
+	params := database.DatabaseParams{HintSz: 1}
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, params, 5)
+	defer s.Close()
+	exact := NewPlaintextServer(metadata, clusters, params)
+
+	c := new(Client)
+	c.Setup(s.Hint)
+	defer c.Free()
+	if c.NumBins() < 2 {
+		t.Fatalf("Expected the clusters to span several bins, but got %d", c.NumBins())
+	}
+
+	emb := []int8{1, -2, 3, 0}
+	k := 10
+	r := &countingResponder{s: s}
+	scores, err := c.GlobalQuery(r, emb, k, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.rounds != c.NumBins() || len(*scores) != k {
+		t.Errorf("Expected %d rounds and %d results, but got %d and %d", c.NumBins(), k, r.rounds, len(*scores))
+	}
+	if recall := RecallAtK(scores, exact.SearchAll(emb), k); recall != 1 {
+		t.Errorf("Expected an exhaustive search to have recall 1, but got %g", recall)
+	}
+
+	if _, err := c.GlobalQuery(s, emb, k, 1); err == nil {
+		t.Errorf("Expected an error probing some bins without centroids")
+	}
+
+	centroids := make([][]float64, len(clusters))
+	for i, cluster := range clusters {
+		centroids[i] = cluster.Centroid
+	}
+	if err := c.SetCentroids(centroids); err != nil {
+		t.Fatal(err)
+	}
+	r = &countingResponder{s: s}
+	if _, err := c.GlobalQuery(r, emb, k, 1); err != nil {
+		t.Fatal(err)
+	}
+	if r.rounds != 1 {
+		t.Errorf("Expected a single round with nprobe 1, but got %d", r.rounds)
+	}
+}
+
+func TestRecallAtK(t *testing.T) {
+	exact := []VectorScore{
+		{ClusterID: 0, IDWithinCluster: 0, Score: 9},
+		{ClusterID: 1, IDWithinCluster: 0, Score: 5},
+		{ClusterID: 1, IDWithinCluster: 1, Score: 5},
+		{ClusterID: 0, IDWithinCluster: 1, Score: 2},
+	}
+	results := []VectorScore{
+		{ClusterID: 0, IDWithinCluster: 0, Score: 9},
+		// tied with the second exact result
+		{ClusterID: 1, IDWithinCluster: 1, Score: 5},
+		{ClusterID: 0, IDWithinCluster: 1, Score: 2},
+	}
+	tests := []struct {
+		k        int
+		expected float64
+	}{{1, 1}, {2, 1}, {3, 2.0 / 3}, {10, 0.75}}
+	for _, test := range tests {
+		if recall := RecallAtK(&results, &exact, test.k); recall != test.expected {
+			t.Errorf("Expected recall@%d %g, but got %g", test.k, test.expected, recall)
+		}
+	}
+}
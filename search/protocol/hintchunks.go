@@ -0,0 +1,225 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+)
+
+// hintChunkMagic starts every serialized HintChunk
+var hintChunkMagic = [4]byte{'T', 'H', 'C', '1'}
+
+// hintChunkHeaderSize is the size of a serialized HintChunk before its data
+const hintChunkHeaderSize = 4 + 4*8 + sha256.Size
+
+// ErrHintChunk is returned for a chunk that is corrupt or does not belong with
+// the chunks received before it
+var ErrHintChunk = errors.New("invalid hint chunk")
+
+// HintChunk is a piece of a serialized hint, so that a client can download the
+// hint in pieces and resume a partial download. The hint is gob-encoded and cut
+// into NumChunks chunks of ChunkSize bytes, the last one holding the rest; every
+// chunk names the TotalSize and the SHA-256 Digest of the whole serialized hint,
+// so that chunks of different hints are never mixed.
+type HintChunk struct {
+	Index     uint64
+	NumChunks uint64
+	ChunkSize uint64
+	TotalSize uint64
+	Digest    [sha256.Size]byte
+	Data      []byte
+}
+
+// EncodeHint serializes a hint, as SplitHint does before cutting it
+func EncodeHint(hint *TiptoeHint) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(hint); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeHint deserializes a hint encoded by EncodeHint
+func DecodeHint(buf []byte) (*TiptoeHint, error) {
+	hint := new(TiptoeHint)
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(hint); err != nil {
+		return nil, fmt.Errorf("error decoding hint: %w", err)
+	}
+	return hint, nil
+}
+
+// SplitHint serializes a hint and cuts it into chunks of chunkSize bytes
+func SplitHint(hint *TiptoeHint, chunkSize uint64) ([]HintChunk, error) {
+	if chunkSize == 0 {
+		return nil, fmt.Errorf("chunks must hold at least a byte")
+	}
+	buf, err := EncodeHint(hint)
+	if err != nil {
+		return nil, err
+	}
+	total := uint64(len(buf))
+	numChunks := (total + chunkSize - 1) / chunkSize
+	digest := sha256.Sum256(buf)
+	chunks := make([]HintChunk, numChunks)
+	for i := range chunks {
+		start := uint64(i) * chunkSize
+		end := start + chunkSize
+		if end > total {
+			end = total
+		}
+		chunks[i] = HintChunk{
+			Index:     uint64(i),
+			NumChunks: numChunks,
+			ChunkSize: chunkSize,
+			TotalSize: total,
+			Digest:    digest,
+			Data:      buf[start:end],
+		}
+	}
+	return chunks, nil
+}
+
+// MarshalBinary lays out a chunk as
+//
+//	"THC1" | index | numChunks | chunkSize | totalSize | digest | data
+//
+// where integers are little-endian uint64s and digest is the 32 bytes of the
+// SHA-256 of the whole hint. WriteHintChunk frames it with its length and
+// checksum.
+func (c HintChunk) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, hintChunkHeaderSize+len(c.Data))
+	buf = append(buf, hintChunkMagic[:]...)
+	for _, v := range []uint64{c.Index, c.NumChunks, c.ChunkSize, c.TotalSize} {
+		buf = binary.LittleEndian.AppendUint64(buf, v)
+	}
+	buf = append(buf, c.Digest[:]...)
+	return append(buf, c.Data...), nil
+}
+
+// UnmarshalBinary reads a chunk laid out by MarshalBinary, failing with
+// ErrHintChunk if it is truncated
+func (c *HintChunk) UnmarshalBinary(buf []byte) error {
+	if len(buf) < hintChunkHeaderSize {
+		return fmt.Errorf("%w: %d bytes is shorter than a chunk header", ErrHintChunk, len(buf))
+	}
+	if !bytes.Equal(buf[:4], hintChunkMagic[:]) {
+		return fmt.Errorf("%w: unexpected magic %q", ErrHintChunk, buf[:4])
+	}
+	c.Index = binary.LittleEndian.Uint64(buf[4:])
+	c.NumChunks = binary.LittleEndian.Uint64(buf[12:])
+	c.ChunkSize = binary.LittleEndian.Uint64(buf[20:])
+	c.TotalSize = binary.LittleEndian.Uint64(buf[28:])
+	copy(c.Digest[:], buf[36:36+sha256.Size])
+	c.Data = append([]byte(nil), buf[hintChunkHeaderSize:]...)
+	return nil
+}
+
+// WriteHintChunk writes a chunk to a stream with utils.WriteMessage, in
+// utils.BinaryWire with its checksum, so that a chunk corrupted in transit is
+// detected on its own and can be downloaded again
+func WriteHintChunk(w io.Writer, c HintChunk) error {
+	return utils.WriteMessage(w, c, utils.BinaryWire, true)
+}
+
+// ReadHintChunk reads a chunk written by WriteHintChunk, failing with
+// ErrHintChunk, and utils.ErrChecksum for a corrupt one, if it cannot
+func ReadHintChunk(r io.Reader) (HintChunk, error) {
+	var c HintChunk
+	if err := utils.ReadMessage(r, utils.BinaryWire, &c, true); err != nil {
+		if errors.Is(err, ErrHintChunk) {
+			return HintChunk{}, err
+		}
+		return HintChunk{}, fmt.Errorf("%w: %w", ErrHintChunk, err)
+	}
+	return c, nil
+}
+
+// HintAssembler reassembles a hint from its chunks, received in any order and
+// possibly more than once, e.g., across the connections of a resumed download.
+// It keeps the chunks received, so that its memory grows with them rather than
+// with the size the first chunk claims for the hint.
+type HintAssembler struct {
+	first    *HintChunk
+	received map[uint64][]byte
+}
+
+// Add places a chunk. The first chunk fixes the hint, and a later chunk that
+// does not belong with it, or is not of the size its index calls for, fails
+// with ErrHintChunk and leaves the assembler as it was.
+func (a *HintAssembler) Add(c HintChunk) error {
+	if a.first == nil {
+		if c.TotalSize > utils.MaxFramedMessageSize {
+			return fmt.Errorf("%w: a hint of %d bytes is beyond %d bytes", ErrHintChunk, c.TotalSize, uint64(utils.MaxFramedMessageSize))
+		}
+		if c.ChunkSize == 0 || c.NumChunks != (c.TotalSize+c.ChunkSize-1)/c.ChunkSize {
+			return fmt.Errorf("%w: %d chunks of %d bytes cannot hold a hint of %d bytes", ErrHintChunk, c.NumChunks, c.ChunkSize, c.TotalSize)
+		}
+	} else if c.NumChunks != a.first.NumChunks || c.ChunkSize != a.first.ChunkSize || c.TotalSize != a.first.TotalSize || c.Digest != a.first.Digest {
+		return fmt.Errorf("%w: chunk %d is of another hint", ErrHintChunk, c.Index)
+	}
+	if c.Index >= c.NumChunks {
+		return fmt.Errorf("%w: chunk %d of a hint of %d chunks", ErrHintChunk, c.Index, c.NumChunks)
+	}
+	start := c.Index * c.ChunkSize
+	end := start + c.ChunkSize
+	if end > c.TotalSize {
+		end = c.TotalSize
+	}
+	if uint64(len(c.Data)) != end-start {
+		return fmt.Errorf("%w: chunk %d holds %d bytes, expected %d", ErrHintChunk, c.Index, len(c.Data), end-start)
+	}
+
+	if a.first == nil {
+		first := c
+		first.Data = nil
+		a.first = &first
+		a.received = make(map[uint64][]byte)
+	}
+	if _, ok := a.received[c.Index]; !ok {
+		a.received[c.Index] = append([]byte(nil), c.Data...)
+	}
+	return nil
+}
+
+// Missing returns the indices of the chunks not received yet, which a resumed
+// download asks for; it is nil before the first chunk, when the number of
+// chunks is not known yet
+func (a *HintAssembler) Missing() []uint64 {
+	if a.first == nil {
+		return nil
+	}
+	res := make([]uint64, 0)
+	for i := uint64(0); i < a.first.NumChunks; i++ {
+		if _, ok := a.received[i]; !ok {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// Complete tells whether every chunk was received
+func (a *HintAssembler) Complete() bool {
+	return a.first != nil && uint64(len(a.received)) == a.first.NumChunks
+}
+
+// Hint checks the reassembled hint against its digest and decodes it, for
+// Client.Setup
+func (a *HintAssembler) Hint() (*TiptoeHint, error) {
+	if !a.Complete() {
+		return nil, fmt.Errorf("the hint is missing %d chunks", len(a.Missing()))
+	}
+	buf := make([]byte, 0, a.first.TotalSize)
+	for i := uint64(0); i < a.first.NumChunks; i++ {
+		buf = append(buf, a.received[i]...)
+	}
+	if digest := sha256.Sum256(buf); digest != a.first.Digest {
+		return nil, fmt.Errorf("%w: the reassembled hint has digest %x, expected %x", ErrHintChunk, digest, a.first.Digest)
+	}
+	return DecodeHint(buf)
+}
@@ -0,0 +1,157 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+)
+
+func TestHintChunks(t *testing.T) {
+	preamble := utils.GenerateTestData()
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.RemoveTestData()
+
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: 900}, 5)
+	defer s.Close()
+
+	const chunkSize = 128
+	chunks, err := SplitHint(s.Hint, chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := EncodeHint(s.Hint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := (len(encoded) + chunkSize - 1) / chunkSize; len(chunks) != n || n < 4 {
+		t.Fatalf("Expected %d chunks of %d bytes, at least 4, but got %d", n, chunkSize, len(chunks))
+	}
+
+	// every chunk goes through its framed layout, in a shuffled order
+	transfer := func(c HintChunk) HintChunk {
+		var buf bytes.Buffer
+		if err := WriteHintChunk(&buf, c); err != nil {
+			t.Fatal(err)
+		}
+		res, err := ReadHintChunk(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	order := rand.New(rand.NewSource(5)).Perm(len(chunks))
+
+	// a download interrupted halfway, resumed for the missing chunks, with a
+	// chunk received twice
+	a := new(HintAssembler)
+	if a.Missing() != nil || a.Complete() {
+		t.Errorf("Expected an empty assembler to know of no chunks")
+	}
+	half := order[:len(order)/2]
+	for _, i := range half {
+		if err := a.Add(transfer(chunks[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.Complete() {
+		t.Fatalf("Expected half the chunks not to complete the hint")
+	}
+	if _, err := a.Hint(); err == nil {
+		t.Errorf("Expected an incomplete hint to be rejected")
+	}
+	missing := a.Missing()
+	if len(missing) != len(chunks)-len(half) {
+		t.Fatalf("Expected %d missing chunks, but got %v", len(chunks)-len(half), missing)
+	}
+	for j := len(missing) - 1; j >= 0; j-- {
+		if err := a.Add(transfer(chunks[missing[j]])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Add(transfer(chunks[half[0]])); err != nil {
+		t.Errorf("Expected a chunk received twice to be accepted, but got %v", err)
+	}
+	if !a.Complete() || len(a.Missing()) != 0 {
+		t.Fatalf("Expected the hint to be complete, but chunks %v are missing", a.Missing())
+	}
+	hint, err := a.Hint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a client set up with the reassembled hint gets the same scores
+	c := new(Client)
+	c.Setup(s.Hint)
+	defer c.Free()
+	reassembled := new(Client)
+	reassembled.Setup(hint)
+	defer reassembled.Free()
+	emb := make([]int8, metadata.Dim)
+	for j := range emb {
+		emb[j] = int8(j%5) - 2
+	}
+	want := roundForTest(t, c, s, emb, 1, false)
+	if got := roundForTest(t, reassembled, s, emb, 1, false); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the scores of the original hint, but got others")
+	}
+
+	// corruption in transit fails the chunk alone, and a chunk of another hint,
+	// or of the wrong size, is rejected
+	var framed bytes.Buffer
+	if err := WriteHintChunk(&framed, chunks[1]); err != nil {
+		t.Fatal(err)
+	}
+	buf := framed.Bytes()
+	buf[len(buf)-4-3] ^= 1
+	if _, err := ReadHintChunk(bytes.NewReader(buf)); !errors.Is(err, ErrHintChunk) || !errors.Is(err, utils.ErrChecksum) {
+		t.Errorf("Expected a corrupt chunk to fail with ErrHintChunk and ErrChecksum, but got %v", err)
+	}
+	if _, err := ReadHintChunk(bytes.NewReader(buf[:10])); !errors.Is(err, ErrHintChunk) {
+		t.Errorf("Expected a truncated chunk to fail with ErrHintChunk, but got %v", err)
+	}
+	var corrupt HintChunk
+	if err := corrupt.UnmarshalBinary(make([]byte, hintChunkHeaderSize-1)); !errors.Is(err, ErrHintChunk) {
+		t.Errorf("Expected a chunk shorter than its header to fail with ErrHintChunk, but got %v", err)
+	}
+	other := chunks[1]
+	other.Digest[0] ^= 1
+	if err := a.Add(other); !errors.Is(err, ErrHintChunk) {
+		t.Errorf("Expected a chunk of another hint to be rejected, but got %v", err)
+	}
+	// a first chunk claiming a huge hint is rejected rather than allocated
+	huge := chunks[0]
+	huge.TotalSize = 1 << 62
+	huge.NumChunks = (huge.TotalSize + huge.ChunkSize - 1) / huge.ChunkSize
+	if err := new(HintAssembler).Add(huge); !errors.Is(err, ErrHintChunk) {
+		t.Errorf("Expected a hint of %d bytes to be rejected, but got %v", huge.TotalSize, err)
+	}
+	short := chunks[1]
+	short.Data = short.Data[1:]
+	if err := new(HintAssembler).Add(short); !errors.Is(err, ErrHintChunk) {
+		t.Errorf("Expected a short chunk to be rejected, but got %v", err)
+	}
+
+	// data altered consistently with the chunk checksum fails the digest
+	tampered := new(HintAssembler)
+	for i, chunk := range chunks {
+		if i == 2 {
+			chunk.Data = append([]byte(nil), chunk.Data...)
+			chunk.Data[0] ^= 1
+		}
+		if err := tampered.Add(transfer(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tampered.Hint(); !errors.Is(err, ErrHintChunk) {
+		t.Errorf("Expected a tampered hint to fail its digest, but got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package protocol
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+)
+
+// LazyServers serves every cluster from a PIR database of its own, built on the
+// first query to the cluster from the cluster loaded by Load, and keeps at most
+// Capacity of them, evicting the least recently queried. Only the clusters in
+// use are held in memory, at the cost of building a database (and its hint) on
+// the first query to a cluster and again after its eviction.
+//
+// Since each cluster is a separate database, the server learns which cluster
+// every query is for: only the query vector stays private, not the access
+// pattern. Results only cover the queried cluster, as with ReconstructWithinCluster.
+type LazyServers struct {
+	metadata database.Metadata
+	load     func(clusterIndex uint64) (*database.Cluster, error)
+	params   database.DatabaseParams
+	precBits uint64
+	capacity int
+
+	// OnEvict, if set, is called with the index of every evicted cluster, e.g., to
+	// free the client set up with its hint
+	OnEvict func(clusterIndex uint64)
+
+	mu        sync.Mutex
+	entries   map[uint64]*list.Element
+	lru       *list.List
+	loads     uint64
+	evictions uint64
+}
+
+type lazyEntry struct {
+	clusterIndex uint64
+	server       *Server
+}
+
+func NewLazyServers(metadata database.Metadata, load func(clusterIndex uint64) (*database.Cluster, error), params database.DatabaseParams, precBits uint64, capacity int) *LazyServers {
+	if capacity <= 0 {
+		panic("capacity must be positive")
+	}
+	return &LazyServers{
+		metadata: metadata,
+		load:     load,
+		params:   params,
+		precBits: precBits,
+		capacity: capacity,
+		entries:  make(map[uint64]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Get returns the server of a cluster, building it if it is not held. The
+// vectors of the cluster are cluster 0 of its server's database. Evicting a
+// server closes it, so a server must not be used after Get has been called
+// Capacity more times for other clusters.
+func (l *LazyServers) Get(clusterIndex uint64) (*Server, error) {
+	if clusterIndex >= l.metadata.NumClusters {
+		return nil, fmt.Errorf("invalid cluster index %d, the database has %d clusters", clusterIndex, l.metadata.NumClusters)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[clusterIndex]; ok {
+		l.lru.MoveToFront(e)
+		return e.Value.(*lazyEntry).server, nil
+	}
+
+	c, err := l.load(clusterIndex)
+	if err != nil {
+		return nil, fmt.Errorf("error loading cluster %d: %w", clusterIndex, err)
+	}
+	if c.Dim != l.metadata.Dim {
+		return nil, fmt.Errorf("cluster %d has dimension %d, but the database has %d", clusterIndex, c.Dim, l.metadata.Dim)
+	}
+	single := *c
+	single.Index = 0
+	metadata := database.Metadata{NumVectors: c.NumVectors, Dim: c.Dim, NumClusters: 1}
+	params := l.params
+	params.PinnedClusters = nil
+	s := new(Server)
+	if err := s.Build(metadata, []*database.Cluster{&single}, params, l.precBits, nil); err != nil {
+		return nil, fmt.Errorf("error building the database of cluster %d: %w", clusterIndex, err)
+	}
+	l.loads++
+
+	l.entries[clusterIndex] = l.lru.PushFront(&lazyEntry{clusterIndex: clusterIndex, server: s})
+	for l.lru.Len() > l.capacity {
+		l.evict(l.lru.Back())
+	}
+	return s, nil
+}
+
+func (l *LazyServers) evict(e *list.Element) {
+	entry := l.lru.Remove(e).(*lazyEntry)
+	delete(l.entries, entry.clusterIndex)
+	entry.server.Close()
+	l.evictions++
+	if l.OnEvict != nil {
+		l.OnEvict(entry.clusterIndex)
+	}
+}
+
+// Stats returns the number of servers built and evicted so far
+func (l *LazyServers) Stats() (uint64, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.loads, l.evictions
+}
+
+// Close closes every server held
+func (l *LazyServers) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.entries {
+		e.Value.(*lazyEntry).server.Close()
+	}
+	l.entries = make(map[uint64]*list.Element)
+	l.lru.Init()
+}
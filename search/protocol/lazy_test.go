@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+)
+
+func TestLazyServers(t *testing.T) {
+	dim := uint64(4)
+	sizes := []int{30, 50, 40}
+	metadata, clusters := database.SyntheticClusters(dim, sizes, 0)
+	params := database.DatabaseParams{HintSz: 900}
+	plain := NewPlaintextServer(metadata, clusters, params)
+
+	loaded := make([]int, len(clusters))
+	evicted := make([]uint64, 0)
+	lazy := NewLazyServers(metadata, func(i uint64) (*database.Cluster, error) {
+		loaded[i]++
+		return clusters[i], nil
+	}, params, 5, 2)
+	lazy.OnEvict = func(i uint64) {
+		evicted = append(evicted, i)
+	}
+	defer lazy.Close()
+
+	emb := []int8{2, -1, 0, 3}
+	servers := make(map[uint64]*Server)
+	for _, cluster := range []uint64{0, 1, 0, 2} {
+		s, err := lazy.Get(cluster)
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[cluster] = s
+		c := new(Client)
+		c.Setup(s.Hint)
+		got := roundForTest(t, c, s, emb, 0, true)
+		c.Free()
+
+		expected := plain.SearchCluster(emb, cluster)
+		if len(*got) != len(*expected) {
+			t.Fatalf("Cluster %d: expected %d results, but got %d", cluster, len(*expected), len(*got))
+		}
+		for i := range *got {
+			if (*got)[i].Score != (*expected)[i].Score {
+				t.Errorf("Cluster %d, result %d: expected score %d, but got %d", cluster, i, (*expected)[i].Score, (*got)[i].Score)
+			}
+		}
+	}
+
+	// cluster 0 was queried again, so cluster 1 is the least recently used
+	if loads, evictions := lazy.Stats(); loads != 3 || evictions != 1 {
+		t.Errorf("Expected 3 databases built and 1 evicted, but got %d and %d", loads, evictions)
+	}
+	if loaded[0] != 1 || len(evicted) != 1 || evicted[0] != 1 {
+		t.Errorf("Expected cluster 0 loaded once and cluster 1 evicted, but got loads %v and evictions %v", loaded, evicted)
+	}
+	if _, err := servers[1].Answer(nil); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Expected the evicted server to be closed, but got %v", err)
+	}
+	if _, err := lazy.Get(3); err == nil {
+		t.Errorf("Expected an error for a cluster that does not exist")
+	}
+}
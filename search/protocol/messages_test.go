@@ -0,0 +1,177 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+// BenchmarkMessageSizes measures the size of every message of a round in the
+// gob and binary wire formats, on a database of 64 clusters of 192-dimensional
+// vectors, and logs them as a table. The hint has no binary layout and is only
+// measured as gob. Run with, e.g.:
+//
+//	go test -run NONE -bench MessageSizes ./search/protocol
+func BenchmarkMessageSizes(b *testing.B) {
+	dim := uint64(192)
+	clusterSizes := make([]int, 64)
+	for i := range clusterSizes {
+		clusterSizes[i] = 100 + (i*37)%200
+	}
+	metadata, clusters := database.SyntheticClusters(dim, clusterSizes, 0)
+
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: 900}, 5)
+	defer s.Close()
+	c := new(Client)
+	c.Setup(s.Hint)
+	defer c.Free()
+
+	emb := make([]int8, dim)
+	for i := range emb {
+		emb[i] = int8(i%7) - 3
+	}
+	hintQuery := c.PreprocessQuery()
+	hintAnswer, err := s.HintAnswer(hintQuery)
+	if err != nil {
+		b.Fatal(err)
+	}
+	c.ProcessHintApply(hintAnswer)
+	query := c.QueryEmbeddings(emb, 0)
+	answer, err := s.Answer(query)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	messages := []struct {
+		name string
+		m    interface{}
+	}{
+		{"hint", s.Hint.PIRHint},
+		{"hint query", *hintQuery},
+		{"hint answer", *hintAnswer},
+		{"query", *query},
+		{"answer", *answer},
+	}
+	formats := []utils.WireFormat{utils.GobWire, utils.BinaryWire}
+	defer func() { utils.ActiveWireFormat = utils.GobWire }()
+
+	sizes := make([][]uint64, len(messages))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i, msg := range messages {
+			sizes[i] = make([]uint64, len(formats))
+			for j, f := range formats {
+				utils.ActiveWireFormat = f
+				sizes[i][j] = utils.MessageSizeBytes(msg.m)
+			}
+		}
+	}
+	b.StopTimer()
+
+	var table strings.Builder
+	fmt.Fprintf(&table, "\n%-12s %14s %14s %8s\n", "message", "gob (B)", "binary (B)", "saved")
+	for i, msg := range messages {
+		gobSz, binSz := sizes[i][0], sizes[i][1]
+		if msg.name == "hint" {
+			fmt.Fprintf(&table, "%-12s %14d %14s %8s\n", msg.name, gobSz, "-", "-")
+			continue
+		}
+		saved := 100 * (float64(gobSz) - float64(binSz)) / float64(gobSz)
+		fmt.Fprintf(&table, "%-12s %14d %14d %7.1f%%\n", msg.name, gobSz, binSz, saved)
+		b.ReportMetric(float64(gobSz), strings.ReplaceAll(msg.name, " ", "")+"-gob-B")
+		b.ReportMetric(float64(binSz), strings.ReplaceAll(msg.name, " ", "")+"-binary-B")
+	}
+	b.Log(table.String())
+}
+
+func TestMessageChecksum(t *testing.T) {
+	dim := uint64(4)
+	floats := [][]float64{{0.5, 0.25, -0.5, 0, 0.125, -0.25, 0.75, 0.5, -0.25, 0.5, 0.25, 0.125}}
+	metadata := database.Metadata{NumVectors: 3, Dim: dim, NumClusters: 1}
+	clusters, err := database.ClustersFromFloats(metadata, floats, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{}, 5)
+	defer s.Close()
+	c := new(Client)
+	c.Setup(s.Hint)
+	defer c.Free()
+
+	offlineAns, err := s.HintAnswer(c.PreprocessQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ProcessHintApply(offlineAns)
+	answer, err := s.Answer(c.QueryEmbeddings([]int8{3, -2, 1, 4}, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := *c.ReconstructWithinCluster(answer, 0, c.DBInfo.P())
+
+	for _, f := range []utils.WireFormat{utils.GobWire, utils.BinaryWire} {
+		for _, checksum := range []bool{false, true} {
+			var buf bytes.Buffer
+			if err := utils.WriteMessage(&buf, *answer, f, checksum); err != nil {
+				t.Fatal(err)
+			}
+			var got pir.Answer[matrix.Elem64]
+			if err := utils.ReadMessage(bytes.NewReader(buf.Bytes()), f, &got, checksum); err != nil {
+				t.Fatalf("%s, checksum %t: %v", f, checksum, err)
+			}
+			if !reflect.DeepEqual(*c.ReconstructWithinCluster(&got, 0, c.DBInfo.P()), expected) {
+				t.Errorf("%s, checksum %t: the answer does not round-trip", f, checksum)
+			}
+		}
+	}
+
+	// flip a high bit of the first value, which shifts its decrypted score
+	var buf bytes.Buffer
+	if err := utils.WriteMessage(&buf, *answer, utils.BinaryWire, true); err != nil {
+		t.Fatal(err)
+	}
+	flipped := append([]byte(nil), buf.Bytes()...)
+	flipped[8+4+4+3*8+7] ^= 1
+	var got pir.Answer[matrix.Elem64]
+	if err := utils.ReadMessage(bytes.NewReader(flipped), utils.BinaryWire, &got, true); !errors.Is(err, utils.ErrChecksum) {
+		t.Errorf("Expected ErrChecksum for a flipped byte, but got %v", err)
+	}
+
+	// without the checksum, the same flip decodes into plausible but wrong scores
+	var uncheckedBuf bytes.Buffer
+	if err := utils.WriteMessage(&uncheckedBuf, *answer, utils.BinaryWire, false); err != nil {
+		t.Fatal(err)
+	}
+	unchecked := uncheckedBuf.Bytes()
+	unchecked[8+4+3*8+7] ^= 1
+	if err := utils.ReadMessage(bytes.NewReader(unchecked), utils.BinaryWire, &got, false); err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(*c.ReconstructWithinCluster(&got, 0, c.DBInfo.P()), expected) {
+		t.Errorf("Expected the flipped byte to change the results without a checksum")
+	}
+
+	// a corrupt length is caught before the payload is read, and without the
+	// checksum, a length beyond the stream fails once the stream ends
+	corrupt := append([]byte(nil), buf.Bytes()...)
+	corrupt[4] ^= 1
+	if err := utils.ReadMessage(bytes.NewReader(corrupt), utils.BinaryWire, &got, true); !errors.Is(err, utils.ErrChecksum) {
+		t.Errorf("Expected ErrChecksum for a corrupt length, but got %v", err)
+	}
+	corrupt = append([]byte(nil), uncheckedBuf.Bytes()...)
+	corrupt[4] ^= 1
+	if err := utils.ReadMessage(bytes.NewReader(corrupt), utils.BinaryWire, &got, false); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected a truncated message for a length of 2^32 more bytes, but got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+)
+
+// FetchVector privately retrieves vector id of a cluster, as stored. Every
+// round queries the bin of the cluster with a unit vector, so its answer holds
+// one coordinate of every vector of the bin: fetching takes Metadata.Dim
+// rounds, and the server learns no more than from as many searches of the bin.
+func (c *Client) FetchVector(r Responder, clusterIndex uint64, id uint64) ([]int8, error) {
+	vectors, err := c.FetchVectors(r, clusterIndex, []uint64{id})
+	if err != nil {
+		return nil, err
+	}
+	return vectors[0], nil
+}
+
+// FetchVectors is FetchVector for several vectors of the same cluster, in the
+// same Metadata.Dim rounds
+func (c *Client) FetchVectors(r Responder, clusterIndex uint64, ids []uint64) ([][]int8, error) {
+	dbIndex, ok := c.ClusterToIndex[uint(clusterIndex)]
+	if !ok {
+		return nil, fmt.Errorf("cluster %d does not exist", clusterIndex)
+	}
+	rowStart := dbIndex / c.DBInfo.M
+	var rowEnd uint64
+	if c.clusterSizes != nil {
+		rowEnd = rowStart + c.clusterSizes[clusterIndex]
+	} else {
+		rowEnd = utils.FindDBEnd(c.IndexToCluster, rowStart, dbIndex%c.DBInfo.M, c.DBInfo.M, c.DBInfo.L, 0)
+	}
+	vectors := make([][]int8, len(ids))
+	for i, id := range ids {
+		if rowStart+id >= rowEnd {
+			return nil, fmt.Errorf("vector %d of cluster %d does not exist, the cluster has %d vectors", id, clusterIndex, rowEnd-rowStart)
+		}
+		vectors[i] = make([]int8, c.Metadata.Dim)
+	}
+
+	unit := make([]int8, c.Metadata.Dim)
+	for j := range unit {
+		unit[j] = 1
+		offlineAns, err := r.HintAnswer(c.PreprocessQuery())
+		if err != nil {
+			return nil, fmt.Errorf("error answering hint query: %w", err)
+		}
+		c.ProcessHintApply(offlineAns)
+		ans, err := r.Answer(c.QueryEmbeddings(unit, clusterIndex))
+		if err != nil {
+			return nil, fmt.Errorf("error answering query: %w", err)
+		}
+		vals := c.UnderhoodClient.RecoverLHE(ans)
+		for i, id := range ids {
+			vectors[i][j] = int8(utils.SmoothResult(uint64(vals.Get(rowStart+id, 0)), c.DBInfo.P()))
+		}
+		unit[j] = 0
+	}
+	return vectors, nil
+}
+
+// MoreLikeThis returns the k vectors of a cluster closest to its vector id, for
+// "more like this" on a result: it fetches the vector with FetchVector and
+// searches the cluster with it, ranking in the client's Order. The vector
+// itself is left out, but not its duplicates, if any.
+func (c *Client) MoreLikeThis(r Responder, clusterIndex uint64, id uint64, k int) (*[]VectorScore, error) {
+	vector, err := c.FetchVector(r, clusterIndex, id)
+	if err != nil {
+		return nil, err
+	}
+
+	offlineAns, err := r.HintAnswer(c.PreprocessQuery())
+	if err != nil {
+		return nil, fmt.Errorf("error answering hint query: %w", err)
+	}
+	c.ProcessHintApply(offlineAns)
+	ans, err := r.Answer(c.QueryEmbeddings(vector, clusterIndex))
+	if err != nil {
+		return nil, fmt.Errorf("error answering query: %w", err)
+	}
+
+	res := make([]VectorScore, 0, k)
+	for _, s := range *c.ReconstructWithinCluster(ans, clusterIndex, c.DBInfo.P()) {
+		if len(res) == k {
+			break
+		}
+		if s.IDWithinCluster != id {
+			res = append(res, s)
+		}
+	}
+	return &res, nil
+}
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+)
+
+func TestMoreLikeThis(t *testing.T) {
+	dim := uint64(4)
+	sizes := []int{30, 20, 25}
+	metadata, clusters := database.SyntheticClusters(dim, sizes, 0)
+
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{}, 5)
+	defer s.Close()
+	c := new(Client)
+	c.Setup(s.Hint)
+	defer c.Free()
+
+	for _, ref := range [][2]uint64{{0, 0}, {1, 19}, {2, 7}} {
+		cluster, id := ref[0], ref[1]
+		expected := clusters[cluster].Vectors[id*dim : (id+1)*dim]
+		vector, err := c.FetchVector(s, cluster, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vector, expected) {
+			t.Errorf("Expected vector %d of cluster %d to be %v, but got %v", id, cluster, expected, vector)
+		}
+
+		k := 5
+		neighbors, err := c.MoreLikeThis(s, cluster, id, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*neighbors) != k {
+			t.Fatalf("Expected %d neighbors, but got %d", k, len(*neighbors))
+		}
+		plain := NewPlaintextServer(metadata, clusters, database.DatabaseParams{})
+		var scores []int
+		for _, sc := range *plain.SearchCluster(expected, cluster) {
+			if sc.IDWithinCluster != id && len(scores) < k {
+				scores = append(scores, sc.Score)
+			}
+		}
+		for i, sc := range *neighbors {
+			if sc.IDWithinCluster == id {
+				t.Errorf("Vector %d of cluster %d is among its own neighbors", id, cluster)
+			}
+			if sc.Score != scores[i] {
+				t.Errorf("Neighbor %d of vector %d of cluster %d has score %d, expected %d", i, id, cluster, sc.Score, scores[i])
+			}
+		}
+	}
+
+	if _, err := c.FetchVector(s, 1, 20); err == nil {
+		t.Errorf("Expected an error fetching a vector beyond the cluster")
+	}
+	if _, err := c.MoreLikeThis(s, 3, 0, 5); err == nil {
+		t.Errorf("Expected an error for a cluster that does not exist")
+	}
+}
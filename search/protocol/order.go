@@ -0,0 +1,54 @@
+package protocol
+
+import "fmt"
+
+// SortOrder is the direction in which results are ranked. Scores are always the
+// inner products computed by the server: with unit-norm vectors, ranking them in
+// Descending order is also ranking by cosine similarity and by increasing L2
+// distance. Ascending returns the least similar vectors first, e.g., to mine
+// hard negatives, or for a database of negated embeddings.
+type SortOrder int
+
+const (
+	// Descending ranks the highest scores first
+	Descending SortOrder = iota
+	// Ascending ranks the lowest scores first
+	Ascending
+)
+
+func ParseSortOrder(s string) (SortOrder, error) {
+	switch s {
+	case "desc":
+		return Descending, nil
+	case "asc":
+		return Ascending, nil
+	}
+	return Descending, fmt.Errorf("unknown sort order %q, expected desc or asc", s)
+}
+
+func (o SortOrder) String() string {
+	switch o {
+	case Descending:
+		return "desc"
+	case Ascending:
+		return "asc"
+	}
+	return fmt.Sprintf("SortOrder(%d)", int(o))
+}
+
+// Before reports whether score a ranks strictly before score b
+func (o SortOrder) Before(a, b int) bool {
+	if o == Ascending {
+		return a < b
+	}
+	return a > b
+}
+
+// Meets reports whether a score is at least as good as threshold, i.e., at
+// least threshold in Descending order and at most threshold in Ascending order
+func (o SortOrder) Meets(score, threshold int) bool {
+	if o == Ascending {
+		return score <= threshold
+	}
+	return score >= threshold
+}
@@ -0,0 +1,96 @@
+package protocol
+
+import (
+	"sort"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+)
+
+// PlaintextServer scores queries directly against the quantized clusters,
+// without PIR, as a baseline for the accuracy and latency of the private search.
+// It sees the query in the clear, so it is for analysis only.
+type PlaintextServer struct {
+	clusters []*database.Cluster
+	// bins lists the clusters of each bin, packed like BuildVectorDatabase does
+	bins  [][]uint
+	binOf map[uint]int
+
+	// Order is the direction in which results are ranked, like Client.Order
+	Order SortOrder
+}
+
+func NewPlaintextServer(metadata database.Metadata, clusters []*database.Cluster, params database.DatabaseParams) *PlaintextServer {
+	cols, _ := database.PackClusters(clusters, params.ColumnCapacity(), params)
+
+	s := &PlaintextServer{
+		clusters: clusters,
+		bins:     cols,
+		binOf:    make(map[uint]int),
+	}
+	for i, col := range cols {
+		for _, c := range col {
+			s.binOf[c] = i
+		}
+	}
+	return s
+}
+
+// SearchCluster scores emb against the vectors of a cluster, like
+// Client.ReconstructWithinCluster
+func (s *PlaintextServer) SearchCluster(emb []int8, clusterIndex uint64) *[]VectorScore {
+	if clusterIndex >= uint64(len(s.clusters)) {
+		panic("Invalid cluster index")
+	}
+	res := s.score(emb, make([]VectorScore, 0), uint(clusterIndex))
+	return sortScores(res, s.Order)
+}
+
+// SearchBin scores emb against the vectors of all clusters in the bin of a
+// cluster, like Client.ReconstructWithinBin. Like the latter with the cluster
+// sizes of the hint, it skips the zero padding rows at the bottom of the bin.
+func (s *PlaintextServer) SearchBin(emb []int8, clusterIndex uint64) *[]VectorScore {
+	if clusterIndex >= uint64(len(s.clusters)) {
+		panic("Invalid cluster index")
+	}
+	res := make([]VectorScore, 0)
+	for _, c := range s.bins[s.binOf[uint(clusterIndex)]] {
+		res = s.score(emb, res, c)
+	}
+	return sortScores(res, s.Order)
+}
+
+// SearchAll scores emb against every vector of the database, the exhaustive
+// baseline of Client.GlobalQuery
+func (s *PlaintextServer) SearchAll(emb []int8) *[]VectorScore {
+	res := make([]VectorScore, 0)
+	for c := range s.clusters {
+		res = s.score(emb, res, uint(c))
+	}
+	return sortScores(res, s.Order)
+}
+
+func (s *PlaintextServer) score(emb []int8, res []VectorScore, clusterIndex uint) []VectorScore {
+	cluster := s.clusters[clusterIndex]
+	if uint64(len(emb)) != cluster.Dim {
+		panic("Query dimension does not match the database")
+	}
+	for i := uint64(0); i < cluster.NumVectors; i++ {
+		score := 0
+		for j, v := range cluster.Vectors[i*cluster.Dim : (i+1)*cluster.Dim] {
+			score += int(emb[j]) * int(v)
+		}
+		res = append(res, VectorScore{
+			ClusterID:       clusterIndex,
+			IDWithinCluster: i,
+			Score:           score,
+		})
+	}
+	return res
+}
+
+func sortScores(res []VectorScore, order SortOrder) *[]VectorScore {
+	sort.SliceStable(res, func(i, j int) bool {
+		return order.Before(res[i].Score, res[j].Score)
+	})
+	return &res
+}
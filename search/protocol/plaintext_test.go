@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+)
+
+func TestPlaintextServer(t *testing.T) {
+	preamble := utils.GenerateTestData()
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.RemoveTestData()
+
+	params := database.DatabaseParams{HintSz: 900}
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, params, 5)
+	defer s.Close()
+	c := new(Client)
+	c.Setup(s.Hint)
+	defer c.Free()
+
+	plaintext := NewPlaintextServer(metadata, clusters, params)
+
+	emb := make([]int8, metadata.Dim)
+	for j := range emb {
+		emb[j] = int8(j%7) - 3
+	}
+	for cluster := uint64(0); cluster < metadata.NumClusters; cluster++ {
+		for _, clusterOnly := range []bool{true, false} {
+			private := roundForTest(t, c, s, emb, cluster, clusterOnly)
+			var baseline *[]VectorScore
+			if clusterOnly {
+				baseline = plaintext.SearchCluster(emb, cluster)
+			} else {
+				baseline = plaintext.SearchBin(emb, cluster)
+			}
+
+			// PIR returns the same scores, plus those of the padding rows
+			scores := make(map[VectorScore]bool)
+			for _, sc := range *private {
+				scores[sc] = true
+			}
+			for _, sc := range *baseline {
+				if !scores[sc] {
+					t.Errorf("Cluster %d (cluster only: %t): plaintext score %+v not found with PIR", cluster, clusterOnly, sc)
+				}
+			}
+			if clusterOnly && uint64(len(*baseline)) != clusters[cluster].NumVectors {
+				t.Errorf("Cluster %d: expected %d plaintext scores, but got %d", cluster, clusters[cluster].NumVectors, len(*baseline))
+			}
+			for i := 1; i < len(*baseline); i++ {
+				if (*baseline)[i-1].Score < (*baseline)[i].Score {
+					t.Errorf("Cluster %d: plaintext scores are not sorted", cluster)
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ahenzinger/underhood/underhood"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+// Responder answers the hint and query of a round. Server implements it; other
+// implementations can forward the messages over a network.
+type Responder interface {
+	HintAnswer(ct *[][]byte) (*underhood.HintAnswer, error)
+	Answer(query *pir.Query[matrix.Elem64]) (*pir.Answer[matrix.Elem64], error)
+}
+
+// ErrUnknownCluster is returned by ValidateCluster for a cluster the database
+// does not have
+var ErrUnknownCluster = errors.New("unknown cluster")
+
+// ValidateCluster checks that a query's cluster is one of the database, before
+// any round. A query routed against another build, of more clusters, may name
+// a cluster the database lacks; one of fewer clusters cannot reach the new ones,
+// but its clusters are still valid.
+func (c *Client) ValidateCluster(clusterIndex uint64) error {
+	if clusterIndex >= c.Metadata.NumClusters {
+		return fmt.Errorf("%w: cluster %d, of a database of %d clusters", ErrUnknownCluster, clusterIndex, c.Metadata.NumClusters)
+	}
+	if c.ClusterToIndex != nil {
+		if _, ok := c.ClusterToIndex[uint(clusterIndex)]; !ok {
+			return fmt.Errorf("%w: cluster %d is not in the database", ErrUnknownCluster, clusterIndex)
+		}
+	}
+	return nil
+}
+
+// Bin returns the database column that holds a cluster. Clusters in the same bin
+// are scored by the same query.
+func (c *Client) Bin(clusterIndex uint64) uint64 {
+	dbIndex, ok := c.ClusterToIndex[uint(clusterIndex)]
+	if !ok {
+		panic("Invalid cluster index")
+	}
+	return dbIndex % c.DBInfo.M
+}
+
+// Round runs the hint round and the query of emb against the bin of clusterIndex,
+// and returns the scores of every vector in that bin, ranked in the client's Order
+func (c *Client) Round(r Responder, emb []int8, clusterIndex uint64) (*[]VectorScore, error) {
+	offlineAns, err := r.HintAnswer(c.PreprocessQuery())
+	if err != nil {
+		return nil, fmt.Errorf("error answering hint query: %w", err)
+	}
+	c.ProcessHintApply(offlineAns)
+
+	ans, err := r.Answer(c.QueryEmbeddings(emb, clusterIndex))
+	if err != nil {
+		return nil, fmt.Errorf("error answering query: %w", err)
+	}
+	return c.ReconstructWithinBin(ans, clusterIndex, c.DBInfo.P()), nil
+}
+
+// ProbeClusters scores emb against the bins of all the given clusters, and
+// returns the scores of every vector in those bins, ranked in the client's Order.
+//
+// The server never learns which clusters are probed: each query is an encryption
+// of a vector over all database columns, and the server's work does not depend on
+// which columns are nonzero. What it does observe is the number of rounds, and
+// probing one round per distinct bin would reveal how many distinct bins the
+// clusters of a query fall into. ProbeClusters therefore always runs exactly
+// numProbes rounds, padding with dummy rounds whose answers are discarded, so the
+// server only learns numProbes, which should be the same for every query.
+// It returns an error if the clusters span more than numProbes bins.
+func (c *Client) ProbeClusters(r Responder, emb []int8, clusterIndices []uint64, numProbes int) (*[]VectorScore, error) {
+	if len(clusterIndices) == 0 {
+		return nil, fmt.Errorf("no clusters to probe")
+	}
+
+	// one cluster per distinct bin is enough to score the whole bin
+	bins := make(map[uint64]bool)
+	probes := make([]uint64, 0, len(clusterIndices))
+	for _, clusterIndex := range clusterIndices {
+		if clusterIndex >= uint64(len(c.ClusterToIndex)) {
+			return nil, fmt.Errorf("invalid cluster index %d", clusterIndex)
+		}
+		bin := c.Bin(clusterIndex)
+		if !bins[bin] {
+			bins[bin] = true
+			probes = append(probes, clusterIndex)
+		}
+	}
+	if len(probes) > numProbes {
+		return nil, fmt.Errorf("clusters span %d bins, but only %d probes are allowed", len(probes), numProbes)
+	}
+
+	res := make([]VectorScore, 0)
+	for _, clusterIndex := range probes {
+		scores, err := c.Round(r, emb, clusterIndex)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, *scores...)
+	}
+
+	// the dummy rounds are indistinguishable from real ones to the server, so any
+	// bin works; their answers are decrypted like real ones and then dropped
+	for i := len(probes); i < numProbes; i++ {
+		if _, err := c.Round(r, emb, probes[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return c.Order.Before(res[i].Score, res[j].Score)
+	})
+
+	return &res, nil
+}
+
+// QueryClusterRange scores emb against the clusters lo to hi, both included, and
+// returns the top k vectors of those clusters, e.g., for time-bucketed clusters.
+// It probes every bin of the range with ProbeClusters, so the server learns the
+// number of bins the range spans; call ProbeClusters with a fixed numProbes to
+// hide it. Vectors of other clusters sharing those bins are not returned.
+// Clusters of the range that are not in the database (e.g., empty ones) are
+// skipped, and a range of only such clusters has no results.
+func (c *Client) QueryClusterRange(r Responder, emb []int8, lo, hi uint64, k int) (*[]VectorScore, error) {
+	if k <= 0 {
+		return nil, fmt.Errorf("k must be positive")
+	}
+	if lo > hi {
+		return nil, fmt.Errorf("invalid cluster range [%d, %d]: lo is greater than hi", lo, hi)
+	}
+	if hi >= c.Metadata.NumClusters {
+		return nil, fmt.Errorf("invalid cluster range [%d, %d]: the database has %d clusters", lo, hi, c.Metadata.NumClusters)
+	}
+
+	clusters := make([]uint64, 0, hi-lo+1)
+	bins := make(map[uint64]bool)
+	for i := lo; i <= hi; i++ {
+		if _, ok := c.ClusterToIndex[uint(i)]; !ok {
+			continue // not in the database
+		}
+		clusters = append(clusters, i)
+		bins[c.Bin(i)] = true
+	}
+	res := make([]VectorScore, 0)
+	if len(clusters) == 0 {
+		return &res, nil
+	}
+
+	scores, err := c.ProbeClusters(r, emb, clusters, len(bins))
+	if err != nil {
+		return nil, err
+	}
+	for _, sc := range *scores {
+		if uint64(sc.ClusterID) >= lo && uint64(sc.ClusterID) <= hi {
+			res = append(res, sc)
+			if len(res) == k {
+				break
+			}
+		}
+	}
+	return &res, nil
+}
@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+	"github.com/ahenzinger/underhood/underhood"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+// countingResponder counts the rounds it answers
+type countingResponder struct {
+	s      *Server
+	hints  int
+	rounds int
+}
+
+func (r *countingResponder) HintAnswer(ct *[][]byte) (*underhood.HintAnswer, error) {
+	r.hints++
+	return r.s.HintAnswer(ct)
+}
+
+func (r *countingResponder) Answer(query *pir.Query[matrix.Elem64]) (*pir.Answer[matrix.Elem64], error) {
+	r.rounds++
+	return r.s.Answer(query)
+}
+
+func TestProbeClusters(t *testing.T) {
+	dim := uint64(4)
+	sizes := []int{60, 60, 60, 60}
+	metadata, clusters := database.SyntheticClusters(dim, sizes, 0)
+
+	// a small hint makes the columns short, so that the clusters span two bins
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: 1}, 5)
+	defer s.Close()
+
+	c := new(Client)
+	c.Setup(s.Hint)
+	defer c.Free()
+
+	binOf := make(map[uint64][]uint64)
+	for i := range clusters {
+		binOf[c.Bin(uint64(i))] = append(binOf[c.Bin(uint64(i))], uint64(i))
+	}
+	if len(binOf) < 2 {
+		t.Fatalf("Expected the clusters to span several bins, but got %v", binOf)
+	}
+
+	emb := []int8{1, -2, 3, 0}
+	for _, probed := range [][]uint64{{0}, {0, 1, 2, 3}} {
+		r := &countingResponder{s: s}
+		scores, err := c.ProbeClusters(r, emb, probed, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.hints != 3 || r.rounds != 3 {
+			t.Errorf("Probing %v took %d hint rounds and %d queries, expected 3 of each", probed, r.hints, r.rounds)
+		}
+
+		// every vector of a probed cluster is scored correctly
+		found := make(map[uint]int)
+		for _, sc := range *scores {
+			cluster := clusters[sc.ClusterID]
+			if sc.IDWithinCluster >= cluster.NumVectors {
+				continue // padding rows at the end of a bin
+			}
+			expected := 0
+			for j := uint64(0); j < dim; j++ {
+				expected += int(emb[j]) * int(cluster.Vectors[sc.IDWithinCluster*dim+j])
+			}
+			if sc.Score != expected {
+				t.Errorf("Vector %d of cluster %d has score %d, expected %d", sc.IDWithinCluster, sc.ClusterID, sc.Score, expected)
+			}
+			found[sc.ClusterID]++
+		}
+		for _, i := range probed {
+			if found[uint(i)] != sizes[i] {
+				t.Errorf("Expected %d scores for cluster %d, but got %d", sizes[i], i, found[uint(i)])
+			}
+		}
+	}
+
+	if _, err := c.ProbeClusters(s, emb, []uint64{0, 1, 2, 3}, 1); err == nil {
+		t.Errorf("Expected an error when the clusters span more bins than probes")
+	}
+}
+
+func TestQueryClusterRange(t *testing.T) {
+	dim := uint64(4)
+	sizes := []int{60, 60, 60, 60}
+	metadata, clusters := database.SyntheticClusters(dim, sizes, 0)
+
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: 1}, 5)
+	defer s.Close()
+	c := new(Client)
+	c.Setup(s.Hint)
+	defer c.Free()
+
+	emb := []int8{2, -1, 0, 3}
+	plain := NewPlaintextServer(metadata, clusters, database.DatabaseParams{HintSz: 1})
+	k := 25
+	r := &countingResponder{s: s}
+	got, err := c.QueryClusterRange(r, emb, 1, 2, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bins := map[uint64]bool{c.Bin(1): true, c.Bin(2): true}; r.rounds != len(bins) {
+		t.Errorf("Expected one round per bin of the range (%d), but got %d", len(bins), r.rounds)
+	}
+
+	expected := append(*plain.SearchCluster(emb, 1), *plain.SearchCluster(emb, 2)...)
+	sortScores(expected, Descending)
+	if len(*got) != k {
+		t.Fatalf("Expected %d results, but got %d", k, len(*got))
+	}
+	for i, sc := range *got {
+		if sc.ClusterID != 1 && sc.ClusterID != 2 {
+			t.Errorf("Result %+v is outside of the range", sc)
+		}
+		if sc.Score != expected[i].Score {
+			t.Errorf("Result %d: expected score %d, but got %d", i, expected[i].Score, sc.Score)
+		}
+	}
+
+	if _, err := c.QueryClusterRange(s, emb, 2, 1, k); err == nil {
+		t.Errorf("Expected an error when lo is greater than hi")
+	}
+	if _, err := c.QueryClusterRange(s, emb, 2, 4, k); err == nil {
+		t.Errorf("Expected an error for a range past the last cluster")
+	}
+}
@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Projection is a linear map applied to raw query vectors before quantization,
+// so that a database can be searched with queries from a model of a different
+// dimension. Weights holds OutDim rows of InDim values.
+type Projection struct {
+	InDim   uint64
+	OutDim  uint64
+	Weights []float64
+}
+
+// ReadProjectionFromCsv reads a projection matrix with one output dimension per
+// line, each line holding the weights of the input dimensions
+func ReadProjectionFromCsv(file string) (*Projection, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	p := new(Projection)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading projection %s: %w", file, err)
+		}
+		for j := range row {
+			w, err := strconv.ParseFloat(row[j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("parsing projection %s row %d: %w", file, p.OutDim, err)
+			}
+			p.Weights = append(p.Weights, w)
+		}
+		p.InDim = uint64(len(row))
+		p.OutDim++
+	}
+
+	if p.OutDim == 0 {
+		return nil, fmt.Errorf("projection %s is empty", file)
+	}
+	return p, nil
+}
+
+// Apply projects a raw query vector of InDim values down to OutDim values
+func (p *Projection) Apply(v []float64) []float64 {
+	if uint64(len(v)) != p.InDim {
+		panic("Projection input dimension mismatch")
+	}
+
+	res := make([]float64, p.OutDim)
+	for i := uint64(0); i < p.OutDim; i++ {
+		row := p.Weights[i*p.InDim : (i+1)*p.InDim]
+		for j, w := range row {
+			res[i] += w * v[j]
+		}
+	}
+	return res
+}
@@ -0,0 +1,132 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// QueryLogVersion is the version of the query log layout, bumped on any
+// incompatible change. Readers reject other versions.
+const QueryLogVersion = 1
+
+var queryLogMagic = [4]byte{'T', 'Q', 'L', '1'}
+
+// LoggedQuery is a query as the client sent it: the quantized embedding, after
+// any projection, and the cluster it was made for, along with its index in the
+// query file
+type LoggedQuery struct {
+	QueryID      int
+	ClusterIndex uint64
+	Embedding    []int8
+}
+
+// QueryLogHeader starts a query log, with what every query of it was quantized
+// for
+type QueryLogHeader struct {
+	Version  uint64
+	Dim      uint64
+	PrecBits uint64
+}
+
+// QueryLogWriter writes a query log, to replay the queries of a run against
+// another build without their source file. Integers are little-endian uint64s:
+//
+//	"TQL1" | version | dim | precBits | (queryID | clusterIndex | embedding)*
+//
+// where every embedding is dim bytes, so that records have a fixed size.
+type QueryLogWriter struct {
+	w      *bufio.Writer
+	header QueryLogHeader
+}
+
+func NewQueryLogWriter(w io.Writer, dim uint64, precBits uint64) (*QueryLogWriter, error) {
+	lw := &QueryLogWriter{w: bufio.NewWriter(w), header: QueryLogHeader{Version: QueryLogVersion, Dim: dim, PrecBits: precBits}}
+	buf := append([]byte(nil), queryLogMagic[:]...)
+	for _, v := range []uint64{lw.header.Version, dim, precBits} {
+		buf = binary.LittleEndian.AppendUint64(buf, v)
+	}
+	if _, err := lw.w.Write(buf); err != nil {
+		return nil, err
+	}
+	return lw, nil
+}
+
+func (lw *QueryLogWriter) Write(q *LoggedQuery) error {
+	if uint64(len(q.Embedding)) != lw.header.Dim {
+		return fmt.Errorf("query %d has %d values, but the log holds %d-dim queries", q.QueryID, len(q.Embedding), lw.header.Dim)
+	}
+	buf := make([]byte, 0, 16+len(q.Embedding))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(q.QueryID))
+	buf = binary.LittleEndian.AppendUint64(buf, q.ClusterIndex)
+	for _, v := range q.Embedding {
+		buf = append(buf, byte(v))
+	}
+	_, err := lw.w.Write(buf)
+	return err
+}
+
+// Flush writes the buffered queries to the underlying writer
+func (lw *QueryLogWriter) Flush() error {
+	return lw.w.Flush()
+}
+
+// QueryLogReader reads a query log written by QueryLogWriter
+type QueryLogReader struct {
+	Header QueryLogHeader
+	r      *bufio.Reader
+}
+
+func NewQueryLogReader(r io.Reader) (*QueryLogReader, error) {
+	lr := &QueryLogReader{r: bufio.NewReader(r)}
+	var magic [4]byte
+	if _, err := io.ReadFull(lr.r, magic[:]); err != nil || magic != queryLogMagic {
+		return nil, fmt.Errorf("not a query log")
+	}
+	fields := make([]uint64, 3)
+	if err := binary.Read(lr.r, binary.LittleEndian, fields); err != nil {
+		return nil, fmt.Errorf("error reading query log header: %w", err)
+	}
+	lr.Header = QueryLogHeader{Version: fields[0], Dim: fields[1], PrecBits: fields[2]}
+	if lr.Header.Version != QueryLogVersion {
+		return nil, fmt.Errorf("query log has version %d, expected %d", lr.Header.Version, QueryLogVersion)
+	}
+	return lr, nil
+}
+
+// Read returns the next query, or io.EOF after the last one
+func (lr *QueryLogReader) Read() (*LoggedQuery, error) {
+	buf := make([]byte, 16+lr.Header.Dim)
+	n, err := io.ReadFull(lr.r, buf)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query log is truncated after %d bytes of a query: %w", n, err)
+	}
+	q := &LoggedQuery{
+		QueryID:      int(binary.LittleEndian.Uint64(buf)),
+		ClusterIndex: binary.LittleEndian.Uint64(buf[8:]),
+		Embedding:    make([]int8, lr.Header.Dim),
+	}
+	for i, v := range buf[16:] {
+		q.Embedding[i] = int8(v)
+	}
+	return q, nil
+}
+
+// ReadAll returns the remaining queries of the log
+func (lr *QueryLogReader) ReadAll() ([]*LoggedQuery, error) {
+	res := make([]*LoggedQuery, 0)
+	for {
+		q, err := lr.Read()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, q)
+	}
+}
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestQueryLog(t *testing.T) {
+	queries := []*LoggedQuery{
+		{QueryID: 0, ClusterIndex: 3, Embedding: []int8{1, -16, 15}},
+		{QueryID: 7, ClusterIndex: 0, Embedding: []int8{0, 0, -1}},
+	}
+	var buf bytes.Buffer
+	w, err := NewQueryLogWriter(&buf, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range queries {
+		if err := w.Write(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Write(&LoggedQuery{Embedding: []int8{1, 2}}); err == nil {
+		t.Errorf("Expected an error writing a query of the wrong dimension")
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// fixed-size records after the header
+	if expected := 4 + 3*8 + len(queries)*(16+3); buf.Len() != expected {
+		t.Errorf("Expected a log of %d bytes, but got %d", expected, buf.Len())
+	}
+	log := buf.Bytes()
+
+	r, err := NewQueryLogReader(bytes.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Header != (QueryLogHeader{Version: QueryLogVersion, Dim: 3, PrecBits: 5}) {
+		t.Errorf("Unexpected header %+v", r.Header)
+	}
+	got, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, queries) {
+		t.Errorf("Expected the queries %v, but got %v", queries, got)
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("Expected io.EOF after the last query, but got %v", err)
+	}
+
+	truncated, _ := NewQueryLogReader(bytes.NewReader(log[:len(log)-1]))
+	if _, err := truncated.ReadAll(); err == nil {
+		t.Errorf("Expected an error reading a truncated log")
+	}
+	other := append([]byte(nil), log...)
+	other[4] = QueryLogVersion + 1
+	if _, err := NewQueryLogReader(bytes.NewReader(other)); err == nil {
+		t.Errorf("Expected an error reading another version")
+	}
+	if _, err := NewQueryLogReader(bytes.NewReader([]byte("0,1,2\n"))); err == nil {
+		t.Errorf("Expected an error reading a csv file")
+	}
+}
@@ -0,0 +1,163 @@
+package protocol
+
+import (
+	"sync"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+)
+
+// ReloadableServer serves queries from a Server that can be rebuilt from updated
+// clusters and swapped in without going offline.
+//
+// A query round (HintAnswer then Answer) must use a single Server together with a
+// client set up from that Server's hint: Snapshot leases both at once. A Server
+// that a reload swaps out is only closed once its last lease is released, so
+// the rounds in flight on it complete.
+type ReloadableServer struct {
+	params   database.DatabaseParams
+	precBits uint64
+
+	mu         sync.Mutex
+	active     *served
+	generation uint64
+
+	// reloadMu serializes reloads, so that only one new database is built at a time
+	reloadMu sync.Mutex
+}
+
+// served is a Server and the number of its leases. Once retired, it is closed
+// when the count drops to 0.
+type served struct {
+	server  *Server
+	leases  int
+	retired bool
+}
+
+// Lease is a Server, its hint and its generation, held for query rounds until
+// Release
+type Lease struct {
+	Server     *Server
+	Hint       *TiptoeHint
+	Generation uint64
+
+	r       *ReloadableServer
+	served  *served
+	release sync.Once
+}
+
+// Release lets the Server of the lease be closed, if it was swapped out and no
+// other lease holds it. The lease must not be used after.
+func (l *Lease) Release() {
+	l.release.Do(func() {
+		l.r.mu.Lock()
+		l.served.leases--
+		closing := l.served.retired && l.served.leases == 0
+		l.r.mu.Unlock()
+		if closing {
+			l.served.server.Close()
+		}
+	})
+}
+
+// NewReloadableServer builds the first database from the given clusters, and
+// returns the error of building it, e.g., a *database.ParamsError
+func NewReloadableServer(metadata database.Metadata, clusters []*database.Cluster, params database.DatabaseParams, precBits uint64) (*ReloadableServer, error) {
+	s := new(Server)
+	if err := s.Build(metadata, clusters, params, precBits, nil); err != nil {
+		return nil, err
+	}
+
+	return &ReloadableServer{
+		params:   params,
+		precBits: precBits,
+		active:   &served{server: s},
+	}, nil
+}
+
+// retire closes a Server that is no longer active, once its last lease is
+// released
+func (r *ReloadableServer) retire(old *served) {
+	r.mu.Lock()
+	old.retired = true
+	closing := old.leases == 0
+	r.mu.Unlock()
+	if closing {
+		old.server.Close()
+	}
+}
+
+// Reload builds a new database from the given clusters and atomically replaces
+// the active one, returning the new generation. Queries keep being answered by
+// the old database while the new one is built, and it is closed once the last
+// lease on it is released. The new database and its hint are swapped in
+// together, only once both are complete. If the new database cannot be built,
+// e.g., the clusters no longer fit the params, the old one stays active and
+// the error is returned.
+func (r *ReloadableServer) Reload(metadata database.Metadata, clusters []*database.Cluster) (uint64, error) {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	s := new(Server)
+	if err := s.Build(metadata, clusters, r.params, r.precBits, nil); err != nil {
+		return r.Generation(), err
+	}
+
+	r.mu.Lock()
+	old := r.active
+	r.active = &served{server: s}
+	r.generation += 1
+	generation := r.generation
+	r.mu.Unlock()
+
+	r.retire(old)
+	return generation, nil
+}
+
+// ReloadResult is the outcome of a ReloadAsync: the generation served after it,
+// and the error of the reload, if any
+type ReloadResult struct {
+	Generation uint64
+	Err        error
+}
+
+// ReloadAsync is Reload in the background: it returns at once, and the channel
+// receives the new generation once the new database and hint are served, or
+// the error of the reload. Until then, Snapshot keeps leasing the old pair.
+func (r *ReloadableServer) ReloadAsync(metadata database.Metadata, clusters []*database.Cluster) <-chan ReloadResult {
+	done := make(chan ReloadResult, 1)
+	go func() {
+		generation, err := r.Reload(metadata, clusters)
+		done <- ReloadResult{Generation: generation, Err: err}
+		close(done)
+	}()
+	return done
+}
+
+// Snapshot leases the current Server, its hint and the generation, read at
+// once, so that a client set up from the hint queries the database it was
+// built for, even if a reload swaps it out in the middle of a round. The caller
+// must Release the lease once its rounds are over.
+func (r *ReloadableServer) Snapshot() *Lease {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.active.leases++
+	return &Lease{Server: r.active.server, Hint: r.active.server.Hint, Generation: r.generation, r: r, served: r.active}
+}
+
+// Generation counts the reloads so far, so that clients can tell when their hint
+// is stale
+func (r *ReloadableServer) Generation() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.generation
+}
+
+// Close closes the current Server, once its last lease is released
+func (r *ReloadableServer) Close() {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+	r.mu.Lock()
+	active := r.active
+	r.mu.Unlock()
+	r.retire(active)
+}
@@ -0,0 +1,208 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+func TestReloadableServer(t *testing.T) {
+	preamble := utils.GenerateTestData()
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.RemoveTestData()
+
+	r, err := NewReloadableServer(metadata, clusters, database.DatabaseParams{HintSz: 900}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// a round that straddles the reload: its hint is answered before
+	old := r.Snapshot()
+	c := new(Client)
+	c.Setup(old.Hint)
+	defer c.Free()
+	offlineAns, err := old.Server.HintAnswer(c.PreprocessQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ProcessHintApply(offlineAns)
+
+	// drop the last cluster and rebuild
+	newMetadata := metadata
+	newMetadata.NumClusters -= 1
+	newMetadata.NumVectors -= clusters[len(clusters)-1].NumVectors
+	if _, err := r.Reload(newMetadata, clusters[:len(clusters)-1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Generation() != 1 {
+		t.Errorf("Expected generation 1 after a reload, but got %d", r.Generation())
+	}
+	lease := r.Snapshot()
+	defer lease.Release()
+	if lease.Server == old.Server || lease.Hint == old.Hint {
+		t.Fatalf("Expected the server and hint to be replaced")
+	}
+	if lease.Hint.Metadata.NumClusters != newMetadata.NumClusters {
+		t.Errorf("Expected the new hint to have %d clusters, but got %d", newMetadata.NumClusters, lease.Hint.Metadata.NumClusters)
+	}
+
+	// the reload is invisible to the round in flight, which ends on the old
+	// database, with the scores of all its clusters
+	last := metadata.NumClusters - 1
+	ans, err := old.Server.Answer(c.QueryEmbeddings(make([]int8, metadata.Dim), last))
+	if err != nil {
+		t.Fatalf("Expected the round in flight to complete after the reload, but got %v", err)
+	}
+	if scores := c.ReconstructWithinCluster(ans, last, c.DBInfo.P()); len(*scores) != int(clusters[last].NumVectors) {
+		t.Errorf("Expected %d scores of the dropped cluster, but got %d", clusters[last].NumVectors, len(*scores))
+	}
+	old.Release()
+	if _, err := old.Server.HintAnswer(c.PreprocessQuery()); err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed from the old server once released, but got %v", err)
+	}
+
+	// a client set up from the new hint can query the new server
+	scores, err := leasedRound(t, lease, metadata.Dim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*scores) != int(clusters[0].NumVectors) {
+		t.Errorf("Expected %d scores, but got %d", clusters[0].NumVectors, len(*scores))
+	}
+}
+
+// leasedRound makes a round on the server of a lease with a new client, and
+// returns the scores of cluster 0
+func leasedRound(t *testing.T, lease *Lease, dim uint64) (*[]VectorScore, error) {
+	t.Helper()
+	c := new(Client)
+	c.Setup(lease.Hint)
+	defer c.Free()
+	offlineAns, err := lease.Server.HintAnswer(c.PreprocessQuery())
+	if err != nil {
+		return nil, err
+	}
+	c.ProcessHintApply(offlineAns)
+	var ans *pir.Answer[matrix.Elem64]
+	ans, err = lease.Server.Answer(c.QueryEmbeddings(make([]int8, dim), 0))
+	if err != nil {
+		return nil, err
+	}
+	return c.ReconstructWithinCluster(ans, 0, c.DBInfo.P()), nil
+}
+
+func TestReloadAsync(t *testing.T) {
+	preamble := utils.GenerateTestData()
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.RemoveTestData()
+
+	r, err := NewReloadableServer(metadata, clusters, database.DatabaseParams{HintSz: 900}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// a lease taken before the reload, for a round after it
+	straddling := r.Snapshot()
+
+	newMetadata := metadata
+	newMetadata.NumClusters -= 1
+	newMetadata.NumVectors -= clusters[len(clusters)-1].NumVectors
+	done := r.ReloadAsync(newMetadata, clusters[:len(clusters)-1])
+
+	// rounds during the build and the swap use a consistent pair, and succeed
+	for generation := uint64(0); generation == 0; {
+		lease := r.Snapshot()
+		if lease.Server.Hint != lease.Hint {
+			t.Fatalf("Expected the snapshot hint to be the hint of its server")
+		}
+		if expected := metadata.NumClusters - lease.Generation; lease.Hint.Metadata.NumClusters != expected {
+			t.Fatalf("Expected %d clusters at generation %d, but got %d", expected, lease.Generation, lease.Hint.Metadata.NumClusters)
+		}
+		scores, err := leasedRound(t, lease, metadata.Dim)
+		lease.Release()
+		if err != nil {
+			t.Fatalf("Expected a leased round to succeed during the reload, but got %v", err)
+		}
+		if len(*scores) != int(clusters[0].NumVectors) {
+			t.Errorf("Expected %d scores, but got %d", clusters[0].NumVectors, len(*scores))
+		}
+
+		select {
+		case result := <-done:
+			if result.Err != nil {
+				t.Fatal(result.Err)
+			}
+			generation = result.Generation
+		default:
+		}
+	}
+
+	lease := r.Snapshot()
+	if lease.Generation != 1 || lease.Hint.Metadata.NumClusters != newMetadata.NumClusters {
+		t.Errorf("Expected generation 1 with %d clusters after the reload, but got %d with %d", newMetadata.NumClusters, lease.Generation, lease.Hint.Metadata.NumClusters)
+	}
+	lease.Release()
+
+	// the old server outlives the reload until its last lease is released
+	if _, err := leasedRound(t, straddling, metadata.Dim); err != nil {
+		t.Errorf("Expected the swapped out server to answer its leased round, but got %v", err)
+	}
+	straddling.Release()
+	straddling.Release()
+	if _, err := straddling.Server.HintAnswer(nil); err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed once the last lease is released, but got %v", err)
+	}
+}
+
+func TestReloadFailure(t *testing.T) {
+	preamble := utils.GenerateTestData()
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.RemoveTestData()
+
+	// metadata of another dimension than the clusters
+	wrongDim := metadata
+	wrongDim.Dim += 1
+	if _, err := NewReloadableServer(wrongDim, clusters, database.DatabaseParams{HintSz: 900}, 5); err == nil {
+		t.Errorf("Expected an error building from clusters of the wrong dimension")
+	}
+
+	r, err := NewReloadableServer(metadata, clusters, database.DatabaseParams{HintSz: 900}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	before := r.Snapshot()
+	before.Release()
+
+	if generation, err := r.Reload(wrongDim, clusters); err == nil || generation != 0 {
+		t.Errorf("Expected a failed reload to return an error and generation 0, but got %v and %d", err, generation)
+	}
+	if result := <-r.ReloadAsync(wrongDim, clusters); result.Err == nil || result.Generation != 0 {
+		t.Errorf("Expected a failed async reload to deliver an error and generation 0, but got %+v", result)
+	}
+
+	// the old database is still served
+	lease := r.Snapshot()
+	defer lease.Release()
+	if lease.Server != before.Server || lease.Generation != 0 {
+		t.Fatalf("Expected a failed reload to keep the old server")
+	}
+	if _, err := leasedRound(t, lease, metadata.Dim); err != nil {
+		t.Errorf("Expected the old server to answer after a failed reload, but got %v", err)
+	}
+}
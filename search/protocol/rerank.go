@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+)
+
+// RerankExact reorders the first k results of a ranking by the exact inner
+// products of the raw query with their unquantized vectors from a sidecar, and
+// drops the others. It returns the exact scores, in the new order, alongside;
+// the Score of the results is left as the quantized one. Results of equal exact
+// scores keep their order.
+//
+// Only the k candidates are looked up, so a sidecar held by a server learns
+// which k vectors a query returned, though not the query itself.
+func RerankExact(scores *[]VectorScore, raw []float64, k int, order SortOrder, sidecar *database.FloatSidecar) (*[]VectorScore, []float64, error) {
+	if uint64(len(raw)) != sidecar.Dim {
+		return nil, nil, fmt.Errorf("expected a query of dimension %d for the sidecar, got %d", sidecar.Dim, len(raw))
+	}
+	n := k
+	if n > len(*scores) {
+		n = len(*scores)
+	}
+	res := make([]VectorScore, n)
+	copy(res, (*scores)[:n])
+	exact := make(map[VectorScore]float64, n)
+	for _, sc := range res {
+		v, ok := sidecar.Vector(uint64(sc.ClusterID), sc.IDWithinCluster)
+		if !ok {
+			return nil, nil, fmt.Errorf("vector %d of cluster %d is not in the sidecar", sc.IDWithinCluster, sc.ClusterID)
+		}
+		dot := 0.0
+		for j, u := range raw {
+			dot += u * v[j]
+		}
+		exact[sc] = dot
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if order == Ascending {
+			return exact[res[i]] < exact[res[j]]
+		}
+		return exact[res[i]] > exact[res[j]]
+	})
+	exactScores := make([]float64, n)
+	for i, sc := range res {
+		exactScores[i] = exact[sc]
+	}
+	return &res, exactScores, nil
+}
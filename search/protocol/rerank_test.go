@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+)
+
+func TestRerankExact(t *testing.T) {
+	const dim, numVectors, numQueries, precBits, k, candidates = 16, 200, 50, 4, 5, 20
+	r := rand.New(rand.NewSource(3))
+	vectors := make([][]float64, numVectors)
+	var sidecar strings.Builder
+	for i := range vectors {
+		vectors[i] = make([]float64, dim)
+		fmt.Fprintf(&sidecar, "1,%d", i)
+		for j := range vectors[i] {
+			vectors[i][j] = r.NormFloat64() / 4
+			fmt.Fprintf(&sidecar, ",%g", vectors[i][j])
+		}
+		sidecar.WriteString("\n")
+	}
+	file := filepath.Join(t.TempDir(), "floats.csv")
+	if err := os.WriteFile(file, []byte(sidecar.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := database.ReadFloatSidecar(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Dim != dim || s.Len() != numVectors {
+		t.Fatalf("Expected %d %d-dim vectors, but got %d %d-dim ones", numVectors, dim, s.Len(), s.Dim)
+	}
+
+	// the recall at k of the quantized ranking, and of its first candidates reranked
+	quantizedHits, rerankedHits := 0, 0
+	for q := 0; q < numQueries; q++ {
+		raw := make([]float64, dim)
+		for j := range raw {
+			raw[j] = r.NormFloat64() / 4
+		}
+		exact := make([]float64, numVectors)
+		scores := make([]VectorScore, numVectors)
+		for i, v := range vectors {
+			score := 0
+			for j := range v {
+				exact[i] += raw[j] * v[j]
+				score += int(utils.QuantizeClamp(raw[j], precBits)) * int(utils.QuantizeClamp(v[j], precBits))
+			}
+			scores[i] = VectorScore{ClusterID: 1, IDWithinCluster: uint64(i), Score: score}
+		}
+		sort.SliceStable(scores, func(i, j int) bool { return scores[i].Score > scores[j].Score })
+		best := make([]int, numVectors)
+		for i := range best {
+			best[i] = i
+		}
+		sort.Slice(best, func(i, j int) bool { return exact[best[i]] > exact[best[j]] })
+		truth := make(map[uint64]bool)
+		for _, i := range best[:k] {
+			truth[uint64(i)] = true
+		}
+
+		reranked, exactScores, err := RerankExact(&scores, raw, candidates, Descending, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*reranked) != candidates {
+			t.Fatalf("Expected %d reranked candidates, but got %d", candidates, len(*reranked))
+		}
+		for i := range *reranked {
+			if i > 0 && exactScores[i] > exactScores[i-1] {
+				t.Fatalf("Expected the candidates by decreasing exact score, but got %v", exactScores)
+			}
+			if want := exact[(*reranked)[i].IDWithinCluster]; math.Abs(exactScores[i]-want) > 1e-9 {
+				t.Errorf("Expected the exact score %g, but got %g", want, exactScores[i])
+			}
+		}
+		for i := 0; i < k; i++ {
+			if truth[scores[i].IDWithinCluster] {
+				quantizedHits++
+			}
+			if truth[(*reranked)[i].IDWithinCluster] {
+				rerankedHits++
+			}
+		}
+	}
+	quantized := float64(quantizedHits) / float64(k*numQueries)
+	reranked := float64(rerankedHits) / float64(k*numQueries)
+	t.Logf("recall@%d of %d-bit scores: %.2f quantized, %.2f with the top %d reranked exactly", k, precBits, quantized, reranked, candidates)
+	if reranked <= quantized {
+		t.Errorf("Expected reranking to improve the recall of %.2f, but got %.2f", quantized, reranked)
+	}
+
+	missing := []VectorScore{{ClusterID: 2, IDWithinCluster: 0}}
+	if _, _, err := RerankExact(&missing, make([]float64, dim), k, Descending, s); err == nil {
+		t.Errorf("Expected a candidate missing from the sidecar to be rejected")
+	}
+	if _, _, err := RerankExact(&missing, make([]float64, dim-1), k, Descending, s); err == nil {
+		t.Errorf("Expected a query of the wrong dimension to be rejected")
+	}
+}
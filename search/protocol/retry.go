@@ -0,0 +1,188 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/ahenzinger/underhood/underhood"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+// ErrCallTimeout is returned for an attempt that exceeds RetryPolicy.Timeout
+var ErrCallTimeout = errors.New("call timed out")
+
+// RetryPolicy retries the calls of a round to a Responder that fail, e.g., on
+// transient network errors. HintAnswer and Answer are read-only, so a call can
+// be retried without side effects on the server.
+type RetryPolicy struct {
+	// Retries is the number of attempts after the first
+	Retries int
+	// Timeout, if positive, bounds every attempt. An attempt that times out is
+	// abandoned, and its result discarded if it completes later: the Responder
+	// cannot be interrupted, so a Server keeps computing it.
+	Timeout time.Duration
+	// Backoff is the wait before the first retry, doubled before every other
+	// one, up to MaxBackoff if positive
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// CallStats is the cost of a call beyond its successful attempt, so that
+// latency statistics can leave out retries
+type CallStats struct {
+	// Attempts is the number of attempts made, the last of which succeeded if
+	// the call did
+	Attempts int
+	// Last is the duration of the last attempt, and Waited the time spent in the
+	// attempts before it and in backoff
+	Last   time.Duration
+	Waited time.Duration
+}
+
+// retryable tells whether an error may be transient. A closed server stays
+// closed: its clients need the hint of the new one (see ReloadableServer).
+func retryable(err error) bool {
+	return !errors.Is(err, ErrServerClosed)
+}
+
+// callWithRetries makes a call as the policy says, until ctx is done
+func callWithRetries[T any](ctx context.Context, p RetryPolicy, call func() (T, error)) (T, CallStats, error) {
+	var stats CallStats
+	start := time.Now()
+	attemptStart := start
+	backoff := p.Backoff
+	for {
+		res, err := attemptWithin(ctx, p.Timeout, call)
+		stats.Attempts++
+		stats.Last = time.Since(attemptStart)
+		if err == nil || stats.Attempts > p.Retries || !retryable(err) || ctx.Err() != nil {
+			stats.Waited = attemptStart.Sub(start)
+			if err != nil && stats.Attempts > 1 {
+				err = fmt.Errorf("after %d attempts: %w", stats.Attempts, err)
+			}
+			return res, stats, err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			stats.Waited = time.Since(start)
+			var zero T
+			return zero, stats, ctx.Err()
+		}
+		attemptStart = time.Now()
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// attemptWithin makes a call once, within the timeout if positive, and returns
+// ctx.Err() as soon as ctx is done. A call that times out or is canceled cannot
+// be interrupted: it is abandoned, and runs to completion in the background.
+func attemptWithin[T any](ctx context.Context, timeout time.Duration, call func() (T, error)) (T, error) {
+	if err := ctx.Err(); err != nil {
+		var zero T
+		return zero, err
+	}
+	if timeout <= 0 && ctx.Done() == nil {
+		return call()
+	}
+	type result struct {
+		res T
+		err error
+	}
+	// buffered, so that an abandoned call does not block once it completes
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				var zero T
+				done <- result{zero, fmt.Errorf("%v", r)}
+			}
+		}()
+		res, err := call()
+		done <- result{res, err}
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var zero T
+	select {
+	case r := <-done:
+		return r.res, r.err
+	case <-expired:
+		return zero, fmt.Errorf("%w after %s", ErrCallTimeout, timeout)
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// HintAnswer answers a hint query with r, retrying as the policy says
+func (p RetryPolicy) HintAnswer(r Responder, ct *[][]byte) (*underhood.HintAnswer, CallStats, error) {
+	return p.HintAnswerContext(context.Background(), r, ct)
+}
+
+// HintAnswerContext is HintAnswer, giving up with ctx.Err() once ctx is done,
+// even in the middle of an attempt
+func (p RetryPolicy) HintAnswerContext(ctx context.Context, r Responder, ct *[][]byte) (*underhood.HintAnswer, CallStats, error) {
+	return callWithRetries(ctx, p, func() (*underhood.HintAnswer, error) { return r.HintAnswer(ct) })
+}
+
+// Answer answers a query with r, retrying as the policy says
+func (p RetryPolicy) Answer(r Responder, query *pir.Query[matrix.Elem64]) (*pir.Answer[matrix.Elem64], CallStats, error) {
+	return p.AnswerContext(context.Background(), r, query)
+}
+
+// AnswerContext is Answer, giving up with ctx.Err() once ctx is done, even in
+// the middle of an attempt
+func (p RetryPolicy) AnswerContext(ctx context.Context, r Responder, query *pir.Query[matrix.Elem64]) (*pir.Answer[matrix.Elem64], CallStats, error) {
+	return callWithRetries(ctx, p, func() (*pir.Answer[matrix.Elem64], error) { return r.Answer(query) })
+}
+
+// RetryingResponder is a Responder that retries the calls to another one, for
+// Client.Round, GlobalQuery and ProbeClusters. It counts the retries and the time they took,
+// for all its calls.
+type RetryingResponder struct {
+	Responder Responder
+	Policy    RetryPolicy
+
+	retries atomic.Uint64
+	waited  atomic.Int64
+}
+
+func (r *RetryingResponder) record(stats CallStats) {
+	r.retries.Add(uint64(stats.Attempts - 1))
+	r.waited.Add(int64(stats.Waited))
+}
+
+func (r *RetryingResponder) HintAnswer(ct *[][]byte) (*underhood.HintAnswer, error) {
+	ans, stats, err := r.Policy.HintAnswer(r.Responder, ct)
+	r.record(stats)
+	return ans, err
+}
+
+func (r *RetryingResponder) Answer(query *pir.Query[matrix.Elem64]) (*pir.Answer[matrix.Elem64], error) {
+	ans, stats, err := r.Policy.Answer(r.Responder, query)
+	r.record(stats)
+	return ans, err
+}
+
+// Retries is the number of retries of all calls so far, and Waited the time
+// spent in failed attempts and backoff
+func (r *RetryingResponder) Retries() uint64 {
+	return r.retries.Load()
+}
+
+func (r *RetryingResponder) Waited() time.Duration {
+	return time.Duration(r.waited.Load())
+}
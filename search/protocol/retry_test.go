@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ahenzinger/underhood/underhood"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+var errFlaky = errors.New("connection reset")
+
+// flakyResponder fails its first failures calls, with err or by taking longer
+// than delay. An attempt that times out keeps running, so the calls are counted
+// atomically.
+type flakyResponder struct {
+	failures int64
+	err      error
+	delay    time.Duration
+	calls    atomic.Int64
+}
+
+func (r *flakyResponder) call() error {
+	if r.calls.Add(1) > r.failures {
+		return nil
+	}
+	if r.delay > 0 {
+		time.Sleep(r.delay)
+		return nil
+	}
+	return r.err
+}
+
+func (r *flakyResponder) HintAnswer(ct *[][]byte) (*underhood.HintAnswer, error) {
+	return new(underhood.HintAnswer), r.call()
+}
+
+func (r *flakyResponder) Answer(query *pir.Query[matrix.Elem64]) (*pir.Answer[matrix.Elem64], error) {
+	return new(pir.Answer[matrix.Elem64]), r.call()
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{Retries: 3, Backoff: 10 * time.Millisecond, MaxBackoff: 15 * time.Millisecond}
+
+	r := &flakyResponder{failures: 2, err: errFlaky}
+	ans, stats, err := policy.Answer(r, nil)
+	if err != nil || ans == nil {
+		t.Fatalf("Expected an answer after two failures, but got %v", err)
+	}
+	if stats.Attempts != 3 {
+		t.Errorf("Expected 3 attempts, but got %d", stats.Attempts)
+	}
+	// two backoffs of 10ms and 15ms, the second capped
+	if stats.Waited < 25*time.Millisecond || stats.Last >= stats.Waited {
+		t.Errorf("Expected the backoff to be counted apart from the last attempt, but waited %s and the last attempt took %s", stats.Waited, stats.Last)
+	}
+
+	r = &flakyResponder{failures: 5, err: errFlaky}
+	if _, stats, err = policy.HintAnswer(r, nil); !errors.Is(err, errFlaky) {
+		t.Errorf("Expected the last error once the retries are used up, but got %v", err)
+	}
+	if stats.Attempts != 4 || r.calls.Load() != 4 {
+		t.Errorf("Expected 4 attempts, but got %d", stats.Attempts)
+	}
+
+	r = &flakyResponder{failures: 1, err: ErrServerClosed}
+	if _, stats, err = policy.Answer(r, nil); !errors.Is(err, ErrServerClosed) || stats.Attempts != 1 {
+		t.Errorf("Expected no retry of a closed server, but got %v after %d attempts", err, stats.Attempts)
+	}
+
+	// the first attempt is abandoned, and the second one answers in time
+	policy.Timeout = 20 * time.Millisecond
+	r = &flakyResponder{failures: 1, delay: 200 * time.Millisecond}
+	start := time.Now()
+	if _, stats, err = policy.Answer(r, nil); err != nil || stats.Attempts != 2 {
+		t.Errorf("Expected an answer on the second attempt, but got %v after %d attempts", err, stats.Attempts)
+	}
+	if took := time.Since(start); took >= 200*time.Millisecond {
+		t.Errorf("Expected the slow attempt to time out, but the call took %s", took)
+	}
+
+	policy.Retries = 0
+	r = &flakyResponder{failures: 1, delay: 200 * time.Millisecond}
+	if _, _, err = policy.Answer(r, nil); !errors.Is(err, ErrCallTimeout) {
+		t.Errorf("Expected ErrCallTimeout, but got %v", err)
+	}
+}
+
+func TestRetryingResponder(t *testing.T) {
+	flaky := &flakyResponder{failures: 1, err: errFlaky}
+	r := &RetryingResponder{Responder: flaky, Policy: RetryPolicy{Retries: 1, Backoff: time.Millisecond}}
+	if _, err := r.HintAnswer(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Answer(nil); err != nil {
+		t.Fatal(err)
+	}
+	if r.Retries() != 1 || r.Waited() < time.Millisecond {
+		t.Errorf("Expected 1 retry after at least 1ms, but got %d after %s", r.Retries(), r.Waited())
+	}
+	if _, err := r.Answer(nil); err != nil || flaky.calls.Load() != 4 {
+		t.Errorf("Expected one call once the failures are over, but got %v after %d calls", err, flaky.calls.Load())
+	}
+}
+
+func TestRetryPolicyContext(t *testing.T) {
+	policy := RetryPolicy{Retries: 3, Backoff: time.Second}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := &flakyResponder{}
+	if _, _, err := policy.Answer(r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, stats, err := policy.AnswerContext(ctx, r, nil); !errors.Is(err, context.Canceled) || stats.Attempts != 1 || r.calls.Load() != 1 {
+		t.Errorf("Expected a canceled context to skip the call, but got %v after %d calls", err, r.calls.Load())
+	}
+
+	// canceled in the middle of a slow attempt, which is abandoned
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	r = &flakyResponder{failures: 1, delay: 200 * time.Millisecond}
+	start := time.Now()
+	if _, stats, err := policy.HintAnswerContext(ctx, r, nil); !errors.Is(err, context.DeadlineExceeded) || stats.Attempts != 1 {
+		t.Errorf("Expected the deadline to end the attempt, but got %v after %d attempts", err, stats.Attempts)
+	}
+	if took := time.Since(start); took >= 200*time.Millisecond {
+		t.Errorf("Expected the call to return at the deadline, but it took %s", took)
+	}
+
+	// canceled in the backoff between attempts
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	r = &flakyResponder{failures: 5, err: errFlaky}
+	start = time.Now()
+	if _, stats, err := policy.AnswerContext(ctx, r, nil); !errors.Is(err, context.DeadlineExceeded) || stats.Attempts != 1 {
+		t.Errorf("Expected the deadline to end the backoff, but got %v after %d attempts", err, stats.Attempts)
+	}
+	if took := time.Since(start); took >= time.Second {
+		t.Errorf("Expected the call to return at the deadline, but it took %s", took)
+	}
+}
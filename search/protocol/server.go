@@ -1,7 +1,9 @@
 package protocol
 
 import (
+	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/DeweiFeng/6.5610-project/search/database"
 	"github.com/DeweiFeng/6.5610-project/search/utils"
@@ -16,24 +18,92 @@ type TiptoeHint struct {
 
 	PIRHint  utils.PIR_hint[matrix.Elem64]
 	IndexMap database.ClusterMap
+
+	// ClusterSizes, if set, holds the number of vectors of every cluster, so that
+	// the client can tell real vectors from padding and empty clusters apart
+	ClusterSizes []uint64
 }
 
+// ErrServerClosed is returned by queries made after Server.Close
+var ErrServerClosed = errors.New("server is closed")
+
 type Server struct {
 	Hint       *TiptoeHint
 	PIRServer  *pir.Server[matrix.Elem64]
 	HintServer *underhood.Server[matrix.Elem64]
+
+	// mu is held for reading by in-flight queries and for writing by Close
+	mu     sync.RWMutex
+	closed bool
+
+	// access, if not nil, counts the queries to each cluster, see TrackClusterAccess
+	access *accessCounts
 }
 
-func (s *Server) ProcessVectorsFromClusters(metadata database.Metadata, clusters []*database.Cluster, hintSz uint64, precBits uint64) {
-	seed := rand.RandomPRGKey()
+func (s *Server) ProcessVectorsFromClusters(metadata database.Metadata, clusters []*database.Cluster, params database.DatabaseParams, precBits uint64) {
+	s.ProcessVectorsFromClustersWithSeed(metadata, clusters, params, precBits, rand.RandomPRGKey())
+}
+
+// ProcessVectorsFromSource is Build, with a random seed, on every cluster of a
+// source, e.g., a database.FileClusterSource, returning the error of reading or
+// building the database
+func (s *Server) ProcessVectorsFromSource(src database.ClusterSource, params database.DatabaseParams, precBits uint64) error {
+	metadata, clusters, err := database.ReadAllFromSource(src, precBits)
+	if err != nil {
+		return err
+	}
+	return s.Build(metadata, clusters, params, precBits, nil)
+}
+
+// ProcessVectorsFromClustersWithSeed is like ProcessVectorsFromClusters, but
+// derives the LWE matrix from the given seed, so that the same seed and inputs
+// give byte-identical hints. The seed is public: it is part of the hint.
+func (s *Server) ProcessVectorsFromClustersWithSeed(metadata database.Metadata, clusters []*database.Cluster, params database.DatabaseParams, precBits uint64, seed *rand.PRGKey) {
+	if err := s.Build(metadata, clusters, params, precBits, seed); err != nil {
+		panic("Error building the database: " + err.Error())
+	}
+}
 
+// Build is ProcessVectorsFromClustersWithSeed, returning the error of building
+// the database instead of panicking, e.g., a *database.ParamsError to retry
+// with other params. A nil seed stands for a random one.
+func (s *Server) Build(metadata database.Metadata, clusters []*database.Cluster, params database.DatabaseParams, precBits uint64, seed *rand.PRGKey) error {
+	if seed == nil {
+		seed = rand.RandomPRGKey()
+	}
 	numClusters := metadata.NumClusters
 	dim := metadata.Dim
 	numVectors := metadata.NumVectors
 
 	fmt.Printf("Preprocessing of %d %d-dim %d-bit embeddings organized in %d clusters\n", numVectors, dim, precBits, numClusters)
 
-	db, indexMap := database.BuildVectorDatabase(metadata, clusters, seed, hintSz, precBits)
+	db, indexMap, err := database.BuildVectorDatabase(metadata, clusters, seed, params, precBits)
+	if err != nil {
+		return err
+	}
+	s.processDatabase(metadata, db, indexMap, seed)
+
+	s.Hint.ClusterSizes = make([]uint64, len(clusters))
+	for i, c := range clusters {
+		s.Hint.ClusterSizes[i] = c.NumVectors
+	}
+
+	// // THIS CHECK DOES NOT MAKE SENSE FOR IMAGE DATASET, BECAUSE VECTORS ARE NORMALIZED
+	// max_inner_prod := 2 * (1 << (2*precBits - 2)) * dim
+	// if s.PIRServer.Params().P < max_inner_prod {
+	// 	fmt.Printf("%d < %d\n", s.PIRServer.Params().P, max_inner_prod)
+	// 	panic("Parameters not supported. Inner products may wrap around.")
+	// }
+	return nil
+}
+
+// ProcessDatabase serves a database that was already built, e.g., by
+// database.MergeDatabases
+func (s *Server) ProcessDatabase(metadata database.Metadata, db *pir.Database[matrix.Elem64], indexMap database.ClusterMap) {
+	s.processDatabase(metadata, db, indexMap, rand.RandomPRGKey())
+}
+
+func (s *Server) processDatabase(metadata database.Metadata, db *pir.Database[matrix.Elem64], indexMap database.ClusterMap, seed *rand.PRGKey) {
 	s.PIRServer = pir.NewServerSeed(db, seed)
 
 	s.Hint = new(TiptoeHint)
@@ -49,21 +119,81 @@ func (s *Server) ProcessVectorsFromClusters(metadata database.Metadata, clusters
 
 	rows := s.Hint.PIRHint.Hint.Rows()
 	s.Hint.PIRHint.Hint.DropLastrows(rows)
+}
 
-	// // THIS CHECK DOES NOT MAKE SENSE FOR IMAGE DATASET, BECAUSE VECTORS ARE NORMALIZED
-	// max_inner_prod := 2 * (1 << (2*precBits - 2)) * dim
-	// if s.PIRServer.Params().P < max_inner_prod {
-	// 	fmt.Printf("%d < %d\n", s.PIRServer.Params().P, max_inner_prod)
-	// 	panic("Parameters not supported. Inner products may wrap around.")
-	// }
+// Seed returns the seed the database was built with, to reproduce it
+func (s *Server) Seed() rand.PRGKey {
+	return s.Hint.PIRHint.Seeds[0]
 }
 
-func (s *Server) HintAnswer(ct *[][]byte) *underhood.HintAnswer {
+func (s *Server) HintAnswer(ct *[][]byte) (*underhood.HintAnswer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrServerClosed
+	}
+
 	offlineAns := s.HintServer.HintAnswer(ct)
-	return offlineAns
+	return offlineAns, nil
 }
 
-func (s *Server) Answer(query *pir.Query[matrix.Elem64]) *pir.Answer[matrix.Elem64] {
+func (s *Server) Answer(query *pir.Query[matrix.Elem64]) (*pir.Answer[matrix.Elem64], error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrServerClosed
+	}
+
 	ans := s.PIRServer.Answer(query)
-	return ans
+	return ans, nil
+}
+
+// AnswerRaw answers a query encoded elsewhere, e.g., by a thin client on a
+// constrained device, so that only the server needs this package. The query and
+// the answer are serialized in utils.BinaryWire. The query must be a column of
+// the shape QueryEmbeddings produces for this database: its M columns, padded
+// to a multiple of the squishing of the database.
+func (s *Server) AnswerRaw(encoded []byte) ([]byte, error) {
+	var query pir.Query[matrix.Elem64]
+	if err := utils.DecodeMessage(encoded, utils.BinaryWire, &query); err != nil {
+		return nil, fmt.Errorf("error decoding query: %w", err)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrServerClosed
+	}
+	// the M columns of the database are padded to a multiple of its squishing
+	info := s.PIRServer.DBInfo()
+	rows := info.M
+	if info.Squishing > 0 {
+		rows = (info.M + info.Squishing - 1) / info.Squishing * info.Squishing
+	}
+	if query.Query.Rows() != rows || query.Query.Cols() != 1 {
+		return nil, fmt.Errorf("query is %d by %d, but the database expects %d by 1", query.Query.Rows(), query.Query.Cols(), rows)
+	}
+
+	ans := s.PIRServer.Answer(&query)
+	return utils.EncodeMessage(*ans, utils.BinaryWire)
+}
+
+// Close releases the database and the hint so that their memory can be reclaimed
+// without waiting for the Server itself to become unreachable. It waits for
+// in-flight queries to finish; queries made afterwards return ErrServerClosed.
+// Calling Close more than once is a no-op.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	if s.HintServer != nil {
+		s.HintServer.Free()
+	}
+	s.HintServer = nil
+	s.PIRServer = nil
+	s.Hint = nil
 }
@@ -1,20 +1,338 @@
 package protocol
 
 import (
+	"bytes"
+	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/DeweiFeng/6.5610-project/search/database"
 	"github.com/DeweiFeng/6.5610-project/search/utils"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+	prgrand "github.com/henrycg/simplepir/rand"
 )
 
 func TestProcessVectorsFromClusters(t *testing.T) {
 	preamble := utils.GenerateTestData()
 	// Test the BuildVectorDatabase function
-	metadata, clusters := database.ReadAllClusters(preamble, 5)
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	hintSz := uint64(900) // hintSz is 900 for text embeddings in Tiptoe, and 500 for image embeddings
 	// get an empty server
 	s := new(Server)
-	s.ProcessVectorsFromClusters(metadata, clusters, hintSz, 5)
+	s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: hintSz}, 5)
 	utils.RemoveTestData()
 }
+
+func TestServerClose(t *testing.T) {
+	preamble := utils.GenerateTestData()
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.RemoveTestData()
+
+	s := new(Server)
+	s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: 900}, 5)
+
+	c := new(Client)
+	c.Setup(s.Hint)
+	defer c.Free()
+
+	offlineAns, err := s.HintAnswer(c.PreprocessQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ProcessHintApply(offlineAns)
+
+	emb := make([]int8, metadata.Dim)
+	query := c.QueryEmbeddings(emb, 0)
+
+	// queries racing with Close either complete or fail with ErrServerClosed
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ans, err := s.Answer(query)
+			if err != nil && err != ErrServerClosed {
+				t.Errorf("Expected ErrServerClosed, but got %v", err)
+			}
+			if err == nil && ans == nil {
+				t.Errorf("Expected an answer from a successful query")
+			}
+		}()
+	}
+	s.Close()
+	wg.Wait()
+
+	if _, err := s.Answer(query); err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed after Close, but got %v", err)
+	}
+	if _, err := s.HintAnswer(c.PreprocessQuery()); err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed after Close, but got %v", err)
+	}
+
+	// closing twice is fine
+	s.Close()
+}
+
+func TestMaxAnswerBytes(t *testing.T) {
+	metadata, clusters := testData(t)
+
+	largest := uint64(0)
+	for _, c := range clusters {
+		if c.NumVectors > largest {
+			largest = c.NumVectors
+		}
+	}
+	for _, wire := range []utils.WireFormat{utils.BinaryWire, utils.GobWire} {
+		budget := utils.AnswerSize(largest, wire) + 7
+		s := new(Server)
+		s.ProcessVectorsFromClusters(metadata, clusters, database.DatabaseParams{HintSz: 900, MaxAnswerBytes: budget, AnswerWire: wire}, 5)
+		if s.Hint.PIRHint.Info.L != largest {
+			t.Errorf("%s: expected %d rows, the largest cluster, but got %d", wire, largest, s.Hint.PIRHint.Info.L)
+		}
+
+		c := new(Client)
+		c.Setup(s.Hint)
+		offlineAns, err := s.HintAnswer(c.PreprocessQuery())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.ProcessHintApply(offlineAns)
+		ans, err := s.Answer(c.QueryEmbeddings(clusters[0].Vectors[:metadata.Dim], 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc, err := utils.EncodeMessage(*ans, wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint64(len(enc)) > budget {
+			t.Errorf("%s: expected an answer within %d bytes, but got %d", wire, budget, len(enc))
+		}
+		if wire == utils.BinaryWire && uint64(len(enc)) != utils.AnswerSize(s.Hint.PIRHint.Info.L, wire) {
+			t.Errorf("Expected an answer of %d bytes, but got %d", utils.AnswerSize(s.Hint.PIRHint.Info.L, wire), len(enc))
+		}
+		c.Free()
+		s.Close()
+
+		// the largest cluster cannot be split, so a smaller budget cannot be met
+		params := database.DatabaseParams{HintSz: 900, MaxAnswerBytes: utils.AnswerSize(largest, wire) - 1, AnswerWire: wire}
+		if _, _, err := database.BuildVectorDatabase(metadata, clusters, nil, params, 5); err == nil {
+			t.Errorf("%s: expected an error for a budget below the largest cluster", wire)
+		}
+	}
+}
+
+func TestAnswerRaw(t *testing.T) {
+	ts := newTestSession(t, database.DatabaseParams{HintSz: 900})
+	s := ts.s
+	clusterIndex := uint64(1)
+	query := ts.query(t, ts.clusters[clusterIndex].Vectors[:ts.metadata.Dim], clusterIndex)
+	encoded, err := utils.EncodeMessage(*query, utils.BinaryWire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := s.AnswerRaw(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ans pir.Answer[matrix.Elem64]
+	if err := utils.DecodeMessage(raw, utils.BinaryWire, &ans); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := s.Answer(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ans, *expected) {
+		t.Errorf("Expected the answer of Answer, but got a different one")
+	}
+
+	// a query for a database of another shape is rejected
+	short := matrix.Zeros[matrix.Elem64](query.Query.Rows()-1, 1)
+	wrong, _ := utils.EncodeMessage(pir.Query[matrix.Elem64]{Query: short}, utils.BinaryWire)
+	if _, err := s.AnswerRaw(wrong); err == nil {
+		t.Errorf("Expected an error for a query of %d rows", short.Rows())
+	}
+	if _, err := s.AnswerRaw(encoded[:len(encoded)-1]); err == nil {
+		t.Errorf("Expected an error for a truncated query")
+	}
+	s.Close()
+	if _, err := s.AnswerRaw(encoded); err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed after Close, but got %v", err)
+	}
+}
+
+func TestMergeDatabases(t *testing.T) {
+	dim := uint64(4)
+	sizes := [][]int{{30, 12, 7}, {25}, {4, 40}}
+	params := database.DatabaseParams{HintSz: 1}
+
+	// build each partition on its own, and all clusters at once
+	dbs := make([]*pir.Database[matrix.Elem64], len(sizes))
+	maps := make([]database.ClusterMap, len(sizes))
+	metas := make([]database.Metadata, len(sizes))
+	union := make([][]float64, 0)
+	for p, partition := range sizes {
+		var floats [][]float64
+		metas[p], floats = database.SyntheticFloats(dim, partition, p*13)
+		var err error
+		dbs[p], maps[p], err = database.BuildVectorDatabaseFromFloats(metas[p], floats, 5, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		union = append(union, floats...)
+	}
+	merged, mergedMap, mergedMeta, err := database.MergeDatabases(dbs, maps, metas)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unionMeta := database.Metadata{NumVectors: mergedMeta.NumVectors, Dim: dim, NumClusters: uint64(len(union))}
+	if !reflect.DeepEqual(mergedMeta, unionMeta) {
+		t.Fatalf("Expected merged metadata %+v, but got %+v", unionMeta, mergedMeta)
+	}
+
+	mergedServer := new(Server)
+	mergedServer.ProcessDatabase(mergedMeta, merged, mergedMap)
+	defer mergedServer.Close()
+	unionClusters, err := database.ClustersFromFloats(unionMeta, union, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	monolithic := new(Server)
+	monolithic.ProcessVectorsFromClusters(unionMeta, unionClusters, params, 5)
+	defer monolithic.Close()
+
+	mergedClient := new(Client)
+	mergedClient.Setup(mergedServer.Hint)
+	defer mergedClient.Free()
+	monolithicClient := new(Client)
+	monolithicClient.Setup(monolithic.Hint)
+	defer monolithicClient.Free()
+
+	emb := []int8{2, -1, 0, 3}
+	for cluster := uint64(0); cluster < unionMeta.NumClusters; cluster++ {
+		expected := roundForTest(t, monolithicClient, monolithic, emb, cluster, true)
+		got := roundForTest(t, mergedClient, mergedServer, emb, cluster, true)
+
+		// the last cluster of a column is followed by padding rows, which depend
+		// on the layout and are scored 0
+		size := uint64(len(union[cluster])) / dim
+		scores := make(map[uint64]int)
+		for _, sc := range *expected {
+			if sc.IDWithinCluster < size {
+				scores[sc.IDWithinCluster] = sc.Score
+			}
+		}
+		found := 0
+		for _, sc := range *got {
+			if sc.IDWithinCluster >= size {
+				if sc.Score != 0 {
+					t.Errorf("Cluster %d: padding row scored %+v", cluster, sc)
+				}
+				continue
+			}
+			found++
+			if sc.ClusterID != uint(cluster) || scores[sc.IDWithinCluster] != sc.Score {
+				t.Errorf("Cluster %d: merged database scored %+v, expected %d", cluster, sc, scores[sc.IDWithinCluster])
+			}
+		}
+		if uint64(found) != size || uint64(len(scores)) != size {
+			t.Errorf("Cluster %d: expected %d scores, but got %d and %d", cluster, size, found, len(scores))
+		}
+	}
+
+	// the inputs must agree on the dimension
+	metas[1].Dim = 8
+	if _, _, _, err := database.MergeDatabases(dbs, maps, metas); err == nil {
+		t.Errorf("Expected an error merging databases of different dimensions")
+	}
+	metas[1].Dim = dim
+
+	// and cannot have been squished
+	otherClusters, err := database.ClustersFromFloats(metas[0], [][]float64{make([]float64, 30*4), make([]float64, 12*4), make([]float64, 7*4)}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, otherMap, err := database.BuildVectorDatabase(metas[0], otherClusters, prgrand.RandomPRGKey(), params, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Squish()
+	if _, _, _, err := database.MergeDatabases(append(dbs, other), append(maps, otherMap), append(metas, metas[0])); err == nil {
+		t.Errorf("Expected an error merging a squished database")
+	}
+}
+
+func TestSeedReproducesHint(t *testing.T) {
+	preamble := utils.GenerateTestData()
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.RemoveTestData()
+	params := database.DatabaseParams{HintSz: 900}
+
+	seed := prgrand.RandomPRGKey()
+	first := new(Server)
+	first.ProcessVectorsFromClustersWithSeed(metadata, clusters, params, 5, seed)
+	defer first.Close()
+	if got := first.Seed(); got != *seed {
+		t.Fatalf("Expected seed %x, but got %x", *seed, got)
+	}
+
+	// the recorded seed rebuilds the same hint
+	recorded := first.Seed()
+	second := new(Server)
+	second.ProcessVectorsFromClustersWithSeed(metadata, clusters, params, 5, &recorded)
+	defer second.Close()
+	if !reflect.DeepEqual(first.Hint.PIRHint, second.Hint.PIRHint) {
+		t.Errorf("Expected identical hints from the same seed")
+	}
+	if !bytes.Equal(first.Hint.IndexMap.MarshalDeterministic(), second.Hint.IndexMap.MarshalDeterministic()) {
+		t.Errorf("Expected identical index maps from the same seed")
+	}
+
+	// a random seed is recorded as well
+	third := new(Server)
+	third.ProcessVectorsFromClusters(metadata, clusters, params, 5)
+	defer third.Close()
+	if third.Seed() == *seed {
+		t.Errorf("Expected a fresh random seed")
+	}
+}
+
+func TestClusterAccessCounts(t *testing.T) {
+	s := new(Server)
+	s.RecordClusterAccess(3)
+	if counts := s.ClusterAccessCounts(); counts != nil {
+		t.Errorf("Expected no counts without tracking, but got %v", counts)
+	}
+
+	s.TrackClusterAccess()
+	for _, cluster := range []uint64{3, 1, 3, 7, 1, 3} {
+		s.RecordClusterAccess(cluster)
+	}
+	counts := s.ClusterAccessCounts()
+	expected := map[uint64]uint64{3: 3, 1: 2, 7: 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Expected counts %v, but got %v", expected, counts)
+	}
+	if hottest := HottestClusters(counts); !reflect.DeepEqual(hottest, []uint64{3, 1, 7}) {
+		t.Errorf("Expected clusters 3, 1, 7 by decreasing count, but got %v", hottest)
+	}
+
+	// the counts are a copy
+	counts[3] = 0
+	if s.ClusterAccessCounts()[3] != 3 {
+		t.Errorf("Modifying the returned counts changed the server's")
+	}
+}
@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"context"
+
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+// StreamWithinBin is a streaming variant of MatchWithinBin, for interactive
+// search: it sends every vector of the bin that meets minScore on the returned
+// channel as soon as its row is scored, in the order of the rows, and closes it
+// after the last row, after k vectors, or as soon as ctx is done, e.g., once
+// the consumer has seen enough. The first results do not wait for the rest of
+// the bin to be scored, but they are not sorted: a consumer that wants the top
+// k keeps the best ones seen so far. Once drained, with k large enough, the
+// stream holds the results of MatchWithinBin, in another order.
+//
+// The answer is decrypted before StreamWithinBin returns, so the client can
+// make its next query right away, and the rows are scored by a goroutine that
+// blocks until each vector is received. The consumer must thus either drain
+// the stream or cancel ctx, which stops the goroutine at its next send.
+func (c *Client) StreamWithinBin(ctx context.Context, answer *pir.Answer[matrix.Elem64], clusterIndex uint64, mod uint64, k int, minScore int) <-chan VectorScore {
+	vals := c.UnderhoodClient.RecoverLHE(answer)
+	out := make(chan VectorScore)
+	go func() {
+		defer close(out)
+		sent := 0
+		c.scoreRows(vals, clusterIndex, mod, func(sc VectorScore) bool {
+			if sent >= k || ctx.Err() != nil {
+				return false
+			}
+			if !c.Order.Meets(sc.Score, minScore) {
+				return true
+			}
+			select {
+			case out <- sc:
+				sent++
+				return sent < k
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return out
+}
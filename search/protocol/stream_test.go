@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+)
+
+func TestStreamWithinBin(t *testing.T) {
+	ts := newTestSession(t, database.DatabaseParams{HintSz: 900})
+	c, metadata := ts.c, ts.metadata
+
+	emb := make([]int8, metadata.Dim)
+	for i := range emb {
+		emb[i] = int8(i%5) - 2
+	}
+	cluster := uint64(2)
+	ans := ts.answer(t, emb, cluster)
+	full := *c.ReconstructWithinBin(ans, cluster, c.DBInfo.P())
+	// the vectors of the bin in the order of the rows
+	rows := c.scoreWithinBin(c.UnderhoodClient.RecoverLHE(ans), cluster, c.DBInfo.P())
+
+	// drained, the stream holds the whole bin, in the order of the rows
+	streamed := make([]VectorScore, 0)
+	for sc := range c.StreamWithinBin(context.Background(), ans, cluster, c.DBInfo.P(), len(full), math.MinInt) {
+		streamed = append(streamed, sc)
+	}
+	if !reflect.DeepEqual(streamed, rows) || len(streamed) != len(full) {
+		t.Errorf("Expected the %d vectors of the bin in the order of the rows, but got %d", len(full), len(streamed))
+	}
+
+	// the stream stops after k results
+	k := 10
+	streamed = streamed[:0]
+	for sc := range c.StreamWithinBin(context.Background(), ans, cluster, c.DBInfo.P(), k, math.MinInt) {
+		streamed = append(streamed, sc)
+	}
+	if !reflect.DeepEqual(streamed, rows[:k]) {
+		t.Errorf("Expected the first %d rows %+v, but got %+v", k, rows[:k], streamed)
+	}
+
+	// the stream skips the vectors below the threshold
+	minScore := full[3].Score
+	expected := len(*FilterScores(&full, minScore, c.Order))
+	got := 0
+	for sc := range c.StreamWithinBin(context.Background(), ans, cluster, c.DBInfo.P(), len(full), minScore) {
+		if sc.Score < minScore {
+			t.Errorf("Streamed %+v below the threshold %d", sc, minScore)
+		}
+		got++
+	}
+	if got != expected {
+		t.Errorf("Expected %d results meeting %d, but got %d", expected, minScore, got)
+	}
+
+	// cancelling closes the stream without draining it, so that a consumer that
+	// stops reading does not leave the goroutine blocked
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := c.StreamWithinBin(ctx, ans, cluster, c.DBInfo.P(), len(full), math.MinInt)
+	if first, ok := <-stream; !ok || first != rows[0] {
+		t.Errorf("Expected the first row first, but got %+v", first)
+	}
+	cancel()
+	rest := 0
+	for range stream {
+		rest++
+	}
+	// the result being sent when ctx is cancelled may still arrive
+	if rest > 1 {
+		t.Errorf("Expected the stream to stop after cancellation, but got %d more results", rest)
+	}
+}
@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+)
+
+// TwoStageClient searches a coarse database, built with few bits per value, for
+// candidates, and reranks them with their vectors from a fine database of the
+// same clusters, built with more bits. The coarse stage is a single round over
+// the cluster, but fetching the candidates with FetchVectors takes a round of
+// the fine database per dimension, Metadata.Dim in all, whatever the number of
+// candidates: a search takes 1 + Metadata.Dim rounds. It pays off when a fine
+// database is too large to search, not to save rounds.
+type TwoStageClient struct {
+	Coarse *Client
+	Fine   *Client
+
+	// the raw queries are quantized with these bits for each stage
+	CoarsePrecBits uint64
+	FinePrecBits   uint64
+
+	// Candidates is the number of coarse results reranked
+	Candidates int
+}
+
+// NewTwoStageClient sets up clients for the hints of two databases, which must
+// hold the same clusters, of the same sizes
+func NewTwoStageClient(coarse *TiptoeHint, fine *TiptoeHint, coarsePrecBits uint64, finePrecBits uint64, candidates int) (*TwoStageClient, error) {
+	if candidates <= 0 {
+		return nil, fmt.Errorf("the number of candidates must be positive, got %d", candidates)
+	}
+	if coarse.Metadata.NumClusters != fine.Metadata.NumClusters || coarse.Metadata.Dim != fine.Metadata.Dim {
+		return nil, fmt.Errorf("the coarse database has %d %d-dim clusters, but the fine one %d %d-dim clusters",
+			coarse.Metadata.NumClusters, coarse.Metadata.Dim, fine.Metadata.NumClusters, fine.Metadata.Dim)
+	}
+	for i := range coarse.ClusterSizes {
+		if i >= len(fine.ClusterSizes) || coarse.ClusterSizes[i] != fine.ClusterSizes[i] {
+			return nil, fmt.Errorf("cluster %d does not have the same vectors in the coarse and fine databases", i)
+		}
+	}
+
+	t := &TwoStageClient{
+		Coarse:         new(Client),
+		Fine:           new(Client),
+		CoarsePrecBits: coarsePrecBits,
+		FinePrecBits:   finePrecBits,
+		Candidates:     candidates,
+	}
+	t.Coarse.Setup(coarse)
+	t.Fine.Setup(fine)
+	return t, nil
+}
+
+// Search returns the top k vectors of a cluster for a raw query: the
+// Candidates best by the coarse database, ranked by their scores against the
+// fine vectors. It takes one round on the coarse database, and Metadata.Dim on
+// the fine one, 1 + Metadata.Dim in all. Vectors of equal fine scores keep their coarse order.
+func (t *TwoStageClient) Search(coarse Responder, fine Responder, raw []float64, clusterIndex uint64, k int) (*[]VectorScore, error) {
+	coarseEmb, err := t.Coarse.PrepareQuery(raw, t.CoarsePrecBits)
+	if err != nil {
+		return nil, err
+	}
+	fineEmb, err := t.Fine.PrepareQuery(raw, t.FinePrecBits)
+	if err != nil {
+		return nil, err
+	}
+
+	offlineAns, err := coarse.HintAnswer(t.Coarse.PreprocessQuery())
+	if err != nil {
+		return nil, fmt.Errorf("error answering coarse hint query: %w", err)
+	}
+	t.Coarse.ProcessHintApply(offlineAns)
+	ans, err := coarse.Answer(t.Coarse.QueryEmbeddings(coarseEmb, clusterIndex))
+	if err != nil {
+		return nil, fmt.Errorf("error answering coarse query: %w", err)
+	}
+	candidates := *t.Coarse.ReconstructWithinCluster(ans, clusterIndex, t.Coarse.DBInfo.P())
+	if len(candidates) > t.Candidates {
+		candidates = candidates[:t.Candidates]
+	}
+	if len(candidates) == 0 {
+		return &candidates, nil
+	}
+
+	ids := make([]uint64, len(candidates))
+	for i, c := range candidates {
+		ids[i] = c.IDWithinCluster
+	}
+	vectors, err := t.Fine.FetchVectors(fine, clusterIndex, ids)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]VectorScore, len(candidates))
+	for i, v := range vectors {
+		score := 0
+		for j := range v {
+			score += int(v[j]) * int(fineEmb[j])
+		}
+		res[i] = VectorScore{ClusterID: uint(clusterIndex), IDWithinCluster: ids[i], Score: score}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return t.Fine.Order.Before(res[i].Score, res[j].Score)
+	})
+	if len(res) > k {
+		res = res[:k]
+	}
+	return &res, nil
+}
+
+func (t *TwoStageClient) Free() {
+	t.Coarse.Free()
+	t.Fine.Free()
+}
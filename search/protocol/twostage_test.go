@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"math"
+	"testing"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+)
+
+func TestTwoStageClient(t *testing.T) {
+	dim := uint64(8)
+	sizes := []int{80, 60}
+	floats := make([][]float64, len(sizes))
+	numVectors := 0
+	for i, sz := range sizes {
+		for j := 0; j < sz*int(dim); j++ {
+			floats[i] = append(floats[i], math.Sin(float64(i*31+j*17))/2)
+		}
+		numVectors += sz
+	}
+	metadata := database.Metadata{NumVectors: uint64(numVectors), Dim: dim, NumClusters: uint64(len(sizes))}
+	coarseBits, fineBits := uint64(2), uint64(6)
+	coarseClusters, err := database.ClustersFromFloats(metadata, floats, coarseBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fineClusters, err := database.ClustersFromFloats(metadata, floats, fineBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coarse := new(Server)
+	coarse.ProcessVectorsFromClusters(metadata, coarseClusters, database.DatabaseParams{}, coarseBits)
+	defer coarse.Close()
+	fine := new(Server)
+	fine.ProcessVectorsFromClusters(metadata, fineClusters, database.DatabaseParams{}, fineBits)
+	defer fine.Close()
+
+	k, candidates := 5, 20
+	c, err := NewTwoStageClient(coarse.Hint, fine.Hint, coarseBits, fineBits, candidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Free()
+
+	plain := NewPlaintextServer(metadata, fineClusters, database.DatabaseParams{})
+	var singleRecall, twoStageRecall float64
+	queries := [][]float64{
+		{0.4, -0.1, 0.3, 0.2, -0.4, 0.1, 0.05, -0.3},
+		{-0.2, 0.35, -0.15, 0.45, 0.1, -0.25, 0.3, 0.2},
+	}
+	for i, raw := range queries {
+		cluster := uint64(i % len(sizes))
+		fineEmb, err := c.Fine.PrepareQuery(raw, fineBits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exact := plain.SearchCluster(fineEmb, cluster)
+		fineScores := make(map[uint64]int)
+		for _, sc := range *exact {
+			fineScores[sc.IDWithinCluster] = sc.Score
+		}
+
+		res, err := c.Search(coarse, fine, raw, cluster, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*res) != k {
+			t.Fatalf("Expected %d results, but got %d", k, len(*res))
+		}
+		for j, sc := range *res {
+			if sc.Score != fineScores[sc.IDWithinCluster] {
+				t.Errorf("Expected vector %d to have its fine score %d, but got %d", sc.IDWithinCluster, fineScores[sc.IDWithinCluster], sc.Score)
+			}
+			if j > 0 && sc.Score > (*res)[j-1].Score {
+				t.Errorf("Expected the results to be sorted, but got %v", *res)
+			}
+		}
+		twoStageRecall += RecallAtK(res, exact, k)
+
+		// single-stage: the coarse top k, compared by their fine scores
+		coarseEmb, err := c.Coarse.PrepareQuery(raw, coarseBits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		single := *NewPlaintextServer(metadata, coarseClusters, database.DatabaseParams{}).SearchCluster(coarseEmb, cluster)
+		single = single[:k]
+		for j := range single {
+			single[j].Score = fineScores[single[j].IDWithinCluster]
+		}
+		singleRecall += RecallAtK(&single, exact, k)
+	}
+	singleRecall /= float64(len(queries))
+	twoStageRecall /= float64(len(queries))
+	// reranking 20 candidates finds all of the exact top 5, against 70% for the
+	// coarse database alone
+	if twoStageRecall < 0.9 || twoStageRecall <= singleRecall {
+		t.Errorf("Expected reranking %d candidates with %d bits to reach a recall@%d of 0.9, above the %.2f of %d bits alone, but got %.2f", candidates, fineBits, k, singleRecall, coarseBits, twoStageRecall)
+	}
+
+	// the databases must hold the same clusters
+	if _, err := NewTwoStageClient(coarse.Hint, coarse.Hint, coarseBits, fineBits, 0); err == nil {
+		t.Errorf("Expected an error for no candidates")
+	}
+	other := new(Server)
+	other.ProcessVectorsFromClusters(database.Metadata{NumVectors: 80, Dim: dim, NumClusters: 1}, fineClusters[:1], database.DatabaseParams{}, fineBits)
+	defer other.Close()
+	if _, err := NewTwoStageClient(coarse.Hint, other.Hint, coarseBits, fineBits, candidates); err == nil {
+		t.Errorf("Expected an error for databases of different clusters")
+	}
+}
@@ -0,0 +1,217 @@
+// Package search runs private nearest neighbor queries end to end, for programs
+// that embed the search instead of running the command line tool: a Session
+// reads the clusters, builds the server and sets up a client with its hint, and
+// Query runs a round of the protocol and reconstructs the top-k.
+package search
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+	"github.com/DeweiFeng/6.5610-project/search/protocol"
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+	"github.com/ahenzinger/underhood/underhood"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+// QueryPerf is the cost of a query: the time of every step, on either side, and
+// the size of every message
+type QueryPerf struct {
+	ClientHintQueryTime       time.Duration
+	ServerHintAnswerTime      time.Duration
+	ClientHintApplyTime       time.Duration
+	ClientQueryProcessingTime time.Duration
+	ServerComputeTime         time.Duration
+	ClientReconTime           time.Duration
+	HintQuerySize             uint64
+	HintAnsSize               uint64
+	QuerySize                 uint64
+	AnsSize                   uint64
+	// NumCandidates is the number of candidates scored by reconstruction,
+	// before the top-k cut off
+	NumCandidates uint64
+	// Retries is the number of retries of the calls to the server with a
+	// RetryPolicy, and RetryWaitTime the time spent in their failed attempts and
+	// backoff, which the server times leave out
+	Retries       int
+	RetryWaitTime time.Duration
+}
+
+// Round runs the server side of a query: the hint round, unless the client has
+// the query cached, and the query itself, timing every step. The calls to the
+// server are retried with retry, if not nil. Reconstructing the scores from the
+// answer is left to the caller, e.g., ReconstructWithinBin.
+func Round(c *protocol.Client, s *protocol.Server, query []int8, clusterIndex uint64, retry *protocol.RetryPolicy) (*pir.Answer[matrix.Elem64], *QueryPerf, error) {
+	return RoundContext(context.Background(), c, s, query, clusterIndex, retry)
+}
+
+// RoundContext is Round, returning ctx.Err() once ctx is done: before every
+// step, and in the middle of a call to the server, which is abandoned. The
+// server cannot interrupt the products of an abandoned call, which finish in
+// the background and hold off Server.Close until they do.
+func RoundContext(ctx context.Context, c *protocol.Client, s *protocol.Server, query []int8, clusterIndex uint64, retry *protocol.RetryPolicy) (ans *pir.Answer[matrix.Elem64], perf *QueryPerf, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if err := c.ValidateCluster(clusterIndex); err != nil {
+		return nil, nil, err
+	}
+	// without retries, a single attempt, which still stops at ctx
+	policy := protocol.RetryPolicy{}
+	if retry != nil {
+		policy = *retry
+	}
+	perf = new(QueryPerf)
+	var hintStats protocol.CallStats
+
+	// a cached query skips the hint round and the encoding, leaving their costs at 0
+	queryEmb := c.CachedQuery(query, clusterIndex)
+	if queryEmb == nil {
+		clientHintQuery := time.Now()
+		ct := c.PreprocessQuery()
+		perf.ClientHintQueryTime = time.Since(clientHintQuery)
+		perf.HintQuerySize = utils.MessageSizeBytes(*ct)
+
+		serverHintAnswerStart := time.Now()
+		var offlineAns *underhood.HintAnswer
+		offlineAns, hintStats, err = policy.HintAnswerContext(ctx, s, ct)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			return nil, nil, fmt.Errorf("error answering hint query: %w", err)
+		}
+		perf.ServerHintAnswerTime = time.Since(serverHintAnswerStart) - hintStats.Waited
+		perf.HintAnsSize = utils.MessageSizeBytes(*offlineAns)
+
+		clientHintApplyStart := time.Now()
+		c.ProcessHintApply(offlineAns)
+		perf.ClientHintApplyTime = time.Since(clientHintApplyStart)
+
+		clientQueryProcessingStart := time.Now()
+		queryEmb = c.QueryEmbeddings(query, clusterIndex)
+		perf.ClientQueryProcessingTime = time.Since(clientQueryProcessingStart)
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	perf.QuerySize = utils.MessageSizeBytes(*queryEmb)
+
+	serverComputeStart := time.Now()
+	var answerStats protocol.CallStats
+	ans, answerStats, err = policy.AnswerContext(ctx, s, queryEmb)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, fmt.Errorf("error answering query: %w", err)
+	}
+	perf.ServerComputeTime = time.Since(serverComputeStart) - answerStats.Waited
+	perf.AnsSize = utils.MessageSizeBytes(*ans)
+	// the server cannot see the cluster of a query, but this process plays both parties
+	s.RecordClusterAccess(clusterIndex)
+
+	for _, stats := range []protocol.CallStats{hintStats, answerStats} {
+		if stats.Attempts > 1 {
+			perf.Retries += stats.Attempts - 1
+		}
+		perf.RetryWaitTime += stats.Waited
+	}
+	return ans, perf, nil
+}
+
+// Session is a server and a client set up with its hint, in the same process
+type Session struct {
+	Metadata database.Metadata
+	Server   *protocol.Server
+	Client   *protocol.Client
+	// Retry, if not nil, retries the calls to the server
+	Retry *protocol.RetryPolicy
+}
+
+// NewSession reads the clusters of a preamble, as the command line tool does,
+// and builds a session serving them
+func NewSession(preamble string, precBits uint64, params database.DatabaseParams) (*Session, error) {
+	metadata, clusters, err := database.ReadAllClusters(preamble, precBits)
+	if err != nil {
+		return nil, err
+	}
+	return NewSessionFromClusters(metadata, clusters, params, precBits)
+}
+
+// NewSessionFromClusters builds a session serving clusters already read
+func NewSessionFromClusters(metadata database.Metadata, clusters []*database.Cluster, params database.DatabaseParams, precBits uint64) (*Session, error) {
+	s := new(protocol.Server)
+	if err := s.Build(metadata, clusters, params, precBits, nil); err != nil {
+		return nil, err
+	}
+	c := new(protocol.Client)
+	c.Setup(s.Hint)
+	return &Session{Metadata: metadata, Server: s, Client: c}, nil
+}
+
+// Close frees the client and the server
+func (s *Session) Close() {
+	s.Client.Free()
+	s.Server.Close()
+}
+
+// Query runs a query to a cluster and returns its top k results, among the
+// vectors of the cluster if clusterOnly, else of its whole bin, as the command
+// line tool does by default. The query must be quantized, e.g., by
+// Client.PrepareQuery, and k at least 1. A Session runs one query at a time.
+func (s *Session) Query(query []int8, clusterIndex uint64, k int, clusterOnly bool) ([]protocol.VectorScore, QueryPerf, error) {
+	return s.QueryContext(context.Background(), query, clusterIndex, k, clusterOnly)
+}
+
+// QueryContext is Query, returning ctx.Err() once ctx is done, between the hint
+// round, the answer and the reconstruction, or during a call to the server, as
+// RoundContext does. Cancelling does not stop the server: a call to it that is
+// in progress is abandoned, and keeps running in a goroutine of its own until
+// its products are done, using the server's cores meanwhile; Close waits for it.
+func (s *Session) QueryContext(ctx context.Context, query []int8, clusterIndex uint64, k int, clusterOnly bool) ([]protocol.VectorScore, QueryPerf, error) {
+	if k < 1 {
+		return nil, QueryPerf{}, fmt.Errorf("k must be at least 1, got %d", k)
+	}
+	if err := s.Client.ValidateCluster(clusterIndex); err != nil {
+		return nil, QueryPerf{}, err
+	}
+	ans, perf, err := RoundContext(ctx, s.Client, s.Server, query, clusterIndex, s.Retry)
+	if err != nil {
+		return nil, QueryPerf{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, QueryPerf{}, err
+	}
+	recon, err := Reconstruct(s.Client, ans, clusterIndex, clusterOnly, perf)
+	if err != nil {
+		return nil, QueryPerf{}, err
+	}
+	if k < len(*recon) {
+		*recon = (*recon)[:k]
+	}
+	return *recon, *perf, nil
+}
+
+// Reconstruct recovers the ranked scores of the vectors of a cluster, or of its
+// bin, from the answer to a query, and records the time it takes in perf
+func Reconstruct(c *protocol.Client, ans *pir.Answer[matrix.Elem64], clusterIndex uint64, clusterOnly bool, perf *QueryPerf) (recon *[]protocol.VectorScore, err error) {
+	if err := c.ValidateCluster(clusterIndex); err != nil {
+		return nil, err
+	}
+
+	scored := c.Scored()
+	start := time.Now()
+	if clusterOnly {
+		recon = c.ReconstructWithinCluster(ans, clusterIndex, c.DBInfo.P())
+	} else {
+		recon = c.ReconstructWithinBin(ans, clusterIndex, c.DBInfo.P())
+	}
+	perf.ClientReconTime = time.Since(start)
+	perf.NumCandidates = c.Scored() - scored
+	return recon, nil
+}
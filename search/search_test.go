@@ -0,0 +1,107 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DeweiFeng/6.5610-project/search/database"
+	"github.com/DeweiFeng/6.5610-project/search/protocol"
+	"github.com/DeweiFeng/6.5610-project/search/utils"
+)
+
+func TestSession(t *testing.T) {
+	preamble := utils.GenerateTestData()
+	defer utils.RemoveTestData()
+	metadata, clusters, err := database.ReadAllClusters(preamble, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := database.DatabaseParams{HintSz: 900}
+	plain := protocol.NewPlaintextServer(metadata, clusters, params)
+
+	s, err := NewSession(preamble, 5, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	emb := make([]int8, metadata.Dim)
+	for j := range emb {
+		emb[j] = int8(j%5) - 2
+	}
+	k := 5
+	for _, clusterOnly := range []bool{true, false} {
+		got, perf, err := s.Query(emb, 1, k, clusterOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := plain.SearchCluster(emb, 1)
+		if !clusterOnly {
+			expected = plain.SearchBin(emb, 1)
+		}
+		if len(got) != k {
+			t.Fatalf("Expected %d results, but got %d", k, len(got))
+		}
+		for i := range got {
+			if got[i].Score != (*expected)[i].Score {
+				t.Errorf("clusterOnly=%v, result %d: expected score %d, but got %d", clusterOnly, i, (*expected)[i].Score, got[i].Score)
+			}
+		}
+		if perf.HintAnsSize == 0 || perf.AnsSize == 0 || perf.NumCandidates < uint64(k) {
+			t.Errorf("Expected the sizes and the candidates of the query in its cost, but got %+v", perf)
+		}
+	}
+
+	if _, _, err := s.Query(emb, metadata.NumClusters, k, true); !errors.Is(err, protocol.ErrUnknownCluster) {
+		t.Errorf("Expected ErrUnknownCluster, but got %v", err)
+	}
+	for _, bad := range []int{0, -1} {
+		if got, _, err := s.Query(emb, 1, bad, true); err == nil {
+			t.Errorf("Expected an error for k=%d, but got %d results", bad, len(got))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := s.QueryContext(ctx, emb, 2, k, true); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a canceled query to return context.Canceled, but got %v", err)
+	}
+	// canceled in the middle of the hint round, or of the answer: the first wait
+	// of a call for the server is its second call to Done
+	for _, n := range []int{2, 4} {
+		ctx, cancel := context.WithCancel(context.Background())
+		during := &cancelOnDone{Context: ctx, cancel: cancel, n: n}
+		if _, _, err := s.QueryContext(during, emb, 2, k, true); !errors.Is(err, context.Canceled) || during.calls < n {
+			t.Errorf("Expected a query canceled at call %d to Done to return context.Canceled, but got %v after %d calls", n, err, during.calls)
+		}
+		cancel()
+	}
+	// the session still answers after a canceled query
+	if got, _, err := s.QueryContext(context.Background(), emb, 2, k, true); err != nil || len(got) != k {
+		t.Errorf("Expected %d results after a canceled query, but got %d and %v", k, len(got), err)
+	}
+
+	// P = 2^15 cannot hold 16-bit values
+	var paramsErr *database.ParamsError
+	if _, err := NewSessionFromClusters(metadata, clusters, params, 16); !errors.As(err, &paramsErr) {
+		t.Errorf("Expected a ParamsError, but got %v", err)
+	}
+}
+
+// cancelOnDone is a context canceled by the n-th call to its Done, so that a
+// round is canceled at a known point of it
+type cancelOnDone struct {
+	context.Context
+	cancel context.CancelFunc
+	n      int
+	calls  int
+}
+
+func (c *cancelOnDone) Done() <-chan struct{} {
+	c.calls++
+	if c.calls == c.n {
+		c.cancel()
+	}
+	return c.Context.Done()
+}
@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"math"
+	"sort"
+)
+
+// CalibrationReport summarizes how well the scores computed on quantized vectors
+// agree with the exact dot products of the original float vectors
+type CalibrationReport struct {
+	PrecBits   uint64
+	NumQueries int
+	NumVectors int
+
+	// mean over queries of the Spearman rank correlation between quantized and
+	// exact scores, a proxy for the recall of the quantized search
+	Spearman float64
+	// mean over queries of the Pearson correlation between quantized and exact scores
+	Pearson float64
+	// mean absolute difference between the dequantized and exact scores
+	MeanAbsError float64
+}
+
+func Dequantize(val int8, precBits uint64) float64 {
+	scale := 1 << (precBits - 1)
+	return float64(val) / float64(scale)
+}
+
+// EstimateQuantizationLoss scores every query against every vector, both exactly
+// and after quantizing both sides with QuantizeClamp, and reports how much the
+// quantization perturbs the scores. Queries for which either set of scores is
+// constant are left out of the correlations.
+func EstimateQuantizationLoss(vectors [][]float64, queries [][]float64, precBits uint64) CalibrationReport {
+	report := CalibrationReport{
+		PrecBits:   precBits,
+		NumQueries: len(queries),
+		NumVectors: len(vectors),
+	}
+	if len(vectors) == 0 || len(queries) == 0 {
+		report.Spearman = math.NaN()
+		report.Pearson = math.NaN()
+		report.MeanAbsError = math.NaN()
+		return report
+	}
+
+	quantizedVectors := make([][]float64, len(vectors))
+	for i, v := range vectors {
+		quantizedVectors[i] = quantizeDequantize(v, precBits)
+	}
+
+	exact := make([]float64, len(vectors))
+	quantized := make([]float64, len(vectors))
+	correlated := 0
+	absError := 0.0
+	for _, q := range queries {
+		quantizedQuery := quantizeDequantize(q, precBits)
+		for i, v := range vectors {
+			if len(v) != len(q) {
+				panic("Error: query and vector dimensions do not match")
+			}
+			exact[i] = dot(q, v)
+			quantized[i] = dot(quantizedQuery, quantizedVectors[i])
+			absError += math.Abs(exact[i] - quantized[i])
+		}
+
+		pearson := PearsonCorrelation(exact, quantized)
+		spearman := SpearmanCorrelation(exact, quantized)
+		if math.IsNaN(pearson) || math.IsNaN(spearman) {
+			continue
+		}
+		report.Pearson += pearson
+		report.Spearman += spearman
+		correlated++
+	}
+
+	report.MeanAbsError = absError / float64(len(queries)*len(vectors))
+	if correlated == 0 {
+		report.Spearman = math.NaN()
+		report.Pearson = math.NaN()
+	} else {
+		report.Spearman /= float64(correlated)
+		report.Pearson /= float64(correlated)
+	}
+
+	return report
+}
+
+func quantizeDequantize(v []float64, precBits uint64) []float64 {
+	res := make([]float64, len(v))
+	for i, x := range v {
+		res[i] = Dequantize(QuantizeClamp(x, precBits), precBits)
+	}
+	return res
+}
+
+func dot(a []float64, b []float64) float64 {
+	res := 0.0
+	for i := range a {
+		res += a[i] * b[i]
+	}
+	return res
+}
+
+// PearsonCorrelation returns the Pearson correlation of x and y, or NaN if
+// either is constant
+func PearsonCorrelation(x []float64, y []float64) float64 {
+	if len(x) != len(y) {
+		panic("Error: cannot correlate samples of different lengths")
+	}
+	n := float64(len(x))
+	meanX, meanY := 0.0, 0.0
+	for i := range x {
+		meanX += x[i]
+		meanY += y[i]
+	}
+	meanX /= n
+	meanY /= n
+
+	cov, varX, varY := 0.0, 0.0, 0.0
+	for i := range x {
+		dx := x[i] - meanX
+		dy := y[i] - meanY
+		cov += dx * dy
+		varX += dx * dx
+		varY += dy * dy
+	}
+	if varX == 0 || varY == 0 {
+		return math.NaN()
+	}
+	return cov / math.Sqrt(varX*varY)
+}
+
+// SpearmanCorrelation returns the Spearman rank correlation of x and y, giving
+// tied values their average rank
+func SpearmanCorrelation(x []float64, y []float64) float64 {
+	return PearsonCorrelation(ranks(x), ranks(y))
+}
+
+func ranks(vals []float64) []float64 {
+	order := make([]int, len(vals))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return vals[order[i]] < vals[order[j]] })
+
+	res := make([]float64, len(vals))
+	for start := 0; start < len(order); {
+		end := start + 1
+		for end < len(order) && vals[order[end]] == vals[order[start]] {
+			end++
+		}
+		// ranks start..end-1 are tied, all get their average
+		rank := float64(start+end-1)/2 + 1
+		for i := start; i < end; i++ {
+			res[order[i]] = rank
+		}
+		start = end
+	}
+	return res
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func randomUnitVectors(r *rand.Rand, n int, dim int) [][]float64 {
+	res := make([][]float64, n)
+	for i := range res {
+		res[i] = make([]float64, dim)
+		norm := 0.0
+		for j := range res[i] {
+			res[i][j] = r.NormFloat64()
+			norm += res[i][j] * res[i][j]
+		}
+		for j := range res[i] {
+			res[i][j] /= math.Sqrt(norm)
+		}
+	}
+	return res
+}
+
+func TestEstimateQuantizationLoss(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	vectors := randomUnitVectors(r, 200, 32)
+	queries := randomUnitVectors(r, 20, 32)
+
+	coarse := EstimateQuantizationLoss(vectors, queries, 3)
+	fine := EstimateQuantizationLoss(vectors, queries, 8)
+
+	if coarse.NumQueries != 20 || coarse.NumVectors != 200 || coarse.PrecBits != 3 {
+		t.Errorf("Report does not describe its inputs: %+v", coarse)
+	}
+	if fine.Spearman < 0.95 {
+		t.Errorf("Spearman correlation with 8 bits is %f, expected at least 0.95", fine.Spearman)
+	}
+	if fine.Spearman <= coarse.Spearman || fine.Pearson <= coarse.Pearson {
+		t.Errorf("More precision bits did not improve the correlation: %+v vs %+v", fine, coarse)
+	}
+	if fine.MeanAbsError >= coarse.MeanAbsError {
+		t.Errorf("More precision bits did not reduce the score error: %f vs %f", fine.MeanAbsError, coarse.MeanAbsError)
+	}
+}
+
+func TestEstimateQuantizationLossAtBoundary(t *testing.T) {
+	// queries with an entry at 1, which 8 bits quantize to the largest int8,
+	// against vectors on the axes, which rank the entries of the queries
+	dim := 4
+	vectors := make([][]float64, 0)
+	for i := 0; i < dim; i++ {
+		for _, sign := range []float64{1, -1} {
+			v := make([]float64, dim)
+			v[i] = sign * 0.5
+			vectors = append(vectors, v)
+		}
+	}
+	queries := [][]float64{{1, 0.5, 0.25, 0}, {-1, 0, 1, 0.75}}
+
+	for precBits := uint64(5); precBits <= 8; precBits++ {
+		report := EstimateQuantizationLoss(vectors, queries, precBits)
+		if report.Spearman < 0.99 || report.Pearson < 0.99 {
+			t.Errorf("Expected the scores with %d bits to rank as the exact ones, but got %+v", precBits, report)
+		}
+		if report.MeanAbsError > 1/float64(int(1)<<(precBits-1)) {
+			t.Errorf("Expected a score error with %d bits of at most one quantization step, but got %+v", precBits, report)
+		}
+	}
+	if got := QuantizeClamp(1, 8); got != 127 || !Saturates(1, 8) {
+		t.Errorf("Expected 1 to saturate at 127 with 8 bits, but got %d", got)
+	}
+	if got := QuantizeClamp(-1, 8); got != -128 || Saturates(-1, 8) {
+		t.Errorf("Expected -1 to quantize to -128 with 8 bits, but got %d", got)
+	}
+}
+
+func TestSpearmanCorrelation(t *testing.T) {
+	x := []float64{1, 2, 3, 4}
+	if c := SpearmanCorrelation(x, []float64{10, 20, 30, 400}); math.Abs(c-1) > 1e-9 {
+		t.Errorf("Spearman correlation of monotonic samples is %f, expected 1", c)
+	}
+	if c := SpearmanCorrelation(x, []float64{4, 3, 2, 1}); math.Abs(c+1) > 1e-9 {
+		t.Errorf("Spearman correlation of reversed samples is %f, expected -1", c)
+	}
+	if c := SpearmanCorrelation(x, []float64{1, 1, 1, 1}); !math.IsNaN(c) {
+		t.Errorf("Spearman correlation with a constant sample is %f, expected NaN", c)
+	}
+	// ties get their average rank
+	r := ranks([]float64{5, 1, 5, 3})
+	want := []float64{3.5, 1, 3.5, 2}
+	for i := range r {
+		if r[i] != want[i] {
+			t.Errorf("ranks returned %v, expected %v", r, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package utils
+
+import "fmt"
+
+// Quantizer maps raw values to the signed integers stored in the database or
+// sent in queries. The database and the queries may use different quantizers:
+// the score of a query and a vector is the dot product of their quantized
+// values, i.e., about their raw dot product times the product of the scales.
+type Quantizer interface {
+	Quantize(val float64) int8
+	Dequantize(val int8) float64
+	// Scale is the factor from raw values to quantized ones
+	Scale() float64
+	// Bound is the largest absolute quantized value
+	Bound() int
+	// Bits is the number of bits of the quantized values, which must fit in the
+	// plaintext modulus along with the other side's
+	Bits() uint64
+}
+
+// LinearQuantizer maps [-Range, Range] linearly onto [-2^(PrecBits-1),
+// 2^(PrecBits-1)], rounding and clamping values outside. With a Range of 1 (or
+// 0, which stands for 1), it is QuantizeClamp.
+type LinearQuantizer struct {
+	PrecBits uint64
+	Range    float64
+}
+
+// NewLinearQuantizer checks the bits and range of a LinearQuantizer
+func NewLinearQuantizer(precBits uint64, valueRange float64) (LinearQuantizer, error) {
+	if precBits < 1 || precBits > 8 {
+		return LinearQuantizer{}, fmt.Errorf("quantized values take 1 to 8 bits, got %d", precBits)
+	}
+	if !(valueRange > 0) {
+		return LinearQuantizer{}, fmt.Errorf("the range of the raw values must be positive, got %g", valueRange)
+	}
+	return LinearQuantizer{PrecBits: precBits, Range: valueRange}, nil
+}
+
+func (q LinearQuantizer) valueRange() float64 {
+	if q.Range == 0 {
+		return 1
+	}
+	return q.Range
+}
+
+func (q LinearQuantizer) Quantize(val float64) int8 {
+	return QuantizeClamp(val/q.valueRange(), q.PrecBits)
+}
+
+func (q LinearQuantizer) Dequantize(val int8) float64 {
+	return Dequantize(val, q.PrecBits) * q.valueRange()
+}
+
+func (q LinearQuantizer) Scale() float64 {
+	return float64(uint64(1)<<(q.PrecBits-1)) / q.valueRange()
+}
+
+func (q LinearQuantizer) Bound() int {
+	return 1 << (q.PrecBits - 1)
+}
+
+func (q LinearQuantizer) Bits() uint64 {
+	return q.PrecBits
+}
+
+// QuantizerScoreScale is the factor between the score of a query and a vector
+// quantized with query and db, and their raw dot product
+func QuantizerScoreScale(query Quantizer, db Quantizer) float64 {
+	return query.Scale() * db.Scale()
+}
+
+// QuantizerScoreRange is the largest absolute score of a query and a vector of
+// dimension dim, quantized with query and db
+func QuantizerScoreRange(dim uint64, query Quantizer, db Quantizer) float64 {
+	return float64(dim) * float64(query.Bound()) * float64(db.Bound())
+}
+
+// ReconstructDot maps a score back to the scale of the raw dot product
+func ReconstructDot(score int, query Quantizer, db Quantizer) float64 {
+	return float64(score) / QuantizerScoreScale(query, db)
+}
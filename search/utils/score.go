@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+)
+
+// ScoreTransform maps the raw quantized dot products of a query's results to the
+// values written to the output
+type ScoreTransform int
+
+const (
+	// IdentityTransform keeps the raw score s
+	IdentityTransform ScoreTransform = iota
+	// SigmoidTransform returns 1 / (1 + exp(-s / 4^(precBits-1))), the sigmoid of
+	// the score rescaled back to the unquantized dot product
+	SigmoidTransform
+	// MinMaxTransform returns (s - min) / (max - min) over the returned results,
+	// or 1 if they all have the same score
+	MinMaxTransform
+	// LinearTransform returns (s + R) / (2R), where R = dim * 4^(precBits-1)
+	// bounds the absolute value of any score
+	LinearTransform
+)
+
+func ParseScoreTransform(s string) (ScoreTransform, error) {
+	switch s {
+	case "identity":
+		return IdentityTransform, nil
+	case "sigmoid":
+		return SigmoidTransform, nil
+	case "minmax":
+		return MinMaxTransform, nil
+	case "linear":
+		return LinearTransform, nil
+	}
+	return IdentityTransform, fmt.Errorf("unknown score transform %q, expected identity, sigmoid, minmax or linear", s)
+}
+
+func (t ScoreTransform) String() string {
+	switch t {
+	case IdentityTransform:
+		return "identity"
+	case SigmoidTransform:
+		return "sigmoid"
+	case MinMaxTransform:
+		return "minmax"
+	case LinearTransform:
+		return "linear"
+	}
+	return fmt.Sprintf("ScoreTransform(%d)", int(t))
+}
+
+// ScoreRange returns the largest absolute score of two dim-dimensional vectors
+// quantized with precBits bits, whose entries lie in [-2^(precBits-1), 2^(precBits-1)]
+func ScoreRange(dim uint64, precBits uint64) float64 {
+	return MixedScoreRange(dim, precBits, precBits)
+}
+
+// ScoreScale is the factor between the score of a query quantized with
+// queryPrecBits bits and a vector quantized with dbPrecBits bits, and their
+// unquantized dot product
+func ScoreScale(queryPrecBits uint64, dbPrecBits uint64) float64 {
+	return float64(uint64(1)<<(queryPrecBits-1)) * float64(uint64(1)<<(dbPrecBits-1))
+}
+
+// MixedScoreRange is like ScoreRange, for queries and vectors quantized with
+// different precisions
+func MixedScoreRange(dim uint64, queryPrecBits uint64, dbPrecBits uint64) float64 {
+	return float64(dim) * ScoreScale(queryPrecBits, dbPrecBits)
+}
+
+// TransformScores applies t to the scores of the results of one query. dim and
+// precBits are those of the database and are only used by the sigmoid and linear
+// transforms.
+func TransformScores(scores []int, t ScoreTransform, dim uint64, precBits uint64) []float64 {
+	return TransformMixedScores(scores, t, dim, precBits, precBits)
+}
+
+// TransformMixedScores is like TransformScores, for a query quantized with
+// queryPrecBits bits and a database quantized with dbPrecBits bits
+func TransformMixedScores(scores []int, t ScoreTransform, dim uint64, queryPrecBits uint64, dbPrecBits uint64) []float64 {
+	return TransformQuantizedScores(scores, t, dim, LinearQuantizer{PrecBits: queryPrecBits}, LinearQuantizer{PrecBits: dbPrecBits})
+}
+
+// TransformQuantizedScores is like TransformScores, for a query and a database
+// quantized with any quantizers
+func TransformQuantizedScores(scores []int, t ScoreTransform, dim uint64, query Quantizer, db Quantizer) []float64 {
+	res := make([]float64, len(scores))
+
+	switch t {
+	case IdentityTransform:
+		for i, s := range scores {
+			res[i] = float64(s)
+		}
+	case SigmoidTransform:
+		scale := QuantizerScoreScale(query, db)
+		for i, s := range scores {
+			res[i] = 1 / (1 + math.Exp(-float64(s)/scale))
+		}
+	case MinMaxTransform:
+		if len(scores) == 0 {
+			return res
+		}
+		min, max := scores[0], scores[0]
+		for _, s := range scores {
+			if s < min {
+				min = s
+			}
+			if s > max {
+				max = s
+			}
+		}
+		for i, s := range scores {
+			if max == min {
+				res[i] = 1
+			} else {
+				res[i] = float64(s-min) / float64(max-min)
+			}
+		}
+	case LinearTransform:
+		r := QuantizerScoreRange(dim, query, db)
+		for i, s := range scores {
+			res[i] = math.Max(0, math.Min(1, (float64(s)+r)/(2*r)))
+		}
+	default:
+		panic("Unknown score transform")
+	}
+
+	return res
+}
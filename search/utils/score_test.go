@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTransformScores(t *testing.T) {
+	dim := uint64(4)
+	precBits := uint64(3)
+	// every entry lies in [-4, 4], so scores lie in [-64, 64]
+	scores := []int{64, 16, 0, -64}
+
+	tests := []struct {
+		transform ScoreTransform
+		want      []float64
+	}{
+		{IdentityTransform, []float64{64, 16, 0, -64}},
+		{SigmoidTransform, []float64{1 / (1 + math.Exp(-4)), 1 / (1 + math.Exp(-1)), 0.5, 1 / (1 + math.Exp(4))}},
+		{MinMaxTransform, []float64{1, 0.625, 0.5, 0}},
+		{LinearTransform, []float64{1, 0.625, 0.5, 0}},
+	}
+
+	for _, test := range tests {
+		got := TransformScores(scores, test.transform, dim, precBits)
+		for i := range got {
+			if math.Abs(got[i]-test.want[i]) > 1e-9 {
+				t.Errorf("%s: score %d transformed to %g, expected %g", test.transform, scores[i], got[i], test.want[i])
+			}
+		}
+	}
+
+	// the min-max transform of a single result (or equal results) is 1
+	got := TransformScores([]int{5, 5}, MinMaxTransform, dim, precBits)
+	if got[0] != 1 || got[1] != 1 {
+		t.Errorf("min-max of equal scores is %v, expected [1 1]", got)
+	}
+
+	for _, name := range []string{"identity", "sigmoid", "minmax", "linear"} {
+		transform, err := ParseScoreTransform(name)
+		if err != nil || transform.String() != name {
+			t.Errorf("ParseScoreTransform(%q) returned %s, %v", name, transform, err)
+		}
+	}
+	if _, err := ParseScoreTransform("softmax"); err == nil {
+		t.Errorf("ParseScoreTransform accepted an unknown transform")
+	}
+}
+
+func TestTransformMixedScores(t *testing.T) {
+	dim := uint64(4)
+	// queries in [-8, 8] and vectors in [-2, 2], so scores lie in [-64, 64] and
+	// a score of 16 is a dot product of 1
+	scores := []int{64, 16, 0, -64}
+	tests := []struct {
+		transform ScoreTransform
+		want      []float64
+	}{
+		{SigmoidTransform, []float64{1 / (1 + math.Exp(-4)), 1 / (1 + math.Exp(-1)), 0.5, 1 / (1 + math.Exp(4))}},
+		{LinearTransform, []float64{1, 0.625, 0.5, 0}},
+	}
+	for _, test := range tests {
+		got := TransformMixedScores(scores, test.transform, dim, 4, 2)
+		for i := range got {
+			if math.Abs(got[i]-test.want[i]) > 1e-9 {
+				t.Errorf("%s: score %d transformed to %g, expected %g", test.transform, scores[i], got[i], test.want[i])
+			}
+		}
+	}
+}
+
+func TestLinearQuantizer(t *testing.T) {
+	// a range of 1 is QuantizeClamp, and a range of r quantizes r*val the same
+	for _, bits := range []uint64{2, 5, 7} {
+		unit, err := NewLinearQuantizer(bits, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wide := LinearQuantizer{PrecBits: bits, Range: 2.5}
+		for _, val := range []float64{-1.5, -1, -0.3, 0, 0.01, 0.49, 1, 3} {
+			if got, want := unit.Quantize(val), QuantizeClamp(val, bits); got != want {
+				t.Errorf("%d bits: quantized %g to %d, expected %d", bits, val, got, want)
+			}
+			if got, want := wide.Quantize(2.5*val), unit.Quantize(val); got != want {
+				t.Errorf("%d bits, range 2.5: quantized %g to %d, expected %d", bits, 2.5*val, got, want)
+			}
+		}
+		if got := wide.Dequantize(wide.Quantize(2.5)); math.Abs(got-2.5) > 1e-9 {
+			t.Errorf("%d bits, range 2.5: dequantized the bound to %g", bits, got)
+		}
+	}
+	if _, err := NewLinearQuantizer(0, 1); err == nil {
+		t.Errorf("Expected 0 bits to be rejected")
+	}
+	if _, err := NewLinearQuantizer(5, 0); err == nil {
+		t.Errorf("Expected an empty range to be rejected")
+	}
+
+	// the score scale is the product of both sides, and the mixed scores of
+	// unit ranges transform like TransformMixedScores
+	query, db := LinearQuantizer{PrecBits: 4, Range: 2}, LinearQuantizer{PrecBits: 6, Range: 0.5}
+	if got := QuantizerScoreScale(query, db); got != 4*64 {
+		t.Errorf("Expected a score scale of %d, but got %g", 4*64, got)
+	}
+	if got := ReconstructDot(512, query, db); got != 2 {
+		t.Errorf("Expected a score of 512 to be a dot product of 2, but got %g", got)
+	}
+	scores := []int{64, 16, 0, -64}
+	for _, transform := range []ScoreTransform{SigmoidTransform, LinearTransform} {
+		got := TransformQuantizedScores(scores, transform, 4, LinearQuantizer{PrecBits: 4}, LinearQuantizer{PrecBits: 2})
+		want := TransformMixedScores(scores, transform, 4, 4, 2)
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("%s: score %d transformed to %g, expected %g", transform, scores[i], got[i], want[i])
+			}
+		}
+	}
+}
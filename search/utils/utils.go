@@ -3,6 +3,7 @@ package utils
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/hex"
 	"fmt"
 	"math"
 	"os"
@@ -54,13 +55,25 @@ func QuantizeClamp(val float64, precBits uint64) int8 {
 	return Clamp(quantized, precBits)
 }
 
+// Saturates tells whether QuantizeClamp clamps val, i.e., whether it quantizes
+// beyond ±2^(precBits-1), or beyond 127 with 8 bits; NaN always does
+func Saturates(val float64, precBits uint64) bool {
+	scale := float64(int(1) << (precBits - 1))
+	rounded := math.Round(val * scale)
+	return !(rounded >= -scale && rounded <= scale && rounded <= math.MaxInt8)
+}
+
 func Clamp(val int, precBits uint64) int8 {
 	min := -int(1 << (precBits - 1))
 	if val <= min {
 		return int8(min)
 	}
 
+	// with 8 bits, 2^7 does not fit in an int8, and would wrap around to -2^7
 	max := int(1 << (precBits - 1))
+	if max > math.MaxInt8 {
+		max = math.MaxInt8
+	}
 	if val > max {
 		return int8(max)
 	}
@@ -170,6 +183,21 @@ func GetCallerDirectory() string {
 	return filepath.Dir(filename)
 }
 
+// ParsePRGKey parses a seed written as hexadecimal, e.g., by FormatPRGKey
+func ParsePRGKey(s string) (*rand.PRGKey, error) {
+	var key rand.PRGKey
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(key) {
+		return nil, fmt.Errorf("seed must be %d hexadecimal digits, got %q", 2*len(key), s)
+	}
+	copy(key[:], b)
+	return &key, nil
+}
+
+func FormatPRGKey(key *rand.PRGKey) string {
+	return hex.EncodeToString(key[:])
+}
+
 func NewUnderhoodClient[T matrix.Elem](h *PIR_hint[T]) *underhood.Client[T] {
 	return underhood.NewClientDistributed[T](h.Seeds, h.Offsets, &h.Info)
 }
@@ -239,7 +267,15 @@ func SortByScores(scores []int) []uint64 {
 	return indices
 }
 
+// MessageSizeBytes is the size of a message in ActiveWireFormat. Messages without
+// a binary layout, such as the hint, are always measured as gob.
 func MessageSizeBytes(m interface{}) uint64 {
+	if ActiveWireFormat == BinaryWire {
+		if enc, err := EncodeMessage(m, BinaryWire); err == nil {
+			return uint64(len(enc))
+		}
+	}
+
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
 
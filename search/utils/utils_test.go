@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"math"
+	"testing"
+)
+
+func TestQuantizeClampBoundaries(t *testing.T) {
+	for precBits := uint64(1); precBits <= 7; precBits++ {
+		s := float64(int(1) << (precBits - 1))
+		max := int8(s)
+
+		tests := []struct {
+			val      float64
+			expected int8
+			// whether the value is clamped, see Saturates
+			saturates bool
+		}{
+			// well below, at and above the representable range [-1, 1]
+			{-1e15, -max, true},
+			{-2, -max, true},
+			{-1 - 1/s, -max, true},
+			{-1, -max, false},
+			{-1 + 1/s, -max + 1, false},
+			{1 - 1/s, max - 1, false},
+			{1, max, false},
+			{1 + 1/s, max, true},
+			{2, max, true},
+			{1e15, max, true},
+			// rounding is half away from zero
+			{0.5 / s, 1, false},
+			{-0.5 / s, -1, false},
+			{0.49 / s, 0, false},
+			{-0.49 / s, 0, false},
+			// zeros and tiny values
+			{0, 0, false},
+			{math.Copysign(0, -1), 0, false},
+			{math.SmallestNonzeroFloat64, 0, false},
+			{-math.SmallestNonzeroFloat64, 0, false},
+		}
+
+		for _, test := range tests {
+			if got := QuantizeClamp(test.val, precBits); got != test.expected {
+				t.Errorf("QuantizeClamp(%g, %d) = %d, expected %d", test.val, precBits, got, test.expected)
+			}
+			if got := Saturates(test.val, precBits); got != test.saturates {
+				t.Errorf("Saturates(%g, %d) = %t, expected %t", test.val, precBits, got, test.saturates)
+			}
+		}
+		// QuantizeClamp of a value beyond the range of int is not pinned, since
+		// converting it to int is implementation-defined, but it saturates
+		for _, val := range []float64{math.NaN(), math.Inf(-1), -1e300, 1e300, math.Inf(1)} {
+			if !Saturates(val, precBits) {
+				t.Errorf("Expected %g to saturate at %d bits", val, precBits)
+			}
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package utils
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/ahenzinger/underhood/underhood"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+// WireFormat selects how protocol messages are serialized
+type WireFormat int
+
+const (
+	// GobWire is Go's gob encoding, which only Go clients can read
+	GobWire WireFormat = iota
+	// BinaryWire is a language-neutral layout, see EncodeMessage
+	BinaryWire
+)
+
+// ActiveWireFormat is the format measured by MessageSizeBytes
+var ActiveWireFormat = GobWire
+
+// ErrNoBinaryLayout is returned when encoding a message that BinaryWire does not cover
+var ErrNoBinaryLayout = errors.New("no binary layout for message")
+
+func ParseWireFormat(s string) (WireFormat, error) {
+	switch s {
+	case "gob":
+		return GobWire, nil
+	case "binary":
+		return BinaryWire, nil
+	}
+	return GobWire, fmt.Errorf("unknown wire format %q, expected gob or binary", s)
+}
+
+func (f WireFormat) String() string {
+	switch f {
+	case GobWire:
+		return "gob"
+	case BinaryWire:
+		return "binary"
+	}
+	return fmt.Sprintf("WireFormat(%d)", int(f))
+}
+
+// Every binary message starts with a magic identifying its type
+var (
+	queryMagic      = [4]byte{'T', 'Q', 'R', '1'}
+	answerMagic     = [4]byte{'T', 'A', 'N', '1'}
+	hintQueryMagic  = [4]byte{'T', 'H', 'Q', '1'}
+	hintAnswerMagic = [4]byte{'T', 'H', 'A', '1'}
+)
+
+// EncodeMessage serializes a query, an answer, a hint query or a hint answer.
+// In BinaryWire, integers are little-endian uint64s and messages are laid out as:
+//
+//	pir.Query:           "TQR1" | matrix
+//	pir.Answer:          "TAN1" | matrix
+//	underhood.HintQuery: "THQ1" | blobs
+//	underhood.HintAnswer: "THA1" | MatrixRows | n | blobs*n
+//
+// where a matrix is elemBytes | rows | cols | values, with each value taking
+// elemBytes (4 or 8) little-endian bytes in row-major order, and blobs is
+// n | (len | bytes)*n. Other messages are laid out by their MarshalBinary
+// method, if they have one, and the others, such as the hint, have no binary
+// layout.
+func EncodeMessage(m interface{}, f WireFormat) ([]byte, error) {
+	if f == GobWire {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	switch v := m.(type) {
+	case pir.Query[matrix.Elem32]:
+		return appendMatrix(queryMagic[:], v.Query), nil
+	case pir.Query[matrix.Elem64]:
+		return appendMatrix(queryMagic[:], v.Query), nil
+	case pir.Answer[matrix.Elem32]:
+		return appendMatrix(answerMagic[:], v.Answer), nil
+	case pir.Answer[matrix.Elem64]:
+		return appendMatrix(answerMagic[:], v.Answer), nil
+	case underhood.HintQuery:
+		return appendBlobs(hintQueryMagic[:], v), nil
+	case underhood.HintAnswer:
+		buf := append([]byte{}, hintAnswerMagic[:]...)
+		buf = binary.LittleEndian.AppendUint64(buf, v.MatrixRows)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(len(v.HintCts)))
+		for _, cts := range v.HintCts {
+			buf = appendBlobs(buf, cts)
+		}
+		return buf, nil
+	case encoding.BinaryMarshaler:
+		return v.MarshalBinary()
+	}
+	return nil, fmt.Errorf("%w %T", ErrNoBinaryLayout, m)
+}
+
+// DecodeMessage is the inverse of EncodeMessage, decoding into out, which must
+// point to a message of the encoded type
+func DecodeMessage(buf []byte, f WireFormat, out interface{}) error {
+	if f == GobWire {
+		return gob.NewDecoder(bytes.NewReader(buf)).Decode(out)
+	}
+
+	r := bytes.NewReader(buf)
+	var err error
+	switch v := out.(type) {
+	case *pir.Query[matrix.Elem32]:
+		v.Query, err = readMatrix[matrix.Elem32](r, queryMagic)
+	case *pir.Query[matrix.Elem64]:
+		v.Query, err = readMatrix[matrix.Elem64](r, queryMagic)
+	case *pir.Answer[matrix.Elem32]:
+		v.Answer, err = readMatrix[matrix.Elem32](r, answerMagic)
+	case *pir.Answer[matrix.Elem64]:
+		v.Answer, err = readMatrix[matrix.Elem64](r, answerMagic)
+	case *underhood.HintQuery:
+		if err = readMagic(r, hintQueryMagic); err == nil {
+			*v, err = readBlobs(r)
+		}
+	case *underhood.HintAnswer:
+		if err = readMagic(r, hintAnswerMagic); err != nil {
+			break
+		}
+		var n uint64
+		if v.MatrixRows, err = readUint64(r); err != nil {
+			break
+		}
+		if n, err = readUint64(r); err != nil {
+			break
+		}
+		// every entry takes at least 8 bytes, which bounds a corrupt count
+		if n > uint64(r.Len())/8 {
+			err = io.ErrUnexpectedEOF
+			break
+		}
+		v.HintCts = make([][]underhood.CipherBlob, n)
+		for i := range v.HintCts {
+			if v.HintCts[i], err = readBlobs(r); err != nil {
+				break
+			}
+		}
+	case encoding.BinaryUnmarshaler:
+		return v.UnmarshalBinary(buf)
+	default:
+		return fmt.Errorf("%w %T", ErrNoBinaryLayout, out)
+	}
+
+	if err != nil {
+		return fmt.Errorf("error decoding binary message: %w", err)
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("binary message has %d trailing bytes", r.Len())
+	}
+	return nil
+}
+
+// ErrChecksum is returned by ReadMessage when a message does not match its
+// checksum, e.g., after a transport error
+var ErrChecksum = errors.New("message checksum mismatch")
+
+// MaxFramedMessageSize bounds the length ReadMessage accepts. The payload is
+// read as it arrives rather than allocated up front, so a corrupt length below
+// the bound only costs memory for the bytes actually sent.
+const MaxFramedMessageSize = 1 << 34
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WriteMessage writes a message to a stream, such as a connection, framed as
+//
+//	len | lencrc | payload | crc
+//
+// where len is the length of payload as a little-endian uint64, and payload is
+// the message encoded in f by EncodeMessage. With checksum, lencrc is the
+// CRC-32C of len, so that a corrupt length is caught before the payload is
+// read, and crc the CRC-32C of len and payload, both little-endian uint32s;
+// without it, both are absent. Both ends must agree on checksum.
+func WriteMessage(w io.Writer, m interface{}, f WireFormat, checksum bool) error {
+	payload, err := EncodeMessage(m, f)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 0, 8+4+len(payload)+4)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(payload)))
+	if checksum {
+		buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+	}
+	buf = append(buf, payload...)
+	if checksum {
+		digest := crc32.Update(crc32.Checksum(buf[:8], crcTable), crcTable, payload)
+		buf = binary.LittleEndian.AppendUint32(buf, digest)
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadMessage reads a message written by WriteMessage into out. With checksum,
+// a message that does not match its checksum fails with ErrChecksum before it
+// is decoded, rather than being decoded into wrong values.
+func ReadMessage(r io.Reader, f WireFormat, out interface{}, checksum bool) error {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	size := binary.LittleEndian.Uint64(header[:])
+	if checksum {
+		var crc [4]byte
+		if _, err := io.ReadFull(r, crc[:]); err != nil {
+			return fmt.Errorf("error reading message length checksum: %w", err)
+		}
+		if got, digest := binary.LittleEndian.Uint32(crc[:]), crc32.Checksum(header[:], crcTable); got != digest {
+			return fmt.Errorf("%w: length %d has checksum %08x, computed %08x", ErrChecksum, size, got, digest)
+		}
+	}
+	if size > MaxFramedMessageSize {
+		return fmt.Errorf("message length %d is beyond %d bytes", size, uint64(MaxFramedMessageSize))
+	}
+	// grown as the payload arrives, so that a stream shorter than its length
+	// fails without allocating the whole length
+	var payloadBuf bytes.Buffer
+	if n, err := io.CopyN(&payloadBuf, r, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("error reading message of %d bytes after %d: %w", size, n, err)
+	}
+	payload := payloadBuf.Bytes()
+	if checksum {
+		var crc [4]byte
+		if _, err := io.ReadFull(r, crc[:]); err != nil {
+			return fmt.Errorf("error reading message checksum: %w", err)
+		}
+		digest := crc32.Update(crc32.Checksum(header[:], crcTable), crcTable, payload)
+		if got := binary.LittleEndian.Uint32(crc[:]); got != digest {
+			return fmt.Errorf("%w: got %08x, computed %08x", ErrChecksum, got, digest)
+		}
+	}
+	return DecodeMessage(payload, f, out)
+}
+
+// BinaryAnswerSize is the size in BinaryWire of an answer holding a column of
+// rows Elem64 values, such as the answers to a database of that many rows
+func BinaryAnswerSize(rows uint64) uint64 {
+	return uint64(len(answerMagic)) + 3*8 + 8*rows
+}
+
+// AnswerSize is BinaryAnswerSize in f. Gob writes integers in 1 to 9 bytes, so
+// in GobWire it is a bound: the size when every value and every length takes 9.
+func AnswerSize(rows uint64, f WireFormat) uint64 {
+	if f == BinaryWire {
+		return BinaryAnswerSize(rows)
+	}
+	// the lengths of the message, of the encoded matrix, of its values, and
+	// the number of values, which take 1 byte in the empty answer
+	return gobEmptyAnswerSize() + 4*8 + 9*rows
+}
+
+var gobEmptyAnswer struct {
+	once sync.Once
+	size uint64
+}
+
+// gobEmptyAnswerSize is the size in GobWire of an answer of no rows, which
+// holds the gob type definitions
+func gobEmptyAnswerSize() uint64 {
+	gobEmptyAnswer.once.Do(func() {
+		enc, err := EncodeMessage(pir.Answer[matrix.Elem64]{Answer: matrix.Zeros[matrix.Elem64](0, 1)}, GobWire)
+		if err != nil {
+			panic("Error encoding an empty answer: " + err.Error())
+		}
+		gobEmptyAnswer.size = uint64(len(enc))
+	})
+	return gobEmptyAnswer.size
+}
+
+func appendMatrix[T matrix.Elem](buf []byte, m *matrix.Matrix[T]) []byte {
+	elemBytes := T(0).Bitlen() / 8
+	buf = binary.LittleEndian.AppendUint64(buf, elemBytes)
+	buf = binary.LittleEndian.AppendUint64(buf, m.Rows())
+	buf = binary.LittleEndian.AppendUint64(buf, m.Cols())
+	for _, v := range m.Data() {
+		if elemBytes == 4 {
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(v))
+		} else {
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(v))
+		}
+	}
+	return buf
+}
+
+func appendBlobs(buf []byte, blobs []underhood.CipherBlob) []byte {
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(blobs)))
+	for _, b := range blobs {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(len(b)))
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+func readMagic(r *bytes.Reader, magic [4]byte) error {
+	var got [4]byte
+	if _, err := io.ReadFull(r, got[:]); err != nil {
+		return err
+	}
+	if got != magic {
+		return fmt.Errorf("expected a %q message, got %q", magic[:], got[:])
+	}
+	return nil
+}
+
+func readUint64(r *bytes.Reader) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b[:]), nil
+}
+
+func readMatrix[T matrix.Elem](r *bytes.Reader, magic [4]byte) (*matrix.Matrix[T], error) {
+	if err := readMagic(r, magic); err != nil {
+		return nil, err
+	}
+	var header [3]uint64
+	for i := range header {
+		v, err := readUint64(r)
+		if err != nil {
+			return nil, err
+		}
+		header[i] = v
+	}
+	elemBytes, rows, cols := header[0], header[1], header[2]
+	if elemBytes != T(0).Bitlen()/8 {
+		return nil, fmt.Errorf("expected %d-byte values, got %d-byte ones", T(0).Bitlen()/8, elemBytes)
+	}
+	// check the size before allocating it
+	if cols != 0 && rows > uint64(r.Len())/elemBytes/cols {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	m := matrix.New[T](rows, cols)
+	data := m.Data()
+	b := make([]byte, elemBytes)
+	for i := range data {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if elemBytes == 4 {
+			data[i] = T(binary.LittleEndian.Uint32(b))
+		} else {
+			data[i] = T(binary.LittleEndian.Uint64(b))
+		}
+	}
+	return m, nil
+}
+
+func readBlobs(r *bytes.Reader) ([]underhood.CipherBlob, error) {
+	n, err := readUint64(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len())/8 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	blobs := make([]underhood.CipherBlob, n)
+	for i := range blobs {
+		size, err := readUint64(r)
+		if err != nil {
+			return nil, err
+		}
+		if size > uint64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		blobs[i] = make([]byte, size)
+		if _, err := io.ReadFull(r, blobs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return blobs, nil
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/ahenzinger/underhood/underhood"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+func TestBinaryWireLayout(t *testing.T) {
+	m := matrix.New[matrix.Elem64](2, 1)
+	m.Set(0, 0, 1)
+	m.Set(1, 0, 1<<40)
+	enc, err := EncodeMessage(pir.Query[matrix.Elem64]{Query: m}, BinaryWire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		'T', 'Q', 'R', '1',
+		8, 0, 0, 0, 0, 0, 0, 0, // elemBytes
+		2, 0, 0, 0, 0, 0, 0, 0, // rows
+		1, 0, 0, 0, 0, 0, 0, 0, // cols
+		1, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 1, 0, 0,
+	}
+	if !bytes.Equal(enc, expected) {
+		t.Errorf("Expected the query to encode to %x, but got %x", expected, enc)
+	}
+
+	ActiveWireFormat = BinaryWire
+	size := MessageSizeBytes(pir.Query[matrix.Elem64]{Query: m})
+	ActiveWireFormat = GobWire
+	if size != uint64(len(expected)) {
+		t.Errorf("Expected a binary size of %d, but got %d", len(expected), size)
+	}
+
+	// every prefix is rejected, and so is a query decoded as an answer
+	for n := 0; n < len(enc); n++ {
+		if err := DecodeMessage(enc[:n], BinaryWire, new(pir.Query[matrix.Elem64])); err == nil {
+			t.Errorf("Expected an error decoding the first %d bytes", n)
+		}
+	}
+	if err := DecodeMessage(enc, BinaryWire, new(pir.Answer[matrix.Elem64])); err == nil {
+		t.Errorf("Expected an error decoding a query as an answer")
+	}
+	if err := DecodeMessage(enc, BinaryWire, new(pir.Query[matrix.Elem32])); err == nil {
+		t.Errorf("Expected an error decoding 8-byte values as 4-byte ones")
+	}
+	if _, err := EncodeMessage(map[uint]uint64{}, BinaryWire); err == nil {
+		t.Errorf("Expected an error encoding a message without binary layout")
+	}
+}
+
+func TestWireFormatsRoundTrip(t *testing.T) {
+	answer := matrix.New[matrix.Elem32](3, 2)
+	for i := range answer.Data() {
+		answer.Data()[i] = matrix.Elem32(i * 1000003)
+	}
+	messages := []interface{}{
+		pir.Answer[matrix.Elem32]{Answer: answer},
+		underhood.HintQuery{{1, 2, 3}, {}, {4}},
+		underhood.HintAnswer{MatrixRows: 7, HintCts: [][]underhood.CipherBlob{{{5, 6}}, {}, {{7}, {8, 9}}}},
+	}
+	for _, m := range messages {
+		decoded := make(map[WireFormat]interface{})
+		for _, f := range []WireFormat{GobWire, BinaryWire} {
+			enc, err := EncodeMessage(m, f)
+			if err != nil {
+				t.Fatalf("Error encoding %T as %s: %v", m, f, err)
+			}
+			out := reflect.New(reflect.TypeOf(m))
+			if err := DecodeMessage(enc, f, out.Interface()); err != nil {
+				t.Fatalf("Error decoding %T as %s: %v", m, f, err)
+			}
+			decoded[f] = out.Elem().Interface()
+		}
+		// gob decodes empty slices as nil, so compare the encodings
+		gobAgain, _ := EncodeMessage(decoded[GobWire], BinaryWire)
+		binaryAgain, _ := EncodeMessage(decoded[BinaryWire], BinaryWire)
+		original, _ := EncodeMessage(m, BinaryWire)
+		if !bytes.Equal(gobAgain, original) || !bytes.Equal(binaryAgain, original) {
+			t.Errorf("Expected %T to round-trip identically through gob and binary", m)
+		}
+	}
+}
+
+func TestAnswerSize(t *testing.T) {
+	// gob writes the largest values in 9 bytes, and its lengths grow with rows
+	for _, rows := range []uint64{0, 1, 15, 16, 1000, 100000} {
+		m := matrix.Zeros[matrix.Elem64](rows, 1)
+		for i := range m.Data() {
+			m.Data()[i] = ^matrix.Elem64(0)
+		}
+		for _, f := range []WireFormat{BinaryWire, GobWire} {
+			enc, err := EncodeMessage(pir.Answer[matrix.Elem64]{Answer: m}, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size := uint64(len(enc))
+			if bound := AnswerSize(rows, f); size > bound || bound-size > 4*8 {
+				t.Errorf("%s: expected an answer to %d rows to take at most %d bytes, and not much fewer, but got %d", f, rows, bound, size)
+			}
+		}
+	}
+}